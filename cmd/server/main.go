@@ -14,6 +14,7 @@ import (
 	"github.com/zixiao/git-server/internal/api"
 	"github.com/zixiao/git-server/internal/config"
 	"github.com/zixiao/git-server/internal/database"
+	"github.com/zixiao/git-server/internal/ssh"
 )
 
 var (
@@ -64,6 +65,22 @@ func main() {
 		log.Fatalf("Failed to create logs directory: %v", err)
 	}
 
+	// Start SSH server
+	if cfg.Security.EnableSSH {
+		sshServer, err := ssh.NewServer(cfg.Security.SSHHostKey)
+		if err != nil {
+			log.Fatalf("Failed to initialize SSH server: %v", err)
+		}
+
+		sshAddr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Security.SSHPort)
+		log.Printf("Starting SSH server on %s...", sshAddr)
+		go func() {
+			if err := sshServer.ListenAndServe(sshAddr); err != nil {
+				log.Fatalf("Failed to start SSH server: %v", err)
+			}
+		}()
+	}
+
 	// Setup router
 	log.Println("Setting up HTTP router...")
 	r := gin.Default()
@@ -5,32 +5,131 @@
 extern "C" {
 #endif
 
+// Parsed git-upload-pack request
+typedef struct {
+    char** wants;
+    int want_count;
+    char** haves;
+    int have_count;
+    char** capabilities;
+    int capability_count;
+    char** shallows;
+    int shallow_count;
+    int depth;
+    long long deepen_since;
+    char** deepen_not;
+    int deepen_not_count;
+    char* filter;
+    int done;
+} git_fetch_request;
+
+// Shallow clone parameters for upload-pack
+typedef struct {
+    int depth;
+    int relative;
+    long long since;
+    const char** deepen_not;
+    int deepen_not_count;
+    const char** client_shallow;
+    int client_shallow_count;
+} git_shallow_options;
+
+// Partial clone filter for upload-pack; negative limits are unset
+typedef struct {
+    int omit_blobs;
+    long long blob_limit;
+    int tree_depth;
+} git_object_filter;
+
+// Parsed git-receive-pack request
+typedef struct {
+    char** old_shas;
+    char** new_shas;
+    char** ref_names;
+    int command_count;
+    char** capabilities;
+    int capability_count;
+    int pack_offset;
+} git_push_request;
+
 // Repository operations
 void* git_repository_new(const char* path);
 void git_repository_free(void* repo);
 int git_repository_init(void* repo, int bare);
 int git_repository_exists(void* repo);
 int git_repository_is_valid(void* repo);
+char* git_repository_get_head(void* repo);
 
 // Reference operations
 int git_repository_create_ref(void* repo, const char* refName, const char* sha);
 char* git_repository_get_ref(void* repo, const char* refName);
 char** git_repository_list_refs(void* repo, int* count);
 int git_repository_delete_ref(void* repo, const char* refName);
+int git_repository_lock_ref(void* repo, const char* refName);
+int git_repository_unlock_ref(void* repo, const char* refName);
+int git_repository_write_ref_lock(void* repo, const char* refName, const char* sha);
+int git_repository_commit_ref(void* repo, const char* refName);
 
 // Branch operations
 int git_repository_create_branch(void* repo, const char* branchName, const char* sha);
 char** git_repository_list_branches(void* repo, int* count);
 int git_repository_delete_branch(void* repo, const char* branchName);
 
+// Object operations
+int git_repository_has_object(void* repo, const char* sha);
+// Reads an object's content; type is set to its pack type (1 commit,
+// 2 tree, 3 blob, 4 tag)
+char* git_repository_read_object(void* repo, const char* sha, int* type, int* outLen);
+// Reads an object's type and size from its header without inflating it
+int git_repository_read_object_header(void* repo, const char* sha, int* type, long long* size);
+// Lists up to limit objects whose names start with prefix
+char** git_repository_find_objects(void* repo, const char* prefix, int limit, int* count);
+// Opens an object to read its content a chunk at a time; type and size are
+// set from its header. The stream is freed with git_object_stream_free.
+void* git_repository_open_object(void* repo, const char* sha, int* type, long long* size);
+// Reads up to len bytes; returns the count, 0 at the end or -1 on error
+int git_object_stream_read(void* stream, char* buf, int len);
+void git_object_stream_free(void* stream);
+char* git_repository_peel_tag(void* repo, const char* sha);
+int git_repository_can_all_from_reach(void* repo, const char** from, int fromCount,
+                                      const char** to, int toCount);
+
 // Pack operations
 int git_repository_receive_pack(void* repo, const char* packData, int packLen);
+void* git_repository_receive_pack_begin(void* repo);
+int git_pack_indexer_append(void* indexer, const char* data, int len);
+int git_pack_indexer_done(void* indexer);
+int git_repository_receive_pack_finish(void* repo, void* indexer, int* objectCount);
+void git_pack_indexer_free(void* indexer);
+int git_repository_begin_quarantine(void* repo);
+int git_repository_migrate_quarantine(void* repo);
+void git_repository_abort_quarantine(void* repo);
+char* git_repository_quarantine_path(void* repo);
+int git_repository_check_connectivity(void* repo, const char* tip);
 char* git_repository_upload_pack(void* repo, const char** wants, int wantCount,
-                                  const char** haves, int haveCount, int* outLen);
+                                  const char** haves, int haveCount,
+                                  const git_shallow_options* options,
+                                  const git_object_filter* filter, int* outLen);
+// Receives generated pack data; returning 0 stops generation
+typedef int (*git_pack_write_cb)(void* payload, const char* data, int len);
+int git_repository_upload_pack_stream(void* repo, const char** wants, int wantCount,
+                                      const char** haves, int haveCount,
+                                      const git_shallow_options* options,
+                                      const git_object_filter* filter,
+                                      git_pack_write_cb write, void* payload);
+int git_repository_compute_shallow(void* repo, const char** wants, int wantCount,
+                                   const git_shallow_options* options,
+                                   char*** shallow, int* shallowCount,
+                                   char*** unshallow, int* unshallowCount);
 
 // Protocol operations
 char* git_protocol_create_ref_advertisement(const char** refs, const char** shas,
-                                            int refCount, const char* service, int* outLen);
+                                            int refCount, const char* service,
+                                            const char* capabilities, int* outLen);
+int git_protocol_parse_upload_pack(const char* data, int len, git_fetch_request* out);
+void git_protocol_free_fetch_request(git_fetch_request* req);
+int git_protocol_parse_receive_pack(const char* data, int len, git_push_request* out);
+void git_protocol_free_push_request(git_push_request* req);
 char* git_protocol_pkt_line(const char* data);
 char* git_protocol_flush_pkt();
 
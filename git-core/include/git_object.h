@@ -30,6 +30,10 @@ public:
     // Calculate SHA-1 hash
     static std::string calculateSHA(const std::string& content);
 
+    // Object type names as used in loose object headers
+    static std::string typeName(GitObjectType type);
+    static bool parseTypeName(const std::string& name, GitObjectType& type);
+
 protected:
     GitObjectType type;
     std::string data;
@@ -56,6 +60,9 @@ class GitTree : public GitObject {
 public:
     explicit GitTree(const std::vector<GitTreeEntry>& entries);
 
+    // Parse raw tree data read from the object store
+    static std::vector<GitTreeEntry> parseEntries(const std::string& data);
+
     void addEntry(const GitTreeEntry& entry);
     std::vector<GitTreeEntry> getEntries() const;
 
@@ -76,6 +83,18 @@ public:
     std::vector<std::string> getParentSHAs() const;
     std::string getMessage() const;
 
+    // Fields of a raw commit read from the object store
+    struct Fields {
+        std::string treeSHA;
+        std::vector<std::string> parentSHAs;
+        std::string author;
+        std::string committer;
+        int64_t commitTime;
+        std::string message;
+    };
+
+    static bool parse(const std::string& data, Fields& fields);
+
 private:
     std::string treeSHA;
     std::vector<std::string> parentSHAs;
@@ -86,6 +105,20 @@ private:
     std::string buildCommitData() const;
 };
 
+class GitTag {
+public:
+    // Fields of a raw annotated tag read from the object store
+    struct Fields {
+        std::string objectSHA;
+        GitObjectType objectType;
+        std::string tagName;
+        std::string tagger;
+        std::string message;
+    };
+
+    static bool parse(const std::string& data, Fields& fields);
+};
+
 } // namespace GitCore
 
 #endif // GIT_OBJECT_H
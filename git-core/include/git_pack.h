@@ -3,7 +3,14 @@
 
 #include <string>
 #include <vector>
+#include <map>
+#include <fstream>
+#include <functional>
+#include <memory>
 #include <cstdint>
+#include <zlib.h>
+#include <openssl/evp.h>
+#include "git_object.h"
 
 namespace GitCore {
 
@@ -12,15 +19,15 @@ public:
     GitPack();
     ~GitPack();
 
-    // Pack file operations
-    bool createPack(const std::vector<std::string>& objectSHAs,
-                   std::string& packData);
-    bool extractPack(const std::string& packData,
-                    const std::string& objectsPath);
-
-    // Pack index operations
-    bool createIndex(const std::string& packPath,
-                    const std::string& idxPath);
+    // Object types in pack
+    enum PackObjectType {
+        OBJ_COMMIT = 1,
+        OBJ_TREE = 2,
+        OBJ_BLOB = 3,
+        OBJ_TAG = 4,
+        OBJ_OFS_DELTA = 6,
+        OBJ_REF_DELTA = 7
+    };
 
     struct PackObject {
         uint8_t type;
@@ -29,28 +36,235 @@ public:
         std::string sha;
     };
 
-    std::vector<PackObject> parsePackFile(const std::string& packData);
+    // Looks up an object outside the pack (e.g. the base of a REF_DELTA)
+    using ObjectResolver = std::function<bool(const std::string& sha,
+                                              uint8_t& type,
+                                              std::string& data)>;
+
+    // Receives pack data as it is generated; returning false stops it
+    using PackSink = std::function<bool(const char* data, size_t len)>;
+
+    // Pack file operations
+    bool createPack(const std::vector<PackObject>& objects,
+                   std::string& packData);
+    bool extractPack(const std::string& packData,
+                    const std::string& objectsPath,
+                    const ObjectResolver& resolver);
+
+    // Pack index operations (version 2)
+    bool createIndex(const std::string& packPath,
+                    const std::string& idxPath);
+
+    // Parse a pack and resolve every delta into a whole object
+    bool parsePackFile(const std::string& packData,
+                       const ObjectResolver& resolver,
+                       std::vector<PackObject>& objects);
+
+    // Conversions between pack and object store types
+    static GitObjectType toObjectType(uint8_t packType);
+    static uint8_t fromObjectType(GitObjectType type);
+    static std::string objectSHA(uint8_t packType, const std::string& data);
+
+    // Object header and delta helpers shared with GitPackFile
+    static bool readObjectHeader(const uint8_t* data, size_t len, size_t& offset,
+                                 uint8_t& type, uint64_t& size);
+    static void writeObjectHeader(std::string& output, uint8_t type, uint64_t size);
+    static bool applyDelta(const std::string& base, const std::string& delta,
+                           std::string& result);
+
+    static std::string compressData(const std::string& data);
+    static std::string decompressData(const std::string& compressed);
+    static bool inflateObject(const uint8_t* data, size_t len, uint64_t size,
+                              std::string& output, size_t& consumed);
+    static bool inflateStream(std::istream& in, uint64_t offset, uint64_t size,
+                              std::string& data);
+    // Inflates no more than len bytes from the start of a zlib stream, so
+    // headers can be read without inflating a whole object
+    static bool inflatePrefix(std::istream& in, uint64_t offset, size_t len,
+                              std::string& data);
+
+    static bool writeLooseObject(const std::string& objectsPath, uint8_t packType,
+                                 const std::string& data, const std::string& sha);
 
 private:
     // Pack format constants
     static const uint32_t PACK_SIGNATURE = 0x5041434b; // 'PACK'
     static const uint32_t PACK_VERSION = 2;
 
-    // Object types in pack
-    enum PackObjectType {
-        OBJ_COMMIT = 1,
-        OBJ_TREE = 2,
-        OBJ_BLOB = 3,
-        OBJ_TAG = 4,
-        OBJ_OFS_DELTA = 6,
-        OBJ_REF_DELTA = 7
+    uint64_t readVarint(const uint8_t* data, size_t& offset);
+    void writeVarint(std::vector<uint8_t>& output, uint64_t value);
+};
+
+// Reads an object's content a chunk at a time. Loose objects and whole
+// pack entries are inflated from disk as they are read; deltas are
+// resolved in memory first and served from there.
+class GitObjectStream {
+public:
+    // Streams size bytes of the zlib stream at offset in path, after
+    // skipping the first skip inflated bytes (a loose object's header)
+    GitObjectStream(GitObjectType type, const std::string& path, uint64_t offset,
+                    uint64_t skip, uint64_t size);
+    GitObjectStream(GitObjectType type, std::string data);
+    ~GitObjectStream();
+
+    bool open();
+    GitObjectType getType() const { return type; }
+    uint64_t getSize() const { return size; }
+    // Returns the number of bytes read, 0 at the end or -1 on error
+    long read(char* buf, size_t len);
+
+private:
+    GitObjectType type;
+    uint64_t size;
+    uint64_t remaining;
+
+    // In memory
+    bool inMemory;
+    std::string data;
+    size_t pos;
+
+    // Inflated from disk
+    std::string path;
+    uint64_t offset;
+    uint64_t skip;
+    std::ifstream file;
+    z_stream zs;
+    bool zsInitialized;
+    bool failed;
+    char inbuffer[16384];
+
+    long inflateInto(char* out, size_t len);
+};
+
+// Read access to an on-disk pack through its version 2 index
+class GitPackFile {
+public:
+    explicit GitPackFile(const std::string& packPath);
+    ~GitPackFile();
+
+    bool open();
+    bool contains(const std::string& sha) const;
+    bool readObject(const std::string& sha, uint8_t& type, std::string& data,
+                    const GitPack::ObjectResolver& resolver);
+    // Reads an object's type and size from the entry headers along its
+    // delta chain, without inflating the object
+    bool readObjectInfo(const std::string& sha, uint8_t& type, uint64_t& size,
+                        const GitPack::ObjectResolver& resolver);
+    // Appends the names of objects starting with prefix, a lowercase hex
+    // string of at least two digits, until found holds limit names
+    void findPrefix(const std::string& prefix, size_t limit,
+                    std::vector<std::string>& found) const;
+    // Opens an object for streaming; nullptr if it cannot be read
+    std::unique_ptr<GitObjectStream> openObject(const std::string& sha,
+                                                const GitPack::ObjectResolver& resolver);
+
+private:
+    // The header of a pack entry: its type and inflated size, where its
+    // data starts and, for deltas, where the base is
+    struct Entry {
+        uint8_t type;
+        uint64_t size;
+        uint64_t dataOffset;
+        uint64_t baseOffset;    // OFS_DELTA
+        std::string baseSHA;    // REF_DELTA
     };
 
-    std::string compressData(const std::string& data);
-    std::string decompressData(const std::string& compressed);
+    std::string packPath;
+    std::string index;
+    uint32_t objectCount;
+    std::ifstream pack;
 
-    uint64_t readVarint(const uint8_t* data, size_t& offset);
-    void writeVarint(std::vector<uint8_t>& output, uint64_t value);
+    // Recently resolved delta bases, keyed by pack offset
+    std::map<uint64_t, std::pair<uint8_t, std::string>> baseCache;
+    size_t baseCacheBytes;
+
+    bool findOffset(const std::string& sha, uint64_t& offset) const;
+    bool readEntry(uint64_t offset, Entry& entry);
+    bool readAt(uint64_t offset, uint8_t& type, std::string& data,
+                const GitPack::ObjectResolver& resolver, int depth);
+    bool infoAt(uint64_t offset, uint8_t& type, uint64_t& size,
+                const GitPack::ObjectResolver& resolver, int depth);
+    bool inflateAt(uint64_t offset, uint64_t size, std::string& data);
+};
+
+// Writes a pack to a sink as objects are added, so only one object and a
+// small output buffer are held in memory at a time
+class GitPackWriter {
+public:
+    GitPackWriter(const GitPack::PackSink& sink, uint32_t objectCount);
+    ~GitPackWriter();
+
+    bool add(uint8_t type, const std::string& data);
+    // Writes the trailing checksum; exactly objectCount objects must have
+    // been added
+    bool finish();
+
+private:
+    GitPack::PackSink sink;
+    std::string buffer;
+    EVP_MD_CTX* hash;
+    bool failed;
+
+    bool flush();
+};
+
+// Indexes a pack as it arrives, so a received pack is never held in memory.
+// Entries are parsed and hashed incrementally by append(); finish() then
+// resolves deltas by reading their bases back from disk.
+class GitPackIndexer {
+public:
+    // The pack is written to packPath as it is appended, unless existing
+    // is set, in which case packPath already holds it
+    explicit GitPackIndexer(const std::string& packPath, bool existing = false);
+    ~GitPackIndexer();
+
+    bool append(const char* data, size_t len);
+    // Resolves deltas; thin-pack bases found through resolver are appended
+    // to the pack so it is self-contained
+    bool finish(const GitPack::ObjectResolver& resolver);
+    bool writeIndex(const std::string& idxPath);
+
+    const std::string& getPackPath() const { return packPath; }
+    uint32_t objectCount() const { return entries.size(); }
+    // Whether the trailing checksum has been read, i.e. the pack is complete
+    bool done() const { return state == DONE; }
+    std::string checksum() const;
+
+private:
+    enum State { PACK_HEADER, ENTRY_HEADER, ENTRY_DATA, TRAILER, DONE, FAILED };
+
+    struct Entry {
+        uint64_t offset;     // start of the entry header
+        uint64_t dataOffset; // start of the compressed data
+        uint8_t type;        // pack type; the base's type once a delta is resolved
+        uint64_t size;       // inflated size of the data (the delta, for deltas)
+        uint32_t crc;        // CRC-32 of the entry as stored
+        uint64_t baseOffset;
+        std::string baseSHA;
+        std::string sha;     // empty until resolved
+    };
+
+    std::string packPath;
+    bool existing;
+    std::ofstream out;
+    State state;
+    uint64_t offset;
+    uint32_t expectedCount;
+    std::string buffer;
+    std::vector<unsigned char> scratch;
+    std::vector<Entry> entries;
+    unsigned char packSHA[20];
+
+    EVP_MD_CTX* packHash;
+    EVP_MD_CTX* objectHash;
+    z_stream zs;
+    bool inflating;
+    uint64_t inflated;
+
+    size_t consume(const uint8_t* data, size_t len);
+    bool startEntry();
+    bool appendBases(const std::vector<std::string>& bases,
+                     const GitPack::ObjectResolver& resolver);
 };
 
 } // namespace GitCore
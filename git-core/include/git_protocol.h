@@ -4,6 +4,7 @@
 #include <string>
 #include <vector>
 #include <map>
+#include <cstdint>
 
 namespace GitCore {
 
@@ -26,12 +27,20 @@ public:
 
     static std::string createRefAdvertisement(
         const std::vector<RefAdvertisement>& refs,
-        const std::string& service);
+        const std::string& service,
+        const std::string& capabilities);
 
     // git-receive-pack (push)
+    struct RefCommand {
+        std::string oldSHA;
+        std::string newSHA;
+        std::string refName;
+    };
+
     struct PushRequest {
-        std::vector<std::string> commands; // old-sha new-sha refname
-        std::string packData;
+        std::vector<RefCommand> commands;
+        std::vector<std::string> capabilities; // sent on the first command
+        size_t packOffset;                     // pack data starts here
     };
 
     static PushRequest parseReceivePack(const std::string& input);
@@ -42,7 +51,13 @@ public:
     struct FetchRequest {
         std::vector<std::string> wants;
         std::vector<std::string> haves;
-        int depth;
+        std::vector<std::string> capabilities; // sent on the first want
+        std::vector<std::string> shallows;     // the client's shallow commits
+        int depth;                             // deepen <n>
+        int64_t deepenSince;                   // deepen-since <timestamp>
+        std::vector<std::string> deepenNot;    // deepen-not <ref>
+        std::string filter;                    // filter <filter-spec>
+        bool done;
     };
 
     static FetchRequest parseUploadPack(const std::string& input);
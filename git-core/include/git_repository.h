@@ -3,9 +3,35 @@
 
 #include <string>
 #include <vector>
+#include <set>
+#include <map>
+#include <memory>
+#include "git_object.h"
+#include "git_pack.h"
 
 namespace GitCore {
 
+// Shallow clone parameters of a fetch
+struct ShallowOptions {
+    int depth = 0;                          // deepen <n>
+    bool relative = false;                  // depth counts from clientShallow
+    int64_t since = 0;                      // deepen-since <timestamp>
+    std::vector<std::string> deepenNot;     // deepen-not, resolved to SHAs
+    std::vector<std::string> clientShallow; // the client's current shallow commits
+
+    bool deepen() const { return depth > 0 || since > 0 || !deepenNot.empty(); }
+};
+
+// Partial clone filter of a fetch; objects the client asked for by name
+// are always sent
+struct ObjectFilter {
+    bool omitBlobs = false;   // blob:none
+    int64_t blobLimit = -1;   // blob:limit=<n>, omits blobs of n bytes or more
+    int treeDepth = -1;       // tree:<depth>, omits objects this deep or deeper
+
+    bool active() const { return omitBlobs || blobLimit >= 0 || treeDepth >= 0; }
+};
+
 class GitRepository {
 public:
     GitRepository(const std::string& path);
@@ -21,27 +47,106 @@ public:
     std::string getObjectsPath() const;
     std::string getRefsPath() const;
     std::string getHeadPath() const;
+    std::string getHead() const;
 
     // Reference operations
     bool createRef(const std::string& refName, const std::string& sha);
     std::string getRef(const std::string& refName) const;
     std::vector<std::string> listRefs() const;
     bool deleteRef(const std::string& refName);
+    bool lockRef(const std::string& refName);
+    bool unlockRef(const std::string& refName);
+    // Writes the new value of a locked ref into its lock file
+    bool writeRefLock(const std::string& refName, const std::string& sha);
+    // Moves a written lock file over the ref, releasing the lock
+    bool commitRef(const std::string& refName);
 
     // Branch operations
     bool createBranch(const std::string& branchName, const std::string& sha);
     std::vector<std::string> listBranches() const;
     bool deleteBranch(const std::string& branchName);
 
+    // Object operations
+    bool hasObject(const std::string& sha);
+    bool readObject(const std::string& sha, GitObjectType& type, std::string& data);
+    // Reads only an object's type and size
+    bool readObjectInfo(const std::string& sha, GitObjectType& type, uint64_t& size);
+    // Names of the objects, loose or packed, that start with prefix; no
+    // more than limit are returned
+    std::vector<std::string> findObjects(const std::string& prefix, size_t limit);
+    // Opens an object to read its content a chunk at a time; nullptr if it
+    // cannot be read
+    std::unique_ptr<GitObjectStream> openObject(const std::string& sha);
+    std::string peelTag(const std::string& sha);
+
+    // History operations
+    bool canAllFromReach(const std::vector<std::string>& from,
+                         const std::vector<std::string>& to);
+    bool collectObjects(const std::vector<std::string>& wants,
+                        const std::vector<std::string>& haves,
+                        std::vector<std::string>& objects,
+                        const std::set<std::string>& shallow = {},
+                        const ObjectFilter& filter = ObjectFilter());
+    bool computeShallow(const std::vector<std::string>& wants,
+                        const ShallowOptions& options,
+                        std::vector<std::string>& shallow,
+                        std::vector<std::string>& unshallow);
+
     // Pack operations (for git protocol)
     bool receivePack(const std::string& packData);
+    // A received pack is streamed into a temporary file under objects/pack
+    // and indexed as it arrives; finishReceivePack() moves it into place
+    std::unique_ptr<GitPackIndexer> beginReceivePack();
+    bool finishReceivePack(GitPackIndexer& indexer);
+
+    // Push quarantine: while one is open, received packs wait in
+    // objects/incoming-XXXXXX, readable but outside the object store,
+    // until migrateQuarantine() moves them in. It is discarded otherwise.
+    bool beginQuarantine();
+    bool migrateQuarantine();
+    void abortQuarantine();
+    std::string getQuarantinePath() const { return quarantinePath; }
+    bool checkConnectivity(const std::string& tip);
     std::string uploadPack(const std::vector<std::string>& wants,
-                          const std::vector<std::string>& haves);
+                          const std::vector<std::string>& haves,
+                          const ShallowOptions& options = ShallowOptions(),
+                          const ObjectFilter& filter = ObjectFilter());
+    // Streams the pack to sink as it is built; stops early if sink fails
+    bool uploadPack(const std::vector<std::string>& wants,
+                    const std::vector<std::string>& haves,
+                    const ShallowOptions& options,
+                    const ObjectFilter& filter,
+                    const GitPack::PackSink& sink);
 
 private:
     std::string repoPath;
     bool initialized;
 
+    // Object store state, loaded lazily
+    std::vector<std::unique_ptr<GitPackFile>> packs;
+    bool packsLoaded;
+    std::string quarantinePath;
+    std::vector<std::unique_ptr<GitPackFile>> quarantinePacks;
+    std::map<std::string, GitCommit::Fields> commitCache;
+
+    void loadPacks();
+    bool inQuarantine(const std::string& sha) const;
+    GitPack::ObjectResolver objectResolver();
+    bool readLooseObject(const std::string& sha, GitObjectType& type, std::string& data);
+    bool readPackedObject(const std::string& sha, GitObjectType& type, std::string& data);
+    bool readLooseObjectInfo(const std::string& sha, GitObjectType& type, uint64_t& size,
+                             size_t& headerLen);
+    bool readPackedObjectInfo(const std::string& sha, GitObjectType& type, uint64_t& size);
+    bool readCommit(const std::string& sha, GitCommit::Fields& fields);
+    bool peel(const std::string& sha, std::string& target, GitObjectType& type,
+              std::vector<std::string>* tags);
+    bool markTreeObjects(const std::string& treeSHA, std::set<std::string>& seen,
+                         std::vector<std::string>* objects);
+    bool filterTreeObjects(const std::vector<std::string>& rootTrees,
+                           const std::set<std::string>& wantedTrees,
+                           const ObjectFilter& filter, std::set<std::string>& seen,
+                           std::vector<std::string>& objects);
+
     bool createDirectory(const std::string& path);
     bool writeFile(const std::string& path, const std::string& content);
     std::string readFile(const std::string& path) const;
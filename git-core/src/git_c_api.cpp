@@ -3,9 +3,61 @@
 #include "git_protocol.h"
 #include <cstring>
 #include <cstdlib>
+#include <algorithm>
 
 using namespace GitCore;
 
+namespace {
+
+char* toCString(const std::string& str) {
+    char* result = (char*)malloc(str.length() + 1);
+    memcpy(result, str.c_str(), str.length() + 1);
+    return result;
+}
+
+char** toCStringArray(const std::vector<std::string>& strs) {
+    if (strs.empty()) {
+        return nullptr;
+    }
+    char** result = (char**)malloc(strs.size() * sizeof(char*));
+    for (size_t i = 0; i < strs.size(); i++) {
+        result[i] = toCString(strs[i]);
+    }
+    return result;
+}
+
+std::vector<std::string> toVector(const char** arr, int count) {
+    std::vector<std::string> result;
+    for (int i = 0; i < count; i++) {
+        result.push_back(arr[i]);
+    }
+    return result;
+}
+
+ShallowOptions toShallowOptions(const git_shallow_options* options) {
+    ShallowOptions result;
+    if (options) {
+        result.depth = options->depth;
+        result.relative = options->relative != 0;
+        result.since = options->since;
+        result.deepenNot = toVector(options->deepen_not, options->deepen_not_count);
+        result.clientShallow = toVector(options->client_shallow, options->client_shallow_count);
+    }
+    return result;
+}
+
+ObjectFilter toObjectFilter(const git_object_filter* filter) {
+    ObjectFilter result;
+    if (filter) {
+        result.omitBlobs = filter->omit_blobs != 0;
+        result.blobLimit = filter->blob_limit;
+        result.treeDepth = filter->tree_depth;
+    }
+    return result;
+}
+
+} // namespace
+
 extern "C" {
 
 void* git_repository_new(const char* path) {
@@ -31,6 +83,15 @@ int git_repository_is_valid(void* repo) {
     return r->isValid() ? 1 : 0;
 }
 
+char* git_repository_get_head(void* repo) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    std::string head = r->getHead();
+    if (head.empty()) {
+        return nullptr;
+    }
+    return toCString(head);
+}
+
 int git_repository_create_ref(void* repo, const char* refName, const char* sha) {
     GitRepository* r = static_cast<GitRepository*>(repo);
     return r->createRef(refName, sha) ? 1 : 0;
@@ -69,6 +130,26 @@ int git_repository_delete_ref(void* repo, const char* refName) {
     return r->deleteRef(refName) ? 1 : 0;
 }
 
+int git_repository_lock_ref(void* repo, const char* refName) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->lockRef(refName) ? 1 : 0;
+}
+
+int git_repository_unlock_ref(void* repo, const char* refName) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->unlockRef(refName) ? 1 : 0;
+}
+
+int git_repository_write_ref_lock(void* repo, const char* refName, const char* sha) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->writeRefLock(refName, sha) ? 1 : 0;
+}
+
+int git_repository_commit_ref(void* repo, const char* refName) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->commitRef(refName) ? 1 : 0;
+}
+
 int git_repository_create_branch(void* repo, const char* branchName, const char* sha) {
     GitRepository* r = static_cast<GitRepository*>(repo);
     return r->createBranch(branchName, sha) ? 1 : 0;
@@ -96,36 +177,210 @@ int git_repository_delete_branch(void* repo, const char* branchName) {
     return r->deleteBranch(branchName) ? 1 : 0;
 }
 
+int git_repository_has_object(void* repo, const char* sha) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->hasObject(sha) ? 1 : 0;
+}
+
+char* git_repository_read_object(void* repo, const char* sha, int* type, int* outLen) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    GitObjectType objectType;
+    std::string data;
+    if (!r->readObject(sha, objectType, data)) {
+        return nullptr;
+    }
+
+    *type = GitPack::fromObjectType(objectType);
+    *outLen = data.length();
+    char* result = (char*)malloc(data.length() + 1);
+    memcpy(result, data.data(), data.length());
+    result[data.length()] = '\0';
+    return result;
+}
+
+int git_repository_read_object_header(void* repo, const char* sha, int* type, long long* size) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    GitObjectType objectType;
+    uint64_t objectSize;
+    if (!r->readObjectInfo(sha, objectType, objectSize)) {
+        return 0;
+    }
+
+    *type = GitPack::fromObjectType(objectType);
+    *size = objectSize;
+    return 1;
+}
+
+char** git_repository_find_objects(void* repo, const char* prefix, int limit, int* count) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    std::vector<std::string> names = r->findObjects(prefix, limit);
+    *count = names.size();
+    return toCStringArray(names);
+}
+
+void* git_repository_open_object(void* repo, const char* sha, int* type, long long* size) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    std::unique_ptr<GitObjectStream> stream = r->openObject(sha);
+    if (!stream) {
+        return nullptr;
+    }
+
+    *type = GitPack::fromObjectType(stream->getType());
+    *size = stream->getSize();
+    return stream.release();
+}
+
+int git_object_stream_read(void* stream, char* buf, int len) {
+    GitObjectStream* s = static_cast<GitObjectStream*>(stream);
+    return s->read(buf, len);
+}
+
+void git_object_stream_free(void* stream) {
+    delete static_cast<GitObjectStream*>(stream);
+}
+
+char* git_repository_peel_tag(void* repo, const char* sha) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    std::string target = r->peelTag(sha);
+    if (target.empty()) {
+        return nullptr;
+    }
+    return toCString(target);
+}
+
+int git_repository_can_all_from_reach(void* repo, const char** from, int fromCount,
+                                      const char** to, int toCount) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->canAllFromReach(toVector(from, fromCount), toVector(to, toCount)) ? 1 : 0;
+}
+
 int git_repository_receive_pack(void* repo, const char* packData, int packLen) {
     GitRepository* r = static_cast<GitRepository*>(repo);
     std::string data(packData, packLen);
     return r->receivePack(data) ? 1 : 0;
 }
 
-char* git_repository_upload_pack(void* repo, const char** wants, int wantCount,
-                                  const char** haves, int haveCount, int* outLen) {
+void* git_repository_receive_pack_begin(void* repo) {
     GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->beginReceivePack().release();
+}
 
-    std::vector<std::string> wantVec;
-    for (int i = 0; i < wantCount; i++) {
-        wantVec.push_back(wants[i]);
-    }
+int git_pack_indexer_append(void* indexer, const char* data, int len) {
+    GitPackIndexer* idx = static_cast<GitPackIndexer*>(indexer);
+    return idx->append(data, len) ? 1 : 0;
+}
 
-    std::vector<std::string> haveVec;
-    for (int i = 0; i < haveCount; i++) {
-        haveVec.push_back(haves[i]);
+int git_pack_indexer_done(void* indexer) {
+    GitPackIndexer* idx = static_cast<GitPackIndexer*>(indexer);
+    return idx->done() ? 1 : 0;
+}
+
+int git_repository_receive_pack_finish(void* repo, void* indexer, int* objectCount) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    GitPackIndexer* idx = static_cast<GitPackIndexer*>(indexer);
+    if (!r->finishReceivePack(*idx)) {
+        return 0;
+    }
+    if (objectCount) {
+        *objectCount = idx->objectCount();
     }
+    return 1;
+}
+
+void git_pack_indexer_free(void* indexer) {
+    delete static_cast<GitPackIndexer*>(indexer);
+}
+
+int git_repository_begin_quarantine(void* repo) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->beginQuarantine() ? 1 : 0;
+}
+
+int git_repository_migrate_quarantine(void* repo) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->migrateQuarantine() ? 1 : 0;
+}
+
+void git_repository_abort_quarantine(void* repo) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    r->abortQuarantine();
+}
 
-    std::string pack = r->uploadPack(wantVec, haveVec);
+char* git_repository_quarantine_path(void* repo) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    std::string path = r->getQuarantinePath();
+    return path.empty() ? nullptr : toCString(path);
+}
+
+int git_repository_check_connectivity(void* repo, const char* tip) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+    return r->checkConnectivity(tip) ? 1 : 0;
+}
+
+char* git_repository_upload_pack(void* repo, const char** wants, int wantCount,
+                                  const char** haves, int haveCount,
+                                  const git_shallow_options* options,
+                                  const git_object_filter* filter, int* outLen) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+
+    std::string pack = r->uploadPack(toVector(wants, wantCount),
+                                     toVector(haves, haveCount),
+                                     toShallowOptions(options),
+                                     toObjectFilter(filter));
     *outLen = pack.length();
+    if (pack.empty()) {
+        return nullptr;
+    }
 
     char* result = (char*)malloc(pack.length());
     memcpy(result, pack.data(), pack.length());
     return result;
 }
 
+int git_repository_upload_pack_stream(void* repo, const char** wants, int wantCount,
+                                      const char** haves, int haveCount,
+                                      const git_shallow_options* options,
+                                      const git_object_filter* filter,
+                                      git_pack_write_cb write, void* payload) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+
+    auto sink = [write, payload](const char* data, size_t len) {
+        while (len > 0) {
+            int chunk = std::min<size_t>(len, 1 << 30);
+            if (!write(payload, data, chunk)) {
+                return false;
+            }
+            data += chunk;
+            len -= chunk;
+        }
+        return true;
+    };
+    return r->uploadPack(toVector(wants, wantCount), toVector(haves, haveCount),
+                         toShallowOptions(options), toObjectFilter(filter), sink) ? 1 : 0;
+}
+
+int git_repository_compute_shallow(void* repo, const char** wants, int wantCount,
+                                   const git_shallow_options* options,
+                                   char*** shallow, int* shallowCount,
+                                   char*** unshallow, int* unshallowCount) {
+    GitRepository* r = static_cast<GitRepository*>(repo);
+
+    std::vector<std::string> shallowSHAs, unshallowSHAs;
+    if (!r->computeShallow(toVector(wants, wantCount), toShallowOptions(options),
+                           shallowSHAs, unshallowSHAs)) {
+        return 0;
+    }
+
+    *shallow = toCStringArray(shallowSHAs);
+    *shallowCount = shallowSHAs.size();
+    *unshallow = toCStringArray(unshallowSHAs);
+    *unshallowCount = unshallowSHAs.size();
+    return 1;
+}
+
 char* git_protocol_create_ref_advertisement(const char** refs, const char** shas,
-                                            int refCount, const char* service, int* outLen) {
+                                            int refCount, const char* service,
+                                            const char* capabilities, int* outLen) {
     std::vector<GitProtocol::RefAdvertisement> refAds;
     for (int i = 0; i < refCount; i++) {
         GitProtocol::RefAdvertisement ad;
@@ -134,7 +389,7 @@ char* git_protocol_create_ref_advertisement(const char** refs, const char** shas
         refAds.push_back(ad);
     }
 
-    std::string adv = GitProtocol::createRefAdvertisement(refAds, service);
+    std::string adv = GitProtocol::createRefAdvertisement(refAds, service, capabilities);
     *outLen = adv.length();
 
     char* result = (char*)malloc(adv.length());
@@ -142,6 +397,64 @@ char* git_protocol_create_ref_advertisement(const char** refs, const char** shas
     return result;
 }
 
+int git_protocol_parse_upload_pack(const char* data, int len, git_fetch_request* out) {
+    GitProtocol::FetchRequest request =
+        GitProtocol::parseUploadPack(std::string(data, len));
+
+    out->wants = toCStringArray(request.wants);
+    out->want_count = request.wants.size();
+    out->haves = toCStringArray(request.haves);
+    out->have_count = request.haves.size();
+    out->capabilities = toCStringArray(request.capabilities);
+    out->capability_count = request.capabilities.size();
+    out->shallows = toCStringArray(request.shallows);
+    out->shallow_count = request.shallows.size();
+    out->depth = request.depth;
+    out->deepen_since = request.deepenSince;
+    out->deepen_not = toCStringArray(request.deepenNot);
+    out->deepen_not_count = request.deepenNot.size();
+    out->filter = request.filter.empty() ? nullptr : toCString(request.filter);
+    out->done = request.done ? 1 : 0;
+    return 1;
+}
+
+void git_protocol_free_fetch_request(git_fetch_request* req) {
+    git_free_string_array(req->wants, req->want_count);
+    git_free_string_array(req->haves, req->have_count);
+    git_free_string_array(req->capabilities, req->capability_count);
+    git_free_string_array(req->shallows, req->shallow_count);
+    git_free_string_array(req->deepen_not, req->deepen_not_count);
+    free(req->filter);
+}
+
+int git_protocol_parse_receive_pack(const char* data, int len, git_push_request* out) {
+    GitProtocol::PushRequest request =
+        GitProtocol::parseReceivePack(std::string(data, len));
+
+    std::vector<std::string> oldSHAs, newSHAs, refNames;
+    for (const auto& command : request.commands) {
+        oldSHAs.push_back(command.oldSHA);
+        newSHAs.push_back(command.newSHA);
+        refNames.push_back(command.refName);
+    }
+
+    out->old_shas = toCStringArray(oldSHAs);
+    out->new_shas = toCStringArray(newSHAs);
+    out->ref_names = toCStringArray(refNames);
+    out->command_count = request.commands.size();
+    out->capabilities = toCStringArray(request.capabilities);
+    out->capability_count = request.capabilities.size();
+    out->pack_offset = request.packOffset;
+    return 1;
+}
+
+void git_protocol_free_push_request(git_push_request* req) {
+    git_free_string_array(req->old_shas, req->command_count);
+    git_free_string_array(req->new_shas, req->command_count);
+    git_free_string_array(req->ref_names, req->command_count);
+    git_free_string_array(req->capabilities, req->capability_count);
+}
+
 char* git_protocol_pkt_line(const char* data) {
     std::string pkt = GitProtocol::pktLine(data);
     char* result = (char*)malloc(pkt.length() + 1);
@@ -32,17 +32,34 @@ size_t GitObject::getSize() const {
 }
 
 std::string GitObject::serialize() const {
-    std::string typeStr;
+    std::ostringstream oss;
+    oss << typeName(type) << " " << data.size() << '\0' << data;
+    return oss.str();
+}
+
+std::string GitObject::typeName(GitObjectType type) {
     switch (type) {
-        case GitObjectType::BLOB:   typeStr = "blob"; break;
-        case GitObjectType::TREE:   typeStr = "tree"; break;
-        case GitObjectType::COMMIT: typeStr = "commit"; break;
-        case GitObjectType::TAG:    typeStr = "tag"; break;
+        case GitObjectType::BLOB:   return "blob";
+        case GitObjectType::TREE:   return "tree";
+        case GitObjectType::COMMIT: return "commit";
+        case GitObjectType::TAG:    return "tag";
     }
+    return "";
+}
 
-    std::ostringstream oss;
-    oss << typeStr << " " << data.size() << '\0' << data;
-    return oss.str();
+bool GitObject::parseTypeName(const std::string& name, GitObjectType& type) {
+    if (name == "blob") {
+        type = GitObjectType::BLOB;
+    } else if (name == "tree") {
+        type = GitObjectType::TREE;
+    } else if (name == "commit") {
+        type = GitObjectType::COMMIT;
+    } else if (name == "tag") {
+        type = GitObjectType::TAG;
+    } else {
+        return false;
+    }
+    return true;
 }
 
 std::string GitObject::calculateSHA(const std::string& content) {
@@ -90,6 +107,32 @@ std::vector<GitTreeEntry> GitTree::getEntries() const {
     return entries;
 }
 
+std::vector<GitTreeEntry> GitTree::parseEntries(const std::string& data) {
+    std::vector<GitTreeEntry> result;
+    size_t pos = 0;
+
+    while (pos < data.size()) {
+        size_t space = data.find(' ', pos);
+        if (space == std::string::npos) break;
+        size_t nul = data.find('\0', space + 1);
+        if (nul == std::string::npos || nul + 21 > data.size()) break;
+
+        std::string mode = data.substr(pos, space - pos);
+        std::string name = data.substr(space + 1, nul - space - 1);
+
+        std::ostringstream oss;
+        for (size_t i = nul + 1; i < nul + 21; i++) {
+            oss << std::hex << std::setw(2) << std::setfill('0')
+                << static_cast<int>(static_cast<unsigned char>(data[i]));
+        }
+
+        result.emplace_back(mode, name, oss.str());
+        pos = nul + 21;
+    }
+
+    return result;
+}
+
 std::string GitTree::buildTreeData() const {
     std::ostringstream oss;
     for (const auto& entry : entries) {
@@ -149,4 +192,81 @@ std::string GitCommit::buildCommitData() const {
     return oss.str();
 }
 
+bool GitCommit::parse(const std::string& data, Fields& fields) {
+    fields.parentSHAs.clear();
+    fields.commitTime = 0;
+
+    size_t pos = 0;
+    while (pos < data.size()) {
+        size_t eol = data.find('\n', pos);
+        if (eol == std::string::npos) {
+            return false;
+        }
+
+        // Blank line separates headers from the message
+        if (eol == pos) {
+            fields.message = data.substr(eol + 1);
+            return !fields.treeSHA.empty();
+        }
+
+        std::string line = data.substr(pos, eol - pos);
+        if (line.compare(0, 5, "tree ") == 0) {
+            fields.treeSHA = line.substr(5);
+        } else if (line.compare(0, 7, "parent ") == 0) {
+            fields.parentSHAs.push_back(line.substr(7));
+        } else if (line.compare(0, 7, "author ") == 0) {
+            fields.author = line.substr(7);
+        } else if (line.compare(0, 10, "committer ") == 0) {
+            fields.committer = line.substr(10);
+
+            // "Name <email> 1700000000 +0000"
+            size_t close = fields.committer.rfind('>');
+            if (close != std::string::npos) {
+                try {
+                    fields.commitTime = std::stoll(fields.committer.substr(close + 1));
+                } catch (const std::exception&) {
+                    fields.commitTime = 0;
+                }
+            }
+        }
+
+        pos = eol + 1;
+    }
+
+    return !fields.treeSHA.empty();
+}
+
+// GitTag implementation
+bool GitTag::parse(const std::string& data, Fields& fields) {
+    size_t pos = 0;
+    bool hasType = false;
+
+    while (pos < data.size()) {
+        size_t eol = data.find('\n', pos);
+        if (eol == std::string::npos) {
+            break;
+        }
+
+        if (eol == pos) {
+            fields.message = data.substr(eol + 1);
+            break;
+        }
+
+        std::string line = data.substr(pos, eol - pos);
+        if (line.compare(0, 7, "object ") == 0) {
+            fields.objectSHA = line.substr(7);
+        } else if (line.compare(0, 5, "type ") == 0) {
+            hasType = GitObject::parseTypeName(line.substr(5), fields.objectType);
+        } else if (line.compare(0, 4, "tag ") == 0) {
+            fields.tagName = line.substr(4);
+        } else if (line.compare(0, 7, "tagger ") == 0) {
+            fields.tagger = line.substr(7);
+        }
+
+        pos = eol + 1;
+    }
+
+    return !fields.objectSHA.empty() && hasType;
+}
+
 } // namespace GitCore
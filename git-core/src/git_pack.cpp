@@ -1,112 +1,371 @@
 #include "git_pack.h"
+#include "git_object.h"
 #include <zlib.h>
+#include <openssl/sha.h>
 #include <cstring>
 #include <stdexcept>
+#include <sstream>
+#include <iomanip>
+#include <filesystem>
+#include <algorithm>
+#include <numeric>
+#include <memory>
+#include <set>
+
+namespace fs = std::filesystem;
 
 namespace GitCore {
 
+namespace {
+
+// Reads one of the size varints a delta starts with
+bool readDeltaSize(const uint8_t* d, size_t len, size_t& pos, uint64_t& value) {
+    value = 0;
+    int shift = 0;
+    uint8_t byte;
+    do {
+        if (pos >= len || shift > 63) {
+            return false;
+        }
+        byte = d[pos++];
+        value |= ((uint64_t)(byte & 0x7F)) << shift;
+        shift += 7;
+    } while (byte & 0x80);
+    return true;
+}
+
+std::string toHex(const unsigned char* data, size_t len) {
+    static const char digits[] = "0123456789abcdef";
+    std::string hex;
+    hex.reserve(len * 2);
+    for (size_t i = 0; i < len; i++) {
+        hex += digits[data[i] >> 4];
+        hex += digits[data[i] & 0x0F];
+    }
+    return hex;
+}
+
+void fromHex(const std::string& hex, unsigned char* out) {
+    auto nibble = [](char c) {
+        return c >= 'a' ? c - 'a' + 10 : c - '0';
+    };
+    for (size_t i = 0; i + 1 < hex.size(); i += 2) {
+        out[i / 2] = (nibble(hex[i]) << 4) | nibble(hex[i + 1]);
+    }
+}
+
+uint32_t readUint32(const unsigned char* p) {
+    return (uint32_t(p[0]) << 24) | (uint32_t(p[1]) << 16) | (uint32_t(p[2]) << 8) | p[3];
+}
+
+void appendUint32(std::string& out, uint32_t value) {
+    out += static_cast<char>(value >> 24);
+    out += static_cast<char>(value >> 16);
+    out += static_cast<char>(value >> 8);
+    out += static_cast<char>(value);
+}
+
+} // namespace
+
 GitPack::GitPack() {
 }
 
 GitPack::~GitPack() {
 }
 
-bool GitPack::createPack(const std::vector<std::string>& objectSHAs,
+bool GitPack::createPack(const std::vector<PackObject>& objects,
                         std::string& packData) {
-    // Simplified pack creation
-    // In a real implementation, this would:
-    // 1. Read all objects
-    // 2. Compress them
-    // 3. Write pack header, objects, and checksum
-
-    std::vector<uint8_t> pack;
-
-    // Write pack signature
-    pack.push_back((PACK_SIGNATURE >> 24) & 0xFF);
-    pack.push_back((PACK_SIGNATURE >> 16) & 0xFF);
-    pack.push_back((PACK_SIGNATURE >> 8) & 0xFF);
-    pack.push_back(PACK_SIGNATURE & 0xFF);
-
-    // Write version
-    pack.push_back((PACK_VERSION >> 24) & 0xFF);
-    pack.push_back((PACK_VERSION >> 16) & 0xFF);
-    pack.push_back((PACK_VERSION >> 8) & 0xFF);
-    pack.push_back(PACK_VERSION & 0xFF);
-
-    // Write object count
-    uint32_t objCount = objectSHAs.size();
-    pack.push_back((objCount >> 24) & 0xFF);
-    pack.push_back((objCount >> 16) & 0xFF);
-    pack.push_back((objCount >> 8) & 0xFF);
-    pack.push_back(objCount & 0xFF);
-
-    // Objects would be written here...
-
-    packData = std::string(pack.begin(), pack.end());
-    return true;
+    packData.clear();
+    GitPackWriter writer([&packData](const char* data, size_t len) {
+        packData.append(data, len);
+        return true;
+    }, objects.size());
+
+    // Objects are stored whole (no deltas), each one zlib compressed
+    for (const auto& obj : objects) {
+        if (!writer.add(obj.type, obj.data)) {
+            return false;
+        }
+    }
+    return writer.finish();
 }
 
 bool GitPack::extractPack(const std::string& packData,
-                         const std::string& objectsPath) {
-    // Simplified pack extraction
-    if (packData.length() < 12) {
+                         const std::string& objectsPath,
+                         const ObjectResolver& resolver) {
+    std::vector<PackObject> objects;
+    if (!parsePackFile(packData, resolver, objects)) {
+        return false;
+    }
+
+    for (const auto& obj : objects) {
+        if (!writeLooseObject(objectsPath, obj.type, obj.data, obj.sha)) {
+            return false;
+        }
+    }
+
+    return true;
+}
+
+bool GitPack::createIndex(const std::string& packPath,
+                         const std::string& idxPath) {
+    std::ifstream in(packPath, std::ios::binary);
+    if (!in) {
         return false;
     }
 
-    // Verify pack signature
-    uint32_t sig = (static_cast<uint8_t>(packData[0]) << 24) |
-                   (static_cast<uint8_t>(packData[1]) << 16) |
-                   (static_cast<uint8_t>(packData[2]) << 8) |
-                   static_cast<uint8_t>(packData[3]);
+    GitPackIndexer indexer(packPath, true);
+    std::vector<char> buffer(65536);
+    while (in) {
+        in.read(buffer.data(), buffer.size());
+        if (in.gcount() > 0 && !indexer.append(buffer.data(), in.gcount())) {
+            return false;
+        }
+    }
 
-    if (sig != PACK_SIGNATURE) {
+    // Without a resolver, thin packs cannot be indexed
+    return indexer.finish(nullptr) && indexer.writeIndex(idxPath);
+}
+
+bool GitPack::parsePackFile(const std::string& packData,
+                            const ObjectResolver& resolver,
+                            std::vector<PackObject>& objects) {
+    if (packData.length() < 12 + SHA_DIGEST_LENGTH) {
         return false;
     }
 
-    // Parse pack version
-    uint32_t version = (static_cast<uint8_t>(packData[4]) << 24) |
-                       (static_cast<uint8_t>(packData[5]) << 16) |
-                       (static_cast<uint8_t>(packData[6]) << 8) |
-                       static_cast<uint8_t>(packData[7]);
+    const uint8_t* d = reinterpret_cast<const uint8_t*>(packData.data());
+    size_t len = packData.length() - SHA_DIGEST_LENGTH;
+
+    // Verify pack signature and version
+    uint32_t sig = (d[0] << 24) | (d[1] << 16) | (d[2] << 8) | d[3];
+    uint32_t version = (d[4] << 24) | (d[5] << 16) | (d[6] << 8) | d[7];
+    if (sig != PACK_SIGNATURE || version != PACK_VERSION) {
+        return false;
+    }
 
-    if (version != PACK_VERSION) {
+    // Verify trailing checksum
+    unsigned char hash[SHA_DIGEST_LENGTH];
+    SHA1(d, len, hash);
+    if (memcmp(hash, d + len, SHA_DIGEST_LENGTH) != 0) {
         return false;
     }
 
-    // Get object count
-    uint32_t objCount = (static_cast<uint8_t>(packData[8]) << 24) |
-                        (static_cast<uint8_t>(packData[9]) << 16) |
-                        (static_cast<uint8_t>(packData[10]) << 8) |
-                        static_cast<uint8_t>(packData[11]);
+    uint32_t objCount = (d[8] << 24) | (d[9] << 16) | (d[10] << 8) | d[11];
 
-    // Parse and extract objects...
-    // In a real implementation, this would decompress and write objects
+    struct Entry {
+        uint64_t offset;
+        uint8_t type;
+        std::string data;
+        uint64_t baseOffset;
+        std::string baseSHA;
+        bool resolved;
+    };
 
-    return true;
+    std::vector<Entry> entries(objCount);
+    std::map<uint64_t, size_t> byOffset;
+    size_t offset = 12;
+
+    // First pass: inflate every entry in pack order
+    for (uint32_t i = 0; i < objCount; i++) {
+        Entry& entry = entries[i];
+        entry.offset = offset;
+        entry.resolved = false;
+        byOffset[offset] = i;
+
+        uint64_t size;
+        if (!readObjectHeader(d, len, offset, entry.type, size)) {
+            return false;
+        }
+
+        if (entry.type == OBJ_OFS_DELTA) {
+            if (offset >= len) return false;
+            uint8_t byte = d[offset++];
+            uint64_t back = byte & 0x7F;
+            while (byte & 0x80) {
+                if (offset >= len) return false;
+                byte = d[offset++];
+                back = ((back + 1) << 7) | (byte & 0x7F);
+            }
+            if (back == 0 || back > entry.offset) {
+                return false;
+            }
+            entry.baseOffset = entry.offset - back;
+        } else if (entry.type == OBJ_REF_DELTA) {
+            if (offset + SHA_DIGEST_LENGTH > len) return false;
+            std::ostringstream oss;
+            for (size_t j = offset; j < offset + SHA_DIGEST_LENGTH; j++) {
+                oss << std::hex << std::setw(2) << std::setfill('0')
+                    << static_cast<int>(d[j]);
+            }
+            entry.baseSHA = oss.str();
+            offset += SHA_DIGEST_LENGTH;
+        } else if (entry.type < OBJ_COMMIT || entry.type > OBJ_TAG) {
+            return false;
+        }
+
+        size_t consumed;
+        if (!inflateObject(d + offset, len - offset, size, entry.data, consumed)) {
+            return false;
+        }
+        offset += consumed;
+    }
+
+    if (offset != len) {
+        return false;
+    }
+
+    // Second pass: resolve deltas until nothing changes
+    std::map<std::string, size_t> bySHA;
+    objects.assign(objCount, PackObject());
+    size_t remaining = objCount;
+    bool progress = true;
+
+    while (remaining > 0 && progress) {
+        progress = false;
+
+        for (uint32_t i = 0; i < objCount; i++) {
+            Entry& entry = entries[i];
+            if (entry.resolved) {
+                continue;
+            }
+
+            PackObject& obj = objects[i];
+            if (entry.type == OBJ_OFS_DELTA || entry.type == OBJ_REF_DELTA) {
+                const PackObject* base = nullptr;
+
+                if (entry.type == OBJ_OFS_DELTA) {
+                    auto it = byOffset.find(entry.baseOffset);
+                    if (it == byOffset.end()) {
+                        return false;
+                    }
+                    if (entries[it->second].resolved) {
+                        base = &objects[it->second];
+                    }
+                } else {
+                    auto it = bySHA.find(entry.baseSHA);
+                    if (it != bySHA.end()) {
+                        base = &objects[it->second];
+                    }
+                }
+
+                if (!base) {
+                    continue;
+                }
+                if (!applyDelta(base->data, entry.data, obj.data)) {
+                    return false;
+                }
+                obj.type = base->type;
+                entry.data.clear();
+            } else {
+                obj.type = entry.type;
+                obj.data.swap(entry.data);
+            }
+
+            obj.size = obj.data.size();
+            obj.sha = objectSHA(obj.type, obj.data);
+            bySHA[obj.sha] = i;
+            entry.resolved = true;
+            remaining--;
+            progress = true;
+        }
+
+        // Thin packs reference bases the receiver already has
+        if (!progress && remaining > 0 && resolver) {
+            for (uint32_t i = 0; i < objCount && !progress; i++) {
+                Entry& entry = entries[i];
+                if (entry.resolved || entry.type != OBJ_REF_DELTA) {
+                    continue;
+                }
+
+                PackObject external;
+                if (!resolver(entry.baseSHA, external.type, external.data)) {
+                    continue;
+                }
+
+                PackObject& obj = objects[i];
+                if (!applyDelta(external.data, entry.data, obj.data)) {
+                    return false;
+                }
+                obj.type = external.type;
+                obj.size = obj.data.size();
+                obj.sha = objectSHA(obj.type, obj.data);
+                bySHA[obj.sha] = i;
+                entry.data.clear();
+                entry.resolved = true;
+                remaining--;
+                progress = true;
+            }
+        }
+    }
+
+    return remaining == 0;
 }
 
-bool GitPack::createIndex(const std::string& packPath,
-                         const std::string& idxPath) {
-    // Simplified index creation
-    // In a real implementation, this would parse the pack file
-    // and create an index for fast object lookup
-    return true;
+GitObjectType GitPack::toObjectType(uint8_t packType) {
+    switch (packType) {
+        case OBJ_COMMIT: return GitObjectType::COMMIT;
+        case OBJ_TREE:   return GitObjectType::TREE;
+        case OBJ_TAG:    return GitObjectType::TAG;
+        default:         return GitObjectType::BLOB;
+    }
 }
 
-std::vector<GitPack::PackObject> GitPack::parsePackFile(const std::string& packData) {
-    std::vector<PackObject> objects;
+uint8_t GitPack::fromObjectType(GitObjectType type) {
+    switch (type) {
+        case GitObjectType::COMMIT: return OBJ_COMMIT;
+        case GitObjectType::TREE:   return OBJ_TREE;
+        case GitObjectType::TAG:    return OBJ_TAG;
+        default:                    return OBJ_BLOB;
+    }
+}
 
-    if (packData.length() < 12) {
-        return objects;
+std::string GitPack::objectSHA(uint8_t packType, const std::string& data) {
+    std::string header = GitObject::typeName(toObjectType(packType)) + " " +
+                         std::to_string(data.size());
+    header += '\0';
+    return GitObject::calculateSHA(header + data);
+}
+
+bool GitPack::writeLooseObject(const std::string& objectsPath, uint8_t packType,
+                               const std::string& data, const std::string& sha) {
+    std::string dir = objectsPath + "/" + sha.substr(0, 2);
+    std::string path = dir + "/" + sha.substr(2);
+
+    // Objects are immutable; an existing file already has this content
+    if (fs::exists(path)) {
+        return true;
     }
 
-    size_t offset = 12; // Skip header
+    std::string header = GitObject::typeName(toObjectType(packType)) + " " +
+                         std::to_string(data.size());
+    header += '\0';
 
-    // Parse objects
-    // This is a simplified version
-    // Real implementation would parse each object header and data
+    std::string compressed;
+    try {
+        compressed = compressData(header + data);
+    } catch (const std::exception& e) {
+        return false;
+    }
+
+    std::error_code ec;
+    fs::create_directories(dir, ec);
+
+    // Write to a temporary name and rename so readers never see partial objects
+    std::string tmpPath = path + ".tmp";
+    {
+        std::ofstream file(tmpPath, std::ios::binary);
+        if (!file) {
+            return false;
+        }
+        file.write(compressed.data(), compressed.size());
+        if (!file.good()) {
+            return false;
+        }
+    }
 
-    return objects;
+    fs::rename(tmpPath, path, ec);
+    return !ec;
 }
 
 std::string GitPack::compressData(const std::string& data) {
@@ -179,6 +438,136 @@ std::string GitPack::decompressData(const std::string& compressed) {
     return decompressed;
 }
 
+bool GitPack::readObjectHeader(const uint8_t* data, size_t len, size_t& offset,
+                               uint8_t& type, uint64_t& size) {
+    if (offset >= len) {
+        return false;
+    }
+
+    uint8_t byte = data[offset++];
+    type = (byte >> 4) & 0x07;
+    size = byte & 0x0F;
+
+    int shift = 4;
+    while (byte & 0x80) {
+        if (offset >= len || shift > 57) {
+            return false;
+        }
+        byte = data[offset++];
+        size |= ((uint64_t)(byte & 0x7F)) << shift;
+        shift += 7;
+    }
+
+    return true;
+}
+
+void GitPack::writeObjectHeader(std::string& output, uint8_t type, uint64_t size) {
+    uint8_t byte = (type << 4) | (size & 0x0F);
+    size >>= 4;
+
+    while (size > 0) {
+        output += static_cast<char>(byte | 0x80);
+        byte = size & 0x7F;
+        size >>= 7;
+    }
+    output += static_cast<char>(byte);
+}
+
+bool GitPack::applyDelta(const std::string& base, const std::string& delta,
+                         std::string& result) {
+    const uint8_t* d = reinterpret_cast<const uint8_t*>(delta.data());
+    size_t len = delta.size();
+    size_t pos = 0;
+
+    uint64_t baseSize, resultSize;
+    if (!readDeltaSize(d, len, pos, baseSize) || !readDeltaSize(d, len, pos, resultSize)) {
+        return false;
+    }
+    if (baseSize != base.size()) {
+        return false;
+    }
+
+    result.clear();
+    result.reserve(resultSize);
+
+    while (pos < len) {
+        uint8_t op = d[pos++];
+
+        if (op & 0x80) {
+            // Copy a range of the base object
+            uint64_t copyOffset = 0;
+            uint64_t copySize = 0;
+            for (int i = 0; i < 4; i++) {
+                if (op & (1 << i)) {
+                    if (pos >= len) return false;
+                    copyOffset |= ((uint64_t)d[pos++]) << (i * 8);
+                }
+            }
+            for (int i = 0; i < 3; i++) {
+                if (op & (0x10 << i)) {
+                    if (pos >= len) return false;
+                    copySize |= ((uint64_t)d[pos++]) << (i * 8);
+                }
+            }
+            if (copySize == 0) {
+                copySize = 0x10000;
+            }
+            if (copyOffset + copySize > base.size()) {
+                return false;
+            }
+            result.append(base, copyOffset, copySize);
+        } else if (op != 0) {
+            // Insert literal bytes from the delta
+            if (pos + op > len) {
+                return false;
+            }
+            result.append(delta, pos, op);
+            pos += op;
+        } else {
+            return false;
+        }
+    }
+
+    return result.size() == resultSize;
+}
+
+bool GitPack::inflateObject(const uint8_t* data, size_t len, uint64_t size,
+                            std::string& output, size_t& consumed) {
+    z_stream zs;
+    memset(&zs, 0, sizeof(zs));
+    if (inflateInit(&zs) != Z_OK) {
+        return false;
+    }
+
+    output.clear();
+    output.resize(size);
+
+    zs.next_in = const_cast<Bytef*>(data);
+    zs.avail_in = len;
+    zs.next_out = reinterpret_cast<Bytef*>(&output[0]);
+    zs.avail_out = size;
+
+    // Anything written to the overflow byte means the size header lied
+    char overflow[1];
+    int ret = Z_OK;
+    while (ret == Z_OK) {
+        if (zs.avail_out == 0) {
+            zs.next_out = reinterpret_cast<Bytef*>(overflow);
+            zs.avail_out = sizeof(overflow);
+        }
+        ret = inflate(&zs, Z_NO_FLUSH);
+        if (ret == Z_OK && zs.avail_in == 0) {
+            break;
+        }
+    }
+
+    consumed = zs.total_in;
+    uint64_t produced = zs.total_out;
+    inflateEnd(&zs);
+
+    return ret == Z_STREAM_END && produced == size;
+}
+
 uint64_t GitPack::readVarint(const uint8_t* data, size_t& offset) {
     uint64_t value = 0;
     uint8_t byte;
@@ -201,4 +590,1091 @@ void GitPack::writeVarint(std::vector<uint8_t>& output, uint64_t value) {
     output.push_back(value & 0x7F);
 }
 
+// GitPackFile implementation
+GitPackFile::GitPackFile(const std::string& packPath)
+    : packPath(packPath), objectCount(0), baseCacheBytes(0) {
+}
+
+GitPackFile::~GitPackFile() {
+}
+
+bool GitPackFile::open() {
+    std::string idxPath = packPath.substr(0, packPath.size() - 5) + ".idx";
+    std::ifstream idxFile(idxPath, std::ios::binary);
+    if (!idxFile) {
+        return false;
+    }
+
+    index.assign(std::istreambuf_iterator<char>(idxFile),
+                 std::istreambuf_iterator<char>());
+
+    // Version 2 index: magic, version, 256-entry fan-out table
+    const uint8_t* d = reinterpret_cast<const uint8_t*>(index.data());
+    if (index.size() < 8 + 256 * 4 ||
+        memcmp(d, "\377tOc", 4) != 0 ||
+        d[4] != 0 || d[5] != 0 || d[6] != 0 || d[7] != 2) {
+        return false;
+    }
+
+    const uint8_t* last = d + 8 + 255 * 4;
+    objectCount = (last[0] << 24) | (last[1] << 16) | (last[2] << 8) | last[3];
+    if (index.size() < 8 + 256 * 4 + (size_t)objectCount * 28 + 40) {
+        return false;
+    }
+
+    pack.open(packPath, std::ios::binary);
+    return pack.good();
+}
+
+bool GitPackFile::contains(const std::string& sha) const {
+    uint64_t offset;
+    return findOffset(sha, offset);
+}
+
+void GitPackFile::findPrefix(const std::string& prefix, size_t limit,
+                             std::vector<std::string>& found) const {
+    if (prefix.size() < 2 || objectCount == 0) {
+        return;
+    }
+    int first;
+    try {
+        first = std::stoi(prefix.substr(0, 2), nullptr, 16);
+    } catch (const std::exception&) {
+        return;
+    }
+
+    const uint8_t* d = reinterpret_cast<const uint8_t*>(index.data());
+    const uint8_t* fanout = d + 8;
+    auto fanoutAt = [&](int i) -> uint32_t {
+        const uint8_t* p = fanout + i * 4;
+        return (p[0] << 24) | (p[1] << 16) | (p[2] << 8) | p[3];
+    };
+    const uint8_t* shas = fanout + 256 * 4;
+    auto nameAt = [&](uint32_t i) { return toHex(shas + (size_t)i * 20, 20); };
+
+    // Names are sorted, so the matches form one run; find where it starts
+    uint32_t lo = first == 0 ? 0 : fanoutAt(first - 1);
+    uint32_t end = fanoutAt(first);
+    uint32_t hi = end;
+    while (lo < hi) {
+        uint32_t mid = lo + (hi - lo) / 2;
+        if (nameAt(mid).compare(0, prefix.size(), prefix) < 0) {
+            lo = mid + 1;
+        } else {
+            hi = mid;
+        }
+    }
+
+    for (uint32_t i = lo; i < end && found.size() < limit; i++) {
+        std::string name = nameAt(i);
+        if (name.compare(0, prefix.size(), prefix) != 0) {
+            break;
+        }
+        found.push_back(name);
+    }
+}
+
+bool GitPackFile::findOffset(const std::string& sha, uint64_t& offset) const {
+    if (sha.size() != 40 || objectCount == 0) {
+        return false;
+    }
+
+    uint8_t target[20];
+    for (int i = 0; i < 20; i++) {
+        try {
+            target[i] = static_cast<uint8_t>(std::stoi(sha.substr(i * 2, 2), nullptr, 16));
+        } catch (const std::exception&) {
+            return false;
+        }
+    }
+
+    const uint8_t* d = reinterpret_cast<const uint8_t*>(index.data());
+    const uint8_t* fanout = d + 8;
+    auto fanoutAt = [&](int i) -> uint32_t {
+        const uint8_t* p = fanout + i * 4;
+        return (p[0] << 24) | (p[1] << 16) | (p[2] << 8) | p[3];
+    };
+
+    uint32_t lo = target[0] == 0 ? 0 : fanoutAt(target[0] - 1);
+    uint32_t hi = fanoutAt(target[0]);
+    const uint8_t* shas = fanout + 256 * 4;
+
+    while (lo < hi) {
+        uint32_t mid = lo + (hi - lo) / 2;
+        int cmp = memcmp(shas + (size_t)mid * 20, target, 20);
+        if (cmp == 0) {
+            const uint8_t* offsets = shas + (size_t)objectCount * 24;
+            const uint8_t* p = offsets + (size_t)mid * 4;
+            uint32_t small = (p[0] << 24) | (p[1] << 16) | (p[2] << 8) | p[3];
+
+            if (small & 0x80000000) {
+                // Offset lives in the 64-bit large offset table
+                const uint8_t* large = offsets + (size_t)objectCount * 4 +
+                                       (size_t)(small & 0x7FFFFFFF) * 8;
+                if (large + 8 > d + index.size()) {
+                    return false;
+                }
+                offset = 0;
+                for (int i = 0; i < 8; i++) {
+                    offset = (offset << 8) | large[i];
+                }
+            } else {
+                offset = small;
+            }
+            return true;
+        }
+        if (cmp < 0) {
+            lo = mid + 1;
+        } else {
+            hi = mid;
+        }
+    }
+
+    return false;
+}
+
+bool GitPackFile::readObject(const std::string& sha, uint8_t& type, std::string& data,
+                             const GitPack::ObjectResolver& resolver) {
+    uint64_t offset;
+    if (!findOffset(sha, offset)) {
+        return false;
+    }
+    return readAt(offset, type, data, resolver, 0);
+}
+
+bool GitPackFile::readObjectInfo(const std::string& sha, uint8_t& type, uint64_t& size,
+                                 const GitPack::ObjectResolver& resolver) {
+    uint64_t offset;
+    if (!findOffset(sha, offset)) {
+        return false;
+    }
+    return infoAt(offset, type, size, resolver, 0);
+}
+
+std::unique_ptr<GitObjectStream> GitPackFile::openObject(
+    const std::string& sha, const GitPack::ObjectResolver& resolver) {
+    uint64_t offset;
+    Entry entry;
+    if (!findOffset(sha, offset) || !readEntry(offset, entry)) {
+        return nullptr;
+    }
+
+    std::unique_ptr<GitObjectStream> stream;
+    if (entry.type == GitPack::OBJ_OFS_DELTA || entry.type == GitPack::OBJ_REF_DELTA) {
+        uint8_t type;
+        std::string data;
+        if (!readAt(offset, type, data, resolver, 0)) {
+            return nullptr;
+        }
+        stream = std::make_unique<GitObjectStream>(GitPack::toObjectType(type), std::move(data));
+    } else {
+        stream = std::make_unique<GitObjectStream>(GitPack::toObjectType(entry.type), packPath,
+                                                   entry.dataOffset, 0, entry.size);
+    }
+    if (!stream->open()) {
+        return nullptr;
+    }
+    return stream;
+}
+
+bool GitPackFile::readEntry(uint64_t offset, Entry& entry) {
+    uint8_t header[32];
+    pack.clear();
+    pack.seekg(offset);
+    pack.read(reinterpret_cast<char*>(header), sizeof(header));
+    size_t got = pack.gcount();
+    if (got == 0) {
+        return false;
+    }
+
+    size_t pos = 0;
+    if (!GitPack::readObjectHeader(header, got, pos, entry.type, entry.size)) {
+        return false;
+    }
+
+    if (entry.type == GitPack::OBJ_OFS_DELTA) {
+        if (pos >= got) return false;
+        uint8_t byte = header[pos++];
+        uint64_t back = byte & 0x7F;
+        while (byte & 0x80) {
+            if (pos >= got) return false;
+            byte = header[pos++];
+            back = ((back + 1) << 7) | (byte & 0x7F);
+        }
+        if (back == 0 || back > offset) {
+            return false;
+        }
+        entry.baseOffset = offset - back;
+    } else if (entry.type == GitPack::OBJ_REF_DELTA) {
+        if (pos + 20 > got) return false;
+        entry.baseSHA = toHex(header + pos, 20);
+        pos += 20;
+    }
+
+    entry.dataOffset = offset + pos;
+    return true;
+}
+
+bool GitPackFile::readAt(uint64_t offset, uint8_t& type, std::string& data,
+                         const GitPack::ObjectResolver& resolver, int depth) {
+    // Guard against corrupt packs with cyclic delta chains
+    if (depth > 10000) {
+        return false;
+    }
+
+    auto cached = baseCache.find(offset);
+    if (cached != baseCache.end()) {
+        type = cached->second.first;
+        data = cached->second.second;
+        return true;
+    }
+
+    Entry entry;
+    if (!readEntry(offset, entry)) {
+        return false;
+    }
+    type = entry.type;
+
+    if (type == GitPack::OBJ_OFS_DELTA || type == GitPack::OBJ_REF_DELTA) {
+        uint8_t baseType;
+        std::string base;
+
+        if (type == GitPack::OBJ_OFS_DELTA) {
+            if (!readAt(entry.baseOffset, baseType, base, resolver, depth + 1)) {
+                return false;
+            }
+        } else {
+            uint64_t baseOffset;
+            if (findOffset(entry.baseSHA, baseOffset)) {
+                if (!readAt(baseOffset, baseType, base, resolver, depth + 1)) {
+                    return false;
+                }
+            } else if (!resolver || !resolver(entry.baseSHA, baseType, base)) {
+                return false;
+            }
+        }
+
+        std::string delta;
+        if (!inflateAt(entry.dataOffset, entry.size, delta)) {
+            return false;
+        }
+        if (!GitPack::applyDelta(base, delta, data)) {
+            return false;
+        }
+        type = baseType;
+    } else {
+        if (!inflateAt(entry.dataOffset, entry.size, data)) {
+            return false;
+        }
+    }
+
+    // Keep delta bases around; long chains share them heavily
+    if (depth > 0 && data.size() < (1 << 20)) {
+        if (baseCacheBytes + data.size() > (32 << 20)) {
+            baseCache.clear();
+            baseCacheBytes = 0;
+        }
+        baseCache[offset] = std::make_pair(type, data);
+        baseCacheBytes += data.size();
+    }
+
+    return true;
+}
+
+bool GitPackFile::infoAt(uint64_t offset, uint8_t& type, uint64_t& size,
+                         const GitPack::ObjectResolver& resolver, int depth) {
+    if (depth > 10000) {
+        return false;
+    }
+
+    Entry entry;
+    if (!readEntry(offset, entry)) {
+        return false;
+    }
+    type = entry.type;
+    size = entry.size;
+    if (type != GitPack::OBJ_OFS_DELTA && type != GitPack::OBJ_REF_DELTA) {
+        return true;
+    }
+
+    // A delta starts with the size of its base and of the object it
+    // produces, two varints of at most ten bytes each
+    std::string prefix;
+    if (!GitPack::inflatePrefix(pack, entry.dataOffset, 20, prefix)) {
+        return false;
+    }
+    const uint8_t* d = reinterpret_cast<const uint8_t*>(prefix.data());
+    size_t pos = 0;
+    uint64_t baseSize;
+    if (!readDeltaSize(d, prefix.size(), pos, baseSize) ||
+        !readDeltaSize(d, prefix.size(), pos, size)) {
+        return false;
+    }
+
+    // The object has the type of the base at the end of the chain
+    if (type == GitPack::OBJ_OFS_DELTA) {
+        return infoAt(entry.baseOffset, type, baseSize, resolver, depth + 1);
+    }
+    uint64_t baseOffset;
+    if (findOffset(entry.baseSHA, baseOffset)) {
+        return infoAt(baseOffset, type, baseSize, resolver, depth + 1);
+    }
+    std::string base;
+    return resolver && resolver(entry.baseSHA, type, base);
+}
+
+bool GitPackFile::inflateAt(uint64_t offset, uint64_t size, std::string& data) {
+    return GitPack::inflateStream(pack, offset, size, data);
+}
+
+bool GitPack::inflateStream(std::istream& in, uint64_t offset, uint64_t size,
+                            std::string& data) {
+    z_stream zs;
+    memset(&zs, 0, sizeof(zs));
+    if (inflateInit(&zs) != Z_OK) {
+        return false;
+    }
+
+    data.clear();
+    data.resize(size);
+
+    char inbuffer[16384];
+    in.clear();
+    in.seekg(offset);
+
+    zs.next_out = reinterpret_cast<Bytef*>(&data[0]);
+    zs.avail_out = size;
+
+    // Anything written to the overflow byte means the size header lied
+    char overflow[1];
+    int ret = Z_OK;
+    while (ret == Z_OK) {
+        if (zs.avail_in == 0) {
+            in.read(inbuffer, sizeof(inbuffer));
+            zs.avail_in = in.gcount();
+            zs.next_in = reinterpret_cast<Bytef*>(inbuffer);
+            if (zs.avail_in == 0) {
+                break;
+            }
+        }
+        if (zs.avail_out == 0) {
+            zs.next_out = reinterpret_cast<Bytef*>(overflow);
+            zs.avail_out = sizeof(overflow);
+        }
+        ret = inflate(&zs, Z_NO_FLUSH);
+    }
+
+    uint64_t produced = zs.total_out;
+    inflateEnd(&zs);
+
+    return ret == Z_STREAM_END && produced == size;
+}
+
+bool GitPack::inflatePrefix(std::istream& in, uint64_t offset, size_t len,
+                            std::string& data) {
+    z_stream zs;
+    memset(&zs, 0, sizeof(zs));
+    if (inflateInit(&zs) != Z_OK) {
+        return false;
+    }
+
+    data.assign(len, '\0');
+
+    char inbuffer[4096];
+    in.clear();
+    in.seekg(offset);
+
+    zs.next_out = reinterpret_cast<Bytef*>(&data[0]);
+    zs.avail_out = len;
+
+    int ret = Z_OK;
+    while (ret == Z_OK && zs.avail_out > 0) {
+        if (zs.avail_in == 0) {
+            in.read(inbuffer, sizeof(inbuffer));
+            zs.avail_in = in.gcount();
+            zs.next_in = reinterpret_cast<Bytef*>(inbuffer);
+            if (zs.avail_in == 0) {
+                break;
+            }
+        }
+        ret = inflate(&zs, Z_NO_FLUSH);
+    }
+
+    data.resize(zs.total_out);
+    inflateEnd(&zs);
+
+    return ret == Z_OK || ret == Z_STREAM_END;
+}
+
+// GitObjectStream implementation
+GitObjectStream::GitObjectStream(GitObjectType type, const std::string& path, uint64_t offset,
+                                 uint64_t skip, uint64_t size)
+    : type(type), size(size), remaining(size), inMemory(false), pos(0), path(path),
+      offset(offset), skip(skip), zsInitialized(false), failed(false) {
+    memset(&zs, 0, sizeof(zs));
+}
+
+GitObjectStream::GitObjectStream(GitObjectType type, std::string data)
+    : type(type), size(data.size()), remaining(data.size()), inMemory(true),
+      data(std::move(data)), pos(0), offset(0), skip(0), zsInitialized(false),
+      failed(false) {
+    memset(&zs, 0, sizeof(zs));
+}
+
+GitObjectStream::~GitObjectStream() {
+    if (zsInitialized) {
+        inflateEnd(&zs);
+    }
+}
+
+bool GitObjectStream::open() {
+    if (inMemory) {
+        return true;
+    }
+
+    file.open(path, std::ios::binary);
+    if (!file) {
+        return false;
+    }
+    file.seekg(offset);
+    if (inflateInit(&zs) != Z_OK) {
+        return false;
+    }
+    zsInitialized = true;
+    return true;
+}
+
+long GitObjectStream::read(char* buf, size_t len) {
+    if (inMemory) {
+        size_t n = std::min(len, data.size() - pos);
+        memcpy(buf, data.data() + pos, n);
+        pos += n;
+        return n;
+    }
+    if (failed) {
+        return -1;
+    }
+
+    while (skip > 0) {
+        char scratch[64];
+        long got = inflateInto(scratch, std::min<uint64_t>(skip, sizeof(scratch)));
+        if (got <= 0) {
+            failed = true;
+            return -1;
+        }
+        skip -= got;
+    }
+
+    if (remaining == 0 || len == 0) {
+        return 0;
+    }
+    long got = inflateInto(buf, std::min<uint64_t>(len, remaining));
+    // Ending before the size in the header means the object is corrupt
+    if (got <= 0) {
+        failed = true;
+        return -1;
+    }
+    remaining -= got;
+    return got;
+}
+
+long GitObjectStream::inflateInto(char* out, size_t len) {
+    zs.next_out = reinterpret_cast<Bytef*>(out);
+    zs.avail_out = len;
+
+    while (zs.avail_out > 0) {
+        if (zs.avail_in == 0) {
+            file.read(inbuffer, sizeof(inbuffer));
+            zs.avail_in = file.gcount();
+            zs.next_in = reinterpret_cast<Bytef*>(inbuffer);
+            if (zs.avail_in == 0) {
+                break;
+            }
+        }
+        int ret = inflate(&zs, Z_NO_FLUSH);
+        if (ret == Z_STREAM_END) {
+            break;
+        }
+        if (ret != Z_OK) {
+            return -1;
+        }
+    }
+
+    return len - zs.avail_out;
+}
+
+// GitPackWriter implementation
+GitPackWriter::GitPackWriter(const GitPack::PackSink& sink, uint32_t objectCount)
+    : sink(sink), hash(EVP_MD_CTX_new()), failed(false) {
+    EVP_DigestInit_ex(hash, EVP_sha1(), nullptr);
+
+    buffer = "PACK";
+    appendUint32(buffer, 2);
+    appendUint32(buffer, objectCount);
+}
+
+GitPackWriter::~GitPackWriter() {
+    EVP_MD_CTX_free(hash);
+}
+
+bool GitPackWriter::add(uint8_t type, const std::string& data) {
+    if (failed) {
+        return false;
+    }
+
+    GitPack::writeObjectHeader(buffer, type, data.size());
+    try {
+        buffer += GitPack::compressData(data);
+    } catch (const std::exception& e) {
+        failed = true;
+        return false;
+    }
+
+    return buffer.size() < 65536 || flush();
+}
+
+bool GitPackWriter::finish() {
+    if (failed) {
+        return false;
+    }
+
+    // Trailing SHA-1 over everything written before it
+    EVP_DigestUpdate(hash, buffer.data(), buffer.size());
+    unsigned char digest[20];
+    EVP_DigestFinal_ex(hash, digest, nullptr);
+    buffer.append(reinterpret_cast<const char*>(digest), sizeof(digest));
+
+    bool ok = sink(buffer.data(), buffer.size());
+    buffer.clear();
+    failed = true;
+    return ok;
+}
+
+bool GitPackWriter::flush() {
+    EVP_DigestUpdate(hash, buffer.data(), buffer.size());
+    if (!sink(buffer.data(), buffer.size())) {
+        failed = true;
+    }
+    buffer.clear();
+    return !failed;
+}
+
+// GitPackIndexer implementation
+GitPackIndexer::GitPackIndexer(const std::string& packPath, bool existing)
+    : packPath(packPath), existing(existing), state(PACK_HEADER), offset(0),
+      expectedCount(0), scratch(65536), packHash(EVP_MD_CTX_new()),
+      objectHash(EVP_MD_CTX_new()), inflating(false), inflated(0) {
+    memset(&zs, 0, sizeof(zs));
+    memset(packSHA, 0, sizeof(packSHA));
+    EVP_DigestInit_ex(packHash, EVP_sha1(), nullptr);
+
+    if (!existing) {
+        out.open(packPath, std::ios::binary | std::ios::trunc);
+        if (!out) {
+            state = FAILED;
+        }
+    }
+}
+
+GitPackIndexer::~GitPackIndexer() {
+    if (inflating) {
+        inflateEnd(&zs);
+    }
+    EVP_MD_CTX_free(packHash);
+    EVP_MD_CTX_free(objectHash);
+
+    // A received pack that was not moved into place is discarded
+    if (!existing) {
+        out.close();
+        std::error_code ec;
+        fs::remove(packPath, ec);
+    }
+}
+
+std::string GitPackIndexer::checksum() const {
+    return toHex(packSHA, sizeof(packSHA));
+}
+
+bool GitPackIndexer::append(const char* data, size_t len) {
+    if (state == FAILED) {
+        return false;
+    }
+    if (!existing) {
+        out.write(data, len);
+        if (!out) {
+            state = FAILED;
+            return false;
+        }
+    }
+
+    const uint8_t* p = reinterpret_cast<const uint8_t*>(data);
+    while (len > 0 && state != FAILED) {
+        size_t used = consume(p, len);
+        p += used;
+        len -= used;
+    }
+    return state != FAILED;
+}
+
+size_t GitPackIndexer::consume(const uint8_t* data, size_t len) {
+    switch (state) {
+    case PACK_HEADER: {
+        size_t n = std::min(len, 12 - buffer.size());
+        buffer.append(reinterpret_cast<const char*>(data), n);
+        EVP_DigestUpdate(packHash, data, n);
+        offset += n;
+
+        if (buffer.size() == 12) {
+            const unsigned char* h = reinterpret_cast<const unsigned char*>(buffer.data());
+            uint32_t version = readUint32(h + 4);
+            if (memcmp(h, "PACK", 4) != 0 || (version != 2 && version != 3)) {
+                state = FAILED;
+                return n;
+            }
+            expectedCount = readUint32(h + 8);
+            buffer.clear();
+            state = expectedCount > 0 ? ENTRY_HEADER : TRAILER;
+        }
+        return n;
+    }
+
+    case ENTRY_HEADER:
+        // Headers are a few bytes; take them one at a time until complete
+        buffer += static_cast<char>(data[0]);
+        EVP_DigestUpdate(packHash, data, 1);
+        offset++;
+        startEntry();
+        return 1;
+
+    case ENTRY_DATA: {
+        Entry& entry = entries.back();
+        bool delta = entry.type == GitPack::OBJ_OFS_DELTA || entry.type == GitPack::OBJ_REF_DELTA;
+
+        zs.next_in = const_cast<Bytef*>(data);
+        zs.avail_in = len;
+        int ret;
+        do {
+            zs.next_out = scratch.data();
+            zs.avail_out = scratch.size();
+            ret = inflate(&zs, Z_NO_FLUSH);
+
+            size_t produced = scratch.size() - zs.avail_out;
+            inflated += produced;
+            if (produced > 0 && !delta) {
+                EVP_DigestUpdate(objectHash, scratch.data(), produced);
+            }
+        } while (ret == Z_OK && (zs.avail_in > 0 || zs.avail_out == 0) &&
+                 inflated <= entry.size);
+
+        size_t used = len - zs.avail_in;
+        EVP_DigestUpdate(packHash, data, used);
+        entry.crc = crc32(entry.crc, data, used);
+        offset += used;
+
+        if (inflated > entry.size || (ret != Z_OK && ret != Z_STREAM_END && ret != Z_BUF_ERROR)) {
+            state = FAILED;
+        } else if (ret == Z_STREAM_END) {
+            inflateEnd(&zs);
+            inflating = false;
+            if (inflated != entry.size) {
+                state = FAILED;
+                return used;
+            }
+            if (!delta) {
+                unsigned char digest[20];
+                EVP_DigestFinal_ex(objectHash, digest, nullptr);
+                entry.sha = toHex(digest, sizeof(digest));
+            }
+            state = entries.size() == expectedCount ? TRAILER : ENTRY_HEADER;
+        } else if (used == 0) {
+            state = FAILED;
+        }
+        return used;
+    }
+
+    case TRAILER: {
+        size_t n = std::min(len, 20 - buffer.size());
+        buffer.append(reinterpret_cast<const char*>(data), n);
+        offset += n;
+
+        if (buffer.size() == 20) {
+            unsigned char digest[20];
+            EVP_DigestFinal_ex(packHash, digest, nullptr);
+            if (memcmp(digest, buffer.data(), 20) != 0) {
+                state = FAILED;
+                return n;
+            }
+            memcpy(packSHA, digest, 20);
+            buffer.clear();
+            state = DONE;
+        }
+        return n;
+    }
+
+    default:
+        // Nothing may follow the trailer
+        state = FAILED;
+        return len;
+    }
+}
+
+bool GitPackIndexer::startEntry() {
+    const uint8_t* h = reinterpret_cast<const uint8_t*>(buffer.data());
+    size_t n = buffer.size();
+
+    // Type and size varint
+    size_t end = 0;
+    while (end < n && (h[end] & 0x80)) {
+        end++;
+    }
+    if (end == n) {
+        if (n > 10) {
+            state = FAILED;
+        }
+        return false;
+    }
+
+    Entry entry;
+    entry.offset = offset - n;
+    entry.baseOffset = 0;
+    entry.crc = crc32(0L, Z_NULL, 0);
+
+    size_t pos = 0;
+    if (!GitPack::readObjectHeader(h, n, pos, entry.type, entry.size)) {
+        state = FAILED;
+        return false;
+    }
+
+    if (entry.type == GitPack::OBJ_OFS_DELTA) {
+        size_t last = pos;
+        while (last < n && (h[last] & 0x80)) {
+            last++;
+        }
+        if (last == n) {
+            if (n - pos > 10) {
+                state = FAILED;
+            }
+            return false;
+        }
+
+        uint8_t byte = h[pos++];
+        uint64_t back = byte & 0x7F;
+        while (byte & 0x80) {
+            byte = h[pos++];
+            back = ((back + 1) << 7) | (byte & 0x7F);
+        }
+        if (back == 0 || back > entry.offset) {
+            state = FAILED;
+            return false;
+        }
+        entry.baseOffset = entry.offset - back;
+    } else if (entry.type == GitPack::OBJ_REF_DELTA) {
+        if (n < pos + 20) {
+            return false;
+        }
+        entry.baseSHA = toHex(h + pos, 20);
+        pos += 20;
+    } else if (entry.type < GitPack::OBJ_COMMIT || entry.type > GitPack::OBJ_TAG) {
+        state = FAILED;
+        return false;
+    } else {
+        std::string header = GitObject::typeName(GitPack::toObjectType(entry.type)) + " " +
+                             std::to_string(entry.size);
+        EVP_DigestInit_ex(objectHash, EVP_sha1(), nullptr);
+        EVP_DigestUpdate(objectHash, header.c_str(), header.size() + 1);
+    }
+
+    entry.dataOffset = offset;
+    entry.crc = crc32(entry.crc, h, n);
+    entries.push_back(entry);
+    buffer.clear();
+
+    if (inflateInit(&zs) != Z_OK) {
+        state = FAILED;
+        return false;
+    }
+    inflating = true;
+    inflated = 0;
+    state = ENTRY_DATA;
+    return true;
+}
+
+bool GitPackIndexer::finish(const GitPack::ObjectResolver& resolver) {
+    if (state != DONE) {
+        return false;
+    }
+    if (!existing) {
+        out.close();
+        if (out.fail()) {
+            return false;
+        }
+    }
+
+    std::ifstream in(packPath, std::ios::binary);
+    if (!in) {
+        return false;
+    }
+
+    std::set<uint64_t> offsets;
+    std::map<uint64_t, std::vector<size_t>> ofsChildren;
+    std::map<std::string, std::vector<size_t>> refChildren;
+    for (const auto& entry : entries) {
+        offsets.insert(entry.offset);
+    }
+    for (size_t i = 0; i < entries.size(); i++) {
+        if (entries[i].type == GitPack::OBJ_OFS_DELTA) {
+            if (!offsets.count(entries[i].baseOffset)) {
+                return false;
+            }
+            ofsChildren[entries[i].baseOffset].push_back(i);
+        } else if (entries[i].type == GitPack::OBJ_REF_DELTA) {
+            refChildren[entries[i].baseSHA].push_back(i);
+        }
+    }
+
+    // Deltas are resolved depth first from each base, so only the bases
+    // along the current chain are held in memory
+    struct Frame {
+        size_t entry;
+        uint8_t baseType;
+        std::shared_ptr<const std::string> base;
+    };
+    std::vector<Frame> stack;
+
+    auto pushChildren = [&](const Entry* base, const std::string& sha, uint8_t type,
+                            const std::shared_ptr<const std::string>& data) {
+        if (base) {
+            auto it = ofsChildren.find(base->offset);
+            if (it != ofsChildren.end()) {
+                for (size_t child : it->second) {
+                    stack.push_back(Frame{child, type, data});
+                }
+            }
+        }
+        auto it = refChildren.find(sha);
+        if (it != refChildren.end()) {
+            for (size_t child : it->second) {
+                stack.push_back(Frame{child, type, data});
+            }
+        }
+    };
+
+    auto drain = [&]() {
+        while (!stack.empty()) {
+            Frame frame = std::move(stack.back());
+            stack.pop_back();
+
+            Entry& entry = entries[frame.entry];
+            if (!entry.sha.empty()) {
+                continue;
+            }
+
+            std::string delta, result;
+            if (!GitPack::inflateStream(in, entry.dataOffset, entry.size, delta) ||
+                !GitPack::applyDelta(*frame.base, delta, result)) {
+                return false;
+            }
+            entry.type = frame.baseType;
+            entry.sha = GitPack::objectSHA(entry.type, result);
+            pushChildren(&entry, entry.sha, entry.type,
+                         std::make_shared<const std::string>(std::move(result)));
+        }
+        return true;
+    };
+
+    for (auto& entry : entries) {
+        if (entry.type == GitPack::OBJ_OFS_DELTA || entry.type == GitPack::OBJ_REF_DELTA ||
+            (!ofsChildren.count(entry.offset) && !refChildren.count(entry.sha))) {
+            continue;
+        }
+
+        std::string data;
+        if (!GitPack::inflateStream(in, entry.dataOffset, entry.size, data)) {
+            return false;
+        }
+        pushChildren(&entry, entry.sha, entry.type,
+                     std::make_shared<const std::string>(std::move(data)));
+        if (!drain()) {
+            return false;
+        }
+    }
+
+    // What is left hangs off bases outside the pack (a thin pack)
+    std::vector<std::string> external;
+    bool progress = resolver != nullptr;
+    while (progress) {
+        progress = false;
+        for (const auto& children : refChildren) {
+            bool pending = std::any_of(children.second.begin(), children.second.end(),
+                                       [&](size_t i) { return entries[i].sha.empty(); });
+            uint8_t type;
+            std::string data;
+            if (!pending || !resolver(children.first, type, data)) {
+                continue;
+            }
+
+            external.push_back(children.first);
+            pushChildren(nullptr, children.first, type,
+                         std::make_shared<const std::string>(std::move(data)));
+            if (!drain()) {
+                return false;
+            }
+            progress = true;
+        }
+    }
+
+    std::set<std::string> packed;
+    for (const auto& entry : entries) {
+        if (entry.sha.empty()) {
+            return false;
+        }
+        packed.insert(entry.sha);
+    }
+    in.close();
+
+    std::vector<std::string> missing;
+    for (const auto& sha : external) {
+        if (!packed.count(sha)) {
+            missing.push_back(sha);
+        }
+    }
+    return missing.empty() || appendBases(missing, resolver);
+}
+
+bool GitPackIndexer::appendBases(const std::vector<std::string>& bases,
+                                 const GitPack::ObjectResolver& resolver) {
+    // Drop the trailer, append the bases whole, then rewrite the object
+    // count and checksum
+    uint64_t end = offset - 20;
+    std::error_code ec;
+    fs::resize_file(packPath, end, ec);
+    if (ec) {
+        return false;
+    }
+
+    std::fstream file(packPath, std::ios::in | std::ios::out | std::ios::binary);
+    if (!file) {
+        return false;
+    }
+    file.seekp(end);
+
+    for (const auto& sha : bases) {
+        uint8_t type;
+        std::string data;
+        if (!resolver(sha, type, data)) {
+            return false;
+        }
+
+        std::string stored;
+        GitPack::writeObjectHeader(stored, type, data.size());
+        size_t headerLength = stored.size();
+        try {
+            stored += GitPack::compressData(data);
+        } catch (const std::exception& e) {
+            return false;
+        }
+
+        Entry entry;
+        entry.offset = end;
+        entry.dataOffset = end + headerLength;
+        entry.type = type;
+        entry.size = data.size();
+        entry.crc = crc32(crc32(0L, Z_NULL, 0),
+                          reinterpret_cast<const Bytef*>(stored.data()), stored.size());
+        entry.baseOffset = 0;
+        entry.sha = sha;
+        entries.push_back(entry);
+
+        file.write(stored.data(), stored.size());
+        end += stored.size();
+    }
+
+    std::string count;
+    appendUint32(count, entries.size());
+    file.seekp(8);
+    file.write(count.data(), count.size());
+    file.flush();
+
+    EVP_MD_CTX* ctx = EVP_MD_CTX_new();
+    EVP_DigestInit_ex(ctx, EVP_sha1(), nullptr);
+    file.seekg(0);
+    uint64_t remaining = end;
+    while (remaining > 0 && file) {
+        file.read(reinterpret_cast<char*>(scratch.data()),
+                  std::min<uint64_t>(scratch.size(), remaining));
+        EVP_DigestUpdate(ctx, scratch.data(), file.gcount());
+        remaining -= file.gcount();
+    }
+    EVP_DigestFinal_ex(ctx, packSHA, nullptr);
+    EVP_MD_CTX_free(ctx);
+    if (remaining > 0) {
+        return false;
+    }
+
+    file.clear();
+    file.seekp(end);
+    file.write(reinterpret_cast<const char*>(packSHA), sizeof(packSHA));
+    offset = end + sizeof(packSHA);
+    return file.good();
+}
+
+bool GitPackIndexer::writeIndex(const std::string& idxPath) {
+    std::vector<size_t> order(entries.size());
+    std::iota(order.begin(), order.end(), 0);
+    std::sort(order.begin(), order.end(), [&](size_t a, size_t b) {
+        return entries[a].sha < entries[b].sha;
+    });
+
+    std::string idx("\377tOc", 4);
+    appendUint32(idx, 2);
+
+    uint32_t fanout[256] = {0};
+    for (const auto& entry : entries) {
+        unsigned char first;
+        fromHex(entry.sha.substr(0, 2), &first);
+        fanout[first]++;
+    }
+    uint32_t total = 0;
+    for (int i = 0; i < 256; i++) {
+        total += fanout[i];
+        appendUint32(idx, total);
+    }
+
+    for (size_t i : order) {
+        unsigned char sha[20];
+        fromHex(entries[i].sha, sha);
+        idx.append(reinterpret_cast<const char*>(sha), sizeof(sha));
+    }
+    for (size_t i : order) {
+        appendUint32(idx, entries[i].crc);
+    }
+
+    // Offsets past 2 GiB go in the 64-bit table
+    std::vector<uint64_t> large;
+    for (size_t i : order) {
+        if (entries[i].offset < 0x80000000ULL) {
+            appendUint32(idx, entries[i].offset);
+        } else {
+            appendUint32(idx, 0x80000000U | large.size());
+            large.push_back(entries[i].offset);
+        }
+    }
+    for (uint64_t value : large) {
+        appendUint32(idx, value >> 32);
+        appendUint32(idx, value & 0xFFFFFFFF);
+    }
+
+    idx.append(reinterpret_cast<const char*>(packSHA), sizeof(packSHA));
+    unsigned char hash[SHA_DIGEST_LENGTH];
+    SHA1(reinterpret_cast<const unsigned char*>(idx.data()), idx.size(), hash);
+    idx.append(reinterpret_cast<const char*>(hash), sizeof(hash));
+
+    std::ofstream file(idxPath, std::ios::binary | std::ios::trunc);
+    if (!file) {
+        return false;
+    }
+    file.write(idx.data(), idx.size());
+    return file.good();
+}
+
 } // namespace GitCore
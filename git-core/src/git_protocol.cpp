@@ -1,6 +1,7 @@
 #include "git_protocol.h"
 #include <sstream>
 #include <iomanip>
+#include <cstdlib>
 
 namespace GitCore {
 
@@ -41,7 +42,12 @@ std::vector<std::string> GitProtocol::parsePktLines(const std::string& input) {
         }
 
         std::string lenStr = input.substr(pos, 4);
-        int len = std::stoi(lenStr, nullptr, 16);
+        int len;
+        try {
+            len = std::stoi(lenStr, nullptr, 16);
+        } catch (const std::exception&) {
+            break;
+        }
 
         if (len == 0) {
             // Flush packet
@@ -64,27 +70,31 @@ std::vector<std::string> GitProtocol::parsePktLines(const std::string& input) {
 
 std::string GitProtocol::createRefAdvertisement(
     const std::vector<RefAdvertisement>& refs,
-    const std::string& service) {
+    const std::string& service,
+    const std::string& capabilities) {
 
     std::ostringstream oss;
 
-    // Service announcement
-    oss << pktLine("# service=" + service + "\n");
-    oss << flushPkt();
+    // Service announcement; only smart HTTP sends one
+    if (!service.empty()) {
+        oss << pktLine("# service=" + service + "\n");
+        oss << flushPkt();
+    }
+
+    // Capabilities ride on the first line, after a NUL byte
+    std::string caps = std::string(1, '\0') + capabilities;
 
     if (refs.empty()) {
         // No refs, advertise capabilities only
         oss << pktLine("0000000000000000000000000000000000000000 "
-                      "capabilities^{}\0report-status delete-refs "
-                      "side-band-64k quiet atomic\n");
+                      "capabilities^{}" + caps + "\n");
     } else {
-        // First ref includes capabilities
         bool first = true;
         for (const auto& ref : refs) {
             std::string line = ref.sha + " " + ref.refName;
 
             if (first) {
-                line += "\0report-status delete-refs side-band-64k quiet atomic";
+                line += caps;
                 first = false;
             }
 
@@ -99,27 +109,59 @@ std::string GitProtocol::createRefAdvertisement(
 
 GitProtocol::PushRequest GitProtocol::parseReceivePack(const std::string& input) {
     PushRequest request;
-    std::vector<std::string> lines = parsePktLines(input);
+    request.packOffset = input.length();
 
-    bool commandsDone = false;
-    std::string packData;
+    // Commands are pkt-lines up to a flush; the raw pack follows
+    size_t pos = 0;
+    while (pos + 4 <= input.length()) {
+        int len;
+        try {
+            len = std::stoi(input.substr(pos, 4), nullptr, 16);
+        } catch (const std::exception&) {
+            break;
+        }
 
-    for (const auto& line : lines) {
-        if (line.empty()) {
-            commandsDone = true;
-            continue;
+        if (len == 0) {
+            pos += 4;
+            request.packOffset = pos;
+            break;
         }
+        if (len < 4 || pos + len > input.length()) {
+            break;
+        }
+
+        std::string line = input.substr(pos + 4, len - 4);
+        pos += len;
 
-        if (!commandsDone) {
-            // Parse command: old-sha new-sha refname
-            request.commands.push_back(line);
-        } else {
-            // Pack data
-            packData += line;
+        if (!line.empty() && line.back() == '\n') {
+            line.pop_back();
         }
+
+        // First command carries the client's capabilities after a NUL
+        size_t nul = line.find('\0');
+        if (nul != std::string::npos) {
+            if (request.commands.empty()) {
+                std::istringstream caps(line.substr(nul + 1));
+                std::string cap;
+                while (caps >> cap) {
+                    request.capabilities.push_back(cap);
+                }
+            }
+            line = line.substr(0, nul);
+        }
+
+        // old-sha new-sha refname
+        if (line.length() < 83 || line[40] != ' ' || line[81] != ' ') {
+            continue;
+        }
+
+        RefCommand command;
+        command.oldSHA = line.substr(0, 40);
+        command.newSHA = line.substr(41, 40);
+        command.refName = line.substr(82);
+        request.commands.push_back(command);
     }
 
-    request.packData = packData;
     return request;
 }
 
@@ -140,22 +182,47 @@ std::string GitProtocol::createReceivePackResponse(bool success,
 GitProtocol::FetchRequest GitProtocol::parseUploadPack(const std::string& input) {
     FetchRequest request;
     request.depth = 0;
+    request.deepenSince = 0;
+
+    request.done = false;
 
     std::vector<std::string> lines = parsePktLines(input);
 
-    for (const auto& line : lines) {
+    for (auto line : lines) {
         if (line.empty()) {
             continue;
         }
+        if (line.back() == '\n') {
+            line.pop_back();
+        }
 
         if (line.substr(0, 5) == "want ") {
             std::string sha = line.substr(5, 40);
             request.wants.push_back(sha);
+
+            // First want line carries the client's capabilities
+            if (request.wants.size() == 1 && line.size() > 46) {
+                std::istringstream caps(line.substr(46));
+                std::string cap;
+                while (caps >> cap) {
+                    request.capabilities.push_back(cap);
+                }
+            }
+        } else if (line == "done") {
+            request.done = true;
         } else if (line.substr(0, 5) == "have ") {
             std::string sha = line.substr(5, 40);
             request.haves.push_back(sha);
-        } else if (line.substr(0, 6) == "depth ") {
-            request.depth = std::stoi(line.substr(6));
+        } else if (line.substr(0, 8) == "shallow ") {
+            request.shallows.push_back(line.substr(8, 40));
+        } else if (line.substr(0, 7) == "deepen ") {
+            request.depth = std::atoi(line.c_str() + 7);
+        } else if (line.substr(0, 13) == "deepen-since ") {
+            request.deepenSince = std::atoll(line.c_str() + 13);
+        } else if (line.substr(0, 11) == "deepen-not ") {
+            request.deepenNot.push_back(line.substr(11));
+        } else if (line.substr(0, 7) == "filter ") {
+            request.filter = line.substr(7);
         }
     }
 
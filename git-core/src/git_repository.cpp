@@ -4,16 +4,53 @@
 #include <sstream>
 #include <algorithm>
 #include <filesystem>
+#include <queue>
+#include <ctime>
+#include <fcntl.h>
+#include <unistd.h>
 
 namespace fs = std::filesystem;
 
 namespace GitCore {
 
+namespace {
+
+bool isValidSHA(const std::string& sha) {
+    return sha.size() == 40 &&
+           std::all_of(sha.begin(), sha.end(), [](char c) {
+               return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f');
+           });
+}
+
+// Parses the "<type> <size>\0" header that starts an inflated loose
+// object; dataStart is set to where the content begins
+bool parseLooseHeader(const std::string& raw, GitObjectType& type, uint64_t& size,
+                      size_t& dataStart) {
+    size_t space = raw.find(' ');
+    size_t nul = raw.find('\0');
+    if (space == std::string::npos || nul == std::string::npos || space > nul) {
+        return false;
+    }
+    if (!GitObject::parseTypeName(raw.substr(0, space), type)) {
+        return false;
+    }
+    try {
+        size = std::stoull(raw.substr(space + 1, nul - space - 1));
+    } catch (const std::exception&) {
+        return false;
+    }
+    dataStart = nul + 1;
+    return true;
+}
+
+} // namespace
+
 GitRepository::GitRepository(const std::string& path)
-    : repoPath(path), initialized(false) {
+    : repoPath(path), initialized(false), packsLoaded(false) {
 }
 
 GitRepository::~GitRepository() {
+    abortQuarantine();
 }
 
 bool GitRepository::init(bool bare) {
@@ -108,19 +145,29 @@ std::string GitRepository::getHeadPath() const {
     return gitDir + "/HEAD";
 }
 
-bool GitRepository::createRef(const std::string& refName, const std::string& sha) {
-    std::string refPath = getRefsPath() + "/" + refName;
+std::string GitRepository::getHead() const {
+    std::string content = readFile(getHeadPath());
+    while (!content.empty() && (content.back() == '\n' || content.back() == '\r')) {
+        content.pop_back();
+    }
 
-    // Create parent directories if needed
-    size_t pos = refPath.find_last_of('/');
-    if (pos != std::string::npos) {
-        std::string parentDir = refPath.substr(0, pos);
-        if (!fs::exists(parentDir)) {
-            fs::create_directories(parentDir);
-        }
+    // Symbolic HEAD: "ref: refs/heads/main"
+    if (content.compare(0, 5, "ref: ") == 0) {
+        return content.substr(5);
     }
+    return content;
+}
 
-    return writeFile(refPath, sha + "\n");
+bool GitRepository::createRef(const std::string& refName, const std::string& sha) {
+    // Written through the lock file, so a crash never leaves a truncated ref
+    if (!lockRef(refName)) {
+        return false;
+    }
+    if (!writeRefLock(refName, sha) || !commitRef(refName)) {
+        unlockRef(refName);
+        return false;
+    }
+    return true;
 }
 
 std::string GitRepository::getRef(const std::string& refName) const {
@@ -144,7 +191,7 @@ std::vector<std::string> GitRepository::listRefs() const {
     std::string refsPath = getRefsPath();
 
     for (const auto& entry : fs::recursive_directory_iterator(refsPath)) {
-        if (entry.is_regular_file()) {
+        if (entry.is_regular_file() && entry.path().extension() != ".lock") {
             std::string refPath = entry.path().string();
             // Get relative path from refs directory
             std::string refName = refPath.substr(refsPath.length() + 1);
@@ -163,6 +210,45 @@ bool GitRepository::deleteRef(const std::string& refName) {
     return fs::remove(refPath);
 }
 
+bool GitRepository::lockRef(const std::string& refName) {
+    std::string lockPath = getRefsPath() + "/" + refName + ".lock";
+
+    std::error_code ec;
+    fs::create_directories(fs::path(lockPath).parent_path(), ec);
+
+    // O_EXCL makes lock creation atomic across processes
+    int fd = ::open(lockPath.c_str(), O_CREAT | O_EXCL | O_WRONLY, 0644);
+    if (fd < 0) {
+        return false;
+    }
+    ::close(fd);
+    return true;
+}
+
+bool GitRepository::unlockRef(const std::string& refName) {
+    std::error_code ec;
+    return fs::remove(getRefsPath() + "/" + refName + ".lock", ec);
+}
+
+bool GitRepository::writeRefLock(const std::string& refName, const std::string& sha) {
+    std::string lockPath = getRefsPath() + "/" + refName + ".lock";
+
+    // Only a lock taken by lockRef is written to
+    int fd = ::open(lockPath.c_str(), O_WRONLY | O_TRUNC);
+    if (fd < 0) {
+        return false;
+    }
+    std::string content = sha + "\n";
+    bool ok = ::write(fd, content.data(), content.size()) == (ssize_t)content.size() &&
+              ::fsync(fd) == 0;
+    return ::close(fd) == 0 && ok;
+}
+
+bool GitRepository::commitRef(const std::string& refName) {
+    std::string refPath = getRefsPath() + "/" + refName;
+    return ::rename((refPath + ".lock").c_str(), refPath.c_str()) == 0;
+}
+
 bool GitRepository::createBranch(const std::string& branchName, const std::string& sha) {
     return createRef("heads/" + branchName, sha);
 }
@@ -184,19 +270,995 @@ bool GitRepository::deleteBranch(const std::string& branchName) {
     return deleteRef("heads/" + branchName);
 }
 
+bool GitRepository::hasObject(const std::string& sha) {
+    if (!isValidSHA(sha)) {
+        return false;
+    }
+
+    std::string loosePath = getObjectsPath() + "/" + sha.substr(0, 2) + "/" + sha.substr(2);
+    if (fs::exists(loosePath)) {
+        return true;
+    }
+
+    loadPacks();
+    for (const auto& pack : packs) {
+        if (pack->contains(sha)) {
+            return true;
+        }
+    }
+    return inQuarantine(sha);
+}
+
+bool GitRepository::readObject(const std::string& sha, GitObjectType& type, std::string& data) {
+    if (!isValidSHA(sha)) {
+        return false;
+    }
+    return readLooseObject(sha, type, data) || readPackedObject(sha, type, data);
+}
+
+bool GitRepository::readObjectInfo(const std::string& sha, GitObjectType& type,
+                                   uint64_t& size) {
+    if (!isValidSHA(sha)) {
+        return false;
+    }
+    size_t headerLen;
+    return readLooseObjectInfo(sha, type, size, headerLen) ||
+           readPackedObjectInfo(sha, type, size);
+}
+
+std::vector<std::string> GitRepository::findObjects(const std::string& prefix, size_t limit) {
+    std::set<std::string> found;
+    if (prefix.size() < 2 || prefix.size() > 40 ||
+        !std::all_of(prefix.begin(), prefix.end(), [](char c) {
+            return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f');
+        })) {
+        return {};
+    }
+
+    std::string dir = getObjectsPath() + "/" + prefix.substr(0, 2);
+    std::error_code ec;
+    if (fs::is_directory(dir, ec)) {
+        for (const auto& entry : fs::directory_iterator(dir, ec)) {
+            std::string name = prefix.substr(0, 2) + entry.path().filename().string();
+            if (isValidSHA(name) && name.compare(0, prefix.size(), prefix) == 0) {
+                found.insert(name);
+            }
+        }
+    }
+
+    loadPacks();
+    for (const auto& pack : packs) {
+        std::vector<std::string> names;
+        pack->findPrefix(prefix, limit, names);
+        found.insert(names.begin(), names.end());
+    }
+
+    std::vector<std::string> result(found.begin(), found.end());
+    if (result.size() > limit) {
+        result.resize(limit);
+    }
+    return result;
+}
+
+std::unique_ptr<GitObjectStream> GitRepository::openObject(const std::string& sha) {
+    if (!isValidSHA(sha)) {
+        return nullptr;
+    }
+
+    GitObjectType type;
+    uint64_t size;
+    size_t headerLen;
+    if (readLooseObjectInfo(sha, type, size, headerLen)) {
+        std::string path = getObjectsPath() + "/" + sha.substr(0, 2) + "/" + sha.substr(2);
+        auto stream = std::make_unique<GitObjectStream>(type, path, 0, headerLen, size);
+        return stream->open() ? std::move(stream) : nullptr;
+    }
+
+    loadPacks();
+    GitPack::ObjectResolver resolver = objectResolver();
+    for (const auto& pack : packs) {
+        if (pack->contains(sha)) {
+            return pack->openObject(sha, resolver);
+        }
+    }
+    for (const auto& pack : quarantinePacks) {
+        if (pack->contains(sha)) {
+            return pack->openObject(sha, resolver);
+        }
+    }
+    return nullptr;
+}
+
+void GitRepository::loadPacks() {
+    if (packsLoaded) {
+        return;
+    }
+    packsLoaded = true;
+
+    std::string packDir = getObjectsPath() + "/pack";
+    if (!fs::exists(packDir)) {
+        return;
+    }
+
+    for (const auto& entry : fs::directory_iterator(packDir)) {
+        std::string path = entry.path().string();
+        if (entry.path().extension() != ".pack") {
+            continue;
+        }
+
+        auto pack = std::make_unique<GitPackFile>(path);
+        if (pack->open()) {
+            packs.push_back(std::move(pack));
+        }
+    }
+}
+
+bool GitRepository::readLooseObject(const std::string& sha, GitObjectType& type,
+                                    std::string& data) {
+    std::string path = getObjectsPath() + "/" + sha.substr(0, 2) + "/" + sha.substr(2);
+    if (!fs::exists(path)) {
+        return false;
+    }
+
+    std::string raw;
+    try {
+        raw = GitPack::decompressData(readFile(path));
+    } catch (const std::exception& e) {
+        return false;
+    }
+
+    uint64_t size;
+    size_t dataStart;
+    if (!parseLooseHeader(raw, type, size, dataStart)) {
+        return false;
+    }
+
+    data = raw.substr(dataStart);
+    return true;
+}
+
+bool GitRepository::readLooseObjectInfo(const std::string& sha, GitObjectType& type,
+                                        uint64_t& size, size_t& headerLen) {
+    std::string path = getObjectsPath() + "/" + sha.substr(0, 2) + "/" + sha.substr(2);
+    std::ifstream file(path, std::ios::binary);
+    if (!file) {
+        return false;
+    }
+
+    // The longest header, "commit <20 digits>\0", fits in 32 bytes
+    std::string header;
+    return GitPack::inflatePrefix(file, 0, 32, header) &&
+           parseLooseHeader(header, type, size, headerLen);
+}
+
+bool GitRepository::readPackedObject(const std::string& sha, GitObjectType& type,
+                                     std::string& data) {
+    loadPacks();
+
+    // REF_DELTA bases may live in another pack or as loose objects
+    GitPack::ObjectResolver resolver = objectResolver();
+
+    for (const auto& pack : packs) {
+        uint8_t packType;
+        if (pack->contains(sha) && pack->readObject(sha, packType, data, resolver)) {
+            type = GitPack::toObjectType(packType);
+            return true;
+        }
+    }
+    for (const auto& pack : quarantinePacks) {
+        uint8_t packType;
+        if (pack->contains(sha) && pack->readObject(sha, packType, data, resolver)) {
+            type = GitPack::toObjectType(packType);
+            return true;
+        }
+    }
+    return false;
+}
+
+bool GitRepository::readPackedObjectInfo(const std::string& sha, GitObjectType& type,
+                                         uint64_t& size) {
+    loadPacks();
+
+    GitPack::ObjectResolver resolver = objectResolver();
+
+    for (const auto& pack : packs) {
+        uint8_t packType;
+        if (pack->contains(sha) && pack->readObjectInfo(sha, packType, size, resolver)) {
+            type = GitPack::toObjectType(packType);
+            return true;
+        }
+    }
+    for (const auto& pack : quarantinePacks) {
+        uint8_t packType;
+        if (pack->contains(sha) && pack->readObjectInfo(sha, packType, size, resolver)) {
+            type = GitPack::toObjectType(packType);
+            return true;
+        }
+    }
+    return false;
+}
+
+bool GitRepository::inQuarantine(const std::string& sha) const {
+    for (const auto& pack : quarantinePacks) {
+        if (pack->contains(sha)) {
+            return true;
+        }
+    }
+    return false;
+}
+
+GitPack::ObjectResolver GitRepository::objectResolver() {
+    return [this](const std::string& sha, uint8_t& type, std::string& data) {
+        GitObjectType objType;
+        if (!readObject(sha, objType, data)) {
+            return false;
+        }
+        type = GitPack::fromObjectType(objType);
+        return true;
+    };
+}
+
+bool GitRepository::readCommit(const std::string& sha, GitCommit::Fields& fields) {
+    auto it = commitCache.find(sha);
+    if (it != commitCache.end()) {
+        fields = it->second;
+        return true;
+    }
+
+    GitObjectType type;
+    std::string data;
+    if (!readObject(sha, type, data) || type != GitObjectType::COMMIT) {
+        return false;
+    }
+    if (!GitCommit::parse(data, fields)) {
+        return false;
+    }
+
+    // Only the graph is needed when walking; drop the message
+    GitCommit::Fields cached = fields;
+    cached.message.clear();
+    commitCache[sha] = cached;
+    return true;
+}
+
+std::string GitRepository::peelTag(const std::string& sha) {
+    std::string target;
+    GitObjectType type;
+    std::vector<std::string> tags;
+    if (!peel(sha, target, type, &tags) || tags.empty()) {
+        return "";
+    }
+    return target;
+}
+
+bool GitRepository::peel(const std::string& sha, std::string& target, GitObjectType& type,
+                         std::vector<std::string>* tags) {
+    target = sha;
+
+    for (int depth = 0; depth < 32; depth++) {
+        std::string data;
+        if (!readObject(target, type, data)) {
+            return false;
+        }
+        if (type != GitObjectType::TAG) {
+            return true;
+        }
+
+        GitTag::Fields tag;
+        if (!GitTag::parse(data, tag)) {
+            return false;
+        }
+        if (tags) {
+            tags->push_back(target);
+        }
+        target = tag.objectSHA;
+    }
+
+    return false;
+}
+
+bool GitRepository::canAllFromReach(const std::vector<std::string>& from,
+                                    const std::vector<std::string>& to) {
+    std::set<std::string> targets;
+    int64_t minTime = INT64_MAX;
+
+    for (const auto& sha : to) {
+        std::string commit;
+        GitObjectType type;
+        GitCommit::Fields fields;
+        if (peel(sha, commit, type, nullptr) && type == GitObjectType::COMMIT &&
+            readCommit(commit, fields)) {
+            targets.insert(commit);
+            minTime = std::min(minTime, fields.commitTime);
+        }
+    }
+
+    if (targets.empty()) {
+        return false;
+    }
+
+    for (const auto& sha : from) {
+        std::string start;
+        GitObjectType type;
+        if (!peel(sha, start, type, nullptr)) {
+            return false;
+        }
+        if (type != GitObjectType::COMMIT) {
+            continue;
+        }
+
+        // Walk parents, but never below the oldest target commit
+        bool found = false;
+        std::set<std::string> visited;
+        std::vector<std::string> stack = {start};
+        while (!stack.empty() && !found) {
+            std::string current = stack.back();
+            stack.pop_back();
+            if (!visited.insert(current).second) {
+                continue;
+            }
+            if (targets.count(current)) {
+                found = true;
+                break;
+            }
+
+            GitCommit::Fields fields;
+            if (!readCommit(current, fields) || fields.commitTime < minTime) {
+                continue;
+            }
+            for (const auto& parent : fields.parentSHAs) {
+                stack.push_back(parent);
+            }
+        }
+
+        if (!found) {
+            return false;
+        }
+    }
+
+    return true;
+}
+
+bool GitRepository::collectObjects(const std::vector<std::string>& wants,
+                                   const std::vector<std::string>& haves,
+                                   std::vector<std::string>& objects,
+                                   const std::set<std::string>& shallow,
+                                   const ObjectFilter& filter) {
+    enum { QUEUED = 1, UNINTERESTING = 2 };
+
+    std::map<std::string, int> flags;
+    std::set<std::string> pending;
+    std::priority_queue<std::pair<int64_t, std::string>> queue;
+    std::vector<std::string> rootTrees;
+    std::set<std::string> wantedTrees;
+    std::vector<std::string> commits;
+    std::set<std::string> seen;
+
+    auto enqueue = [&](const std::string& sha, bool uninteresting) {
+        GitCommit::Fields fields;
+        if (!readCommit(sha, fields)) {
+            return uninteresting;
+        }
+
+        int& flag = flags[sha];
+        if (uninteresting && !(flag & UNINTERESTING)) {
+            flag |= UNINTERESTING;
+            pending.erase(sha);
+        }
+        if (!(flag & QUEUED)) {
+            flag |= QUEUED;
+            queue.push(std::make_pair(fields.commitTime, sha));
+            if (!uninteresting) {
+                pending.insert(sha);
+            }
+        }
+        return true;
+    };
+
+    // The client's haves (and everything behind them) are uninteresting
+    for (const auto& sha : haves) {
+        std::string commit;
+        GitObjectType type;
+        if (peel(sha, commit, type, nullptr) && type == GitObjectType::COMMIT) {
+            enqueue(commit, true);
+        }
+    }
+
+    for (const auto& sha : wants) {
+        std::string target;
+        GitObjectType type;
+        std::vector<std::string> tags;
+        if (!peel(sha, target, type, &tags)) {
+            return false;
+        }
+        for (const auto& tag : tags) {
+            if (seen.insert(tag).second) {
+                objects.push_back(tag);
+            }
+        }
+
+        if (type == GitObjectType::COMMIT) {
+            if (!enqueue(target, false)) {
+                return false;
+            }
+        } else if (type == GitObjectType::TREE) {
+            rootTrees.push_back(target);
+            wantedTrees.insert(target);
+        } else if (seen.insert(target).second) {
+            objects.push_back(target);
+        }
+    }
+
+    // Date-ordered walk; stop once only uninteresting commits remain
+    while (!queue.empty() && !pending.empty()) {
+        std::string sha = queue.top().second;
+        queue.pop();
+        pending.erase(sha);
+
+        GitCommit::Fields fields;
+        if (!readCommit(sha, fields)) {
+            return false;
+        }
+
+        bool uninteresting = flags[sha] & UNINTERESTING;
+        if (!uninteresting) {
+            commits.push_back(sha);
+        }
+
+        // The client has no history behind a shallow commit
+        if (shallow.count(sha)) {
+            continue;
+        }
+        for (const auto& parent : fields.parentSHAs) {
+            if (!enqueue(parent, uninteresting) && !uninteresting) {
+                return false;
+            }
+        }
+    }
+
+    // A commit may have been reached as interesting before a have covered it
+    commits.erase(std::remove_if(commits.begin(), commits.end(),
+                                 [&](const std::string& sha) {
+                                     return flags[sha] & UNINTERESTING;
+                                 }),
+                  commits.end());
+
+    // Trees of the boundary commits are already on the client
+    std::set<std::string> edges;
+    for (const auto& sha : commits) {
+        GitCommit::Fields fields;
+        readCommit(sha, fields);
+        for (const auto& parent : fields.parentSHAs) {
+            if (flags[parent] & UNINTERESTING) {
+                edges.insert(parent);
+            }
+        }
+    }
+    for (const auto& sha : haves) {
+        std::string commit;
+        GitObjectType type;
+        if (peel(sha, commit, type, nullptr) && type == GitObjectType::COMMIT) {
+            edges.insert(commit);
+        }
+    }
+    for (const auto& sha : edges) {
+        GitCommit::Fields fields;
+        if (readCommit(sha, fields)) {
+            markTreeObjects(fields.treeSHA, seen, nullptr);
+        }
+    }
+
+    for (const auto& sha : commits) {
+        GitCommit::Fields fields;
+        readCommit(sha, fields);
+        objects.push_back(sha);
+        rootTrees.push_back(fields.treeSHA);
+    }
+
+    if (filter.active()) {
+        return filterTreeObjects(rootTrees, wantedTrees, filter, seen, objects);
+    }
+    for (const auto& tree : rootTrees) {
+        if (!markTreeObjects(tree, seen, &objects)) {
+            return false;
+        }
+    }
+
+    return true;
+}
+
+bool GitRepository::computeShallow(const std::vector<std::string>& wants,
+                                   const ShallowOptions& options,
+                                   std::vector<std::string>& shallow,
+                                   std::vector<std::string>& unshallow) {
+    std::vector<std::string> starts;
+    for (const auto& sha : wants) {
+        std::string commit;
+        GitObjectType type;
+        if (!peel(sha, commit, type, nullptr)) {
+            return false;
+        }
+        if (type == GitObjectType::COMMIT) {
+            starts.push_back(commit);
+        }
+    }
+
+    // deepen-relative counts from the client's shallow commits that the
+    // wants reach, rather than from the wants themselves
+    int depth = options.depth;
+    if (options.relative) {
+        std::set<std::string> clientShallow(options.clientShallow.begin(),
+                                            options.clientShallow.end());
+        int64_t minTime = INT64_MAX;
+        for (const auto& sha : clientShallow) {
+            GitCommit::Fields fields;
+            if (readCommit(sha, fields)) {
+                minTime = std::min(minTime, fields.commitTime);
+            }
+        }
+
+        std::set<std::string> visited;
+        std::vector<std::string> pending = starts;
+        starts.clear();
+        while (!pending.empty()) {
+            std::string sha = pending.back();
+            pending.pop_back();
+            GitCommit::Fields fields;
+            if (!visited.insert(sha).second || !readCommit(sha, fields) ||
+                fields.commitTime < minTime) {
+                continue;
+            }
+            if (clientShallow.count(sha)) {
+                starts.push_back(sha);
+                continue;
+            }
+            pending.insert(pending.end(), fields.parentSHAs.begin(), fields.parentSHAs.end());
+        }
+        depth++;
+    }
+
+    // Commits behind deepen-not refs are cut off
+    std::set<std::string> excluded;
+    std::vector<std::string> stack = options.deepenNot;
+    while (!stack.empty()) {
+        std::string sha = stack.back();
+        stack.pop_back();
+        GitCommit::Fields fields;
+        if (!excluded.insert(sha).second || !readCommit(sha, fields)) {
+            continue;
+        }
+        stack.insert(stack.end(), fields.parentSHAs.begin(), fields.parentSHAs.end());
+    }
+
+    auto included = [&](const std::string& sha, const GitCommit::Fields& fields) {
+        return !excluded.count(sha) &&
+               (options.since <= 0 || fields.commitTime >= options.since);
+    };
+
+    // Breadth-first, so each commit is first reached at its smallest depth
+    std::map<std::string, int> depths;
+    std::set<std::string> boundary;
+    std::queue<std::string> queue;
+    for (const auto& sha : starts) {
+        GitCommit::Fields fields;
+        if (!depths.count(sha) && readCommit(sha, fields) && included(sha, fields)) {
+            depths[sha] = 1;
+            queue.push(sha);
+        }
+    }
+
+    while (!queue.empty()) {
+        std::string sha = queue.front();
+        queue.pop();
+
+        GitCommit::Fields fields;
+        if (!readCommit(sha, fields)) {
+            return false;
+        }
+        if (fields.parentSHAs.empty()) {
+            continue;
+        }
+        if (depth > 0 && depths[sha] >= depth) {
+            boundary.insert(sha);
+            continue;
+        }
+
+        for (const auto& parent : fields.parentSHAs) {
+            GitCommit::Fields parentFields;
+            if (!readCommit(parent, parentFields)) {
+                return false;
+            }
+            if (!included(parent, parentFields)) {
+                boundary.insert(sha);
+                continue;
+            }
+            if (!depths.count(parent)) {
+                depths[parent] = depths[sha] + 1;
+                queue.push(parent);
+            }
+        }
+    }
+
+    if (depths.empty()) {
+        return false;
+    }
+
+    std::set<std::string> clientShallow(options.clientShallow.begin(),
+                                        options.clientShallow.end());
+    for (const auto& sha : boundary) {
+        if (!clientShallow.count(sha)) {
+            shallow.push_back(sha);
+        }
+    }
+    for (const auto& sha : clientShallow) {
+        if (depths.count(sha) && !boundary.count(sha)) {
+            unshallow.push_back(sha);
+        }
+    }
+    return true;
+}
+
+bool GitRepository::markTreeObjects(const std::string& treeSHA, std::set<std::string>& seen,
+                                    std::vector<std::string>* objects) {
+    std::vector<std::string> stack = {treeSHA};
+
+    while (!stack.empty()) {
+        std::string sha = stack.back();
+        stack.pop_back();
+        if (!seen.insert(sha).second) {
+            continue;
+        }
+
+        GitObjectType type;
+        std::string data;
+        if (!readObject(sha, type, data) || type != GitObjectType::TREE) {
+            // Boundary trees may be incomplete; trees we send may not
+            if (objects) {
+                return false;
+            }
+            continue;
+        }
+        if (objects) {
+            objects->push_back(sha);
+        }
+
+        for (const auto& entry : GitTree::parseEntries(data)) {
+            if (entry.mode == "160000") {
+                // Submodule commits live in another repository
+                continue;
+            }
+            if (entry.mode == "40000" || entry.mode == "040000") {
+                stack.push_back(entry.sha);
+            } else if (seen.insert(entry.sha).second && objects) {
+                objects->push_back(entry.sha);
+            }
+        }
+    }
+
+    return true;
+}
+
+bool GitRepository::filterTreeObjects(const std::vector<std::string>& rootTrees,
+                                      const std::set<std::string>& wantedTrees,
+                                      const ObjectFilter& filter, std::set<std::string>& seen,
+                                      std::vector<std::string>& objects) {
+    // A tree may be reached again closer to the root, where more of it
+    // passes the depth filter, so remember the smallest depth walked
+    std::map<std::string, int> treeDepths;
+    std::vector<std::pair<std::string, int>> stack;
+    for (auto it = rootTrees.rbegin(); it != rootTrees.rend(); ++it) {
+        stack.push_back(std::make_pair(*it, 0));
+    }
+
+    while (!stack.empty()) {
+        std::string sha = stack.back().first;
+        int depth = stack.back().second;
+        stack.pop_back();
+
+        auto walked = treeDepths.find(sha);
+        if (walked != treeDepths.end() && walked->second <= depth) {
+            continue;
+        }
+        if (walked == treeDepths.end() && seen.count(sha)) {
+            // Already on the client
+            continue;
+        }
+        treeDepths[sha] = depth;
+
+        bool wanted = depth == 0 && wantedTrees.count(sha);
+        if (!wanted && filter.treeDepth >= 0 && depth >= filter.treeDepth) {
+            continue;
+        }
+
+        GitObjectType type;
+        std::string data;
+        if (!readObject(sha, type, data) || type != GitObjectType::TREE) {
+            return false;
+        }
+        if (seen.insert(sha).second) {
+            objects.push_back(sha);
+        }
+
+        for (const auto& entry : GitTree::parseEntries(data)) {
+            if (entry.mode == "160000") {
+                continue;
+            }
+            if (entry.mode == "40000" || entry.mode == "040000") {
+                stack.push_back(std::make_pair(entry.sha, depth + 1));
+                continue;
+            }
+
+            if (seen.count(entry.sha) || filter.omitBlobs ||
+                (filter.treeDepth >= 0 && depth + 1 >= filter.treeDepth)) {
+                continue;
+            }
+            if (filter.blobLimit >= 0) {
+                GitObjectType blobType;
+                std::string blob;
+                if (!readObject(entry.sha, blobType, blob)) {
+                    return false;
+                }
+                if (static_cast<int64_t>(blob.size()) >= filter.blobLimit) {
+                    continue;
+                }
+            }
+            seen.insert(entry.sha);
+            objects.push_back(entry.sha);
+        }
+    }
+
+    return true;
+}
+
 bool GitRepository::receivePack(const std::string& packData) {
-    // Simplified pack receiving
-    // In a real implementation, this would parse and extract the pack file
-    std::string packPath = getObjectsPath() + "/pack/pack-" +
-                          std::to_string(std::time(nullptr)) + ".pack";
-    return writeFile(packPath, packData);
+    std::unique_ptr<GitPackIndexer> indexer = beginReceivePack();
+    return indexer && indexer->append(packData.data(), packData.size()) &&
+           finishReceivePack(*indexer);
+}
+
+std::unique_ptr<GitPackIndexer> GitRepository::beginReceivePack() {
+    std::string packDir = (quarantinePath.empty() ? getObjectsPath() : quarantinePath) + "/pack";
+    std::error_code ec;
+    fs::create_directories(packDir, ec);
+
+    // No .pack extension, so readers ignore it until it is complete
+    std::string path = packDir + "/tmp_pack_XXXXXX";
+    int fd = mkstemp(&path[0]);
+    if (fd < 0) {
+        return nullptr;
+    }
+    close(fd);
+
+    return std::make_unique<GitPackIndexer>(path);
+}
+
+bool GitRepository::finishReceivePack(GitPackIndexer& indexer) {
+    // Bases of thin-pack deltas must already be in the repository
+    if (!indexer.finish(objectResolver())) {
+        return false;
+    }
+    if (indexer.objectCount() == 0) {
+        return true;
+    }
+
+    std::string packDir = fs::path(indexer.getPackPath()).parent_path().string();
+    std::string base = packDir + "/pack-" + indexer.checksum();
+    std::string tmpIdx = indexer.getPackPath() + ".idx";
+    std::error_code ec;
+    if (!indexer.writeIndex(tmpIdx)) {
+        fs::remove(tmpIdx, ec);
+        return false;
+    }
+
+    // Packs are found by their .pack file, so the index goes in first
+    fs::rename(tmpIdx, base + ".idx", ec);
+    if (ec) {
+        fs::remove(tmpIdx, ec);
+        return false;
+    }
+    fs::rename(indexer.getPackPath(), base + ".pack", ec);
+    if (ec) {
+        return false;
+    }
+
+    if (!quarantinePath.empty()) {
+        auto pack = std::make_unique<GitPackFile>(base + ".pack");
+        if (!pack->open()) {
+            return false;
+        }
+        quarantinePacks.push_back(std::move(pack));
+        return true;
+    }
+
+    packs.clear();
+    packsLoaded = false;
+    return true;
+}
+
+bool GitRepository::beginQuarantine() {
+    if (!quarantinePath.empty()) {
+        return true;
+    }
+
+    std::string path = getObjectsPath() + "/incoming-XXXXXX";
+    if (!mkdtemp(&path[0])) {
+        return false;
+    }
+    quarantinePath = path;
+    return true;
+}
+
+bool GitRepository::migrateQuarantine() {
+    if (quarantinePath.empty()) {
+        return true;
+    }
+
+    std::string packDir = getObjectsPath() + "/pack";
+    std::error_code ec;
+    fs::create_directories(packDir, ec);
+
+    // Each index goes in ahead of its pack, as when receiving
+    std::vector<fs::path> files;
+    for (const auto& entry : fs::directory_iterator(quarantinePath + "/pack", ec)) {
+        std::string ext = entry.path().extension().string();
+        if (ext == ".idx" || ext == ".pack") {
+            files.push_back(entry.path());
+        }
+    }
+    std::sort(files.begin(), files.end(), [](const fs::path& a, const fs::path& b) {
+        return (a.extension() == ".idx") > (b.extension() == ".idx");
+    });
+
+    quarantinePacks.clear();
+    for (const auto& file : files) {
+        fs::rename(file, packDir + "/" + file.filename().string(), ec);
+        if (ec) {
+            return false;
+        }
+    }
+
+    fs::remove_all(quarantinePath, ec);
+    quarantinePath.clear();
+    packs.clear();
+    packsLoaded = false;
+    return true;
+}
+
+void GitRepository::abortQuarantine() {
+    if (quarantinePath.empty()) {
+        return;
+    }
+
+    quarantinePacks.clear();
+    std::error_code ec;
+    fs::remove_all(quarantinePath, ec);
+    quarantinePath.clear();
+}
+
+bool GitRepository::checkConnectivity(const std::string& tip) {
+    // Only quarantined objects are walked: anything already in the object
+    // store was checked when it came in
+    std::vector<std::string> stack = {tip};
+    std::set<std::string> seen;
+
+    while (!stack.empty()) {
+        std::string sha = stack.back();
+        stack.pop_back();
+        if (!seen.insert(sha).second) {
+            continue;
+        }
+        if (!inQuarantine(sha)) {
+            if (!hasObject(sha)) {
+                return false;
+            }
+            continue;
+        }
+
+        GitObjectType type;
+        std::string data;
+        if (!readObject(sha, type, data)) {
+            return false;
+        }
+
+        switch (type) {
+        case GitObjectType::COMMIT: {
+            GitCommit::Fields fields;
+            if (!GitCommit::parse(data, fields)) {
+                return false;
+            }
+            stack.push_back(fields.treeSHA);
+            stack.insert(stack.end(), fields.parentSHAs.begin(), fields.parentSHAs.end());
+            break;
+        }
+        case GitObjectType::TREE:
+            for (const auto& entry : GitTree::parseEntries(data)) {
+                if (entry.mode == "160000") {
+                    // Submodule commits live in another repository
+                    continue;
+                }
+                if (entry.mode == "40000" || entry.mode == "040000") {
+                    stack.push_back(entry.sha);
+                } else if (seen.insert(entry.sha).second && !hasObject(entry.sha)) {
+                    return false;
+                }
+            }
+            break;
+        case GitObjectType::TAG: {
+            GitTag::Fields fields;
+            if (!GitTag::parse(data, fields)) {
+                return false;
+            }
+            stack.push_back(fields.objectSHA);
+            break;
+        }
+        default:
+            break;
+        }
+    }
+
+    return true;
 }
 
 std::string GitRepository::uploadPack(const std::vector<std::string>& wants,
-                                     const std::vector<std::string>& haves) {
-    // Simplified pack generation
-    // In a real implementation, this would generate a pack file with requested objects
-    return "PACK data placeholder";
+                                     const std::vector<std::string>& haves,
+                                     const ShallowOptions& options,
+                                     const ObjectFilter& filter) {
+    std::string packData;
+    bool ok = uploadPack(wants, haves, options, filter,
+                         [&packData](const char* data, size_t len) {
+                             packData.append(data, len);
+                             return true;
+                         });
+    return ok ? packData : "";
+}
+
+bool GitRepository::uploadPack(const std::vector<std::string>& wants,
+                               const std::vector<std::string>& haves,
+                               const ShallowOptions& options,
+                               const ObjectFilter& filter,
+                               const GitPack::PackSink& sink) {
+    if (wants.empty()) {
+        return false;
+    }
+
+    // Walks stop at every shallow commit the client will have
+    std::vector<std::string> packWants = wants;
+    std::vector<std::string> packHaves = haves;
+    std::set<std::string> shallow(options.clientShallow.begin(), options.clientShallow.end());
+    if (options.deepen()) {
+        std::vector<std::string> newShallow, unshallow;
+        if (!computeShallow(wants, options, newShallow, unshallow)) {
+            return false;
+        }
+        shallow.insert(newShallow.begin(), newShallow.end());
+
+        // The client has an unshallowed commit but none of its parents
+        for (const auto& sha : unshallow) {
+            GitCommit::Fields fields;
+            if (readCommit(sha, fields)) {
+                packWants.insert(packWants.end(), fields.parentSHAs.begin(),
+                                 fields.parentSHAs.end());
+            }
+            packHaves.push_back(sha);
+        }
+    }
+
+    std::vector<std::string> shas;
+    if (!collectObjects(packWants, packHaves, shas, shallow, filter)) {
+        return false;
+    }
+
+    // Objects are read and written one at a time
+    GitPackWriter writer(sink, shas.size());
+    for (const auto& sha : shas) {
+        GitObjectType type;
+        std::string data;
+        if (!readObject(sha, type, data) ||
+            !writer.add(GitPack::fromObjectType(type), data)) {
+            return false;
+        }
+    }
+    return writer.finish();
 }
 
 bool GitRepository::createDirectory(const std::string& path) {
@@ -21,6 +21,18 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+// LoginTwoFactorRequest represents the second step of a login with
+// two-factor authentication
+type LoginTwoFactorRequest struct {
+	TwoFactorToken string `json:"two_factor_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+// RefreshRequest represents a token refresh request
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
 // Register handles user registration
 func Register(c *gin.Context) {
 	var req RegisterRequest
@@ -39,16 +51,18 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	// Generate token
-	token, err := auth.GenerateToken(user)
+	// Start a session
+	tokens, err := auth.CreateSession(user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"user":  user,
-		"token": token,
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	})
 }
 
@@ -60,7 +74,19 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	token, user, err := auth.Login(req.Username, req.Password)
+	tokens, user, err := auth.Login(req.Username, req.Password, c.Request.UserAgent(), c.ClientIP())
+	if err == auth.ErrTwoFactorRequired {
+		pending, err := auth.GeneratePendingLogin(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"two_factor_token":    pending,
+		})
+		return
+	}
 	if err != nil {
 		if err == auth.ErrInvalidCredentials {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
@@ -71,11 +97,94 @@ func Login(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"user":  user,
-		"token": token,
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	})
 }
 
+// LoginTwoFactor finishes a login for an account with two-factor
+// authentication
+func LoginTwoFactor(c *gin.Context) {
+	var req LoginTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, user, err := auth.CompleteLogin(req.TwoFactorToken, req.Code, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidToken, auth.ErrUserNotFound:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired two-factor token"})
+		case auth.ErrInvalidCode, auth.ErrTwoFactorNotEnabled:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two-factor code"})
+		case auth.ErrTwoFactorLocked:
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many invalid codes, try again later"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh
+// token
+func Refresh(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, user, err := auth.RefreshSession(req.RefreshToken, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		if err == auth.ErrInvalidToken || err == auth.ErrUserNotFound {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// Logout ends the session of the request's access token
+func Logout(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	sessionID, ok := c.Get("session_id")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "not signed in with a session"})
+		return
+	}
+
+	if err := auth.RevokeSession(userID.(int64), sessionID.(int64)); err != nil && err != auth.ErrSessionNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
 // GetCurrentUser returns the current authenticated user
 func GetCurrentUser(c *gin.Context) {
 	userID, exists := c.Get("user_id")
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+// BlameRangeInfo is a run of lines from the same commit as the API
+// returns it
+type BlameRangeInfo struct {
+	Commit *CommitInfo `json:"commit"`
+	// Path is the file's path in the commit, set when it differs from the
+	// blamed path
+	Path          string   `json:"path,omitempty"`
+	StartLine     int      `json:"start_line"`
+	EndLine       int      `json:"end_line"`
+	OrigStartLine int      `json:"orig_start_line"`
+	Lines         []string `json:"lines"`
+}
+
+// GetBlame attributes each line of a file at a ref to the commit that
+// introduced it, following renames unless follow_renames=false
+func GetBlame(c *gin.Context) {
+	repo := readableRepository(c)
+	if repo == nil {
+		return
+	}
+
+	algorithm, ok := diffAlgorithm(c)
+	if !ok {
+		return
+	}
+	opts := &gitcore.BlameOptions{
+		FollowRenames: c.Query("follow_renames") != "false",
+		Algorithm:     algorithm,
+	}
+
+	gitRepo, commit, filePath := openRevision(c, repo)
+	if gitRepo == nil {
+		return
+	}
+	defer gitRepo.Free()
+
+	entry := lookupPath(c, gitRepo, commit, filePath)
+	if entry == nil {
+		return
+	}
+	if entry.Type() != gitcore.ObjectBlob {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is not a file"})
+		return
+	}
+
+	// The size comes from the object header, so a large file is turned
+	// down without being read
+	_, size, err := gitRepo.ReadObjectHeader(entry.SHA)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if size > config.GlobalConfig.Git.MaxContentSize*1024*1024 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "file is too large to blame"})
+		return
+	}
+
+	blob, err := gitRepo.ReadBlob(entry.SHA)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if gitcore.IsBinary(blob.Data) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot blame a binary file"})
+		return
+	}
+
+	blame, err := gitRepo.Blame(commit, filePath, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var lines []string
+	if len(blob.Data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(blob.Data), "\n"), "\n")
+	}
+	ranges := make([]*BlameRangeInfo, len(blame.Hunks))
+	for i, hunk := range blame.Hunks {
+		r := &BlameRangeInfo{
+			Commit:        newCommitInfo(hunk.Commit),
+			StartLine:     hunk.StartLine,
+			EndLine:       hunk.StartLine + hunk.Lines - 1,
+			OrigStartLine: hunk.OrigStartLine,
+			Lines:         lines[hunk.StartLine-1 : hunk.StartLine-1+hunk.Lines],
+		}
+		if hunk.Path != blame.Path {
+			r.Path = hunk.Path
+		}
+		ranges[i] = r
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"commit": newCommitInfo(commit),
+		"path":   blame.Path,
+		"sha":    blame.SHA,
+		"ranges": ranges,
+	})
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/internal/repository"
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+func TestGetBlameLimits(t *testing.T) {
+	r := setupTest(t)
+	user := newTestUser(t, "alice")
+	if _, err := repository.Create(user.ID, "history", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The history fixture of pkg/gitcore, with its main branch
+	pack, err := os.ReadFile("../../pkg/gitcore/testdata/history.pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := os.ReadFile("../../pkg/gitcore/testdata/history.refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitRepo := gitcore.NewRepository(config.GlobalConfig.GetRepoPath("alice", "history"))
+	defer gitRepo.Free()
+	if err := gitRepo.ReceivePack(pack); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(refs), "\n") {
+		if sha, name, _ := strings.Cut(line, " "); name == "refs/heads/main" {
+			if err := gitRepo.CreateRef("heads/main", sha); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		maxContent int64
+		want       int
+	}{
+		{"text file", "store.go", 1, http.StatusOK},
+		{"binary file", "logo.png", 1, http.StatusBadRequest},
+		{"directory", "text", 1, http.StatusBadRequest},
+		{"file over the limit", "store.go", 0, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.GlobalConfig.Git.MaxContentSize = tt.maxContent
+			w := serve(r, http.MethodGet, "/api/v1/repos/alice/history/blame/main/"+tt.path, "", "")
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
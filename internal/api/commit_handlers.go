@@ -0,0 +1,168 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+// Commit list page sizes
+const (
+	defaultPerPage = 30
+	maxPerPage     = 100
+)
+
+// GitIdentity is the author or committer of a commit
+type GitIdentity struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+// CommitInfo is a commit as the API returns it
+type CommitInfo struct {
+	SHA       string      `json:"sha"`
+	Tree      string      `json:"tree"`
+	Parents   []string    `json:"parents"`
+	Author    GitIdentity `json:"author"`
+	Committer GitIdentity `json:"committer"`
+	Message   string      `json:"message"`
+}
+
+// newCommitInfo converts a parsed commit for a response
+func newCommitInfo(commit *gitcore.Commit) *CommitInfo {
+	return &CommitInfo{
+		SHA:     commit.SHA,
+		Tree:    commit.Tree,
+		Parents: commit.Parents,
+		Author: GitIdentity{
+			Name:  commit.Author.Name,
+			Email: commit.Author.Email,
+			Date:  commit.Author.When,
+		},
+		Committer: GitIdentity{
+			Name:  commit.Committer.Name,
+			Email: commit.Committer.Email,
+			Date:  commit.Committer.When,
+		},
+		Message: commit.Message,
+	}
+}
+
+// pagination reads the page and per_page query parameters. On failure
+// the response has been written and ok is false.
+func pagination(c *gin.Context) (page, perPage int, ok bool) {
+	page, perPage = 1, defaultPerPage
+	var err error
+	if value := c.Query("page"); value != "" {
+		if page, err = strconv.Atoi(value); err != nil || page < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+			return 0, 0, false
+		}
+	}
+	if value := c.Query("per_page"); value != "" {
+		if perPage, err = strconv.Atoi(value); err != nil || perPage < 1 || perPage > maxPerPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "per_page must be between 1 and 100"})
+			return 0, 0, false
+		}
+	}
+	return page, perPage, true
+}
+
+// queryTime reads an RFC 3339 time query parameter; a missing one is the
+// zero time. On failure the response has been written and ok is false.
+func queryTime(c *gin.Context, name string) (time.Time, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name + " time, expected RFC 3339"})
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// ListCommits lists the history of a repository, newest first. sha is a
+// revision or an "a..b" range and defaults to HEAD; path, author, since
+// and until filter the commits, and first_parent and order=topo change
+// the walk.
+func ListCommits(c *gin.Context) {
+	repo := readableRepository(c)
+	if repo == nil {
+		return
+	}
+
+	page, perPage, ok := pagination(c)
+	if !ok {
+		return
+	}
+	since, ok := queryTime(c, "since")
+	if !ok {
+		return
+	}
+	until, ok := queryTime(c, "until")
+	if !ok {
+		return
+	}
+
+	opts := &gitcore.WalkOptions{
+		Path:        c.Query("path"),
+		Author:      c.Query("author"),
+		Since:       since,
+		Until:       until,
+		FirstParent: c.Query("first_parent") == "true",
+	}
+	switch c.Query("order") {
+	case "", "date":
+	case "topo":
+		opts.Order = gitcore.OrderTopo
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be date or topo"})
+		return
+	}
+
+	gitRepo := gitcore.NewRepository(config.GlobalConfig.GetRepoPath(c.Param("owner"), repo.Name))
+	defer gitRepo.Free()
+
+	rev := c.DefaultQuery("sha", "HEAD")
+	include, exclude, err := gitRepo.ResolveRange(rev)
+	if err != nil {
+		revisionError(c, err)
+		return
+	}
+	opts.Include, opts.Exclude = include, exclude
+
+	// One commit past the page tells whether there is another
+	skip := (page - 1) * perPage
+	commits := []*CommitInfo{}
+	hasMore := false
+	err = gitRepo.Walk(opts, func(commit *gitcore.Commit) error {
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		if len(commits) == perPage {
+			hasMore = true
+			return gitcore.ErrStopWalk
+		}
+		commits = append(commits, newCommitInfo(commit))
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"commits":  commits,
+		"page":     page,
+		"per_page": perPage,
+		"has_more": hasMore,
+	})
+}
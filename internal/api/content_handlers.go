@@ -0,0 +1,381 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/auth"
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/internal/models"
+	"github.com/zixiao/git-server/internal/repository"
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+// lastCommitSearchLimit bounds how many commits a tree listing reads to
+// find the last commit of each entry
+const lastCommitSearchLimit = 5000
+
+// sniffSize is how much of a blob is read to tell text from binary; git
+// looks at the first 8000 bytes
+const sniffSize = 8000
+
+// TreeEntryInfo is a directory entry as the API returns it
+type TreeEntryInfo struct {
+	Name string             `json:"name"`
+	Path string             `json:"path"`
+	Type gitcore.ObjectType `json:"type"`
+	Mode string             `json:"mode"`
+	SHA  string             `json:"sha"`
+	// Size is set for files and symlinks
+	Size       *int64      `json:"size,omitempty"`
+	LastCommit *CommitInfo `json:"last_commit,omitempty"`
+}
+
+// readableRepository loads the repository of a request for reading. Public
+// repositories are open to anyone; private ones need read access and, for
+// access tokens, the repo:read scope. On failure the response has been
+// written and nil is returned.
+func readableRepository(c *gin.Context) *models.Repository {
+	repo, err := repository.Get(c.Param("owner"), c.Param("repo"))
+	if err != nil {
+		if err == repository.ErrRepoNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "repository not found"})
+			return nil
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+
+	err = repository.Authorize(currentActor(c), repo, repository.ActionRead)
+	if err != nil || (repo.IsPrivate && !hasScope(c, auth.ScopeRepoRead)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return nil
+	}
+	return repo
+}
+
+// openRevision opens the git repository of a browsing request and splits
+// its "/<ref>/<path>" parameter. Ref names may contain slashes, so the
+// longest leading part that resolves to a commit is the ref. On failure
+// the response has been written and a nil repository is returned;
+// otherwise the caller must free it.
+func openRevision(c *gin.Context, repo *models.Repository) (*gitcore.Repository, *gitcore.Commit, string) {
+	parts := strings.Split(strings.Trim(c.Param("path"), "/"), "/")
+
+	gitRepo := gitcore.NewRepository(config.GlobalConfig.GetRepoPath(c.Param("owner"), repo.Name))
+	for i := len(parts); i > 0; i-- {
+		commit, err := gitRepo.ResolveCommit(strings.Join(parts[:i], "/"))
+		if err == gitcore.ErrUnknownRevision {
+			continue
+		}
+		if err != nil {
+			gitRepo.Free()
+			revisionError(c, err)
+			return nil, nil, ""
+		}
+		return gitRepo, commit, strings.Join(parts[i:], "/")
+	}
+
+	gitRepo.Free()
+	c.JSON(http.StatusNotFound, gin.H{"error": "ref not found"})
+	return nil, nil, ""
+}
+
+// revisionError writes the response for a revision that did not resolve
+func revisionError(c *gin.Context, err error) {
+	switch err {
+	case gitcore.ErrUnknownRevision:
+		c.JSON(http.StatusNotFound, gin.H{"error": "ref not found"})
+	case gitcore.ErrAmbiguousRevision:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "short SHA is ambiguous"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// lookupPath finds the entry at a path of a commit. On failure the
+// response has been written and nil is returned.
+func lookupPath(c *gin.Context, gitRepo *gitcore.Repository, commit *gitcore.Commit, filePath string) *gitcore.TreeEntry {
+	entry, err := gitRepo.TreeEntryByPath(commit.Tree, filePath)
+	if err != nil {
+		if errors.Is(err, gitcore.ErrPathNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
+			return nil
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+	return entry
+}
+
+// listDirectory reads the entries of a directory, directories first and
+// then by name. Files and symlinks get their size.
+func listDirectory(gitRepo *gitcore.Repository, dir, tree string) ([]*TreeEntryInfo, error) {
+	t, err := gitRepo.ReadTree(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*TreeEntryInfo, 0, len(t.Entries))
+	for _, e := range t.Entries {
+		entry := &TreeEntryInfo{
+			Name: e.Name,
+			Path: path.Join(dir, e.Name),
+			Type: e.Type(),
+			Mode: e.Mode,
+			SHA:  e.SHA,
+		}
+		if entry.Type == gitcore.ObjectBlob {
+			_, size, err := gitRepo.ReadObjectHeader(e.SHA)
+			if err != nil {
+				return nil, err
+			}
+			entry.Size = &size
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		iDir := entries[i].Type == gitcore.ObjectTree
+		jDir := entries[j].Type == gitcore.ObjectTree
+		if iDir != jDir {
+			return iDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// GetTree lists a directory of a repository at a ref, with the last
+// commit that changed each entry
+func GetTree(c *gin.Context) {
+	repo := readableRepository(c)
+	if repo == nil {
+		return
+	}
+
+	gitRepo, commit, dir := openRevision(c, repo)
+	if gitRepo == nil {
+		return
+	}
+	defer gitRepo.Free()
+
+	entry := lookupPath(c, gitRepo, commit, dir)
+	if entry == nil {
+		return
+	}
+	if entry.Mode != gitcore.ModeDir {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is not a directory"})
+		return
+	}
+
+	entries, err := listDirectory(gitRepo, dir, entry.SHA)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
+	}
+	lastCommits, err := gitRepo.LastCommits(commit, dir, names, lastCommitSearchLimit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, e := range entries {
+		if last, ok := lastCommits[e.Name]; ok {
+			e.LastCommit = newCommitInfo(last)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"commit":  newCommitInfo(commit),
+		"path":    dir,
+		"sha":     entry.SHA,
+		"entries": entries,
+	})
+}
+
+// GetContents returns a file of a repository at a ref, or the entries of
+// a directory. File content is base64 encoded, or sent as is with
+// ?format=raw; files over the configured size are only sent raw.
+func GetContents(c *gin.Context) {
+	repo := readableRepository(c)
+	if repo == nil {
+		return
+	}
+
+	gitRepo, commit, filePath := openRevision(c, repo)
+	if gitRepo == nil {
+		return
+	}
+	defer gitRepo.Free()
+
+	entry := lookupPath(c, gitRepo, commit, filePath)
+	if entry == nil {
+		return
+	}
+
+	switch entry.Mode {
+	case gitcore.ModeDir:
+		entries, err := listDirectory(gitRepo, filePath, entry.SHA)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"type":    "dir",
+			"path":    filePath,
+			"sha":     entry.SHA,
+			"entries": entries,
+		})
+		return
+	case gitcore.ModeSubmodule:
+		c.JSON(http.StatusOK, gin.H{
+			"type": "submodule",
+			"name": entry.Name,
+			"path": filePath,
+			"sha":  entry.SHA,
+		})
+		return
+	}
+
+	if c.Query("format") == "raw" {
+		blob, err := gitRepo.OpenBlob(entry.SHA)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer blob.Close()
+		serveBlob(c, blob)
+		return
+	}
+
+	_, size, err := gitRepo.ReadObjectHeader(entry.SHA)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Large files would bloat the JSON; the client fetches them raw, so
+	// only enough of them is read to tell text from binary
+	tooLarge := size > config.GlobalConfig.Git.MaxContentSize*1024*1024
+	var data []byte
+	if tooLarge {
+		data, err = blobPrefix(gitRepo, entry.SHA)
+	} else {
+		var blob *gitcore.Blob
+		if blob, err = gitRepo.ReadBlob(entry.SHA); err == nil {
+			data = blob.Data
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fileType := "file"
+	if entry.Mode == gitcore.ModeSymlink {
+		fileType = "symlink"
+	}
+	response := gin.H{
+		"type":   fileType,
+		"name":   entry.Name,
+		"path":   filePath,
+		"sha":    entry.SHA,
+		"size":   size,
+		"binary": gitcore.IsBinary(data),
+	}
+	if fileType == "symlink" {
+		response["target"] = string(data)
+	}
+
+	if tooLarge {
+		response["encoding"] = "none"
+		response["content"] = ""
+	} else {
+		response["encoding"] = "base64"
+		response["content"] = data
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetRaw sends a file of a repository at a ref as is
+func GetRaw(c *gin.Context) {
+	repo := readableRepository(c)
+	if repo == nil {
+		return
+	}
+
+	gitRepo, commit, filePath := openRevision(c, repo)
+	if gitRepo == nil {
+		return
+	}
+	defer gitRepo.Free()
+
+	entry := lookupPath(c, gitRepo, commit, filePath)
+	if entry == nil {
+		return
+	}
+	if entry.Type() != gitcore.ObjectBlob {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is not a file"})
+		return
+	}
+
+	blob, err := gitRepo.OpenBlob(entry.SHA)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer blob.Close()
+
+	serveBlob(c, blob)
+}
+
+// blobPrefix reads the start of a blob, as much as sniffing its content
+// looks at
+func blobPrefix(gitRepo *gitcore.Repository, sha string) ([]byte, error) {
+	blob, err := gitRepo.OpenBlob(sha)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return io.ReadAll(io.LimitReader(blob, sniffSize))
+}
+
+// serveBlob streams a blob as the response body. Text is always sent as
+// text/plain, so files from a repository cannot run as HTML or scripts on
+// the server's origin; binary files get the type their content suggests.
+// Both are decided from the start of the blob.
+func serveBlob(c *gin.Context, blob *gitcore.ObjectReader) {
+	etag := `"` + blob.SHA + `"`
+	c.Header("ETag", etag)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	content := bufio.NewReaderSize(blob, sniffSize)
+	prefix, err := content.Peek(sniffSize)
+	if err != nil && err != io.EOF {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if gitcore.IsBinary(prefix) {
+		contentType = http.DetectContentType(prefix)
+	}
+	c.DataFromReader(http.StatusOK, blob.Size, contentType, content, nil)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/auth"
+	"github.com/zixiao/git-server/internal/repository"
+)
+
+// AddDeployKeyRequest represents a deploy key creation request. Keys are
+// read-only unless read_only is set to false.
+type AddDeployKeyRequest struct {
+	Title    string `json:"title" binding:"required,max=100"`
+	Key      string `json:"key" binding:"required"`
+	ReadOnly *bool  `json:"read_only"`
+}
+
+// ListDeployKeys lists a repository's deploy keys
+func ListDeployKeys(c *gin.Context) {
+	repo := authorizedRepository(c, repository.ActionAdmin)
+	if repo == nil {
+		return
+	}
+
+	keys, err := repository.ListDeployKeys(repo.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// GetDeployKey returns one of a repository's deploy keys
+func GetDeployKey(c *gin.Context) {
+	repo := authorizedRepository(c, repository.ActionAdmin)
+	if repo == nil {
+		return
+	}
+
+	keyID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key id"})
+		return
+	}
+
+	key, err := repository.GetDeployKey(repo.ID, keyID)
+	if err != nil {
+		if err == repository.ErrDeployKeyNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"key": key})
+}
+
+// AddDeployKey adds a deploy key to a repository
+func AddDeployKey(c *gin.Context) {
+	repo := authorizedRepository(c, repository.ActionAdmin)
+	if repo == nil {
+		return
+	}
+
+	var req AddDeployKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	readOnly := req.ReadOnly == nil || *req.ReadOnly
+	key, err := repository.AddDeployKey(repo.ID, req.Title, req.Key, readOnly)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidKey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err == auth.ErrKeyExists {
+			c.JSON(http.StatusConflict, gin.H{"error": "key is already in use"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"key": key})
+}
+
+// DeleteDeployKey removes a deploy key from a repository
+func DeleteDeployKey(c *gin.Context) {
+	repo := authorizedRepository(c, repository.ActionAdmin)
+	if repo == nil {
+		return
+	}
+
+	keyID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key id"})
+		return
+	}
+
+	if err := repository.DeleteDeployKey(repo.ID, keyID); err != nil {
+		if err == repository.ErrDeployKeyNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "key deleted"})
+}
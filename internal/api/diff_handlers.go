@@ -0,0 +1,379 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+// Diff limits. JSON diffs use gitcore's defaults; raw diffs and patches
+// are meant to be applied, so they get larger limits and are refused
+// rather than cut when over them.
+const (
+	maxCompareCommits = 250
+	rawDiffMaxFiles   = 3000
+	rawDiffMaxLines   = 200000
+)
+
+// Raw diff formats, chosen by a ".diff" or ".patch" suffix
+const (
+	formatDiff  = "diff"
+	formatPatch = "patch"
+)
+
+// DiffStats counts the changed lines of a diff
+type DiffStats struct {
+	Additions int `json:"additions"`
+	Deletions int `json:"deletions"`
+	Total     int `json:"total"`
+}
+
+// DiffFileInfo is a file change as the API returns it
+type DiffFileInfo struct {
+	Filename         string               `json:"filename"`
+	PreviousFilename string               `json:"previous_filename,omitempty"`
+	Status           gitcore.ChangeStatus `json:"status"`
+	OldMode          string               `json:"old_mode,omitempty"`
+	NewMode          string               `json:"new_mode,omitempty"`
+	OldSHA           string               `json:"old_sha,omitempty"`
+	NewSHA           string               `json:"new_sha,omitempty"`
+	Similarity       int                  `json:"similarity,omitempty"`
+	Additions        int                  `json:"additions"`
+	Deletions        int                  `json:"deletions"`
+	Changes          int                  `json:"changes"`
+	Binary           bool                 `json:"binary"`
+	// Truncated is set when the patch was left out to keep the response
+	// small
+	Truncated bool   `json:"truncated"`
+	Patch     string `json:"patch,omitempty"`
+}
+
+// newDiffStats totals a diff for a response
+func newDiffStats(diff *gitcore.Diff) DiffStats {
+	return DiffStats{
+		Additions: diff.Additions,
+		Deletions: diff.Deletions,
+		Total:     diff.Additions + diff.Deletions,
+	}
+}
+
+// newDiffFiles converts the file changes of a diff for a response
+func newDiffFiles(diff *gitcore.Diff) []*DiffFileInfo {
+	files := make([]*DiffFileInfo, len(diff.Files))
+	for i, f := range diff.Files {
+		file := &DiffFileInfo{
+			Filename:   f.Path(),
+			Status:     f.Status,
+			OldMode:    f.OldMode,
+			NewMode:    f.NewMode,
+			OldSHA:     f.OldSHA,
+			NewSHA:     f.NewSHA,
+			Similarity: f.Similarity,
+			Additions:  f.Additions,
+			Deletions:  f.Deletions,
+			Changes:    f.Additions + f.Deletions,
+			Binary:     f.Binary,
+			Truncated:  f.Truncated,
+			Patch:      f.Patch(),
+		}
+		if f.Status == gitcore.StatusRenamed || f.Status == gitcore.StatusCopied {
+			file.PreviousFilename = f.OldPath
+		}
+		files[i] = file
+	}
+	return files
+}
+
+// splitDiffFormat splits a ".diff" or ".patch" suffix off a revision
+func splitDiffFormat(rev string) (string, string) {
+	for _, format := range []string{formatDiff, formatPatch} {
+		if trimmed, ok := strings.CutSuffix(rev, "."+format); ok {
+			return trimmed, format
+		}
+	}
+	return rev, ""
+}
+
+// diffAlgorithm reads the algorithm query parameter, myers or histogram.
+// On failure the response has been written and ok is false.
+func diffAlgorithm(c *gin.Context) (gitcore.DiffAlgorithm, bool) {
+	switch c.Query("algorithm") {
+	case "", "myers":
+		return gitcore.DiffMyers, true
+	case "histogram":
+		return gitcore.DiffHistogram, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "algorithm must be myers or histogram"})
+	return 0, false
+}
+
+// diffOptions builds the options of a diff request: the algorithm query
+// parameter picks myers or histogram, and raw formats get their larger
+// limits. On failure the response has been written and nil is returned.
+func diffOptions(c *gin.Context, format string) *gitcore.DiffOptions {
+	opts := gitcore.DefaultDiffOptions()
+	var ok bool
+	if opts.Algorithm, ok = diffAlgorithm(c); !ok {
+		return nil
+	}
+
+	if format != "" {
+		opts.MaxFiles = rawDiffMaxFiles
+		opts.MaxLines = rawDiffMaxLines
+	}
+	return opts
+}
+
+// commitDiff compares a commit with its first parent, or with the empty
+// tree for a root commit
+func commitDiff(gitRepo *gitcore.Repository, commit *gitcore.Commit, opts *gitcore.DiffOptions) (*gitcore.Diff, error) {
+	parentTree := ""
+	if len(commit.Parents) > 0 {
+		parent, err := gitRepo.ReadCommit(commit.Parents[0])
+		if err != nil {
+			return nil, err
+		}
+		parentTree = parent.Tree
+	}
+	return gitRepo.DiffTrees(parentTree, commit.Tree, opts)
+}
+
+// writeRawDiff sends diffs in a raw format: the diff as git diff prints
+// it, or each commit with its diff as git format-patch does. Truncated
+// diffs would not apply, so they are refused.
+func writeRawDiff(c *gin.Context, gitRepo *gitcore.Repository, format string, commits []*gitcore.Commit, diffs []*gitcore.Diff) {
+	for _, diff := range diffs {
+		if diff.Truncated {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "diff is too large to show raw"})
+			return
+		}
+	}
+
+	var body strings.Builder
+	for i, diff := range diffs {
+		var err error
+		if format == formatPatch {
+			err = gitRepo.FormatPatch(&body, commits[i], diff, i+1, len(diffs))
+		} else {
+			err = diff.WriteUnified(&body)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(body.String()))
+}
+
+// GetCommit returns a commit with its changes against its first parent.
+// A ".diff" or ".patch" suffix on the revision returns them raw.
+func GetCommit(c *gin.Context) {
+	repo := readableRepository(c)
+	if repo == nil {
+		return
+	}
+
+	rev, format := splitDiffFormat(c.Param("sha"))
+	opts := diffOptions(c, format)
+	if opts == nil {
+		return
+	}
+
+	gitRepo := gitcore.NewRepository(config.GlobalConfig.GetRepoPath(c.Param("owner"), repo.Name))
+	defer gitRepo.Free()
+
+	commit, err := gitRepo.ResolveCommit(rev)
+	if err != nil {
+		revisionError(c, err)
+		return
+	}
+
+	diff, err := commitDiff(gitRepo, commit, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if format != "" {
+		writeRawDiff(c, gitRepo, format, []*gitcore.Commit{commit}, []*gitcore.Diff{diff})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"commit":    newCommitInfo(commit),
+		"stats":     newDiffStats(diff),
+		"files":     newDiffFiles(diff),
+		"truncated": diff.Truncated,
+	})
+}
+
+// countCommits counts the commits reachable from include but not from
+// exclude
+func countCommits(gitRepo *gitcore.Repository, include, exclude string) (int, error) {
+	count := 0
+	err := gitRepo.Walk(&gitcore.WalkOptions{
+		Include: []string{include},
+		Exclude: []string{exclude},
+	}, func(*gitcore.Commit) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// CompareCommits compares two revisions. "base...head" diffs head against
+// its merge base with base, as a pull request shows it; "base..head"
+// diffs head against base directly. Either way the commits are those of
+// head that base lacks, oldest first, up to the newest 250. A ".diff" or
+// ".patch" suffix returns the diff or the commits' patches raw.
+func CompareCommits(c *gin.Context) {
+	repo := readableRepository(c)
+	if repo == nil {
+		return
+	}
+
+	basehead, format := splitDiffFormat(strings.TrimPrefix(c.Param("basehead"), "/"))
+	base, head, threeDot := strings.Cut(basehead, "...")
+	if !threeDot {
+		var twoDot bool
+		if base, head, twoDot = strings.Cut(basehead, ".."); !twoDot {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expected base...head or base..head"})
+			return
+		}
+	}
+	opts := diffOptions(c, format)
+	if opts == nil {
+		return
+	}
+
+	gitRepo := gitcore.NewRepository(config.GlobalConfig.GetRepoPath(c.Param("owner"), repo.Name))
+	defer gitRepo.Free()
+
+	baseCommit, err := gitRepo.ResolveCommit(base)
+	var headCommit *gitcore.Commit
+	if err == nil {
+		headCommit, err = gitRepo.ResolveCommit(head)
+	}
+	if err != nil {
+		revisionError(c, err)
+		return
+	}
+
+	compare(c, gitRepo, baseCommit, headCommit, threeDot, format, opts)
+}
+
+// compare writes the comparison of two resolved commits
+func compare(c *gin.Context, gitRepo *gitcore.Repository, base, head *gitcore.Commit, threeDot bool, format string, opts *gitcore.DiffOptions) {
+	// Unrelated histories have no merge base, which only a direct
+	// comparison can do without
+	var mergeBase *gitcore.Commit
+	mergeBaseSHA, err := gitRepo.MergeBase(base.SHA, head.SHA)
+	if err == nil {
+		mergeBase, err = gitRepo.ReadCommit(mergeBaseSHA)
+	}
+	if err == gitcore.ErrNoMergeBase && threeDot {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no common ancestor"})
+		return
+	}
+	if err != nil && err != gitcore.ErrNoMergeBase {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The commits, newest first as walked; the list keeps the newest ones
+	// unless all are needed for patches
+	var commits []*gitcore.Commit
+	aheadBy := 0
+	err = gitRepo.Walk(&gitcore.WalkOptions{
+		Include: []string{head.SHA},
+		Exclude: []string{base.SHA},
+	}, func(commit *gitcore.Commit) error {
+		aheadBy++
+		if format == formatPatch || len(commits) < maxCompareCommits {
+			commits = append(commits, commit)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+
+	if format == formatPatch {
+		// As with git format-patch, merges are left out
+		var patched []*gitcore.Commit
+		var diffs []*gitcore.Diff
+		for _, commit := range commits {
+			if len(commit.Parents) > 1 {
+				continue
+			}
+			diff, err := commitDiff(gitRepo, commit, opts)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			patched = append(patched, commit)
+			diffs = append(diffs, diff)
+		}
+		writeRawDiff(c, gitRepo, format, patched, diffs)
+		return
+	}
+
+	fromTree := base.Tree
+	if threeDot {
+		fromTree = mergeBase.Tree
+	}
+	diff, err := gitRepo.DiffTrees(fromTree, head.Tree, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if format == formatDiff {
+		writeRawDiff(c, gitRepo, format, nil, []*gitcore.Diff{diff})
+		return
+	}
+
+	behindBy, err := countCommits(gitRepo, base.SHA, head.SHA)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := "identical"
+	switch {
+	case aheadBy > 0 && behindBy > 0:
+		status = "diverged"
+	case aheadBy > 0:
+		status = "ahead"
+	case behindBy > 0:
+		status = "behind"
+	}
+
+	commitInfos := make([]*CommitInfo, len(commits))
+	for i, commit := range commits {
+		commitInfos[i] = newCommitInfo(commit)
+	}
+	response := gin.H{
+		"base_commit":   newCommitInfo(base),
+		"head_commit":   newCommitInfo(head),
+		"status":        status,
+		"ahead_by":      aheadBy,
+		"behind_by":     behindBy,
+		"total_commits": aheadBy,
+		"commits":       commitInfos,
+		"stats":         newDiffStats(diff),
+		"files":         newDiffFiles(diff),
+		"truncated":     diff.Truncated,
+	}
+	if mergeBase != nil {
+		response["merge_base_commit"] = newCommitInfo(mergeBase)
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -1,19 +1,67 @@
 package api
 
 import (
+	"compress/gzip"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/auth"
 	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/internal/gitservice"
+	"github.com/zixiao/git-server/internal/models"
 	"github.com/zixiao/git-server/internal/repository"
 	"github.com/zixiao/git-server/pkg/gitcore"
 )
 
+// gitRepoParams returns the owner and repository name of a git route,
+// accepting clone URLs with or without the ".git" suffix
+func gitRepoParams(c *gin.Context) (string, string) {
+	return c.Param("owner"), strings.TrimSuffix(c.Param("repo"), ".git")
+}
+
+// requestBody returns the request body, decompressing it if the client
+// sent it gzip encoded
+func requestBody(c *gin.Context) (io.ReadCloser, error) {
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		return gzip.NewReader(c.Request.Body)
+	}
+	return c.Request.Body, nil
+}
+
+// authorizeGit checks a git request's access to a repository. Anonymous
+// clients are challenged for credentials when the repository is private or
+// the action is a push; access tokens need the matching scope then. On
+// failure the response has been written and false is returned.
+func authorizeGit(c *gin.Context, repo *models.Repository, action repository.Action) bool {
+	scope := auth.ScopeRepoRead
+	if action == repository.ActionWrite {
+		scope = auth.ScopeRepoWrite
+	}
+
+	actor := currentActor(c)
+	needsCredentials := repo.IsPrivate || action != repository.ActionRead
+	if needsCredentials && actor == nil {
+		gitAuthChallenge(c)
+		return false
+	}
+
+	err := repository.Authorize(actor, repo, action)
+	if err == repository.ErrTwoFactorRequired {
+		c.String(http.StatusForbidden, "Two-factor authentication required")
+		return false
+	}
+	if err != nil || (needsCredentials && !hasScope(c, scope)) {
+		c.String(http.StatusForbidden, "Access denied")
+		return false
+	}
+	return true
+}
+
 // GitInfoRefs handles git info/refs request
 func GitInfoRefs(c *gin.Context) {
-	owner := c.Param("owner")
-	repoName := c.Param("repo")
+	owner, repoName := gitRepoParams(c)
 	service := c.Query("service")
 
 	// Get repository
@@ -23,20 +71,15 @@ func GitInfoRefs(c *gin.Context) {
 		return
 	}
 
-	// Check access for private repositories
-	if repo.IsPrivate {
-		userID, exists := c.Get("user_id")
-		if !exists {
-			c.Header("WWW-Authenticate", "Basic realm=\"Git\"")
-			c.String(http.StatusUnauthorized, "Authentication required")
-			return
-		}
-
-		hasAccess, err := repository.CheckAccess(repo.ID, userID.(int64), "read")
-		if err != nil || !hasAccess {
-			c.String(http.StatusForbidden, "Access denied")
-			return
-		}
+	// Pushes always need credentials. Git only sends them once challenged
+	// and cannot replay a pack upload, so the challenge comes here rather
+	// than from receive-pack.
+	action := repository.ActionRead
+	if service == gitservice.ServiceReceivePack {
+		action = repository.ActionWrite
+	}
+	if !authorizeGit(c, repo, action) {
+		return
 	}
 
 	// Get repository path
@@ -44,24 +87,17 @@ func GitInfoRefs(c *gin.Context) {
 	gitRepo := gitcore.NewRepository(repoPath)
 	defer gitRepo.Free()
 
-	// Get all refs
-	refs, err := gitRepo.ListRefs()
-	if err != nil {
-		c.String(http.StatusInternalServerError, "Failed to list refs")
+	// Protocol v2 clients get a capability advertisement instead of refs
+	// and list refs with the ls-refs command
+	if service == gitservice.ServiceUploadPack && gitcore.IsProtocolV2(c.GetHeader("Git-Protocol")) {
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/x-"+service+"-advertisement",
+			gitcore.CreateV2Advertisement(gitcore.ProtocolV2Capabilities))
 		return
 	}
 
-	// Build refs map
-	refsMap := make(map[string]string)
-	for _, ref := range refs {
-		sha, err := gitRepo.GetRef(ref)
-		if err == nil && sha != "" {
-			refsMap["refs/"+ref] = sha
-		}
-	}
-
 	// Create advertisement
-	adv, err := gitcore.CreateRefAdvertisement(refsMap, service)
+	adv, err := gitservice.AdvertiseRefs(gitRepo, service, true)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Failed to create advertisement")
 		return
@@ -76,8 +112,7 @@ func GitInfoRefs(c *gin.Context) {
 
 // GitReceivePack handles git push (receive-pack)
 func GitReceivePack(c *gin.Context) {
-	owner := c.Param("owner")
-	repoName := c.Param("repo")
+	owner, repoName := gitRepoParams(c)
 
 	// Get repository
 	repo, err := repository.Get(owner, repoName)
@@ -87,23 +122,19 @@ func GitReceivePack(c *gin.Context) {
 	}
 
 	// Check write access
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.Header("WWW-Authenticate", "Basic realm=\"Git\"")
-		c.String(http.StatusUnauthorized, "Authentication required")
+	if !authorizeGit(c, repo, repository.ActionWrite) {
 		return
 	}
 
-	hasAccess, err := repository.CheckAccess(repo.ID, userID.(int64), "write")
-	if err != nil || !hasAccess {
-		c.String(http.StatusForbidden, "Access denied")
+	// Read the commands; the pack that follows is streamed to disk
+	body, err := requestBody(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid request encoding")
 		return
 	}
-
-	// Read pack data
-	packData, err := io.ReadAll(c.Request.Body)
+	req, pack, err := gitcore.ReadReceivePack(body)
 	if err != nil {
-		c.String(http.StatusInternalServerError, "Failed to read pack data")
+		c.String(http.StatusBadRequest, "Invalid receive-pack request")
 		return
 	}
 
@@ -112,22 +143,21 @@ func GitReceivePack(c *gin.Context) {
 	gitRepo := gitcore.NewRepository(repoPath)
 	defer gitRepo.Free()
 
-	// Receive pack
-	if err := gitRepo.ReceivePack(packData); err != nil {
+	c.Header("Content-Type", "application/x-git-receive-pack-result")
+	c.Header("Cache-Control", "no-cache")
+
+	// Progress and hook output reach the client while the push is still
+	// being processed
+	stream := &streamWriter{c: c}
+	err = gitservice.ReceivePack(c.Request.Context(), gitRepo, req, pack, stream)
+	if err != nil && !stream.started {
 		c.String(http.StatusInternalServerError, "Failed to receive pack")
-		return
 	}
-
-	// Return success
-	response := gitcore.PktLine("unpack ok\n") + gitcore.FlushPkt()
-	c.Header("Content-Type", "application/x-git-receive-pack-result")
-	c.String(http.StatusOK, response)
 }
 
 // GitUploadPack handles git pull/fetch (upload-pack)
 func GitUploadPack(c *gin.Context) {
-	owner := c.Param("owner")
-	repoName := c.Param("repo")
+	owner, repoName := gitRepoParams(c)
 
 	// Get repository
 	repo, err := repository.Get(owner, repoName)
@@ -136,46 +166,71 @@ func GitUploadPack(c *gin.Context) {
 		return
 	}
 
-	// Check read access for private repositories
-	if repo.IsPrivate {
-		userID, exists := c.Get("user_id")
-		if !exists {
-			c.Header("WWW-Authenticate", "Basic realm=\"Git\"")
-			c.String(http.StatusUnauthorized, "Authentication required")
-			return
-		}
-
-		hasAccess, err := repository.CheckAccess(repo.ID, userID.(int64), "read")
-		if err != nil || !hasAccess {
-			c.String(http.StatusForbidden, "Access denied")
-			return
-		}
+	// Check read access
+	if !authorizeGit(c, repo, repository.ActionRead) {
+		return
 	}
 
 	// Read request body (wants and haves)
-	_, err = io.ReadAll(c.Request.Body)
+	body, err := requestBody(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid request encoding")
+		return
+	}
+	data, err := io.ReadAll(body)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Failed to read request")
 		return
 	}
 
-	// Parse wants and haves (simplified)
-	wants := []string{}
-	haves := []string{}
-
 	// Get repository path
 	repoPath := config.GlobalConfig.GetRepoPath(owner, repoName)
 	gitRepo := gitcore.NewRepository(repoPath)
 	defer gitRepo.Free()
 
-	// Upload pack
-	packData, err := gitRepo.UploadPack(wants, haves)
+	c.Header("Content-Type", "application/x-git-upload-pack-result")
+	c.Header("Cache-Control", "no-cache")
+
+	if gitcore.IsProtocolV2(c.GetHeader("Git-Protocol")) {
+		cmd, err := gitcore.ParseCommandRequest(data)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid protocol v2 request")
+			return
+		}
+		gitservice.UploadPackV2(c.Request.Context(), gitRepo, cmd, c.Writer)
+		return
+	}
+
+	req, err := gitcore.ParseUploadPack(data)
 	if err != nil {
-		c.String(http.StatusInternalServerError, "Failed to upload pack")
+		c.String(http.StatusBadRequest, "Invalid upload-pack request")
 		return
 	}
 
-	// Return pack data
-	c.Header("Content-Type", "application/x-git-upload-pack-result")
-	c.Data(http.StatusOK, "application/x-git-upload-pack-result", packData)
+	// The response is streamed; a failure before anything was sent can
+	// still get an error status
+	stream := &streamWriter{c: c}
+	err = gitservice.UploadPack(c.Request.Context(), gitRepo, req, stream)
+	if err != nil && !stream.started {
+		c.String(http.StatusInternalServerError, "Failed to upload pack")
+	}
+}
+
+// streamWriter writes a streamed response, committing the status with the
+// first write and flushing every write to the client
+type streamWriter struct {
+	c       *gin.Context
+	started bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		s.c.Status(http.StatusOK)
+	}
+	n, err := s.c.Writer.Write(p)
+	if err == nil {
+		s.c.Writer.Flush()
+	}
+	return n, err
 }
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/repository"
+)
+
+// ListInvitations lists the current user's pending collaboration
+// invitations
+func ListInvitations(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	invitations, err := repository.ListInvitations(userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+// AcceptInvitation accepts one of the current user's invitations
+func AcceptInvitation(c *gin.Context) {
+	answerInvitation(c, repository.AcceptInvitation, "invitation accepted")
+}
+
+// DeclineInvitation declines one of the current user's invitations
+func DeclineInvitation(c *gin.Context) {
+	answerInvitation(c, repository.DeclineInvitation, "invitation declined")
+}
+
+// answerInvitation accepts or declines the invitation named in the request
+func answerInvitation(c *gin.Context, answer func(userID, invitationID int64) error, message string) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	invitationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid invitation id"})
+		return
+	}
+
+	if err := answer(userID.(int64), invitationID); err != nil {
+		if err == repository.ErrInvitationNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
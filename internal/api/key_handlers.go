@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/auth"
+)
+
+// AddSSHKeyRequest represents an SSH key registration request
+type AddSSHKeyRequest struct {
+	Title string `json:"title" binding:"required,max=100"`
+	Key   string `json:"key" binding:"required"`
+}
+
+// ListSSHKeys lists the current user's SSH keys
+func ListSSHKeys(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	keys, err := auth.ListSSHKeys(userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// AddSSHKey registers an SSH public key to the current user
+func AddSSHKey(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	var req AddSSHKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, err := auth.AddSSHKey(userID.(int64), req.Title, req.Key)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidKey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err == auth.ErrKeyExists {
+			c.JSON(http.StatusConflict, gin.H{"error": "key is already in use"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"key": key})
+}
+
+// DeleteSSHKey removes one of the current user's SSH keys
+func DeleteSSHKey(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	keyID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key id"})
+		return
+	}
+
+	if err := auth.DeleteSSHKey(userID.(int64), keyID); err != nil {
+		if err == auth.ErrKeyNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "key deleted"})
+}
+
+// ListUserSSHKeys lists the SSH public keys of any user
+func ListUserSSHKeys(c *gin.Context) {
+	user, err := auth.GetUserByUsername(c.Param("username"))
+	if err != nil {
+		if err == auth.ErrUserNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	keys, err := auth.ListSSHKeys(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
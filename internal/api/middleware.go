@@ -2,12 +2,16 @@ package api
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/zixiao/git-server/internal/auth"
+	"github.com/zixiao/git-server/internal/models"
+	"github.com/zixiao/git-server/internal/repository"
 )
 
-// AuthMiddleware validates JWT token
+// AuthMiddleware validates the bearer token, either a JWT or a personal
+// access token
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.GetHeader("Authorization")
@@ -22,22 +26,16 @@ func AuthMiddleware() gin.HandlerFunc {
 			token = token[7:]
 		}
 
-		claims, err := auth.ValidateToken(token)
-		if err != nil {
+		if !setTokenUser(c, token) {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
 			c.Abort()
 			return
 		}
-
-		// Set user info in context
-		c.Set("user_id", claims.UserID)
-		c.Set("username", claims.Username)
-		c.Set("is_admin", claims.IsAdmin)
 		c.Next()
 	}
 }
 
-// OptionalAuthMiddleware validates JWT token if present
+// OptionalAuthMiddleware validates the bearer token if present
 func OptionalAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.GetHeader("Authorization")
@@ -51,18 +49,166 @@ func OptionalAuthMiddleware() gin.HandlerFunc {
 			token = token[7:]
 		}
 
-		claims, err := auth.ValidateToken(token)
-		if err == nil {
-			// Set user info in context
-			c.Set("user_id", claims.UserID)
-			c.Set("username", claims.Username)
-			c.Set("is_admin", claims.IsAdmin)
+		setTokenUser(c, token)
+		c.Next()
+	}
+}
+
+// setTokenUser sets the user info in context from a JWT or a personal
+// access token. Access tokens also set their scopes, which limit what the
+// request may do; JWT sessions are not limited. A JWT is only accepted
+// while its session is live and its user active.
+func setTokenUser(c *gin.Context, token string) bool {
+	if claims, err := auth.ValidateToken(token); err == nil {
+		user, err := auth.ValidateSession(claims)
+		if err != nil {
+			return false
+		}
+		c.Set("user_id", user.ID)
+		c.Set("username", user.Username)
+		c.Set("is_admin", user.IsAdmin)
+		c.Set("session_id", claims.SessionID)
+		return true
+	}
+
+	user, scopes, err := auth.ValidateAccessToken(token)
+	if err != nil {
+		return false
+	}
+	c.Set("user_id", user.ID)
+	c.Set("username", user.Username)
+	c.Set("is_admin", user.IsAdmin)
+	c.Set("scopes", scopes)
+	return true
+}
+
+// hasScope reports whether the request's credentials allow the given
+// access token scope
+func hasScope(c *gin.Context, scope string) bool {
+	scopes, ok := c.Get("scopes")
+	if !ok {
+		return true
+	}
+	return auth.HasScope(scopes.([]string), scope)
+}
+
+// currentActor returns the authenticated user of a request as a repository
+// actor, or nil for an anonymous request
+func currentActor(c *gin.Context) *repository.Actor {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		return nil
+	}
+	return &repository.Actor{UserID: userID.(int64), IsAdmin: c.GetBool("is_admin")}
+}
+
+// RequireScope rejects requests made with an access token that lacks the
+// given scope
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasScope(c, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "token requires the " + scope + " scope"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSiteAdmin rejects requests from users who are not site admins
+func RequireSiteAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool("is_admin") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "site admin required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GitAuthMiddleware authenticates git clients. HTTP Basic credentials are
+// accepted with either the account password or a personal access token as
+// the secret, and a Bearer token works as it does for the API. Accounts
+// with two-factor authentication cannot use their password. Access tokens
+// are limited to their scopes. Requests without credentials go through
+// anonymously and the git handlers challenge them when needed; bad
+// credentials are challenged straight away so credential helpers discard
+// them and prompt again.
+func GitAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" {
+			c.Next()
+			return
+		}
+
+		switch {
+		case strings.HasPrefix(header, "Basic "):
+			username, secret, ok := c.Request.BasicAuth()
+			if !ok {
+				gitAuthChallenge(c)
+				return
+			}
+			user, scopes, err := basicAuthUser(username, secret)
+			if err != nil {
+				gitAuthChallenge(c)
+				return
+			}
+			c.Set("user_id", user.ID)
+			c.Set("username", user.Username)
+			c.Set("is_admin", user.IsAdmin)
+			if scopes != nil {
+				c.Set("scopes", scopes)
+			}
+
+		case strings.HasPrefix(header, "Bearer "):
+			if !setTokenUser(c, strings.TrimPrefix(header, "Bearer ")) {
+				gitAuthChallenge(c)
+				return
+			}
+
+		default:
+			gitAuthChallenge(c)
+			return
 		}
 
 		c.Next()
 	}
 }
 
+// basicAuthUser resolves Basic credentials. A personal access token is
+// tried first; with a token the username is not checked, since git
+// clients are often configured with a placeholder one. Scopes are nil for
+// a password. Accounts with two-factor authentication must use a token,
+// as a password alone would bypass the second factor.
+func basicAuthUser(username, secret string) (*models.User, []string, error) {
+	if user, scopes, err := auth.ValidateAccessToken(secret); err == nil {
+		return user, scopes, nil
+	}
+	user, err := auth.Authenticate(username, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enabled, err := auth.TwoFactorEnabled(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enabled {
+		return nil, nil, auth.ErrTwoFactorRequired
+	}
+	return user, nil, nil
+}
+
+// gitAuthChallenge answers a git request with a Basic challenge, which
+// makes git ask its credential helper (or the user) for credentials
+func gitAuthChallenge(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Basic realm="Git", charset="UTF-8"`)
+	c.String(http.StatusUnauthorized, "Authentication required")
+	c.Abort()
+}
+
 // CORSMiddleware handles CORS
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/zixiao/git-server/internal/auth"
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/internal/database"
+	"github.com/zixiao/git-server/internal/models"
+	"github.com/zixiao/git-server/internal/repository"
+)
+
+// setupTest points the server at a new SQLite database and repository
+// directory and returns a router with every route
+func setupTest(t *testing.T) *gin.Engine {
+	t.Helper()
+	dir := t.TempDir()
+	saved := config.GlobalConfig
+	config.GlobalConfig = &config.Config{
+		Git: config.GitConfig{
+			RepoPath:       filepath.Join(dir, "repositories"),
+			MaxContentSize: 1,
+		},
+		Security: config.SecurityConfig{
+			JWTSecret:              "test-secret",
+			AccessTokenExpiration:  15,
+			RefreshTokenExpiration: 720,
+			PasswordMin:            8,
+		},
+	}
+	t.Cleanup(func() { config.GlobalConfig = saved })
+
+	err := database.Init(database.Config{
+		Type: "sqlite3",
+		Path: filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	SetupRoutes(r)
+	return r
+}
+
+// newTestUser registers a user with the password "password"
+func newTestUser(t *testing.T, name string) *models.User {
+	t.Helper()
+	user, err := auth.Register(name, name+"@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// newAccessToken creates a personal access token with scopes and returns
+// its value
+func newAccessToken(t *testing.T, user *models.User, scopes ...string) string {
+	t.Helper()
+	token, err := auth.CreateAccessToken(user.ID, "test", scopes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Token
+}
+
+// newSessionToken signs the user in and returns the session's access token
+func newSessionToken(t *testing.T, user *models.User) string {
+	t.Helper()
+	tokens, err := auth.CreateSession(user, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens.AccessToken
+}
+
+// serve sends a request through the router; header is a full
+// Authorization header value, or empty for none
+func serve(r *gin.Engine, method, path, header, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if header != "" {
+		req.Header.Set("Authorization", header)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRequireScope(t *testing.T) {
+	r := setupTest(t)
+	user := newTestUser(t, "alice")
+	session := newSessionToken(t, user)
+	repoRead := newAccessToken(t, user, auth.ScopeRepoRead)
+	userScope := newAccessToken(t, user, auth.ScopeUser)
+	admin := newAccessToken(t, user, auth.ScopeAdmin)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"session reads the account", http.MethodGet, "/api/v1/user", session, http.StatusOK},
+		{"user scope reads the account", http.MethodGet, "/api/v1/user", userScope, http.StatusOK},
+		{"repo:read reads the account", http.MethodGet, "/api/v1/user", repoRead, http.StatusForbidden},
+		{"admin reads the account", http.MethodGet, "/api/v1/user", admin, http.StatusForbidden},
+		{"repo:read lists tokens", http.MethodGet, "/api/v1/user/tokens", repoRead, http.StatusForbidden},
+		{"user scope lists tokens", http.MethodGet, "/api/v1/user/tokens", userScope, http.StatusOK},
+		{"repo:read creates an organization", http.MethodPost, "/api/v1/orgs", repoRead, http.StatusForbidden},
+		{"user scope creates an organization", http.MethodPost, "/api/v1/orgs", userScope, http.StatusForbidden},
+		{"unknown token", http.MethodGet, "/api/v1/user", "not-a-token", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, tt.method, tt.path, "Bearer "+tt.token, "")
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+// Git over HTTP limits access tokens to their scopes: pushing needs
+// repo:write and reading a private repository repo:read
+func TestGitAuthScopes(t *testing.T) {
+	r := setupTest(t)
+	user := newTestUser(t, "alice")
+	if _, err := repository.Create(user.ID, "private", "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	basic := func(username, secret string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(username, secret)
+		return req.Header.Get("Authorization")
+	}
+	repoRead := basic("git", newAccessToken(t, user, auth.ScopeRepoRead))
+	repoWrite := basic("git", newAccessToken(t, user, auth.ScopeRepoWrite))
+	userScope := basic("git", newAccessToken(t, user, auth.ScopeUser))
+	fetch := "/alice/private.git/info/refs?service=git-upload-pack"
+	push := "/alice/private.git/info/refs?service=git-receive-pack"
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		want   int
+	}{
+		{"anonymous fetch", fetch, "", http.StatusUnauthorized},
+		{"repo:read fetches", fetch, repoRead, http.StatusOK},
+		{"repo:read pushes", push, repoRead, http.StatusForbidden},
+		{"repo:write pushes", push, repoWrite, http.StatusOK},
+		{"user scope fetches", fetch, userScope, http.StatusForbidden},
+		{"password pushes", push, basic("alice", "password"), http.StatusOK},
+		{"wrong password", fetch, basic("alice", "wrong"), http.StatusUnauthorized},
+		{"bearer repo:read pushes", push, "Bearer " + newAccessToken(t, user, auth.ScopeRepoRead), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, tt.path, tt.header, "")
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,494 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/auth"
+	"github.com/zixiao/git-server/internal/models"
+	"github.com/zixiao/git-server/internal/organization"
+	"github.com/zixiao/git-server/internal/repository"
+)
+
+// CreateOrganizationRequest represents an organization creation request
+type CreateOrganizationRequest struct {
+	Name     string `json:"name" binding:"required,min=3,max=50"`
+	Email    string `json:"email" binding:"required,email"`
+	FullName string `json:"full_name"`
+}
+
+// SetOrgMemberRequest represents a request to add an organization member
+// or change their role
+type SetOrgMemberRequest struct {
+	Role string `json:"role" binding:"required,oneof=owner member"`
+}
+
+// CreateTeamRequest represents a team creation request
+type CreateTeamRequest struct {
+	Name        string `json:"name" binding:"required,min=1,max=100"`
+	Description string `json:"description"`
+	Permission  string `json:"permission" binding:"omitempty,oneof=read triage write maintain admin"`
+}
+
+// UpdateTeamRequest represents a request to change a team
+type UpdateTeamRequest struct {
+	Description string `json:"description"`
+	Permission  string `json:"permission" binding:"required,oneof=read triage write maintain admin"`
+}
+
+// CreateOrganization creates an organization owned by the current user
+func CreateOrganization(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	var req CreateOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	org, err := organization.Create(userID.(int64), req.Name, req.FullName, req.Email)
+	if err != nil {
+		if err == organization.ErrNameTaken {
+			c.JSON(http.StatusConflict, gin.H{"error": "name or email already taken"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"organization": org})
+}
+
+// GetOrganization retrieves an organization
+func GetOrganization(c *gin.Context) {
+	org, err := organization.Get(c.Param("org"))
+	if err != nil {
+		if err == organization.ErrOrgNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"organization": org})
+}
+
+// ListUserOrganizations lists the organizations the current user belongs
+// to
+func ListUserOrganizations(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	orgs, err := organization.ListForUser(userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"organizations": orgs})
+}
+
+// DeleteOrganization deletes an organization that owns no repositories
+func DeleteOrganization(c *gin.Context) {
+	org := authorizedOrganization(c, organization.RoleOwner)
+	if org == nil {
+		return
+	}
+
+	if err := organization.Delete(org.ID); err != nil {
+		if err == organization.ErrOrgNotEmpty {
+			c.JSON(http.StatusConflict, gin.H{"error": "organization still owns repositories"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "organization deleted"})
+}
+
+// authorizedOrganization loads the organization of a request and checks
+// that the current user holds role in it; any member satisfies
+// RoleMember, and site admins satisfy both. On failure the response has
+// been written and nil is returned.
+func authorizedOrganization(c *gin.Context, role string) *models.Organization {
+	actor := currentActor(c)
+	if actor == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return nil
+	}
+
+	org, err := organization.Get(c.Param("org"))
+	if err != nil {
+		if err == organization.ErrOrgNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+			return nil
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+
+	if actor.IsAdmin {
+		return org
+	}
+
+	memberRole, err := organization.MemberRole(org.ID, actor.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+	if memberRole == "" || (role == organization.RoleOwner && memberRole != organization.RoleOwner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return nil
+	}
+
+	return org
+}
+
+// ListOrgMembers lists an organization's members
+func ListOrgMembers(c *gin.Context) {
+	org := authorizedOrganization(c, organization.RoleMember)
+	if org == nil {
+		return
+	}
+
+	members, err := organization.ListMembers(org.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// SetOrgMember adds a user to an organization or changes their role
+func SetOrgMember(c *gin.Context) {
+	org := authorizedOrganization(c, organization.RoleOwner)
+	if org == nil {
+		return
+	}
+
+	var req SetOrgMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member, err := auth.GetUserByUsername(c.Param("username"))
+	if err != nil || member.Type != models.UserTypeUser {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if err := organization.SetMember(org.ID, member.ID, req.Role); err != nil {
+		if err == organization.ErrLastOwner {
+			c.JSON(http.StatusConflict, gin.H{"error": "an organization needs at least one owner"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "member updated"})
+}
+
+// RemoveOrgMember removes a user from an organization. Owners may remove
+// anyone; members may remove themselves.
+func RemoveOrgMember(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	member, err := auth.GetUserByUsername(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	role := organization.RoleOwner
+	if member.ID == userID.(int64) {
+		role = organization.RoleMember
+	}
+	org := authorizedOrganization(c, role)
+	if org == nil {
+		return
+	}
+
+	if err := organization.RemoveMember(org.ID, member.ID); err != nil {
+		if err == organization.ErrNotMember {
+			c.JSON(http.StatusNotFound, gin.H{"error": "member not found"})
+			return
+		}
+		if err == organization.ErrLastOwner {
+			c.JSON(http.StatusConflict, gin.H{"error": "an organization needs at least one owner"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "member removed"})
+}
+
+// authorizedTeam loads the organization and team of a request, checking
+// the current user's organization role as authorizedOrganization does. On
+// failure the response has been written and nil is returned.
+func authorizedTeam(c *gin.Context, role string) (*models.Organization, *models.Team) {
+	org := authorizedOrganization(c, role)
+	if org == nil {
+		return nil, nil
+	}
+
+	team, err := organization.GetTeam(org.ID, c.Param("team"))
+	if err != nil {
+		if err == organization.ErrTeamNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "team not found"})
+			return nil, nil
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil
+	}
+
+	return org, team
+}
+
+// ListTeams lists an organization's teams
+func ListTeams(c *gin.Context) {
+	org := authorizedOrganization(c, organization.RoleMember)
+	if org == nil {
+		return
+	}
+
+	teams, err := organization.ListTeams(org.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"teams": teams})
+}
+
+// CreateTeam creates a team in an organization
+func CreateTeam(c *gin.Context) {
+	org := authorizedOrganization(c, organization.RoleOwner)
+	if org == nil {
+		return
+	}
+
+	var req CreateTeamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Permission == "" {
+		req.Permission = repository.RoleRead
+	}
+
+	team, err := organization.CreateTeam(org.ID, req.Name, req.Description, req.Permission)
+	if err != nil {
+		if err == organization.ErrTeamExists {
+			c.JSON(http.StatusConflict, gin.H{"error": "team already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"team": team})
+}
+
+// GetTeam retrieves a team
+func GetTeam(c *gin.Context) {
+	_, team := authorizedTeam(c, organization.RoleMember)
+	if team == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"team": team})
+}
+
+// UpdateTeam changes a team's description and permission
+func UpdateTeam(c *gin.Context) {
+	_, team := authorizedTeam(c, organization.RoleOwner)
+	if team == nil {
+		return
+	}
+
+	var req UpdateTeamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := organization.UpdateTeam(team.ID, req.Description, req.Permission); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	team.Description = req.Description
+	team.Permission = req.Permission
+	c.JSON(http.StatusOK, gin.H{"team": team})
+}
+
+// DeleteTeam deletes a team
+func DeleteTeam(c *gin.Context) {
+	_, team := authorizedTeam(c, organization.RoleOwner)
+	if team == nil {
+		return
+	}
+
+	if err := organization.DeleteTeam(team.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "team deleted"})
+}
+
+// ListTeamMembers lists a team's members
+func ListTeamMembers(c *gin.Context) {
+	_, team := authorizedTeam(c, organization.RoleMember)
+	if team == nil {
+		return
+	}
+
+	members, err := organization.ListTeamMembers(team.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// AddTeamMember adds an organization member to a team
+func AddTeamMember(c *gin.Context) {
+	_, team := authorizedTeam(c, organization.RoleOwner)
+	if team == nil {
+		return
+	}
+
+	member, err := auth.GetUserByUsername(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if err := organization.AddTeamMember(team, member.ID); err != nil {
+		if err == organization.ErrNotMember {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user is not a member of the organization"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "team member added"})
+}
+
+// RemoveTeamMember removes a user from a team
+func RemoveTeamMember(c *gin.Context) {
+	_, team := authorizedTeam(c, organization.RoleOwner)
+	if team == nil {
+		return
+	}
+
+	member, err := auth.GetUserByUsername(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if err := organization.RemoveTeamMember(team.ID, member.ID); err != nil {
+		if err == organization.ErrNotMember {
+			c.JSON(http.StatusNotFound, gin.H{"error": "team member not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "team member removed"})
+}
+
+// ListTeamRepositories lists the repositories a team has access to
+func ListTeamRepositories(c *gin.Context) {
+	_, team := authorizedTeam(c, organization.RoleMember)
+	if team == nil {
+		return
+	}
+
+	repos, err := organization.ListTeamRepositories(team.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"repositories": repos})
+}
+
+// AddTeamRepository grants a team access to one of the organization's
+// repositories
+func AddTeamRepository(c *gin.Context) {
+	org, team := authorizedTeam(c, organization.RoleOwner)
+	if team == nil {
+		return
+	}
+
+	repo, err := repository.Get(org.Name, c.Param("repo"))
+	if err != nil {
+		if err == repository.ErrRepoNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "repository not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := organization.AddTeamRepository(team.ID, repo.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "team repository added"})
+}
+
+// RemoveTeamRepository revokes a team's access to a repository
+func RemoveTeamRepository(c *gin.Context) {
+	org, team := authorizedTeam(c, organization.RoleOwner)
+	if team == nil {
+		return
+	}
+
+	repo, err := repository.Get(org.Name, c.Param("repo"))
+	if err != nil {
+		if err == repository.ErrRepoNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "repository not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	removed, err := organization.RemoveTeamRepository(team.ID, repo.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "team repository not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "team repository removed"})
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/zixiao/git-server/internal/auth"
 	"github.com/zixiao/git-server/internal/models"
+	"github.com/zixiao/git-server/internal/organization"
 	"github.com/zixiao/git-server/internal/repository"
 )
 
@@ -14,6 +15,9 @@ type CreateRepositoryRequest struct {
 	Name        string `json:"name" binding:"required,min=1,max=100"`
 	Description string `json:"description"`
 	IsPrivate   bool   `json:"is_private"`
+	// Owner names an organization to create the repository in; by
+	// default it belongs to the current user
+	Owner string `json:"owner"`
 }
 
 // CreateRepository handles repository creation
@@ -30,7 +34,32 @@ func CreateRepository(c *gin.Context) {
 		return
 	}
 
-	repo, err := repository.Create(userID.(int64), req.Name, req.Description, req.IsPrivate)
+	ownerID := userID.(int64)
+	if req.Owner != "" {
+		org, err := organization.Get(req.Owner)
+		if err != nil {
+			if err == organization.ErrOrgNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Only organization owners create its repositories
+		role, err := organization.MemberRole(org.ID, ownerID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if role != organization.RoleOwner && !c.GetBool("is_admin") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+			return
+		}
+		ownerID = org.ID
+	}
+
+	repo, err := repository.Create(ownerID, req.Name, req.Description, req.IsPrivate)
 	if err != nil {
 		if err == repository.ErrRepoExists {
 			c.JSON(http.StatusConflict, gin.H{"error": "repository already exists"})
@@ -63,18 +92,10 @@ func GetRepository(c *gin.Context) {
 	}
 
 	// Check access for private repositories
-	if repo.IsPrivate {
-		userID, exists := c.Get("user_id")
-		if !exists {
-			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
-			return
-		}
-
-		hasAccess, err := repository.CheckAccess(repo.ID, userID.(int64), "read")
-		if err != nil || !hasAccess {
-			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
-			return
-		}
+	err = repository.Authorize(currentActor(c), repo, repository.ActionRead)
+	if err != nil || (repo.IsPrivate && !hasScope(c, auth.ScopeRepoRead)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"repository": repo})
@@ -97,21 +118,62 @@ func ListRepositories(c *gin.Context) {
 		return
 	}
 
-	// Filter private repositories if not owner
-	userID, authenticated := c.Get("user_id")
-	if !authenticated || userID.(int64) != user.ID {
-		filtered := []*models.Repository{}
-		for _, repo := range repos {
-			if !repo.IsPrivate {
-				filtered = append(filtered, repo)
+	// Filter out private repositories the user cannot read, and all of
+	// them if the token cannot read repositories
+	actor := currentActor(c)
+	filtered := []*models.Repository{}
+	for _, repo := range repos {
+		if repo.IsPrivate {
+			if !hasScope(c, auth.ScopeRepoRead) || repository.Authorize(actor, repo, repository.ActionRead) != nil {
+				continue
 			}
 		}
-		repos = filtered
+		filtered = append(filtered, repo)
 	}
+	repos = filtered
 
 	c.JSON(http.StatusOK, gin.H{"repositories": repos})
 }
 
+// UpdateRepositoryRequest represents a repository settings update; only
+// the fields given are changed
+type UpdateRepositoryRequest struct {
+	Description      *string `json:"description"`
+	IsPrivate        *bool   `json:"is_private"`
+	RequireTwoFactor *bool   `json:"require_two_factor"`
+}
+
+// UpdateRepository changes a repository's settings
+func UpdateRepository(c *gin.Context) {
+	repo := authorizedRepository(c, repository.ActionAdmin)
+	if repo == nil {
+		return
+	}
+
+	var req UpdateRepositoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Description != nil {
+		repo.Description = *req.Description
+	}
+	if req.IsPrivate != nil {
+		repo.IsPrivate = *req.IsPrivate
+	}
+	if req.RequireTwoFactor != nil {
+		repo.RequireTwoFactor = *req.RequireTwoFactor
+	}
+
+	if err := repository.Update(repo); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"repository": repo})
+}
+
 // DeleteRepository deletes a repository
 func DeleteRepository(c *gin.Context) {
 	userID, exists := c.Get("user_id")
@@ -133,12 +195,13 @@ func DeleteRepository(c *gin.Context) {
 		return
 	}
 
+	if err := repository.Authorize(currentActor(c), repo, repository.ActionDelete); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
 	err = repository.Delete(repo.ID, userID.(int64))
 	if err != nil {
-		if err == repository.ErrAccessDenied {
-			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
-			return
-		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -146,32 +209,73 @@ func DeleteRepository(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "repository deleted"})
 }
 
-// AddCollaboratorRequest represents a request to add a collaborator
+// authorizedRepository loads the repository of a request and checks that
+// the current user may perform action on it. On failure the response has
+// been written and nil is returned.
+func authorizedRepository(c *gin.Context, action repository.Action) *models.Repository {
+	actor := currentActor(c)
+	if actor == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return nil
+	}
+
+	repo, err := repository.Get(c.Param("owner"), c.Param("repo"))
+	if err != nil {
+		if err == repository.ErrRepoNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "repository not found"})
+			return nil
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+
+	if err := repository.Authorize(actor, repo, action); err != nil {
+		if err == repository.ErrTwoFactorRequired {
+			c.JSON(http.StatusForbidden, gin.H{"error": "two-factor authentication required"})
+			return nil
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return nil
+	}
+
+	return repo
+}
+
+// AddCollaboratorRequest represents a request to invite a collaborator
 type AddCollaboratorRequest struct {
 	Username   string `json:"username" binding:"required"`
-	Permission string `json:"permission" binding:"required,oneof=read write admin"`
+	Permission string `json:"permission" binding:"required,oneof=read triage write maintain admin"`
 }
 
-// AddCollaborator adds a collaborator to a repository
-func AddCollaborator(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+// UpdateCollaboratorRequest represents a request to change a
+// collaborator's role
+type UpdateCollaboratorRequest struct {
+	Permission string `json:"permission" binding:"required,oneof=read triage write maintain admin"`
+}
+
+// ListCollaborators lists a repository's collaborators and pending
+// invitations. It needs push access, since the list includes emails and
+// invitations that readers of a public repository should not see.
+func ListCollaborators(c *gin.Context) {
+	repo := authorizedRepository(c, repository.ActionWrite)
+	if repo == nil {
 		return
 	}
 
-	owner := c.Param("owner")
-	repoName := c.Param("repo")
-
-	repo, err := repository.Get(owner, repoName)
+	collaborators, err := repository.ListCollaborators(repo.ID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "repository not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Check if user is owner
-	if repo.OwnerID != userID.(int64) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+	c.JSON(http.StatusOK, gin.H{"collaborators": collaborators})
+}
+
+// AddCollaborator invites a user to collaborate on a repository; they gain
+// access once they accept
+func AddCollaborator(c *gin.Context) {
+	repo := authorizedRepository(c, repository.ActionAdmin)
+	if repo == nil {
 		return
 	}
 
@@ -187,42 +291,71 @@ func AddCollaborator(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
+	if collabUser.Type == models.UserTypeOrganization {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "an organization cannot be a collaborator"})
+		return
+	}
+	if collabUser.ID == repo.OwnerID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the owner cannot be a collaborator"})
+		return
+	}
 
-	err = repository.AddCollaborator(repo.ID, collabUser.ID, req.Permission)
+	collab, err := repository.InviteCollaborator(repo.ID, collabUser.ID, req.Permission)
 	if err != nil {
+		if err == repository.ErrCollaboratorExists {
+			c.JSON(http.StatusConflict, gin.H{"error": "user is already a collaborator or invited"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "collaborator added"})
+	c.JSON(http.StatusCreated, gin.H{"invitation": collab})
 }
 
-// RemoveCollaborator removes a collaborator from a repository
-func RemoveCollaborator(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+// UpdateCollaborator changes a collaborator's role in place
+func UpdateCollaborator(c *gin.Context) {
+	repo := authorizedRepository(c, repository.ActionAdmin)
+	if repo == nil {
 		return
 	}
 
-	owner := c.Param("owner")
-	repoName := c.Param("repo")
-	username := c.Param("username")
+	var req UpdateCollaboratorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	repo, err := repository.Get(owner, repoName)
+	// Get collaborator user
+	collabUser, err := auth.GetUserByUsername(c.Param("username"))
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "repository not found"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
 
-	// Check if user is owner
-	if repo.OwnerID != userID.(int64) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+	err = repository.UpdateCollaborator(repo.ID, collabUser.ID, req.Permission)
+	if err != nil {
+		if err == repository.ErrCollaboratorNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "collaborator not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "collaborator updated"})
+}
+
+// RemoveCollaborator removes a collaborator from a repository, or
+// withdraws their invitation
+func RemoveCollaborator(c *gin.Context) {
+	repo := authorizedRepository(c, repository.ActionAdmin)
+	if repo == nil {
 		return
 	}
 
 	// Get collaborator user
-	collabUser, err := auth.GetUserByUsername(username)
+	collabUser, err := auth.GetUserByUsername(c.Param("username"))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
@@ -230,6 +363,10 @@ func RemoveCollaborator(c *gin.Context) {
 
 	err = repository.RemoveCollaborator(repo.ID, collabUser.ID)
 	if err != nil {
+		if err == repository.ErrCollaboratorNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "collaborator not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
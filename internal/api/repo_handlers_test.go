@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/zixiao/git-server/internal/repository"
+)
+
+// Collaborators of a public repository are listed only to those who can
+// push to it
+func TestListCollaboratorsAccess(t *testing.T) {
+	r := setupTest(t)
+	owner := newTestUser(t, "owner")
+	writer := newTestUser(t, "writer")
+	reader := newTestUser(t, "reader")
+	stranger := newTestUser(t, "stranger")
+	repo, err := repository.Create(owner.ID, "public", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, collab := range []struct {
+		userID int64
+		role   string
+	}{{writer.ID, repository.RoleWrite}, {reader.ID, repository.RoleRead}} {
+		invitation, err := repository.InviteCollaborator(repo.ID, collab.userID, collab.role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repository.AcceptInvitation(collab.userID, invitation.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"owner", newSessionToken(t, owner), http.StatusOK},
+		{"write collaborator", newSessionToken(t, writer), http.StatusOK},
+		{"read collaborator", newSessionToken(t, reader), http.StatusForbidden},
+		{"stranger", newSessionToken(t, stranger), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, "/api/v1/repos/owner/public/collaborators", "Bearer "+tt.token, "")
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
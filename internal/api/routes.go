@@ -2,6 +2,7 @@ package api
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/auth"
 )
 
 // SetupRoutes configures all API routes
@@ -13,10 +14,13 @@ func SetupRoutes(r *gin.Engine) {
 	v1 := r.Group("/api/v1")
 	{
 		// Public routes
-		auth := v1.Group("/auth")
+		authRoutes := v1.Group("/auth")
 		{
-			auth.POST("/register", Register)
-			auth.POST("/login", Login)
+			authRoutes.POST("/register", Register)
+			authRoutes.POST("/login", Login)
+			authRoutes.POST("/login/2fa", LoginTwoFactor)
+			authRoutes.POST("/refresh", Refresh)
+			authRoutes.POST("/logout", AuthMiddleware(), Logout)
 		}
 
 		// Protected routes
@@ -24,29 +28,115 @@ func SetupRoutes(r *gin.Engine) {
 		protected.Use(AuthMiddleware())
 		{
 			// Current user
-			protected.GET("/user", GetCurrentUser)
+			user := protected.Group("/user")
+			user.Use(RequireScope(auth.ScopeUser))
+			{
+				user.GET("", GetCurrentUser)
+
+				// Personal access tokens
+				user.GET("/tokens", ListAccessTokens)
+				user.POST("/tokens", CreateAccessToken)
+				user.DELETE("/tokens/:id", DeleteAccessToken)
+
+				// Two-factor authentication
+				user.GET("/2fa", GetTwoFactor)
+				user.POST("/2fa/enroll", EnrollTwoFactor)
+				user.POST("/2fa/confirm", ConfirmTwoFactor)
+				user.POST("/2fa/disable", DisableTwoFactor)
+				user.POST("/2fa/recovery-codes", RegenerateRecoveryCodes)
+
+				// Signed-in sessions
+				user.GET("/sessions", ListSessions)
+				user.DELETE("/sessions/:id", RevokeSession)
+
+				// SSH keys
+				user.GET("/keys", ListSSHKeys)
+				user.POST("/keys", AddSSHKey)
+				user.DELETE("/keys/:id", DeleteSSHKey)
+
+				// Collaboration invitations
+				user.GET("/invitations", ListInvitations)
+				user.POST("/invitations/:id/accept", AcceptInvitation)
+				user.DELETE("/invitations/:id", DeclineInvitation)
+
+				// Organizations
+				user.GET("/orgs", ListUserOrganizations)
+			}
+
+			// Organizations
+			orgs := protected.Group("/orgs")
+			{
+				orgs.POST("", RequireScope(auth.ScopeAdmin), CreateOrganization)
+				orgs.DELETE("/:org", RequireScope(auth.ScopeAdmin), DeleteOrganization)
+
+				// Members
+				orgs.GET("/:org/members", RequireScope(auth.ScopeRepoRead), ListOrgMembers)
+				orgs.PUT("/:org/members/:username", RequireScope(auth.ScopeAdmin), SetOrgMember)
+				orgs.DELETE("/:org/members/:username", RequireScope(auth.ScopeAdmin), RemoveOrgMember)
+
+				// Teams
+				orgs.GET("/:org/teams", RequireScope(auth.ScopeRepoRead), ListTeams)
+				orgs.POST("/:org/teams", RequireScope(auth.ScopeAdmin), CreateTeam)
+				orgs.GET("/:org/teams/:team", RequireScope(auth.ScopeRepoRead), GetTeam)
+				orgs.PUT("/:org/teams/:team", RequireScope(auth.ScopeAdmin), UpdateTeam)
+				orgs.DELETE("/:org/teams/:team", RequireScope(auth.ScopeAdmin), DeleteTeam)
+				orgs.GET("/:org/teams/:team/members", RequireScope(auth.ScopeRepoRead), ListTeamMembers)
+				orgs.PUT("/:org/teams/:team/members/:username", RequireScope(auth.ScopeAdmin), AddTeamMember)
+				orgs.DELETE("/:org/teams/:team/members/:username", RequireScope(auth.ScopeAdmin), RemoveTeamMember)
+				orgs.GET("/:org/teams/:team/repos", RequireScope(auth.ScopeRepoRead), ListTeamRepositories)
+				orgs.PUT("/:org/teams/:team/repos/:repo", RequireScope(auth.ScopeAdmin), AddTeamRepository)
+				orgs.DELETE("/:org/teams/:team/repos/:repo", RequireScope(auth.ScopeAdmin), RemoveTeamRepository)
+			}
 
 			// Repositories
 			repos := protected.Group("/repos")
 			{
-				repos.POST("", CreateRepository)
+				repos.POST("", RequireScope(auth.ScopeRepoWrite), CreateRepository)
 				repos.GET("/:owner/:repo", OptionalAuthMiddleware(), GetRepository)
-				repos.DELETE("/:owner/:repo", DeleteRepository)
+				repos.PATCH("/:owner/:repo", RequireScope(auth.ScopeAdmin), UpdateRepository)
+				repos.DELETE("/:owner/:repo", RequireScope(auth.ScopeAdmin), DeleteRepository)
 
 				// Collaborators
-				repos.POST("/:owner/:repo/collaborators", AddCollaborator)
-				repos.DELETE("/:owner/:repo/collaborators/:username", RemoveCollaborator)
+				repos.GET("/:owner/:repo/collaborators", RequireScope(auth.ScopeRepoRead), ListCollaborators)
+				repos.POST("/:owner/:repo/collaborators", RequireScope(auth.ScopeAdmin), AddCollaborator)
+				repos.PUT("/:owner/:repo/collaborators/:username", RequireScope(auth.ScopeAdmin), UpdateCollaborator)
+				repos.DELETE("/:owner/:repo/collaborators/:username", RequireScope(auth.ScopeAdmin), RemoveCollaborator)
+
+				// Deploy keys
+				repos.GET("/:owner/:repo/keys", RequireScope(auth.ScopeAdmin), ListDeployKeys)
+				repos.POST("/:owner/:repo/keys", RequireScope(auth.ScopeAdmin), AddDeployKey)
+				repos.GET("/:owner/:repo/keys/:id", RequireScope(auth.ScopeAdmin), GetDeployKey)
+				repos.DELETE("/:owner/:repo/keys/:id", RequireScope(auth.ScopeAdmin), DeleteDeployKey)
+			}
+
+			// Site administration
+			admin := protected.Group("/admin")
+			admin.Use(RequireSiteAdmin(), RequireScope(auth.ScopeAdmin))
+			{
+				admin.GET("/users/2fa", ListTwoFactorStatus)
 			}
 		}
 
 		// User routes (must come after more specific routes)
 		v1.GET("/users/:username", GetUser)
 		v1.GET("/users/:username/repos", OptionalAuthMiddleware(), ListRepositories)
+		v1.GET("/users/:username/keys", ListUserSSHKeys)
+		v1.GET("/orgs/:org", GetOrganization)
+
+		// Repository browsing and history; ":ref" may contain slashes, so
+		// ref and path share one parameter
+		v1.GET("/repos/:owner/:repo/tree/*path", OptionalAuthMiddleware(), GetTree)
+		v1.GET("/repos/:owner/:repo/contents/*path", OptionalAuthMiddleware(), GetContents)
+		v1.GET("/repos/:owner/:repo/raw/*path", OptionalAuthMiddleware(), GetRaw)
+		v1.GET("/repos/:owner/:repo/blame/*path", OptionalAuthMiddleware(), GetBlame)
+		v1.GET("/repos/:owner/:repo/commits", OptionalAuthMiddleware(), ListCommits)
+		v1.GET("/repos/:owner/:repo/commits/:sha", OptionalAuthMiddleware(), GetCommit)
+		v1.GET("/repos/:owner/:repo/compare/*basehead", OptionalAuthMiddleware(), CompareCommits)
 	}
 
 	// Git HTTP protocol routes
 	git := r.Group("/:owner/:repo")
-	git.Use(OptionalAuthMiddleware())
+	git.Use(GitAuthMiddleware())
 	{
 		git.GET("/info/refs", GitInfoRefs)
 		git.POST("/git-receive-pack", GitReceivePack)
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/zixiao/git-server/internal/auth"
+)
+
+// An access token can create tokens with its own scopes or narrower ones,
+// but not broader ones; a signed-in session can create any
+func TestCreateAccessTokenScopes(t *testing.T) {
+	r := setupTest(t)
+	user := newTestUser(t, "alice")
+	session := newSessionToken(t, user)
+	userScope := newAccessToken(t, user, auth.ScopeUser)
+	userAndAdmin := newAccessToken(t, user, auth.ScopeUser, auth.ScopeAdmin)
+
+	tests := []struct {
+		name   string
+		token  string
+		scopes string
+		want   int
+	}{
+		{"session grants admin", session, `["admin"]`, http.StatusCreated},
+		{"user grants user", userScope, `["user"]`, http.StatusCreated},
+		{"user grants admin", userScope, `["admin"]`, http.StatusForbidden},
+		{"user grants repo:write", userScope, `["repo:write"]`, http.StatusForbidden},
+		{"user grants user and repo:read", userScope, `["user", "repo:read"]`, http.StatusForbidden},
+		{"admin grants implied repo:write", userAndAdmin, `["repo:write"]`, http.StatusCreated},
+		{"admin grants admin and user", userAndAdmin, `["admin", "user"]`, http.StatusCreated},
+		{"unknown scope", userAndAdmin, `["root"]`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"name": "new", "scopes": ` + tt.scopes + `}`
+			w := serve(r, http.MethodPost, "/api/v1/user/tokens", "Bearer "+tt.token, body)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+}
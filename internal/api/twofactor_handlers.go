@@ -0,0 +1,158 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zixiao/git-server/internal/auth"
+)
+
+// TwoFactorCodeRequest carries a TOTP or recovery code
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// GetTwoFactor returns the current user's two-factor status
+func GetTwoFactor(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	status, err := auth.GetTwoFactorStatus(userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"two_factor": status})
+}
+
+// EnrollTwoFactor starts two-factor enrollment for the current user and
+// returns the TOTP secret to add to an authenticator app
+func EnrollTwoFactor(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	user, err := auth.GetUserByID(userID.(int64))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	enrollment, err := auth.EnrollTwoFactor(user)
+	if err != nil {
+		if err == auth.ErrTwoFactorEnabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication already enabled"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enrollment": enrollment})
+}
+
+// ConfirmTwoFactor enables two-factor authentication once the current
+// user proves their authenticator works. The recovery codes are only
+// returned in this response.
+func ConfirmTwoFactor(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := auth.ConfirmTwoFactor(userID.(int64), req.Code)
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTwoFactor turns off two-factor authentication for the current
+// user
+func DisableTwoFactor(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := auth.DisableTwoFactor(userID.(int64), req.Code); err != nil {
+		twoFactorError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes
+func RegenerateRecoveryCodes(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := auth.RegenerateRecoveryCodes(userID.(int64), req.Code)
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// ListTwoFactorStatus lists every user's two-factor status for site
+// admins
+func ListTwoFactorStatus(c *gin.Context) {
+	statuses, err := auth.ListTwoFactorStatus()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": statuses})
+}
+
+// twoFactorError writes the response for an error from a two-factor
+// operation
+func twoFactorError(c *gin.Context, err error) {
+	switch err {
+	case auth.ErrInvalidCode:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid two-factor code"})
+	case auth.ErrTwoFactorNotEnabled:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication not enabled"})
+	case auth.ErrTwoFactorEnabled:
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication already enabled"})
+	case auth.ErrTwoFactorLocked:
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many invalid codes, try again later"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
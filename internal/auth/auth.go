@@ -2,10 +2,13 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/rsa"
 	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -13,6 +16,7 @@ import (
 	"github.com/zixiao/git-server/internal/database"
 	"github.com/zixiao/git-server/internal/models"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -24,13 +28,50 @@ var (
 	ErrUserNotFound = errors.New("user not found")
 	// ErrInvalidToken is returned when a token is invalid or expired
 	ErrInvalidToken = errors.New("invalid token")
+	// ErrInvalidScope is returned for an unknown access token scope
+	ErrInvalidScope = errors.New("invalid scope")
+	// ErrTokenNotFound is returned when an access token cannot be found
+	ErrTokenNotFound = errors.New("access token not found")
+	// ErrKeyNotFound is returned when an SSH key cannot be found
+	ErrKeyNotFound = errors.New("ssh key not found")
+	// ErrKeyExists is returned when an SSH key is already registered
+	ErrKeyExists = errors.New("ssh key already exists")
+	// ErrInvalidKey is returned for a public key that cannot be parsed or
+	// is too weak to accept
+	ErrInvalidKey = errors.New("invalid ssh key")
 )
 
+// minRSAKeyBits is the smallest RSA modulus accepted for SSH keys
+const minRSAKeyBits = 2048
+
+// Access token scopes
+const (
+	// ScopeRepoRead allows cloning, fetching and reading repositories
+	ScopeRepoRead = "repo:read"
+	// ScopeRepoWrite allows pushing and creating repositories; implies
+	// repo:read
+	ScopeRepoWrite = "repo:write"
+	// ScopeAdmin allows administering repositories, such as deleting them
+	// or managing collaborators; implies repo:write
+	ScopeAdmin = "admin"
+	// ScopeUser allows reading the account and managing its tokens
+	ScopeUser = "user"
+)
+
+// impliedScopes lists the scopes each scope grants besides itself
+var impliedScopes = map[string][]string{
+	ScopeRepoRead:  nil,
+	ScopeRepoWrite: {ScopeRepoRead},
+	ScopeAdmin:     {ScopeRepoWrite, ScopeRepoRead},
+	ScopeUser:      nil,
+}
+
 // JWTClaims represents JWT token claims
 type JWTClaims struct {
-	UserID   int64  `json:"user_id"`
-	Username string `json:"username"`
-	IsAdmin  bool   `json:"is_admin"`
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	IsAdmin   bool   `json:"is_admin"`
+	SessionID int64  `json:"sid"`
 	jwt.RegisteredClaims
 }
 
@@ -46,15 +87,17 @@ func VerifyPassword(password, hash string) bool {
 	return err == nil
 }
 
-// GenerateToken generates a JWT token for a user
-func GenerateToken(user *models.User) (string, error) {
+// GenerateToken generates a short-lived JWT access token for a user's
+// session
+func GenerateToken(user *models.User, sessionID int64) (string, error) {
 	cfg := config.GlobalConfig
-	expirationTime := time.Now().Add(time.Duration(cfg.Security.JWTExpiration) * time.Hour)
+	expirationTime := time.Now().Add(accessTokenLifetime())
 
 	claims := &JWTClaims{
-		UserID:   user.ID,
-		Username: user.Username,
-		IsAdmin:  user.IsAdmin,
+		UserID:    user.ID,
+		Username:  user.Username,
+		IsAdmin:   user.IsAdmin,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -129,52 +172,73 @@ func Register(username, email, password, fullName string) (*models.User, error)
 		FullName:  fullName,
 		IsAdmin:   false,
 		IsActive:  true,
+		Type:      models.UserTypeUser,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}, nil
 }
 
-// Login authenticates a user and returns a token
-func Login(username, password string) (string, *models.User, error) {
+// Authenticate checks a username and password against an active account
+func Authenticate(username, password string) (*models.User, error) {
 	var user models.User
 	err := database.DB.QueryRow(`
-		SELECT id, username, email, password, full_name, is_admin, is_active, created_at, updated_at
-		FROM users WHERE username = ? AND is_active = 1
-	`, username).Scan(&user.ID, &user.Username, &user.Email, &user.Password,
-		&user.FullName, &user.IsAdmin, &user.IsActive, &user.CreatedAt, &user.UpdatedAt)
+		SELECT id, username, email, password, full_name, is_admin, is_active, type, created_at, updated_at
+		FROM users WHERE username = ? AND is_active = 1 AND type = ?
+	`, username, models.UserTypeUser).Scan(&user.ID, &user.Username, &user.Email, &user.Password,
+		&user.FullName, &user.IsAdmin, &user.IsActive, &user.Type, &user.CreatedAt, &user.UpdatedAt)
 
 	if err == sql.ErrNoRows {
-		return "", nil, ErrInvalidCredentials
+		return nil, ErrInvalidCredentials
 	}
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to query user: %w", err)
+		return nil, fmt.Errorf("failed to query user: %w", err)
 	}
 
 	// Verify password
 	if !VerifyPassword(password, user.Password) {
-		return "", nil, ErrInvalidCredentials
+		return nil, ErrInvalidCredentials
 	}
 
-	// Generate token
-	token, err := GenerateToken(&user)
+	// Don't return password hash
+	user.Password = ""
+
+	return &user, nil
+}
+
+// Login authenticates a user and starts a session for the client. For an
+// account with two-factor authentication it starts no session and returns
+// the user with ErrTwoFactorRequired; the login is finished by
+// CompleteLogin.
+func Login(username, password, userAgent, ipAddress string) (*TokenPair, *models.User, error) {
+	user, err := Authenticate(username, password)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+		return nil, nil, err
 	}
 
-	// Don't return password hash
-	user.Password = ""
+	enabled, err := TwoFactorEnabled(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enabled {
+		return nil, user, ErrTwoFactorRequired
+	}
 
-	return token, &user, nil
+	tokens, err := CreateSession(user, userAgent, ipAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tokens, user, nil
 }
 
 // GetUserByID retrieves a user by ID
 func GetUserByID(userID int64) (*models.User, error) {
 	var user models.User
 	err := database.DB.QueryRow(`
-		SELECT id, username, email, full_name, is_admin, is_active, created_at, updated_at
+		SELECT id, username, email, full_name, is_admin, is_active, type, created_at, updated_at
 		FROM users WHERE id = ?
 	`, userID).Scan(&user.ID, &user.Username, &user.Email, &user.FullName,
-		&user.IsAdmin, &user.IsActive, &user.CreatedAt, &user.UpdatedAt)
+		&user.IsAdmin, &user.IsActive, &user.Type, &user.CreatedAt, &user.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrUserNotFound
@@ -190,10 +254,10 @@ func GetUserByID(userID int64) (*models.User, error) {
 func GetUserByUsername(username string) (*models.User, error) {
 	var user models.User
 	err := database.DB.QueryRow(`
-		SELECT id, username, email, full_name, is_admin, is_active, created_at, updated_at
+		SELECT id, username, email, full_name, is_admin, is_active, type, created_at, updated_at
 		FROM users WHERE username = ?
 	`, username).Scan(&user.ID, &user.Username, &user.Email, &user.FullName,
-		&user.IsAdmin, &user.IsActive, &user.CreatedAt, &user.UpdatedAt)
+		&user.IsAdmin, &user.IsActive, &user.Type, &user.CreatedAt, &user.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrUserNotFound
@@ -214,8 +278,48 @@ func GenerateAccessToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes), nil
 }
 
-// CreateAccessToken creates a new access token for a user
-func CreateAccessToken(userID int64, name string, expiresAt *time.Time) (*models.AccessToken, error) {
+// NormalizeScopes checks scopes against the known ones and returns them
+// sorted without duplicates
+func NormalizeScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, scope := range scopes {
+		if _, ok := impliedScopes[scope]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// HasScope reports whether a token with the given scopes may act with the
+// required scope, directly or through a broader one
+func HasScope(scopes []string, required string) bool {
+	for _, scope := range scopes {
+		if scope == required {
+			return true
+		}
+		for _, implied := range impliedScopes[scope] {
+			if implied == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CreateAccessToken creates a new access token for a user. The token value
+// is only ever returned here.
+func CreateAccessToken(userID int64, name string, scopes []string, expiresAt *time.Time) (*models.AccessToken, error) {
+	scopes, err := NormalizeScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+
 	token, err := GenerateAccessToken()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token: %w", err)
@@ -227,9 +331,9 @@ func CreateAccessToken(userID int64, name string, expiresAt *time.Time) (*models
 	}
 
 	result, err := database.DB.Exec(`
-		INSERT INTO access_tokens (user_id, token, name, expires_at)
-		VALUES (?, ?, ?, ?)
-	`, userID, token, name, expiresAtSQL)
+		INSERT INTO access_tokens (user_id, token, name, scopes, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, userID, token, name, strings.Join(scopes, ","), expiresAtSQL)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create access token: %w", err)
@@ -240,42 +344,276 @@ func CreateAccessToken(userID int64, name string, expiresAt *time.Time) (*models
 		return nil, fmt.Errorf("failed to get token ID: %w", err)
 	}
 
-	accessToken := &models.AccessToken{
+	return &models.AccessToken{
 		ID:        tokenID,
 		UserID:    userID,
 		Token:     token,
 		Name:      name,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
 		CreatedAt: time.Now(),
+	}, nil
+}
+
+// ListAccessTokens lists a user's access tokens, without their values
+func ListAccessTokens(userID int64) ([]*models.AccessToken, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, user_id, name, scopes, expires_at, last_used_at, created_at
+		FROM access_tokens WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query access tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []*models.AccessToken{}
+	for rows.Next() {
+		var token models.AccessToken
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&token.ID, &token.UserID, &token.Name, &scopes,
+			&expiresAt, &lastUsedAt, &token.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan access token: %w", err)
+		}
+		token.Scopes = splitScopes(scopes)
+		token.ExpiresAt = nullTimePtr(expiresAt)
+		token.LastUsedAt = nullTimePtr(lastUsedAt)
+		tokens = append(tokens, &token)
 	}
 
-	if expiresAt != nil {
-		accessToken.ExpiresAt = *expiresAt
+	return tokens, rows.Err()
+}
+
+// DeleteAccessToken revokes one of a user's access tokens
+func DeleteAccessToken(userID, tokenID int64) error {
+	result, err := database.DB.Exec(`
+		DELETE FROM access_tokens WHERE id = ? AND user_id = ?
+	`, tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete access token: %w", err)
 	}
 
-	return accessToken, nil
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete access token: %w", err)
+	}
+	if affected == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
 }
 
-// ValidateAccessToken validates an access token and returns the user
-func ValidateAccessToken(token string) (*models.User, error) {
-	var accessToken models.AccessToken
+// ValidateAccessToken validates an access token and returns its user and
+// scopes, recording that it was used
+func ValidateAccessToken(token string) (*models.User, []string, error) {
+	var tokenID, userID int64
+	var scopes string
+	var expiresAt sql.NullTime
 	err := database.DB.QueryRow(`
-		SELECT id, user_id, token, name, expires_at, created_at
+		SELECT id, user_id, scopes, expires_at
 		FROM access_tokens WHERE token = ?
-	`, token).Scan(&accessToken.ID, &accessToken.UserID, &accessToken.Token,
-		&accessToken.Name, &accessToken.ExpiresAt, &accessToken.CreatedAt)
+	`, token).Scan(&tokenID, &userID, &scopes, &expiresAt)
 
 	if err == sql.ErrNoRows {
-		return nil, ErrInvalidToken
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query access token: %w", err)
+	}
+
+	// Check if token is expired; tokens without an expiry never expire
+	if expiresAt.Valid && expiresAt.Time.Before(time.Now()) {
+		return nil, nil, ErrInvalidToken
 	}
+
+	// Get user; tokens of disabled accounts stop working
+	user, err := GetUserByID(userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query access token: %w", err)
+		return nil, nil, err
+	}
+	if !user.IsActive {
+		return nil, nil, ErrInvalidToken
 	}
 
-	// Check if token is expired
-	if !accessToken.ExpiresAt.IsZero() && accessToken.ExpiresAt.Before(time.Now()) {
-		return nil, ErrInvalidToken
+	if _, err := database.DB.Exec(`
+		UPDATE access_tokens SET last_used_at = ? WHERE id = ?
+	`, time.Now(), tokenID); err != nil {
+		return nil, nil, fmt.Errorf("failed to update access token: %w", err)
 	}
 
-	// Get user
-	return GetUserByID(accessToken.UserID)
+	return user, splitScopes(scopes), nil
+}
+
+// splitScopes parses the stored form of a token's scopes
+func splitScopes(scopes string) []string {
+	if scopes == "" {
+		return []string{}
+	}
+	return strings.Split(scopes, ",")
+}
+
+// nullTimePtr converts a nullable time column to a pointer
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// GetUserBySSHKey returns the user an SSH public key belongs to, looked up
+// by its SHA256 fingerprint. Keys of disabled accounts are not accepted.
+func GetUserBySSHKey(fingerprint string) (*models.User, error) {
+	var userID int64
+	err := database.DB.QueryRow(`
+		SELECT user_id FROM ssh_keys WHERE fingerprint = ?
+	`, fingerprint).Scan(&userID)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ssh key: %w", err)
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		return nil, ErrKeyNotFound
+	}
+	return user, nil
+}
+
+// ParseSSHKey parses a public key in authorized_keys format and checks that
+// it is strong enough to accept. It returns the key without its comment
+// and its SHA256 fingerprint.
+func ParseSSHKey(authorizedKey string) (string, string, error) {
+	key, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return "", "", fmt.Errorf("%w: only one key may be added at a time", ErrInvalidKey)
+	}
+
+	switch key.Type() {
+	case ssh.KeyAlgoDSA:
+		return "", "", fmt.Errorf("%w: DSA keys are not supported", ErrInvalidKey)
+	case ssh.KeyAlgoRSA:
+		cryptoKey, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return "", "", ErrInvalidKey
+		}
+		rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok || rsaKey.N.BitLen() < minRSAKeyBits {
+			return "", "", fmt.Errorf("%w: RSA keys must be at least %d bits", ErrInvalidKey, minRSAKeyBits)
+		}
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoED25519, ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+	default:
+		return "", "", fmt.Errorf("%w: unsupported key type %s", ErrInvalidKey, key.Type())
+	}
+
+	normalized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	return normalized, ssh.FingerprintSHA256(key), nil
+}
+
+// SSHKeyInUse reports whether a key is registered, either to a user or as
+// a repository deploy key. SSH logins are matched by fingerprint, so a key
+// may only be registered once.
+func SSHKeyInUse(fingerprint string) (bool, error) {
+	var count int
+	err := database.DB.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM ssh_keys WHERE fingerprint = ?) +
+		       (SELECT COUNT(*) FROM deploy_keys WHERE fingerprint = ?)
+	`, fingerprint, fingerprint).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to query ssh keys: %w", err)
+	}
+	return count > 0, nil
+}
+
+// AddSSHKey validates a public key and registers it to a user. A key can
+// belong to only one account or deploy key.
+func AddSSHKey(userID int64, title, authorizedKey string) (*models.SSHKey, error) {
+	key, fingerprint, err := ParseSSHKey(authorizedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse, err := SSHKeyInUse(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if inUse {
+		return nil, ErrKeyExists
+	}
+
+	result, err := database.DB.Exec(`
+		INSERT INTO ssh_keys (user_id, title, key, fingerprint)
+		VALUES (?, ?, ?, ?)
+	`, userID, title, key, fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add ssh key: %w", err)
+	}
+
+	keyID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ssh key ID: %w", err)
+	}
+
+	return &models.SSHKey{
+		ID:          keyID,
+		UserID:      userID,
+		Title:       title,
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+// ListSSHKeys lists a user's SSH keys
+func ListSSHKeys(userID int64) ([]*models.SSHKey, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, user_id, title, key, fingerprint, created_at
+		FROM ssh_keys WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ssh keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []*models.SSHKey{}
+	for rows.Next() {
+		var key models.SSHKey
+		if err := rows.Scan(&key.ID, &key.UserID, &key.Title, &key.Key,
+			&key.Fingerprint, &key.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan ssh key: %w", err)
+		}
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+// DeleteSSHKey removes one of a user's SSH keys
+func DeleteSSHKey(userID, keyID int64) error {
+	result, err := database.DB.Exec(`
+		DELETE FROM ssh_keys WHERE id = ? AND user_id = ?
+	`, keyID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete ssh key: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete ssh key: %w", err)
+	}
+	if affected == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
 }
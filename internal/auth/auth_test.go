@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/internal/database"
+	"github.com/zixiao/git-server/internal/models"
+)
+
+// setupTest points the database package at a new SQLite database and
+// sets the configuration the package reads
+func setupTest(t *testing.T) {
+	t.Helper()
+	saved := config.GlobalConfig
+	config.GlobalConfig = &config.Config{Security: config.SecurityConfig{
+		JWTSecret:              "test-secret",
+		AccessTokenExpiration:  15,
+		RefreshTokenExpiration: 720,
+	}}
+	t.Cleanup(func() { config.GlobalConfig = saved })
+
+	err := database.Init(database.Config{
+		Type: "sqlite3",
+		Path: filepath.Join(t.TempDir(), "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+}
+
+// mustExec runs a statement the test depends on
+func mustExec(t *testing.T, query string, args ...any) {
+	t.Helper()
+	if _, err := database.DB.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestUser registers a user with the password "password"
+func newTestUser(t *testing.T, name string) *models.User {
+	t.Helper()
+	user, err := Register(name, name+"@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/internal/database"
+	"github.com/zixiao/git-server/internal/models"
+)
+
+// ErrSessionNotFound is returned when a session cannot be found
+var ErrSessionNotFound = errors.New("session not found")
+
+// maxUserAgentLength bounds the stored User-Agent of a session
+const maxUserAgentLength = 255
+
+// TokenPair is the credentials handed to a client when a session starts or
+// is refreshed. The access token is a short-lived JWT; the refresh token
+// is single-use and replaced on every refresh.
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // access token lifetime in seconds
+}
+
+// accessTokenLifetime is how long a JWT access token is valid
+func accessTokenLifetime() time.Duration {
+	return time.Duration(config.GlobalConfig.Security.AccessTokenExpiration) * time.Minute
+}
+
+// refreshTokenLifetime is how long a session lasts without being refreshed
+func refreshTokenLifetime() time.Duration {
+	return time.Duration(config.GlobalConfig.Security.RefreshTokenExpiration) * time.Hour
+}
+
+// hashToken returns the stored form of a refresh token or recovery code.
+// Only hashes are stored, so a leaked database does not leak credentials.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a session for a user and returns its first tokens
+func CreateSession(user *models.User, userAgent, ipAddress string) (*TokenPair, error) {
+	refreshToken, err := GenerateAccessToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	// Expired sessions are pruned as the user signs in again
+	database.DB.Exec(`
+		DELETE FROM sessions WHERE user_id = ? AND expires_at < ?
+	`, user.ID, time.Now())
+
+	result, err := database.DB.Exec(`
+		INSERT INTO sessions (user_id, refresh_token, user_agent, ip_address, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, user.ID, hashToken(refreshToken), userAgent, ipAddress,
+		time.Now().Add(refreshTokenLifetime()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	sessionID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session ID: %w", err)
+	}
+
+	return issueTokens(user, sessionID, refreshToken)
+}
+
+// issueTokens signs an access token for a session and pairs it with the
+// session's current refresh token
+func issueTokens(user *models.User, sessionID int64, refreshToken string) (*TokenPair, error) {
+	accessToken, err := GenerateToken(user, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenLifetime().Seconds()),
+	}, nil
+}
+
+// RefreshSession exchanges a refresh token for new tokens, rotating the
+// refresh token. Presenting a refresh token that was already exchanged
+// means it was copied, so the whole session is revoked.
+func RefreshSession(refreshToken, userAgent, ipAddress string) (*TokenPair, *models.User, error) {
+	hash := hashToken(refreshToken)
+
+	var sessionID, userID int64
+	var expiresAt time.Time
+	err := database.DB.QueryRow(`
+		SELECT id, user_id, expires_at FROM sessions WHERE refresh_token = ?
+	`, hash).Scan(&sessionID, &userID, &expiresAt)
+
+	if err == sql.ErrNoRows {
+		if _, err := database.DB.Exec(`
+			DELETE FROM sessions WHERE previous_token = ?
+		`, hash); err != nil {
+			return nil, nil, fmt.Errorf("failed to revoke session: %w", err)
+		}
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query session: %w", err)
+	}
+
+	if expiresAt.Before(time.Now()) {
+		database.DB.Exec("DELETE FROM sessions WHERE id = ?", sessionID)
+		return nil, nil, ErrInvalidToken
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.IsActive {
+		return nil, nil, ErrInvalidToken
+	}
+
+	newToken, err := GenerateAccessToken()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	// Only the holder of the current refresh token wins a concurrent
+	// refresh; the loser sees no row updated
+	result, err := database.DB.Exec(`
+		UPDATE sessions
+		SET refresh_token = ?, previous_token = ?, user_agent = ?, ip_address = ?,
+		    expires_at = ?, last_used_at = ?
+		WHERE id = ? AND refresh_token = ?
+	`, hashToken(newToken), hash, userAgent, ipAddress,
+		time.Now().Add(refreshTokenLifetime()), time.Now(), sessionID, hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to update session: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to update session: %w", err)
+	}
+	if affected == 0 {
+		return nil, nil, ErrInvalidToken
+	}
+
+	tokens, err := issueTokens(user, sessionID, newToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, user, nil
+}
+
+// ValidateSession checks that the session of a JWT access token is still
+// live and its user still active, and returns the user
+func ValidateSession(claims *JWTClaims) (*models.User, error) {
+	var userID int64
+	var expiresAt time.Time
+	err := database.DB.QueryRow(`
+		SELECT user_id, expires_at FROM sessions WHERE id = ?
+	`, claims.SessionID).Scan(&userID, &expiresAt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session: %w", err)
+	}
+	if userID != claims.UserID || expiresAt.Before(time.Now()) {
+		return nil, ErrInvalidToken
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		return nil, ErrInvalidToken
+	}
+
+	return user, nil
+}
+
+// ListSessions lists a user's live sessions
+func ListSessions(userID int64) ([]*models.Session, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, user_id, user_agent, ip_address, expires_at, last_used_at, created_at
+		FROM sessions WHERE user_id = ? AND expires_at > ?
+		ORDER BY created_at DESC, id DESC
+	`, userID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []*models.Session{}
+	for rows.Next() {
+		var session models.Session
+		var userAgent, ipAddress sql.NullString
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&session.ID, &session.UserID, &userAgent, &ipAddress,
+			&session.ExpiresAt, &lastUsedAt, &session.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		session.UserAgent = userAgent.String
+		session.IPAddress = ipAddress.String
+		session.LastUsedAt = nullTimePtr(lastUsedAt)
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends one of a user's sessions. Its refresh token stops
+// working at once, and so do its access tokens.
+func RevokeSession(userID, sessionID int64) error {
+	result, err := database.DB.Exec(`
+		DELETE FROM sessions WHERE id = ? AND user_id = ?
+	`, sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	if affected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
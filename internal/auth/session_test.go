@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zixiao/git-server/internal/database"
+)
+
+func TestRefreshSession(t *testing.T) {
+	setupTest(t)
+
+	tests := []struct {
+		name string
+		// present returns the refresh token to exchange, given the
+		// session's first tokens
+		present func(t *testing.T, first *TokenPair) string
+		wantErr error
+		// live is whether the session survives the exchange
+		live bool
+	}{
+		{
+			name:    "current token",
+			present: func(t *testing.T, first *TokenPair) string { return first.RefreshToken },
+			live:    true,
+		},
+		{
+			name:    "unknown token",
+			present: func(t *testing.T, first *TokenPair) string { return "not-a-token" },
+			wantErr: ErrInvalidToken,
+			live:    true,
+		},
+		{
+			name: "token already exchanged",
+			present: func(t *testing.T, first *TokenPair) string {
+				if _, _, err := RefreshSession(first.RefreshToken, "", ""); err != nil {
+					t.Fatal(err)
+				}
+				return first.RefreshToken
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "expired session",
+			present: func(t *testing.T, first *TokenPair) string {
+				mustExec(t, `UPDATE sessions SET expires_at = ?`, time.Now().Add(-time.Minute))
+				return first.RefreshToken
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "deactivated user",
+			present: func(t *testing.T, first *TokenPair) string {
+				mustExec(t, `UPDATE users SET is_active = ?`, false)
+				return first.RefreshToken
+			},
+			wantErr: ErrInvalidToken,
+			live:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mustExec(t, `DELETE FROM sessions`)
+			mustExec(t, `DELETE FROM users`)
+			user := newTestUser(t, "alice")
+			first, err := CreateSession(user, "test", "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := ValidateToken(first.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tokens, _, err := RefreshSession(tt.present(t, first), "test", "127.0.0.1")
+			if err != tt.wantErr {
+				t.Fatalf("RefreshSession error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if tokens.RefreshToken == first.RefreshToken {
+					t.Error("refresh token was not rotated")
+				}
+				refreshed, err := ValidateToken(tokens.AccessToken)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if refreshed.SessionID != claims.SessionID || refreshed.UserID != user.ID {
+					t.Errorf("new access token is for session %d of user %d, want %d of %d",
+						refreshed.SessionID, refreshed.UserID, claims.SessionID, user.ID)
+				}
+			}
+
+			var sessions int
+			database.DB.QueryRow(`SELECT COUNT(*) FROM sessions WHERE id = ?`, claims.SessionID).Scan(&sessions)
+			if live := sessions == 1; live != tt.live {
+				t.Errorf("session live = %v, want %v", live, tt.live)
+			}
+		})
+	}
+}
+
+// Reusing an exchanged refresh token revokes the session it belonged to,
+// including the tokens that replaced it, and no other session
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	setupTest(t)
+	user := newTestUser(t, "alice")
+
+	stolen, err := CreateSession(user, "laptop", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := CreateSession(user, "phone", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _, err := RefreshSession(stolen.RefreshToken, "laptop", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateToken(current.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateSession(claims); err != nil {
+		t.Fatalf("ValidateSession before reuse: %v", err)
+	}
+
+	if _, _, err := RefreshSession(stolen.RefreshToken, "attacker", ""); err != ErrInvalidToken {
+		t.Fatalf("reusing a refresh token: error = %v, want ErrInvalidToken", err)
+	}
+	if _, _, err := RefreshSession(current.RefreshToken, "laptop", ""); err != ErrInvalidToken {
+		t.Errorf("refreshing a revoked session: error = %v, want ErrInvalidToken", err)
+	}
+	if _, err := ValidateSession(claims); err != ErrInvalidToken {
+		t.Errorf("ValidateSession of a revoked session: error = %v, want ErrInvalidToken", err)
+	}
+	if _, _, err := RefreshSession(other.RefreshToken, "phone", ""); err != nil {
+		t.Errorf("refreshing another session: %v", err)
+	}
+}
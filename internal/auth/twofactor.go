@@ -0,0 +1,456 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/internal/database"
+	"github.com/zixiao/git-server/internal/models"
+)
+
+var (
+	// ErrTwoFactorRequired is returned by Login when the password was
+	// right but the account needs a second factor
+	ErrTwoFactorRequired = errors.New("two-factor code required")
+	// ErrTwoFactorEnabled is returned when enrolling an account that
+	// already has two-factor authentication
+	ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+	// ErrTwoFactorNotEnabled is returned when an account has no
+	// two-factor authentication, or has not confirmed its enrollment
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication not enabled")
+	// ErrInvalidCode is returned for a wrong, reused or expired TOTP or
+	// recovery code
+	ErrInvalidCode = errors.New("invalid two-factor code")
+	// ErrTwoFactorLocked is returned while code checks are suspended after
+	// too many wrong codes
+	ErrTwoFactorLocked = errors.New("too many invalid two-factor codes")
+)
+
+// TOTP parameters (RFC 6238), the defaults every authenticator app
+// supports
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many periods either side of now are accepted, to
+	// allow for clock drift
+	totpSkew = 1
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes are issued at a time
+	recoveryCodeCount = 10
+	// maxCodeAttempts is how many wrong codes in a row suspend checks
+	maxCodeAttempts = 5
+	// codeLockout is how long checks stay suspended
+	codeLockout = 5 * time.Minute
+	// pendingLoginLifetime is how long a client has to enter its code
+	// after giving the right password
+	pendingLoginLifetime = 5 * time.Minute
+	// pendingLoginAudience marks the JWTs that stand for a half-finished
+	// login, so they cannot be used as access tokens
+	pendingLoginAudience = "two-factor"
+)
+
+// Enrollment is a TOTP secret waiting for its first code
+type Enrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauth_url"`
+}
+
+// totpCode computes the TOTP code of a secret for a time step
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the time step at which code is valid for the secret,
+// looking totpSkew steps either side of now, or 0 if it matches none
+func matchTOTP(secret, code string, now time.Time) uint64 {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+
+	current := uint64(now.Unix()) / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// generateRecoveryCode returns a random recovery code such as
+// "3f9a1-c07e2"
+func generateRecoveryCode() (string, error) {
+	bytes := make([]byte, 5)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(bytes)
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeCode strips the spaces and dashes people type into codes
+func normalizeCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// EnrollTwoFactor generates a TOTP secret for a user. Two-factor
+// authentication is enabled once a code from it is confirmed with
+// ConfirmTwoFactor; enrolling again replaces an unconfirmed secret.
+func EnrollTwoFactor(user *models.User) (*Enrollment, error) {
+	enabled, err := TwoFactorEnabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+
+	if _, err := database.DB.Exec(`
+		DELETE FROM two_factor WHERE user_id = ?
+	`, user.ID); err != nil {
+		return nil, fmt.Errorf("failed to reset two-factor enrollment: %w", err)
+	}
+	if _, err := database.DB.Exec(`
+		INSERT INTO two_factor (user_id, secret, enabled) VALUES (?, ?, ?)
+	`, user.ID, secret, false); err != nil {
+		return nil, fmt.Errorf("failed to save two-factor secret: %w", err)
+	}
+
+	issuer := "ZiXiao Git Server"
+	label := url.PathEscape(issuer + ":" + user.Username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("period", fmt.Sprint(totpPeriod))
+	params.Set("digits", fmt.Sprint(totpDigits))
+
+	return &Enrollment{
+		Secret:     secret,
+		OTPAuthURL: "otpauth://totp/" + label + "?" + params.Encode(),
+	}, nil
+}
+
+// ConfirmTwoFactor enables two-factor authentication for a user who
+// enrolled, given a current code, and returns their recovery codes
+func ConfirmTwoFactor(userID int64, code string) ([]string, error) {
+	var secret string
+	var enabled bool
+	err := database.DB.QueryRow(`
+		SELECT secret, enabled FROM two_factor WHERE user_id = ?
+	`, userID).Scan(&secret, &enabled)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query two-factor settings: %w", err)
+	}
+	if enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	step := matchTOTP(secret, normalizeCode(code), time.Now())
+	if step == 0 {
+		return nil, ErrInvalidCode
+	}
+
+	if _, err := database.DB.Exec(`
+		UPDATE two_factor SET enabled = ?, last_counter = ? WHERE user_id = ?
+	`, true, step, userID); err != nil {
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %w", err)
+	}
+
+	return replaceRecoveryCodes(userID)
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user after
+// checking a current TOTP or recovery code
+func DisableTwoFactor(userID int64, code string) error {
+	if err := VerifyTwoFactor(userID, code); err != nil {
+		return err
+	}
+
+	if _, err := database.DB.Exec(`
+		DELETE FROM recovery_codes WHERE user_id = ?
+	`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	if _, err := database.DB.Exec(`
+		DELETE FROM two_factor WHERE user_id = ?
+	`, userID); err != nil {
+		return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes after checking
+// a current TOTP or recovery code
+func RegenerateRecoveryCodes(userID int64, code string) ([]string, error) {
+	if err := VerifyTwoFactor(userID, code); err != nil {
+		return nil, err
+	}
+	return replaceRecoveryCodes(userID)
+}
+
+// replaceRecoveryCodes issues a fresh set of recovery codes, invalidating
+// the old ones. Only hashes are stored.
+func replaceRecoveryCodes(userID int64) ([]string, error) {
+	if _, err := database.DB.Exec(`
+		DELETE FROM recovery_codes WHERE user_id = ?
+	`, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		if _, err := database.DB.Exec(`
+			INSERT INTO recovery_codes (user_id, code) VALUES (?, ?)
+		`, userID, hashToken(normalizeCode(code))); err != nil {
+			return nil, fmt.Errorf("failed to save recovery code: %w", err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// VerifyTwoFactor checks a TOTP code, or a recovery code, which is used
+// up, for a user with two-factor authentication enabled. A TOTP code is
+// accepted only once. After maxCodeAttempts wrong codes in a row, checks
+// fail with ErrTwoFactorLocked for codeLockout.
+func VerifyTwoFactor(userID int64, code string) error {
+	var secret string
+	var enabled bool
+	var lastCounter uint64
+	var failedAttempts int
+	var lastFailedAt sql.NullTime
+	err := database.DB.QueryRow(`
+		SELECT secret, enabled, last_counter, failed_attempts, last_failed_at
+		FROM two_factor WHERE user_id = ?
+	`, userID).Scan(&secret, &enabled, &lastCounter, &failedAttempts, &lastFailedAt)
+
+	if err == sql.ErrNoRows || (err == nil && !enabled) {
+		return ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query two-factor settings: %w", err)
+	}
+
+	if failedAttempts >= maxCodeAttempts && lastFailedAt.Valid &&
+		time.Since(lastFailedAt.Time) < codeLockout {
+		return ErrTwoFactorLocked
+	}
+
+	code = normalizeCode(code)
+	if step := matchTOTP(secret, code, time.Now()); step > lastCounter {
+		// Advancing last_counter only if it is still behind makes a
+		// concurrent replay of the same code fail
+		result, err := database.DB.Exec(`
+			UPDATE two_factor SET last_counter = ?, failed_attempts = 0
+			WHERE user_id = ? AND last_counter < ?
+		`, step, userID, step)
+		if err != nil {
+			return fmt.Errorf("failed to update two-factor settings: %w", err)
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+			return nil
+		}
+	} else if step == 0 {
+		result, err := database.DB.Exec(`
+			DELETE FROM recovery_codes WHERE user_id = ? AND code = ?
+		`, userID, hashToken(code))
+		if err != nil {
+			return fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+			database.DB.Exec(`
+				UPDATE two_factor SET failed_attempts = 0 WHERE user_id = ?
+			`, userID)
+			return nil
+		}
+	}
+
+	if failedAttempts >= maxCodeAttempts {
+		// The lockout has passed; start counting again
+		failedAttempts = 0
+	}
+	database.DB.Exec(`
+		UPDATE two_factor SET failed_attempts = ?, last_failed_at = ? WHERE user_id = ?
+	`, failedAttempts+1, time.Now(), userID)
+	return ErrInvalidCode
+}
+
+// TwoFactorEnabled reports whether a user has confirmed two-factor
+// authentication
+func TwoFactorEnabled(userID int64) (bool, error) {
+	var enabled bool
+	err := database.DB.QueryRow(`
+		SELECT enabled FROM two_factor WHERE user_id = ?
+	`, userID).Scan(&enabled)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query two-factor settings: %w", err)
+	}
+	return enabled, nil
+}
+
+// GetTwoFactorStatus returns a user's two-factor status
+func GetTwoFactorStatus(userID int64) (*models.TwoFactorStatus, error) {
+	enabled, err := TwoFactorEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &models.TwoFactorStatus{Enabled: enabled}
+	if enabled {
+		err := database.DB.QueryRow(`
+			SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?
+		`, userID).Scan(&status.RecoveryCodesRemaining)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count recovery codes: %w", err)
+		}
+	}
+	return status, nil
+}
+
+// ListTwoFactorStatus lists every user account with its two-factor status
+// for site admins
+func ListTwoFactorStatus() ([]*models.TwoFactorStatus, error) {
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.username, u.email, u.full_name, u.is_admin, u.is_active, u.type,
+		       u.created_at, u.updated_at, t.enabled,
+		       (SELECT COUNT(*) FROM recovery_codes c WHERE c.user_id = u.id)
+		FROM users u
+		LEFT JOIN two_factor t ON t.user_id = u.id
+		WHERE u.type = ?
+		ORDER BY u.username
+	`, models.UserTypeUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	statuses := []*models.TwoFactorStatus{}
+	for rows.Next() {
+		status := models.TwoFactorStatus{User: &models.User{}}
+		user := status.User
+		var fullName sql.NullString
+		var enabled sql.NullBool
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &fullName,
+			&user.IsAdmin, &user.IsActive, &user.Type, &user.CreatedAt,
+			&user.UpdatedAt, &enabled, &status.RecoveryCodesRemaining); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		user.FullName = fullName.String
+		status.Enabled = enabled.Valid && enabled.Bool
+		statuses = append(statuses, &status)
+	}
+
+	return statuses, rows.Err()
+}
+
+// pendingLoginClaims identify a user who gave the right password and has
+// yet to give a two-factor code
+type pendingLoginClaims struct {
+	UserID int64 `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+// GeneratePendingLogin signs the token a client exchanges, together with
+// a two-factor code, for a session
+func GeneratePendingLogin(user *models.User) (string, error) {
+	claims := &pendingLoginClaims{
+		UserID: user.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(pendingLoginLifetime)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "zixiao-git-server",
+			Audience:  jwt.ClaimStrings{pendingLoginAudience},
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(config.GlobalConfig.Security.JWTSecret))
+}
+
+// CompleteLogin finishes a login that needed a second factor: given a
+// token from GeneratePendingLogin and a TOTP or recovery code, it starts a
+// session for the client
+func CompleteLogin(pendingToken, code, userAgent, ipAddress string) (*TokenPair, *models.User, error) {
+	token, err := jwt.ParseWithClaims(pendingToken, &pendingLoginClaims{},
+		func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return []byte(config.GlobalConfig.Security.JWTSecret), nil
+		}, jwt.WithAudience(pendingLoginAudience))
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+	claims, ok := token.Claims.(*pendingLoginClaims)
+	if !ok || !token.Valid {
+		return nil, nil, ErrInvalidToken
+	}
+
+	user, err := GetUserByID(claims.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.IsActive {
+		return nil, nil, ErrInvalidToken
+	}
+
+	if err := VerifyTwoFactor(user.ID, code); err != nil {
+		return nil, nil, err
+	}
+
+	tokens, err := CreateSession(user, userAgent, ipAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, user, nil
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// codeAt returns the TOTP code of an enrolled secret for a time step
+func codeAt(t *testing.T, secret string, step uint64) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, step)
+}
+
+// The SHA-1 test vectors of RFC 6238, whose eight digit codes end in the
+// six digit ones
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, uint64(tt.unix/totpPeriod)); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1234567890, 0)
+	current := uint64(now.Unix()) / totpPeriod
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		want   uint64
+	}{
+		{"current step", secret, codeAt(t, secret, current), current},
+		{"previous step", secret, codeAt(t, secret, current-1), current - 1},
+		{"next step", secret, codeAt(t, secret, current+1), current + 1},
+		{"two steps behind", secret, codeAt(t, secret, current-2), 0},
+		{"two steps ahead", secret, codeAt(t, secret, current+2), 0},
+		{"short code", secret, codeAt(t, secret, current)[1:], 0},
+		{"long code", secret, codeAt(t, secret, current) + "0", 0},
+		{"invalid secret", "not base32!", codeAt(t, secret, current), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchTOTP(tt.secret, tt.code, now); got != tt.want {
+				t.Errorf("matchTOTP = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTwoFactor(t *testing.T) {
+	setupTest(t)
+	user := newTestUser(t, "alice")
+
+	if err := VerifyTwoFactor(user.ID, "123456"); err != ErrTwoFactorNotEnabled {
+		t.Fatalf("VerifyTwoFactor before enrolling: error = %v, want ErrTwoFactorNotEnabled", err)
+	}
+	enrollment, err := EnrollTwoFactor(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyTwoFactor(user.ID, "123456"); err != ErrTwoFactorNotEnabled {
+		t.Fatalf("VerifyTwoFactor before confirming: error = %v, want ErrTwoFactorNotEnabled", err)
+	}
+	secret := enrollment.Secret
+
+	// Every code below stays inside the accepted window for a full period
+	// after confirming
+	confirmed := uint64(time.Now().Unix()) / totpPeriod
+	if _, err := ConfirmTwoFactor(user.ID, codeAt(t, secret, confirmed-1)+"0"); err != ErrInvalidCode {
+		t.Fatalf("ConfirmTwoFactor with a wrong code: error = %v, want ErrInvalidCode", err)
+	}
+	recovery, err := ConfirmTwoFactor(user.ID, codeAt(t, secret, confirmed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recovery), recoveryCodeCount)
+	}
+	if _, err := EnrollTwoFactor(user); err != ErrTwoFactorEnabled {
+		t.Fatalf("enrolling again: error = %v, want ErrTwoFactorEnabled", err)
+	}
+
+	// The checks run in order, each seeing what the ones before it used
+	steps := []struct {
+		name string
+		code string
+		want error
+	}{
+		{"code used to confirm", codeAt(t, secret, confirmed), ErrInvalidCode},
+		{"code of an earlier step", codeAt(t, secret, confirmed-1), ErrInvalidCode},
+		{"code of the next step", codeAt(t, secret, confirmed+1), nil},
+		{"same code again", codeAt(t, secret, confirmed+1), ErrInvalidCode},
+		{"code older than the last used", codeAt(t, secret, confirmed), ErrInvalidCode},
+		{"recovery code as typed", " " + strings.ToUpper(recovery[0]) + " ", nil},
+		{"same recovery code again", recovery[0], ErrInvalidCode},
+		{"recovery code without dash", strings.ReplaceAll(recovery[1], "-", ""), nil},
+		{"wrong code", "abcdef", ErrInvalidCode},
+	}
+	for _, tt := range steps {
+		if err := VerifyTwoFactor(user.ID, tt.code); err != tt.want {
+			t.Errorf("%s: VerifyTwoFactor error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyTwoFactorLockout(t *testing.T) {
+	setupTest(t)
+	user := newTestUser(t, "alice")
+	enrollment, err := EnrollTwoFactor(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := uint64(time.Now().Unix()) / totpPeriod
+	recovery, err := ConfirmTwoFactor(user.ID, codeAt(t, enrollment.Secret, step))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A right code resets the count of wrong ones
+	for i := 0; i < maxCodeAttempts-1; i++ {
+		if err := VerifyTwoFactor(user.ID, "abcdef"); err != ErrInvalidCode {
+			t.Fatalf("wrong code %d: error = %v, want ErrInvalidCode", i+1, err)
+		}
+	}
+	if err := VerifyTwoFactor(user.ID, recovery[0]); err != nil {
+		t.Fatalf("recovery code before the limit: %v", err)
+	}
+
+	for i := 0; i < maxCodeAttempts; i++ {
+		if err := VerifyTwoFactor(user.ID, "abcdef"); err != ErrInvalidCode {
+			t.Fatalf("wrong code %d: error = %v, want ErrInvalidCode", i+1, err)
+		}
+	}
+	if err := VerifyTwoFactor(user.ID, codeAt(t, enrollment.Secret, step+1)); err != ErrTwoFactorLocked {
+		t.Fatalf("right code while locked: error = %v, want ErrTwoFactorLocked", err)
+	}
+	if err := VerifyTwoFactor(user.ID, recovery[1]); err != ErrTwoFactorLocked {
+		t.Fatalf("recovery code while locked: error = %v, want ErrTwoFactorLocked", err)
+	}
+
+	mustExec(t, `UPDATE two_factor SET last_failed_at = ?`, time.Now().Add(-codeLockout))
+	if err := VerifyTwoFactor(user.ID, codeAt(t, enrollment.Secret, step+1)); err != nil {
+		t.Errorf("right code after the lockout: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"log"
 	"os"
 
 	"gopkg.in/yaml.v3"
@@ -40,15 +41,24 @@ type GitConfig struct {
 	MaxRepoSize  int64    `yaml:"max_repo_size"` // in MB
 	MaxFileSize  int64    `yaml:"max_file_size"` // in MB
 	AllowedTypes []string `yaml:"allowed_types"` // file extensions
+	// MaxContentSize is the largest file the contents API returns inline,
+	// in MB; larger files are only served raw
+	MaxContentSize int64 `yaml:"max_content_size"`
 }
 
 // SecurityConfig holds security-related configuration
 type SecurityConfig struct {
-	JWTSecret     string `yaml:"jwt_secret"`
-	JWTExpiration int    `yaml:"jwt_expiration"` // in hours
-	PasswordMin   int    `yaml:"password_min"`
-	EnableSSH     bool   `yaml:"enable_ssh"`
-	SSHPort       int    `yaml:"ssh_port"`
+	JWTSecret              string `yaml:"jwt_secret"`
+	AccessTokenExpiration  int    `yaml:"access_token_expiration"`  // in minutes
+	RefreshTokenExpiration int    `yaml:"refresh_token_expiration"` // in hours
+	PasswordMin            int    `yaml:"password_min"`
+	EnableSSH              bool   `yaml:"enable_ssh"`
+	SSHPort                int    `yaml:"ssh_port"`
+	SSHHostKey             string `yaml:"ssh_host_key"` // generated if missing
+	// JWTExpiration is the deprecated jwt_expiration, in hours, from before
+	// sessions existed. Load moves it to RefreshTokenExpiration when that
+	// is not set, so sessions last as long as the old tokens did.
+	JWTExpiration int `yaml:"jwt_expiration,omitempty"`
 }
 
 // GlobalConfig is the application-wide configuration instance
@@ -66,6 +76,14 @@ func Load(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if cfg.Security.JWTExpiration != 0 {
+		log.Printf("Warning: security.jwt_expiration is deprecated; use access_token_expiration (minutes) and refresh_token_expiration (hours)")
+		if cfg.Security.RefreshTokenExpiration == 0 {
+			cfg.Security.RefreshTokenExpiration = cfg.Security.JWTExpiration
+		}
+		cfg.Security.JWTExpiration = 0
+	}
+
 	// Set defaults
 	if cfg.Server.Host == "" {
 		cfg.Server.Host = "0.0.0.0"
@@ -91,8 +109,14 @@ func Load(configPath string) (*Config, error) {
 	if cfg.Git.MaxFileSize == 0 {
 		cfg.Git.MaxFileSize = 100 // 100MB default
 	}
-	if cfg.Security.JWTExpiration == 0 {
-		cfg.Security.JWTExpiration = 24 // 24 hours
+	if cfg.Git.MaxContentSize == 0 {
+		cfg.Git.MaxContentSize = 1 // 1MB default
+	}
+	if cfg.Security.AccessTokenExpiration == 0 {
+		cfg.Security.AccessTokenExpiration = 15 // 15 minutes
+	}
+	if cfg.Security.RefreshTokenExpiration == 0 {
+		cfg.Security.RefreshTokenExpiration = 720 // 30 days
 	}
 	if cfg.Security.PasswordMin == 0 {
 		cfg.Security.PasswordMin = 8
@@ -100,6 +124,9 @@ func Load(configPath string) (*Config, error) {
 	if cfg.Security.SSHPort == 0 {
 		cfg.Security.SSHPort = 2222
 	}
+	if cfg.Security.SSHHostKey == "" {
+		cfg.Security.SSHHostKey = "./data/ssh_host_ed25519_key"
+	}
 
 	GlobalConfig = &cfg
 	return &cfg, nil
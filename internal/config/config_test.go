@@ -0,0 +1,52 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTokenExpiration(t *testing.T) {
+	tests := []struct {
+		name        string
+		security    string
+		wantAccess  int
+		wantRefresh int
+	}{
+		{"defaults", "", 15, 720},
+		{"new keys", "access_token_expiration: 5\n  refresh_token_expiration: 48\n", 5, 48},
+		{"deprecated jwt_expiration", "jwt_expiration: 24\n", 15, 24},
+		{"refresh_token_expiration over jwt_expiration", "jwt_expiration: 24\n  refresh_token_expiration: 48\n", 15, 48},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte("security:\n  "+tt.security), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg.Security.AccessTokenExpiration; got != tt.wantAccess {
+				t.Errorf("AccessTokenExpiration = %d, want %d", got, tt.wantAccess)
+			}
+			if got := cfg.Security.RefreshTokenExpiration; got != tt.wantRefresh {
+				t.Errorf("RefreshTokenExpiration = %d, want %d", got, tt.wantRefresh)
+			}
+
+			// A saved configuration carries the value under the new key only
+			if err := cfg.Save(path); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(data), "jwt_expiration") {
+				t.Errorf("saved configuration sets jwt_expiration:\n%s", data)
+			}
+		})
+	}
+}
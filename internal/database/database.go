@@ -83,8 +83,77 @@ func Close() error {
 // createTables creates all necessary database tables
 func createTables(dbType string) error {
 	schema := getSchema(dbType)
-	_, err := DB.Exec(schema)
-	return err
+	if _, err := DB.Exec(schema); err != nil {
+		return err
+	}
+	return addColumns(dbType)
+}
+
+// column is a column added to a table after it was first released; tables
+// created by an older version get it on startup
+type column struct {
+	table      string
+	name       string
+	definition map[string]string // by database type; "" is the default
+}
+
+var addedColumns = []column{
+	// Accounts created before organizations existed are all users
+	{"users", "type", map[string]string{
+		"":          "TEXT NOT NULL DEFAULT 'user'",
+		"postgres":  "VARCHAR(50) NOT NULL DEFAULT 'user'",
+		"sqlserver": "NVARCHAR(50) NOT NULL DEFAULT 'user'",
+	}},
+	{"access_tokens", "scopes", map[string]string{
+		"":          "TEXT NOT NULL DEFAULT ''",
+		"postgres":  "VARCHAR(255) NOT NULL DEFAULT ''",
+		"sqlserver": "NVARCHAR(255) NOT NULL DEFAULT ''",
+	}},
+	{"access_tokens", "last_used_at", map[string]string{
+		"":         "DATETIME",
+		"postgres": "TIMESTAMP",
+	}},
+	// Collaborations that existed before invitations count as accepted
+	{"collaborations", "pending", map[string]string{
+		"":          "BOOLEAN NOT NULL DEFAULT 0",
+		"postgres":  "BOOLEAN NOT NULL DEFAULT FALSE",
+		"sqlserver": "BIT NOT NULL DEFAULT 0",
+	}},
+	{"repositories", "require_two_factor", map[string]string{
+		"":          "BOOLEAN NOT NULL DEFAULT 0",
+		"postgres":  "BOOLEAN NOT NULL DEFAULT FALSE",
+		"sqlserver": "BIT NOT NULL DEFAULT 0",
+	}},
+}
+
+// addColumns adds any columns in addedColumns that a table lacks
+func addColumns(dbType string) error {
+	if dbType == "mssql" {
+		dbType = "sqlserver"
+	}
+
+	for _, col := range addedColumns {
+		// Selecting the column fails only if it is missing
+		probe := fmt.Sprintf("SELECT %s FROM %s WHERE 1 = 0", col.name, col.table)
+		if rows, err := DB.Query(probe); err == nil {
+			rows.Close()
+			continue
+		}
+
+		definition, ok := col.definition[dbType]
+		if !ok {
+			definition = col.definition[""]
+		}
+		keyword := "ADD COLUMN"
+		if dbType == "sqlserver" {
+			keyword = "ADD"
+		}
+		stmt := fmt.Sprintf("ALTER TABLE %s %s %s %s", col.table, keyword, col.name, definition)
+		if _, err := DB.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", col.table, col.name, err)
+		}
+	}
+	return nil
 }
 
 // getSchema returns the appropriate schema for the database type
@@ -110,6 +179,7 @@ func getSQLiteSchema() string {
 		full_name TEXT,
 		is_admin BOOLEAN DEFAULT 0,
 		is_active BOOLEAN DEFAULT 1,
+		type TEXT NOT NULL DEFAULT 'user',
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
@@ -121,6 +191,7 @@ func getSQLiteSchema() string {
 		owner_id INTEGER NOT NULL,
 		is_private BOOLEAN DEFAULT 0,
 		default_branch TEXT DEFAULT 'main',
+		require_two_factor BOOLEAN NOT NULL DEFAULT 0,
 		size INTEGER DEFAULT 0,
 		stars INTEGER DEFAULT 0,
 		forks INTEGER DEFAULT 0,
@@ -140,23 +211,112 @@ func getSQLiteSchema() string {
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 	);
 
+	CREATE TABLE IF NOT EXISTS deploy_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		repository_id INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL UNIQUE,
+		read_only BOOLEAN DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (repository_id) REFERENCES repositories(id) ON DELETE CASCADE
+	);
+
 	CREATE TABLE IF NOT EXISTS collaborations (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		repository_id INTEGER NOT NULL,
 		user_id INTEGER NOT NULL,
 		permission TEXT NOT NULL DEFAULT 'read',
+		pending BOOLEAN NOT NULL DEFAULT 0,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (repository_id) REFERENCES repositories(id) ON DELETE CASCADE,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
 		UNIQUE(repository_id, user_id)
 	);
 
+	CREATE TABLE IF NOT EXISTS org_members (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL DEFAULT 'member',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (org_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(org_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS teams (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		description TEXT,
+		permission TEXT NOT NULL DEFAULT 'read',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (org_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(org_id, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS team_members (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		team_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(team_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS team_repositories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		team_id INTEGER NOT NULL,
+		repository_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+		FOREIGN KEY (repository_id) REFERENCES repositories(id) ON DELETE CASCADE,
+		UNIQUE(team_id, repository_id)
+	);
+
 	CREATE TABLE IF NOT EXISTS access_tokens (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id INTEGER NOT NULL,
 		token TEXT NOT NULL UNIQUE,
 		name TEXT NOT NULL,
+		scopes TEXT NOT NULL DEFAULT '',
 		expires_at DATETIME,
+		last_used_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		refresh_token TEXT NOT NULL UNIQUE,
+		previous_token TEXT,
+		user_agent TEXT,
+		ip_address TEXT,
+		expires_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS two_factor (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL UNIQUE,
+		secret TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT 0,
+		last_counter INTEGER NOT NULL DEFAULT 0,
+		failed_attempts INTEGER NOT NULL DEFAULT 0,
+		last_failed_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code TEXT NOT NULL,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 	);
@@ -175,8 +335,14 @@ func getSQLiteSchema() string {
 
 	CREATE INDEX IF NOT EXISTS idx_repositories_owner ON repositories(owner_id);
 	CREATE INDEX IF NOT EXISTS idx_ssh_keys_user ON ssh_keys(user_id);
+	CREATE INDEX IF NOT EXISTS idx_deploy_keys_repo ON deploy_keys(repository_id);
 	CREATE INDEX IF NOT EXISTS idx_collaborations_repo ON collaborations(repository_id);
 	CREATE INDEX IF NOT EXISTS idx_collaborations_user ON collaborations(user_id);
+	CREATE INDEX IF NOT EXISTS idx_org_members_user ON org_members(user_id);
+	CREATE INDEX IF NOT EXISTS idx_team_members_user ON team_members(user_id);
+	CREATE INDEX IF NOT EXISTS idx_team_repositories_repo ON team_repositories(repository_id);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+	CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);
 	CREATE INDEX IF NOT EXISTS idx_activities_user ON activities(user_id);
 	CREATE INDEX IF NOT EXISTS idx_activities_repo ON activities(repository_id);
 	`
@@ -193,6 +359,7 @@ func getPostgreSQLSchema() string {
 		full_name VARCHAR(255),
 		is_admin BOOLEAN DEFAULT FALSE,
 		is_active BOOLEAN DEFAULT TRUE,
+		type VARCHAR(50) NOT NULL DEFAULT 'user',
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
@@ -204,6 +371,7 @@ func getPostgreSQLSchema() string {
 		owner_id INTEGER NOT NULL,
 		is_private BOOLEAN DEFAULT FALSE,
 		default_branch VARCHAR(255) DEFAULT 'main',
+		require_two_factor BOOLEAN NOT NULL DEFAULT FALSE,
 		size BIGINT DEFAULT 0,
 		stars INTEGER DEFAULT 0,
 		forks INTEGER DEFAULT 0,
@@ -223,23 +391,112 @@ func getPostgreSQLSchema() string {
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 	);
 
+	CREATE TABLE IF NOT EXISTS deploy_keys (
+		id SERIAL PRIMARY KEY,
+		repository_id INTEGER NOT NULL,
+		title VARCHAR(255) NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint VARCHAR(255) NOT NULL UNIQUE,
+		read_only BOOLEAN DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (repository_id) REFERENCES repositories(id) ON DELETE CASCADE
+	);
+
 	CREATE TABLE IF NOT EXISTS collaborations (
 		id SERIAL PRIMARY KEY,
 		repository_id INTEGER NOT NULL,
 		user_id INTEGER NOT NULL,
 		permission VARCHAR(50) NOT NULL DEFAULT 'read',
+		pending BOOLEAN NOT NULL DEFAULT FALSE,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (repository_id) REFERENCES repositories(id) ON DELETE CASCADE,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
 		UNIQUE(repository_id, user_id)
 	);
 
+	CREATE TABLE IF NOT EXISTS org_members (
+		id SERIAL PRIMARY KEY,
+		org_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role VARCHAR(50) NOT NULL DEFAULT 'member',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (org_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(org_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS teams (
+		id SERIAL PRIMARY KEY,
+		org_id INTEGER NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		description TEXT,
+		permission VARCHAR(50) NOT NULL DEFAULT 'read',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (org_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(org_id, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS team_members (
+		id SERIAL PRIMARY KEY,
+		team_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(team_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS team_repositories (
+		id SERIAL PRIMARY KEY,
+		team_id INTEGER NOT NULL,
+		repository_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+		FOREIGN KEY (repository_id) REFERENCES repositories(id) ON DELETE CASCADE,
+		UNIQUE(team_id, repository_id)
+	);
+
 	CREATE TABLE IF NOT EXISTS access_tokens (
 		id SERIAL PRIMARY KEY,
 		user_id INTEGER NOT NULL,
 		token VARCHAR(255) NOT NULL UNIQUE,
 		name VARCHAR(255) NOT NULL,
+		scopes VARCHAR(255) NOT NULL DEFAULT '',
 		expires_at TIMESTAMP,
+		last_used_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		refresh_token VARCHAR(64) NOT NULL UNIQUE,
+		previous_token VARCHAR(64),
+		user_agent VARCHAR(255),
+		ip_address VARCHAR(64),
+		expires_at TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS two_factor (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL UNIQUE,
+		secret VARCHAR(64) NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		last_counter BIGINT NOT NULL DEFAULT 0,
+		failed_attempts INTEGER NOT NULL DEFAULT 0,
+		last_failed_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		code VARCHAR(64) NOT NULL,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 	);
@@ -258,8 +515,14 @@ func getPostgreSQLSchema() string {
 
 	CREATE INDEX IF NOT EXISTS idx_repositories_owner ON repositories(owner_id);
 	CREATE INDEX IF NOT EXISTS idx_ssh_keys_user ON ssh_keys(user_id);
+	CREATE INDEX IF NOT EXISTS idx_deploy_keys_repo ON deploy_keys(repository_id);
 	CREATE INDEX IF NOT EXISTS idx_collaborations_repo ON collaborations(repository_id);
 	CREATE INDEX IF NOT EXISTS idx_collaborations_user ON collaborations(user_id);
+	CREATE INDEX IF NOT EXISTS idx_org_members_user ON org_members(user_id);
+	CREATE INDEX IF NOT EXISTS idx_team_members_user ON team_members(user_id);
+	CREATE INDEX IF NOT EXISTS idx_team_repositories_repo ON team_repositories(repository_id);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+	CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);
 	CREATE INDEX IF NOT EXISTS idx_activities_user ON activities(user_id);
 	CREATE INDEX IF NOT EXISTS idx_activities_repo ON activities(repository_id);
 	`
@@ -277,6 +540,7 @@ func getSQLServerSchema() string {
 		full_name NVARCHAR(255),
 		is_admin BIT DEFAULT 0,
 		is_active BIT DEFAULT 1,
+		type NVARCHAR(50) NOT NULL DEFAULT 'user',
 		created_at DATETIME DEFAULT GETDATE(),
 		updated_at DATETIME DEFAULT GETDATE()
 	);
@@ -289,6 +553,7 @@ func getSQLServerSchema() string {
 		owner_id INT NOT NULL,
 		is_private BIT DEFAULT 0,
 		default_branch NVARCHAR(255) DEFAULT 'main',
+		require_two_factor BIT NOT NULL DEFAULT 0,
 		size BIGINT DEFAULT 0,
 		stars INT DEFAULT 0,
 		forks INT DEFAULT 0,
@@ -309,25 +574,122 @@ func getSQLServerSchema() string {
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 	);
 
+	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'deploy_keys')
+	CREATE TABLE deploy_keys (
+		id INT IDENTITY(1,1) PRIMARY KEY,
+		repository_id INT NOT NULL,
+		title NVARCHAR(255) NOT NULL,
+		[key] NVARCHAR(MAX) NOT NULL,
+		fingerprint NVARCHAR(255) NOT NULL UNIQUE,
+		read_only BIT DEFAULT 1,
+		created_at DATETIME DEFAULT GETDATE(),
+		FOREIGN KEY (repository_id) REFERENCES repositories(id) ON DELETE CASCADE
+	);
+
 	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'collaborations')
 	CREATE TABLE collaborations (
 		id INT IDENTITY(1,1) PRIMARY KEY,
 		repository_id INT NOT NULL,
 		user_id INT NOT NULL,
 		permission NVARCHAR(50) NOT NULL DEFAULT 'read',
+		pending BIT NOT NULL DEFAULT 0,
 		created_at DATETIME DEFAULT GETDATE(),
 		FOREIGN KEY (repository_id) REFERENCES repositories(id) ON DELETE CASCADE,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
 		UNIQUE(repository_id, user_id)
 	);
 
+	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'org_members')
+	CREATE TABLE org_members (
+		id INT IDENTITY(1,1) PRIMARY KEY,
+		org_id INT NOT NULL,
+		user_id INT NOT NULL,
+		role NVARCHAR(50) NOT NULL DEFAULT 'member',
+		created_at DATETIME DEFAULT GETDATE(),
+		FOREIGN KEY (org_id) REFERENCES users(id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		UNIQUE(org_id, user_id)
+	);
+
+	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'teams')
+	CREATE TABLE teams (
+		id INT IDENTITY(1,1) PRIMARY KEY,
+		org_id INT NOT NULL,
+		name NVARCHAR(255) NOT NULL,
+		description NVARCHAR(MAX),
+		permission NVARCHAR(50) NOT NULL DEFAULT 'read',
+		created_at DATETIME DEFAULT GETDATE(),
+		FOREIGN KEY (org_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(org_id, name)
+	);
+
+	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'team_members')
+	CREATE TABLE team_members (
+		id INT IDENTITY(1,1) PRIMARY KEY,
+		team_id INT NOT NULL,
+		user_id INT NOT NULL,
+		created_at DATETIME DEFAULT GETDATE(),
+		FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		UNIQUE(team_id, user_id)
+	);
+
+	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'team_repositories')
+	CREATE TABLE team_repositories (
+		id INT IDENTITY(1,1) PRIMARY KEY,
+		team_id INT NOT NULL,
+		repository_id INT NOT NULL,
+		created_at DATETIME DEFAULT GETDATE(),
+		FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+		FOREIGN KEY (repository_id) REFERENCES repositories(id),
+		UNIQUE(team_id, repository_id)
+	);
+
 	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'access_tokens')
 	CREATE TABLE access_tokens (
 		id INT IDENTITY(1,1) PRIMARY KEY,
 		user_id INT NOT NULL,
 		token NVARCHAR(255) NOT NULL UNIQUE,
 		name NVARCHAR(255) NOT NULL,
+		scopes NVARCHAR(255) NOT NULL DEFAULT '',
 		expires_at DATETIME,
+		last_used_at DATETIME,
+		created_at DATETIME DEFAULT GETDATE(),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'sessions')
+	CREATE TABLE sessions (
+		id INT IDENTITY(1,1) PRIMARY KEY,
+		user_id INT NOT NULL,
+		refresh_token NVARCHAR(64) NOT NULL UNIQUE,
+		previous_token NVARCHAR(64),
+		user_agent NVARCHAR(255),
+		ip_address NVARCHAR(64),
+		expires_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		created_at DATETIME DEFAULT GETDATE(),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'two_factor')
+	CREATE TABLE two_factor (
+		id INT IDENTITY(1,1) PRIMARY KEY,
+		user_id INT NOT NULL UNIQUE,
+		secret NVARCHAR(64) NOT NULL,
+		enabled BIT NOT NULL DEFAULT 0,
+		last_counter BIGINT NOT NULL DEFAULT 0,
+		failed_attempts INT NOT NULL DEFAULT 0,
+		last_failed_at DATETIME,
+		created_at DATETIME DEFAULT GETDATE(),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	IF NOT EXISTS (SELECT * FROM sys.tables WHERE name = 'recovery_codes')
+	CREATE TABLE recovery_codes (
+		id INT IDENTITY(1,1) PRIMARY KEY,
+		user_id INT NOT NULL,
+		code NVARCHAR(64) NOT NULL,
 		created_at DATETIME DEFAULT GETDATE(),
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 	);
@@ -351,12 +713,30 @@ func getSQLServerSchema() string {
 	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_ssh_keys_user')
 	CREATE INDEX idx_ssh_keys_user ON ssh_keys(user_id);
 
+	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_deploy_keys_repo')
+	CREATE INDEX idx_deploy_keys_repo ON deploy_keys(repository_id);
+
 	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_collaborations_repo')
 	CREATE INDEX idx_collaborations_repo ON collaborations(repository_id);
 
 	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_collaborations_user')
 	CREATE INDEX idx_collaborations_user ON collaborations(user_id);
 
+	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_org_members_user')
+	CREATE INDEX idx_org_members_user ON org_members(user_id);
+
+	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_team_members_user')
+	CREATE INDEX idx_team_members_user ON team_members(user_id);
+
+	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_team_repositories_repo')
+	CREATE INDEX idx_team_repositories_repo ON team_repositories(repository_id);
+
+	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_sessions_user')
+	CREATE INDEX idx_sessions_user ON sessions(user_id);
+
+	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_recovery_codes_user')
+	CREATE INDEX idx_recovery_codes_user ON recovery_codes(user_id);
+
 	IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_activities_user')
 	CREATE INDEX idx_activities_user ON activities(user_id);
 
@@ -0,0 +1,188 @@
+package gitservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+// ReceivePack applies a push: the pack is unpacked into quarantine, every
+// ref update is checked and passed to the pre-receive hook, and only then
+// do the objects and refs change. The report goes to w, on the data band
+// when the client uses side-band.
+func ReceivePack(ctx context.Context, gitRepo *gitcore.Repository, req *gitcore.PushRequest, pack io.Reader, w io.Writer) error {
+	band := sideBandFor(w, req.HasCapability)
+
+	// Unpack objects into quarantine; delete-only pushes carry no pack
+	var unpackErr error
+	if pack != nil {
+		var count int
+		unpackErr = gitRepo.BeginQuarantine()
+		if unpackErr == nil {
+			defer gitRepo.AbortQuarantine()
+			count, unpackErr = gitRepo.ReceivePackStream(pack)
+		}
+		if band != nil {
+			if unpackErr != nil {
+				band.Message("error: unpacking objects failed: %v\n", unpackErr)
+			} else {
+				band.Progress("Unpacking objects: %d, done.\n", count)
+			}
+		}
+	}
+
+	// Every update is checked, and every new tip must be complete, before
+	// any ref moves; an atomic push goes ahead only if all of them pass
+	head, _ := gitRepo.GetHead()
+	atomic := req.HasCapability("atomic")
+	rejected := make([]string, len(req.Commands))
+	for i, cmd := range req.Commands {
+		if unpackErr != nil {
+			rejected[i] = "unpacker error"
+		} else if err := checkRefCommand(gitRepo, cmd, head); err != nil {
+			rejected[i] = err.Error()
+		}
+	}
+	if atomic && anyRejected(rejected) {
+		rejectRemaining(rejected, "atomic push failure")
+	}
+
+	// pre-receive sees the quarantined objects and can turn the push down
+	hookOut := io.Discard
+	if band != nil {
+		hookOut = band.MessageWriter()
+	}
+	if pending := commandsLeft(req.Commands, rejected); len(pending) > 0 {
+		err := gitRepo.RunHook(ctx, "pre-receive", gitcore.HookRefLines(pending),
+			gitRepo.HookEnv(req.Options), hookOut)
+		if err != nil {
+			rejectRemaining(rejected, err.Error())
+		}
+	}
+
+	// Only now do the quarantined objects join the object store
+	if len(commandsLeft(req.Commands, rejected)) > 0 {
+		if err := gitRepo.MigrateQuarantine(); err != nil {
+			rejectRemaining(rejected, err.Error())
+		}
+	}
+
+	if atomic {
+		if pending := commandsLeft(req.Commands, rejected); len(pending) > 0 {
+			updates := make([]gitcore.RefCommand, len(pending))
+			for i, cmd := range pending {
+				updates[i] = cmd
+				updates[i].RefName = strings.TrimPrefix(cmd.RefName, "refs/")
+			}
+
+			var txErr *gitcore.TransactionError
+			if err := gitRepo.UpdateRefs(updates); errors.As(err, &txErr) {
+				for i, cmd := range req.Commands {
+					if cmd.RefName == "refs/"+txErr.RefName {
+						rejected[i] = txErr.Err.Error()
+					}
+				}
+				rejectRemaining(rejected, "atomic push failure")
+			}
+		}
+	} else {
+		for i, cmd := range req.Commands {
+			if rejected[i] != "" {
+				continue
+			}
+			if err := gitRepo.UpdateRef(strings.TrimPrefix(cmd.RefName, "refs/"), cmd.OldSHA, cmd.NewSHA); err != nil {
+				rejected[i] = err.Error()
+			}
+		}
+	}
+
+	var report bytes.Buffer
+	if unpackErr != nil {
+		report.WriteString(gitcore.PktLine("unpack " + unpackErr.Error() + "\n"))
+	} else {
+		report.WriteString(gitcore.PktLine("unpack ok\n"))
+	}
+	for i, cmd := range req.Commands {
+		if rejected[i] != "" {
+			if band != nil && unpackErr == nil {
+				band.Message("error: refusing to update %s: %s\n", cmd.RefName, rejected[i])
+			}
+			report.WriteString(gitcore.PktLine("ng " + cmd.RefName + " " + rejected[i] + "\n"))
+			continue
+		}
+		report.WriteString(gitcore.PktLine("ok " + cmd.RefName + "\n"))
+	}
+	report.WriteString(gitcore.FlushPkt())
+
+	// The report travels on the data band when side-band is in use;
+	// clients that did not ask for report-status get none
+	var err error
+	if req.HasCapability("report-status") {
+		if band != nil {
+			_, err = band.Write(report.Bytes())
+		} else {
+			_, err = w.Write(report.Bytes())
+		}
+	}
+
+	// post-receive runs once the refs have moved; it cannot undo the push
+	if updated := commandsLeft(req.Commands, rejected); len(updated) > 0 {
+		gitRepo.RunHook(ctx, "post-receive", gitcore.HookRefLines(updated),
+			gitRepo.HookEnv(req.Options), hookOut)
+	}
+	if band != nil && err == nil {
+		err = band.Flush()
+	}
+	return err
+}
+
+// checkRefCommand validates a single pushed ref update before anything is
+// written
+func checkRefCommand(gitRepo *gitcore.Repository, cmd gitcore.RefCommand, head string) error {
+	if !gitcore.IsValidRefName(cmd.RefName) {
+		return errors.New("funny refname")
+	}
+
+	if cmd.NewSHA == gitcore.ZeroSHA {
+		if cmd.RefName == head {
+			return errors.New("deletion of the current branch prohibited")
+		}
+	} else if !gitRepo.CheckConnectivity(cmd.NewSHA) {
+		return errors.New("missing necessary objects")
+	}
+	return nil
+}
+
+// commandsLeft returns the commands that have not been rejected
+func commandsLeft(commands []gitcore.RefCommand, rejected []string) []gitcore.RefCommand {
+	var left []gitcore.RefCommand
+	for i, cmd := range commands {
+		if rejected[i] == "" {
+			left = append(left, cmd)
+		}
+	}
+	return left
+}
+
+// anyRejected reports whether any command has been rejected
+func anyRejected(rejected []string) bool {
+	for _, reason := range rejected {
+		if reason != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectRemaining rejects every command not rejected yet with reason
+func rejectRemaining(rejected []string, reason string) {
+	for i := range rejected {
+		if rejected[i] == "" {
+			rejected[i] = reason
+		}
+	}
+}
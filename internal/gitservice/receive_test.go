@@ -0,0 +1,125 @@
+package gitservice
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+func TestReceivePack(t *testing.T) {
+	history := openTestHistory(t)
+	const (
+		c7 = "fb07918b66faa0cd49e41274cf49197405e61e1c"
+		c8 = "e997d77ebd982a63b8279fce2eae0d2fec6f8545"
+	)
+	full, err := history.UploadPack([]string{c8}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// thin holds c8 alone, without the history it builds on
+	thin, err := history.UploadPack([]string{c8}, []string{c7}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		pack []byte
+		// hook is the pre-receive hook, if any
+		hook string
+		// report is the status sent back for refs/heads/main
+		report []string
+		// stored tells whether c8 ends up in the object store
+		stored bool
+	}{
+		{
+			name:   "complete pack",
+			pack:   full,
+			report: []string{"unpack ok\n", "ok refs/heads/main\n"},
+			stored: true,
+		},
+		{
+			name:   "missing objects",
+			pack:   thin,
+			report: []string{"unpack ok\n", "ng refs/heads/main missing necessary objects\n"},
+		},
+		{
+			name:   "truncated pack",
+			pack:   full[:len(full)/2],
+			report: []string{"unpack failed to index pack\n", "ng refs/heads/main unpacker error\n"},
+		},
+		{
+			name:   "declined by pre-receive",
+			pack:   full,
+			hook:   "#!/bin/sh\necho declined\nexit 1\n",
+			report: []string{"unpack ok\n", "ng refs/heads/main pre-receive hook declined\n"},
+		},
+		{
+			// The hook reads the pushed objects from quarantine, while
+			// the object store does not have them yet
+			name: "quarantined until accepted",
+			pack: full,
+			hook: "#!/bin/sh\nread old new ref\n" +
+				"git cat-file -e \"$new\" || exit 1\n" +
+				"env -u GIT_OBJECT_DIRECTORY -u GIT_ALTERNATE_OBJECT_DIRECTORIES git cat-file -e \"$new\" 2>/dev/null && exit 1\n" +
+				"exit 0\n",
+			report: []string{"unpack ok\n", "ok refs/heads/main\n"},
+			stored: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "push.git")
+			repo := gitcore.NewRepository(path)
+			defer repo.Free()
+			if err := repo.Init(true); err != nil {
+				t.Fatal(err)
+			}
+			if tt.hook != "" {
+				if err := os.MkdirAll(filepath.Join(path, "hooks"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(path, "hooks", "pre-receive"), []byte(tt.hook), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			req := &gitcore.PushRequest{
+				Commands:     []gitcore.RefCommand{{OldSHA: gitcore.ZeroSHA, NewSHA: c8, RefName: "refs/heads/main"}},
+				Capabilities: []string{"report-status"},
+			}
+			var out bytes.Buffer
+			if err := ReceivePack(context.Background(), repo, req, bytes.NewReader(tt.pack), &out); err != nil {
+				t.Fatal(err)
+			}
+
+			var want bytes.Buffer
+			for _, line := range tt.report {
+				want.WriteString(gitcore.PktLine(line))
+			}
+			want.WriteString(gitcore.FlushPkt())
+			if out.String() != want.String() {
+				t.Errorf("report = %q, want %q", out.String(), want.String())
+			}
+
+			if got := repo.HasObject(c8); got != tt.stored {
+				t.Errorf("c8 stored = %v, want %v", got, tt.stored)
+			}
+			if tt.stored {
+				if sha, _ := repo.GetRef("heads/main"); sha != c8 {
+					t.Errorf("heads/main = %q, want %s", sha, c8)
+				}
+			} else if sha, err := repo.GetRef("heads/main"); err == nil {
+				t.Errorf("heads/main created as %s", sha)
+			}
+			incoming, _ := filepath.Glob(filepath.Join(path, "objects", "incoming-*"))
+			if len(incoming) > 0 {
+				t.Errorf("quarantine left behind: %v", incoming)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package gitservice
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+// maxArchiveArgs caps the arguments of an upload-archive request, as git
+// does
+const maxArchiveArgs = 64
+
+// ServeUploadPack runs an upload-pack session over a connection that stays
+// open in both directions, as SSH provides: the ref advertisement, then
+// negotiation rounds that each end with a flush from the client, then the
+// pack. With protocol v2 the client gets the capability advertisement
+// instead and may run any number of commands.
+func ServeUploadPack(ctx context.Context, gitRepo *gitcore.Repository, r io.Reader, w io.Writer, protocolV2 bool) error {
+	in := gitcore.NewPktReader(r)
+	if protocolV2 {
+		return serveUploadPackV2(ctx, gitRepo, in, w)
+	}
+
+	adv, err := AdvertiseRefs(gitRepo, ServiceUploadPack, false)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(adv); err != nil {
+		return err
+	}
+
+	// A flush alone means the client only wanted the refs (ls-remote)
+	section, err := in.ReadSection()
+	if err == io.EOF || (err == nil && gitcore.IsFlushPkt(section)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := gitcore.ParseUploadPack(section)
+	if err != nil {
+		return writeError(w, err)
+	}
+	opts, err := gitRepo.UploadPackOptions(req)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	// A deepening client reads the shallow boundary before sending haves
+	if opts.Deepen() {
+		update, err := gitRepo.ComputeShallow(req.Wants, opts)
+		if err != nil {
+			return writeError(w, err)
+		}
+		if _, err := io.WriteString(w, update.PktLines()+gitcore.FlushPkt()); err != nil {
+			return err
+		}
+	}
+
+	// Haves arrive once each, in rounds ending with a flush, until "done"
+	// or until the server has found enough common history
+	common := []string{}
+	for {
+		round := &gitcore.FetchRequest{Wants: req.Wants, Capabilities: req.Capabilities}
+		for !round.Done {
+			pkt, err := in.ReadPkt()
+			if err != nil {
+				return err
+			}
+			if gitcore.IsFlushPkt(pkt) {
+				break
+			}
+
+			line := gitcore.PktPayload(pkt)
+			switch {
+			case strings.HasPrefix(line, "have "):
+				round.Haves = append(round.Haves, strings.TrimPrefix(line, "have "))
+			case line == "done":
+				round.Done = true
+			default:
+				return writeError(w, fmt.Errorf("expected have or done, got '%s'", line))
+			}
+		}
+
+		neg, err := gitRepo.NegotiateRound(round, common)
+		if err != nil {
+			return writeError(w, err)
+		}
+		common = neg.Common
+		if _, err := w.Write(neg.Response); err != nil {
+			return err
+		}
+		if neg.Ready {
+			break
+		}
+	}
+
+	if band := sideBandFor(w, req.HasCapability); band != nil {
+		return sendPack(ctx, gitRepo, band, req.Wants, common, opts)
+	}
+	return gitRepo.UploadPackTo(ctx, w, req.Wants, common, opts)
+}
+
+// serveUploadPackV2 answers protocol v2 commands until the client ends the
+// session with a flush or by closing the connection
+func serveUploadPackV2(ctx context.Context, gitRepo *gitcore.Repository, in *gitcore.PktReader, w io.Writer) error {
+	adv := gitcore.CreateV2Advertisement(gitcore.ProtocolV2Capabilities)
+	if _, err := w.Write(adv); err != nil {
+		return err
+	}
+
+	for {
+		section, err := in.ReadSection()
+		if err == io.EOF || (err == nil && gitcore.IsFlushPkt(section)) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		cmd, err := gitcore.ParseCommandRequest(section)
+		if err != nil {
+			return writeError(w, err)
+		}
+		if err := UploadPackV2(ctx, gitRepo, cmd, w); err != nil {
+			return err
+		}
+	}
+}
+
+// ServeReceivePack runs a receive-pack session over a connection that stays
+// open in both directions: the ref advertisement, then the push
+func ServeReceivePack(ctx context.Context, gitRepo *gitcore.Repository, r io.Reader, w io.Writer) error {
+	adv, err := AdvertiseRefs(gitRepo, ServiceReceivePack, false)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(adv); err != nil {
+		return err
+	}
+
+	req, pack, err := gitcore.ReadReceivePack(r)
+	if err != nil {
+		return err
+	}
+
+	// A flush alone means there was nothing to push
+	if len(req.Commands) == 0 {
+		return nil
+	}
+	return ReceivePack(ctx, gitRepo, req, pack, w)
+}
+
+// ServeUploadArchive runs an upload-archive session: the client sends the
+// "git archive" arguments, and once they are accepted the archive follows
+// on side-band data
+func ServeUploadArchive(gitRepo *gitcore.Repository, r io.Reader, w io.Writer) error {
+	in := gitcore.NewPktReader(r)
+
+	var args []string
+	for {
+		pkt, err := in.ReadPkt()
+		if err != nil {
+			return err
+		}
+		if gitcore.IsFlushPkt(pkt) {
+			break
+		}
+
+		line := gitcore.PktPayload(pkt)
+		if !strings.HasPrefix(line, "argument ") {
+			return writeNACK(w, fmt.Errorf("expected argument, got '%s'", line))
+		}
+		if len(args) == maxArchiveArgs {
+			return writeNACK(w, fmt.Errorf("too many options (>%d)", maxArchiveArgs))
+		}
+		args = append(args, strings.TrimPrefix(line, "argument "))
+	}
+
+	opts, err := gitcore.ParseArchiveArgs(args)
+	if err != nil {
+		return writeNACK(w, err)
+	}
+	if _, err := io.WriteString(w, gitcore.PktLine("ACK\n")+gitcore.FlushPkt()); err != nil {
+		return err
+	}
+
+	// Archive writers make many small writes; batch them into packets
+	band := gitcore.NewSideBandWriter(w, true)
+	out := bufio.NewWriterSize(band, 64<<10)
+	err = gitRepo.WriteArchive(out, opts)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		band.Fatal("upload-archive: " + err.Error())
+		return err
+	}
+	return band.Flush()
+}
+
+// writeNACK turns an upload-archive request down; the client prints the
+// reason
+func writeNACK(w io.Writer, err error) error {
+	if _, werr := io.WriteString(w, gitcore.PktLine("NACK "+err.Error()+"\n")); werr != nil {
+		return werr
+	}
+	return err
+}
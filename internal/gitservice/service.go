@@ -0,0 +1,74 @@
+// Package gitservice implements the git services (upload-pack,
+// receive-pack and upload-archive) independently of the transport. The
+// smart HTTP handlers use the stateless request functions; SSH uses the
+// Serve functions, which run a whole session over one connection.
+package gitservice
+
+import (
+	"io"
+
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+// Service names, as clients request them
+const (
+	ServiceUploadPack    = "git-upload-pack"
+	ServiceReceivePack   = "git-receive-pack"
+	ServiceUploadArchive = "git-upload-archive"
+)
+
+// Capabilities advertised for each service
+var (
+	UploadPackCapabilities = []string{"multi_ack", "multi_ack_detailed", "no-done",
+		"side-band", "side-band-64k", "no-progress", "shallow", "deepen-since", "deepen-not",
+		"deepen-relative", "filter", "allow-tip-sha1-in-want", "allow-reachable-sha1-in-want"}
+	ReceivePackCapabilities = []string{"report-status", "delete-refs", "ofs-delta",
+		"side-band-64k", "quiet", "atomic", "push-options"}
+)
+
+// AdvertiseRefs creates the ref advertisement for upload-pack or
+// receive-pack. Smart HTTP announces the service ahead of the refs; SSH
+// does not.
+func AdvertiseRefs(gitRepo *gitcore.Repository, service string, announce bool) ([]byte, error) {
+	refsMap, err := gitRepo.RefMap()
+	if err != nil {
+		return nil, err
+	}
+
+	var capabilities []string
+	if service == ServiceUploadPack {
+		capabilities = append(capabilities, UploadPackCapabilities...)
+	} else {
+		capabilities = append(capabilities, ReceivePackCapabilities...)
+	}
+
+	// Advertise HEAD so clones know which branch to check out
+	if head, err := gitRepo.GetHead(); err == nil {
+		if sha, ok := refsMap[head]; ok {
+			refsMap["HEAD"] = sha
+			capabilities = append(capabilities, "symref=HEAD:"+head)
+		}
+	}
+
+	if !announce {
+		service = ""
+	}
+	return gitcore.CreateRefAdvertisement(refsMap, service, capabilities)
+}
+
+// sideBandFor returns a side-band writer over w if the client negotiated
+// side-band or side-band-64k, or nil otherwise
+func sideBandFor(w io.Writer, hasCapability func(string) bool) *gitcore.SideBandWriter {
+	var band *gitcore.SideBandWriter
+	switch {
+	case hasCapability("side-band-64k"):
+		band = gitcore.NewSideBandWriter(w, true)
+	case hasCapability("side-band"):
+		band = gitcore.NewSideBandWriter(w, false)
+	default:
+		return nil
+	}
+
+	band.Quiet = hasCapability("quiet") || hasCapability("no-progress")
+	return band
+}
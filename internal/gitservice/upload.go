@@ -0,0 +1,168 @@
+package gitservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+// UploadPack answers one stateless protocol v0 upload-pack request: the
+// shallow boundary and ACK/NAK lines of the round, followed by the pack
+// once negotiation is done. Request errors reach the client as an ERR
+// packet. Nothing is written to w before the pack starts, so if it fails
+// early the caller can still report the returned error another way.
+func UploadPack(ctx context.Context, gitRepo *gitcore.Repository, req *gitcore.FetchRequest, w io.Writer) error {
+	// Negotiate common history
+	neg, err := gitRepo.Negotiate(req)
+	if err != nil {
+		return writeError(w, err)
+	}
+	opts, err := gitRepo.UploadPackOptions(req)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	// The shallow boundary precedes the ACK/NAK lines of every round
+	var out bytes.Buffer
+	if opts.Deepen() {
+		update, err := gitRepo.ComputeShallow(req.Wants, opts)
+		if err != nil {
+			return writeError(w, err)
+		}
+		out.WriteString(update.PktLines())
+		out.WriteString(gitcore.FlushPkt())
+	}
+	out.Write(neg.Response)
+
+	if !neg.Ready {
+		_, err := w.Write(out.Bytes())
+		return err
+	}
+
+	// Pack only what the client is missing, streamed as it is generated
+	stream := &prefixWriter{w: w, prefix: out.Bytes()}
+	if band := sideBandFor(stream, req.HasCapability); band != nil {
+		return sendPack(ctx, gitRepo, band, req.Wants, neg.Common, opts)
+	}
+	return gitRepo.UploadPackTo(ctx, stream, req.Wants, neg.Common, opts)
+}
+
+// UploadPackV2 runs a protocol v2 ls-refs, fetch or object-info command
+func UploadPackV2(ctx context.Context, gitRepo *gitcore.Repository, cmd *gitcore.CommandRequest, w io.Writer) error {
+	switch cmd.Command {
+	case "ls-refs":
+		refs, err := gitRepo.LsRefs(cmd.Args)
+		if err != nil {
+			return writeError(w, err)
+		}
+		_, err = w.Write(refs)
+		return err
+
+	case "fetch":
+		req, err := gitcore.ParseFetchArgs(cmd.Args)
+		if err != nil {
+			return writeError(w, err)
+		}
+
+		neg, err := gitRepo.NegotiateV2(req)
+		if err != nil {
+			return writeError(w, err)
+		}
+		opts, err := gitRepo.UploadPackOptions(req)
+		if err != nil {
+			return writeError(w, err)
+		}
+
+		var out bytes.Buffer
+		out.Write(neg.Response)
+		if !neg.Ready {
+			_, err := w.Write(out.Bytes())
+			return err
+		}
+
+		if opts.Deepen() {
+			update, err := gitRepo.ComputeShallow(req.Wants, opts)
+			if err != nil {
+				return writeError(w, err)
+			}
+			out.WriteString(gitcore.PktLine("shallow-info\n"))
+			out.WriteString(update.PktLines())
+			out.WriteString(gitcore.DelimPkt)
+		}
+
+		// The packfile section is always multiplexed
+		out.WriteString(gitcore.PktLine("packfile\n"))
+		band := gitcore.NewSideBandWriter(&prefixWriter{w: w, prefix: out.Bytes()}, true)
+		band.Quiet = req.HasCapability("no-progress")
+		return sendPack(ctx, gitRepo, band, req.Wants, neg.Common, opts)
+
+	case "object-info":
+		info, err := gitRepo.ObjectInfo(cmd.Args)
+		if err != nil {
+			return writeError(w, err)
+		}
+		_, err = w.Write(info)
+		return err
+
+	default:
+		return writeError(w, errors.New("unknown command "+cmd.Command))
+	}
+}
+
+// writeError reports an upload-pack failure to the client as an ERR
+// packet
+func writeError(w io.Writer, err error) error {
+	_, werr := io.WriteString(w, gitcore.PktLine("ERR upload-pack: "+err.Error()+"\n"))
+	return werr
+}
+
+// sendPack streams a pack on the data band between progress messages and
+// ends the stream; a failure is reported on the error band
+func sendPack(ctx context.Context, gitRepo *gitcore.Repository, band *gitcore.SideBandWriter,
+	wants, haves []string, opts *gitcore.UploadPackOptions) error {
+	pack := &packProgress{band: band}
+	if err := gitRepo.UploadPackTo(ctx, pack, wants, haves, opts); err != nil {
+		band.Fatal("upload-pack: " + err.Error())
+		return err
+	}
+	band.Progress("Total %d (delta 0), reused 0 (delta 0)\n", pack.count)
+	return band.Flush()
+}
+
+// packProgress forwards a pack to the data band, announcing the object
+// count from the pack header ahead of the data
+type packProgress struct {
+	band    *gitcore.SideBandWriter
+	started bool
+	count   int
+}
+
+func (p *packProgress) Write(data []byte) (int, error) {
+	if !p.started {
+		p.started = true
+		p.count = gitcore.PackObjectCount(data)
+		p.band.Progress("Counting objects: %d, done.\n", p.count)
+	}
+	return p.band.Write(data)
+}
+
+// prefixWriter holds back a prefix (the negotiation lines) until the first
+// write, so nothing is sent if the pack fails before it starts
+type prefixWriter struct {
+	w       io.Writer
+	prefix  []byte
+	started bool
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	if !p.started {
+		p.started = true
+		if _, err := p.w.Write(p.prefix); err != nil {
+			return 0, err
+		}
+	}
+	return p.w.Write(data)
+}
@@ -0,0 +1,164 @@
+package gitservice
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zixiao/git-server/pkg/gitcore"
+)
+
+// openTestHistory returns a bare repository holding the history fixture
+// of pkg/gitcore, whose commits are tagged c1 to c8
+func openTestHistory(t *testing.T) *gitcore.Repository {
+	t.Helper()
+	pack, err := os.ReadFile("../../pkg/gitcore/testdata/history.pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := os.ReadFile("../../pkg/gitcore/testdata/history.refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := gitcore.NewRepository(filepath.Join(t.TempDir(), "history.git"))
+	t.Cleanup(repo.Free)
+	if err := repo.Init(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ReceivePack(pack); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(refs)), "\n") {
+		sha, name, _ := strings.Cut(line, " ")
+		if err := repo.CreateRef(strings.TrimPrefix(name, "refs/"), sha); err != nil {
+			t.Fatalf("creating %s: %v", name, err)
+		}
+	}
+	return repo
+}
+
+// readFetchResponse splits a v2 fetch response into its pkt-lines, with
+// "(delim)" for delimiters, up to the packfile section, and the pack sent
+// on band 1 of that section
+func readFetchResponse(t *testing.T, response []byte) ([]string, []byte) {
+	t.Helper()
+	in := gitcore.NewPktReader(bytes.NewReader(response))
+	var lines []string
+	for {
+		pkt, err := in.ReadPkt()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case gitcore.IsFlushPkt(pkt):
+			lines = append(lines, "(flush)")
+		case string(pkt) == gitcore.DelimPkt:
+			lines = append(lines, "(delim)")
+		default:
+			lines = append(lines, gitcore.PktPayload(pkt))
+		}
+		if lines[len(lines)-1] == "packfile" {
+			break
+		}
+	}
+
+	var pack bytes.Buffer
+	for {
+		pkt, err := in.ReadPkt()
+		if err != nil {
+			t.Fatalf("packfile section: %v", err)
+		}
+		if gitcore.IsFlushPkt(pkt) {
+			break
+		}
+		switch pkt[4] {
+		case 1:
+			pack.Write(pkt[5:])
+		case 3:
+			t.Fatalf("fatal error on band 3: %s", pkt[5:])
+		}
+	}
+	if rest, _ := io.ReadAll(in.Reader()); len(rest) > 0 {
+		t.Errorf("%d bytes after the packfile section", len(rest))
+	}
+	return append(lines, "(flush)"), pack.Bytes()
+}
+
+func TestUploadPackV2Fetch(t *testing.T) {
+	repo := openTestHistory(t)
+	const (
+		c7      = "fb07918b66faa0cd49e41274cf49197405e61e1c"
+		c8      = "e997d77ebd982a63b8279fce2eae0d2fec6f8545"
+		missing = "1111111111111111111111111111111111111111"
+	)
+
+	tests := []struct {
+		name string
+		args []string
+		// want are the response's pkt-lines up to its pack
+		want []string
+		// objects is how many objects the pack holds, as git rev-list
+		// --objects counts them, or 0 for no pack
+		objects int
+	}{
+		{
+			name: "nothing in common",
+			args: []string{"want " + c8, "have " + missing},
+			want: []string{"acknowledgments", "NAK", "(flush)"},
+		},
+		{
+			name:    "ready to send",
+			args:    []string{"thin-pack", "no-progress", "want " + c8, "have " + c7, "have " + missing},
+			want:    []string{"acknowledgments", "ACK " + c7, "ready", "(delim)", "packfile", "(flush)"},
+			objects: 5,
+		},
+		{
+			name:    "done",
+			args:    []string{"want " + c8, "have " + c7, "done"},
+			want:    []string{"packfile", "(flush)"},
+			objects: 5,
+		},
+		{
+			name:    "shallow clone",
+			args:    []string{"want " + c8, "deepen 1", "done"},
+			want:    []string{"shallow-info", "shallow " + c8, "(delim)", "packfile", "(flush)"},
+			objects: 8,
+		},
+		{
+			name: "unknown want",
+			args: []string{"want " + missing, "done"},
+			want: []string{"ERR upload-pack: not our ref " + missing},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response bytes.Buffer
+			cmd := &gitcore.CommandRequest{Command: "fetch", Args: tt.args}
+			if err := UploadPackV2(context.Background(), repo, cmd, &response); err != nil {
+				t.Fatal(err)
+			}
+
+			lines, pack := readFetchResponse(t, response.Bytes())
+			if strings.Join(lines, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("response\ngot:  %q\nwant: %q", lines, tt.want)
+			}
+			if tt.objects == 0 {
+				return
+			}
+			if !bytes.HasPrefix(pack, []byte("PACK")) {
+				t.Fatalf("packfile section holds no pack: %q", pack)
+			}
+			if got := gitcore.PackObjectCount(pack); got != tt.objects {
+				t.Errorf("pack holds %d objects, want %d", got, tt.objects)
+			}
+		})
+	}
+}
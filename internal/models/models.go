@@ -4,6 +4,13 @@ import (
 	"time"
 )
 
+// Account types. Organizations are stored with users, so the two share a
+// namespace and either can own repositories.
+const (
+	UserTypeUser         = "user"
+	UserTypeOrganization = "organization"
+)
+
 // User represents a user account
 type User struct {
 	ID        int64     `json:"id" db:"id"`
@@ -13,24 +20,55 @@ type User struct {
 	FullName  string    `json:"full_name" db:"full_name"`
 	IsAdmin   bool      `json:"is_admin" db:"is_admin"`
 	IsActive  bool      `json:"is_active" db:"is_active"`
+	Type      string    `json:"type" db:"type"` // user or organization
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// Organization represents an organization account, which owns
+// repositories on behalf of its members
+type Organization struct {
+	ID        int64     `json:"id" db:"id"`
+	Name      string    `json:"name" db:"username"`
+	Email     string    `json:"email" db:"email"`
+	FullName  string    `json:"full_name" db:"full_name"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// OrgMember is a member of an organization with their account
+type OrgMember struct {
+	User      *User     `json:"user"`
+	Role      string    `json:"role"` // owner or member
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Team represents a group of organization members who are granted a role
+// on a set of the organization's repositories
+type Team struct {
+	ID          int64     `json:"id" db:"id"`
+	OrgID       int64     `json:"org_id" db:"org_id"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	Permission  string    `json:"permission" db:"permission"` // read, triage, write, maintain, admin
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
 // Repository represents a git repository
 type Repository struct {
-	ID            int64     `json:"id" db:"id"`
-	Name          string    `json:"name" db:"name"`
-	Description   string    `json:"description" db:"description"`
-	OwnerID       int64     `json:"owner_id" db:"owner_id"`
-	OwnerName     string    `json:"owner_name" db:"-"` // Joined field
-	IsPrivate     bool      `json:"is_private" db:"is_private"`
-	DefaultBranch string    `json:"default_branch" db:"default_branch"`
-	Size          int64     `json:"size" db:"size"` // in bytes
-	Stars         int       `json:"stars" db:"stars"`
-	Forks         int       `json:"forks" db:"forks"`
-	CreatedAt     time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+	ID               int64     `json:"id" db:"id"`
+	Name             string    `json:"name" db:"name"`
+	Description      string    `json:"description" db:"description"`
+	OwnerID          int64     `json:"owner_id" db:"owner_id"`
+	OwnerName        string    `json:"owner_name" db:"-"` // Joined field
+	IsPrivate        bool      `json:"is_private" db:"is_private"`
+	DefaultBranch    string    `json:"default_branch" db:"default_branch"`
+	RequireTwoFactor bool      `json:"require_two_factor" db:"require_two_factor"` // Writers need 2FA
+	Size             int64     `json:"size" db:"size"`                             // in bytes
+	Stars            int       `json:"stars" db:"stars"`
+	Forks            int       `json:"forks" db:"forks"`
+	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
 }
 
 // SSHKey represents a user's SSH public key
@@ -43,23 +81,79 @@ type SSHKey struct {
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 }
 
-// Collaboration represents repository access permissions
+// DeployKey represents an SSH public key that grants access to a single
+// repository
+type DeployKey struct {
+	ID           int64     `json:"id" db:"id"`
+	RepositoryID int64     `json:"repository_id" db:"repository_id"`
+	Title        string    `json:"title" db:"title"`
+	Key          string    `json:"key" db:"key"` // Public key content
+	Fingerprint  string    `json:"fingerprint" db:"fingerprint"`
+	ReadOnly     bool      `json:"read_only" db:"read_only"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// Collaboration represents repository access permissions. A pending
+// collaboration is an invitation the user has not accepted yet, and grants
+// nothing.
 type Collaboration struct {
 	ID           int64     `json:"id" db:"id"`
 	RepositoryID int64     `json:"repository_id" db:"repository_id"`
 	UserID       int64     `json:"user_id" db:"user_id"`
-	Permission   string    `json:"permission" db:"permission"` // read, write, admin
+	Permission   string    `json:"permission" db:"permission"` // read, triage, write, maintain, admin
+	Pending      bool      `json:"pending" db:"pending"`
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 }
 
-// AccessToken represents an API access token
+// Collaborator is a repository collaborator with their account, as listed
+// for a repository
+type Collaborator struct {
+	ID         int64     `json:"id"` // Collaboration ID
+	User       *User     `json:"user"`
+	Permission string    `json:"permission"`
+	Pending    bool      `json:"pending"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Invitation is a pending collaboration, as listed for the invited user
+type Invitation struct {
+	ID         int64       `json:"id"` // Collaboration ID
+	Repository *Repository `json:"repository"`
+	Permission string      `json:"permission"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// AccessToken represents a personal access token
 type AccessToken struct {
-	ID        int64     `json:"id" db:"id"`
-	UserID    int64     `json:"user_id" db:"user_id"`
-	Token     string    `json:"token" db:"token"`
-	Name      string    `json:"name" db:"name"`
-	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ID         int64      `json:"id" db:"id"`
+	UserID     int64      `json:"user_id" db:"user_id"`
+	Token      string     `json:"token,omitempty" db:"token"` // Only returned when created
+	Name       string     `json:"name" db:"name"`
+	Scopes     []string   `json:"scopes" db:"scopes"` // Stored comma separated
+	ExpiresAt  *time.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Session is a signed-in client of a user, kept alive by rotating refresh
+// tokens
+type Session struct {
+	ID         int64      `json:"id" db:"id"`
+	UserID     int64      `json:"user_id" db:"user_id"`
+	UserAgent  string     `json:"user_agent" db:"user_agent"`
+	IPAddress  string     `json:"ip_address" db:"ip_address"`
+	ExpiresAt  time.Time  `json:"expires_at" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	Current    bool       `json:"current" db:"-"` // Set for the requesting session
+}
+
+// TwoFactorStatus reports whether a user has two-factor authentication
+// enabled
+type TwoFactorStatus struct {
+	User                   *User `json:"user,omitempty"`
+	Enabled                bool  `json:"enabled"`
+	RecoveryCodesRemaining int   `json:"recovery_codes_remaining"`
 }
 
 // Activity represents user or repository activity
@@ -0,0 +1,551 @@
+// Package organization manages organizations, their members and teams.
+// Organizations are stored as accounts in the users table, so their names
+// share the namespace with usernames and they own repositories the same
+// way users do.
+package organization
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/zixiao/git-server/internal/database"
+	"github.com/zixiao/git-server/internal/models"
+)
+
+// Organization member roles
+const (
+	// RoleOwner administers the organization and all of its repositories
+	RoleOwner = "owner"
+	// RoleMember gets access to repositories through teams
+	RoleMember = "member"
+)
+
+var (
+	// ErrNameTaken is returned when a user or organization already has the
+	// name
+	ErrNameTaken = fmt.Errorf("name already taken")
+	// ErrOrgNotFound is returned when an organization cannot be found
+	ErrOrgNotFound = fmt.Errorf("organization not found")
+	// ErrOrgNotEmpty is returned when deleting an organization that still
+	// owns repositories
+	ErrOrgNotEmpty = fmt.Errorf("organization still owns repositories")
+	// ErrNotMember is returned when a user is not a member of the
+	// organization
+	ErrNotMember = fmt.Errorf("not a member of the organization")
+	// ErrLastOwner is returned when removing or demoting the last owner
+	ErrLastOwner = fmt.Errorf("an organization needs at least one owner")
+	// ErrTeamExists is returned when the organization already has a team
+	// with the name
+	ErrTeamExists = fmt.Errorf("team already exists")
+	// ErrTeamNotFound is returned when a team cannot be found
+	ErrTeamNotFound = fmt.Errorf("team not found")
+)
+
+// Create creates an organization with the creating user as its owner
+func Create(creatorID int64, name, fullName, email string) (*models.Organization, error) {
+	var taken int
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM users WHERE username = ? OR email = ?
+	`, name, email).Scan(&taken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	if taken > 0 {
+		return nil, ErrNameTaken
+	}
+
+	// Organizations cannot log in: an empty password never verifies
+	result, err := database.DB.Exec(`
+		INSERT INTO users (username, email, password, full_name, is_admin, is_active, type)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, name, email, "", fullName, false, true, models.UserTypeOrganization)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create organization: %w", err)
+	}
+
+	orgID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization ID: %w", err)
+	}
+
+	if _, err := database.DB.Exec(`
+		INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)
+	`, orgID, creatorID, RoleOwner); err != nil {
+		database.DB.Exec("DELETE FROM users WHERE id = ?", orgID)
+		return nil, fmt.Errorf("failed to add organization owner: %w", err)
+	}
+
+	return &models.Organization{
+		ID:        orgID,
+		Name:      name,
+		Email:     email,
+		FullName:  fullName,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+// Get retrieves an organization by name
+func Get(name string) (*models.Organization, error) {
+	var org models.Organization
+	var fullName sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT id, username, email, full_name, created_at, updated_at
+		FROM users WHERE username = ? AND type = ?
+	`, name, models.UserTypeOrganization).Scan(&org.ID, &org.Name, &org.Email,
+		&fullName, &org.CreatedAt, &org.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrOrgNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization: %w", err)
+	}
+
+	org.FullName = fullName.String
+	return &org, nil
+}
+
+// ListForUser lists the organizations a user is a member of
+func ListForUser(userID int64) ([]*models.Organization, error) {
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.username, u.email, u.full_name, u.created_at, u.updated_at
+		FROM org_members m
+		JOIN users u ON m.org_id = u.id
+		WHERE m.user_id = ?
+		ORDER BY u.username
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organizations: %w", err)
+	}
+	defer rows.Close()
+
+	orgs := []*models.Organization{}
+	for rows.Next() {
+		var org models.Organization
+		var fullName sql.NullString
+		if err := rows.Scan(&org.ID, &org.Name, &org.Email, &fullName,
+			&org.CreatedAt, &org.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan organization: %w", err)
+		}
+		org.FullName = fullName.String
+		orgs = append(orgs, &org)
+	}
+
+	return orgs, rows.Err()
+}
+
+// Delete deletes an organization with its members and teams. It must not
+// own any repositories.
+func Delete(orgID int64) error {
+	var repos int
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM repositories WHERE owner_id = ?
+	`, orgID).Scan(&repos)
+	if err != nil {
+		return fmt.Errorf("failed to query repositories: %w", err)
+	}
+	if repos > 0 {
+		return ErrOrgNotEmpty
+	}
+
+	// Delete explicitly rather than through cascades, which not every
+	// database applies to every table
+	for _, stmt := range []string{
+		"DELETE FROM team_repositories WHERE team_id IN (SELECT id FROM teams WHERE org_id = ?)",
+		"DELETE FROM team_members WHERE team_id IN (SELECT id FROM teams WHERE org_id = ?)",
+		"DELETE FROM teams WHERE org_id = ?",
+		"DELETE FROM org_members WHERE org_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err := database.DB.Exec(stmt, orgID); err != nil {
+			return fmt.Errorf("failed to delete organization: %w", err)
+		}
+	}
+	return nil
+}
+
+// MemberRole returns a user's role in an organization, or "" if they are
+// not a member
+func MemberRole(orgID, userID int64) (string, error) {
+	var role string
+	err := database.DB.QueryRow(`
+		SELECT role FROM org_members WHERE org_id = ? AND user_id = ?
+	`, orgID, userID).Scan(&role)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query organization member: %w", err)
+	}
+	return role, nil
+}
+
+// ListMembers lists an organization's members
+func ListMembers(orgID int64) ([]*models.OrgMember, error) {
+	rows, err := database.DB.Query(`
+		SELECT m.role, m.created_at,
+		       u.id, u.username, u.email, u.full_name, u.is_admin, u.is_active, u.type,
+		       u.created_at, u.updated_at
+		FROM org_members m
+		JOIN users u ON m.user_id = u.id
+		WHERE m.org_id = ?
+		ORDER BY u.username
+	`, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []*models.OrgMember{}
+	for rows.Next() {
+		member := models.OrgMember{User: &models.User{}}
+		user := member.User
+		var fullName sql.NullString
+		if err := rows.Scan(&member.Role, &member.CreatedAt,
+			&user.ID, &user.Username, &user.Email, &fullName, &user.IsAdmin,
+			&user.IsActive, &user.Type, &user.CreatedAt, &user.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan organization member: %w", err)
+		}
+		user.FullName = fullName.String
+		members = append(members, &member)
+	}
+
+	return members, rows.Err()
+}
+
+// SetMember adds a user to an organization with the given role, or
+// changes the role of an existing member
+func SetMember(orgID, userID int64, role string) error {
+	current, err := MemberRole(orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	if current == "" {
+		_, err = database.DB.Exec(`
+			INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)
+		`, orgID, userID, role)
+		if err != nil {
+			return fmt.Errorf("failed to add organization member: %w", err)
+		}
+		return nil
+	}
+
+	if current == RoleOwner && role != RoleOwner {
+		if err := checkNotLastOwner(orgID); err != nil {
+			return err
+		}
+	}
+	_, err = database.DB.Exec(`
+		UPDATE org_members SET role = ? WHERE org_id = ? AND user_id = ?
+	`, role, orgID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update organization member: %w", err)
+	}
+	return nil
+}
+
+// RemoveMember removes a user from an organization and its teams
+func RemoveMember(orgID, userID int64) error {
+	role, err := MemberRole(orgID, userID)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return ErrNotMember
+	}
+	if role == RoleOwner {
+		if err := checkNotLastOwner(orgID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := database.DB.Exec(`
+		DELETE FROM team_members
+		WHERE user_id = ? AND team_id IN (SELECT id FROM teams WHERE org_id = ?)
+	`, userID, orgID); err != nil {
+		return fmt.Errorf("failed to remove team memberships: %w", err)
+	}
+	if _, err := database.DB.Exec(`
+		DELETE FROM org_members WHERE org_id = ? AND user_id = ?
+	`, orgID, userID); err != nil {
+		return fmt.Errorf("failed to remove organization member: %w", err)
+	}
+	return nil
+}
+
+// checkNotLastOwner returns ErrLastOwner if the organization has only one
+// owner left
+func checkNotLastOwner(orgID int64) error {
+	var owners int
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM org_members WHERE org_id = ? AND role = ?
+	`, orgID, RoleOwner).Scan(&owners)
+	if err != nil {
+		return fmt.Errorf("failed to query organization owners: %w", err)
+	}
+	if owners <= 1 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// CreateTeam creates a team in an organization granting permission on the
+// repositories later added to it
+func CreateTeam(orgID int64, name, description, permission string) (*models.Team, error) {
+	if _, err := GetTeam(orgID, name); err == nil {
+		return nil, ErrTeamExists
+	} else if err != ErrTeamNotFound {
+		return nil, err
+	}
+
+	result, err := database.DB.Exec(`
+		INSERT INTO teams (org_id, name, description, permission)
+		VALUES (?, ?, ?, ?)
+	`, orgID, name, description, permission)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create team: %w", err)
+	}
+
+	teamID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get team ID: %w", err)
+	}
+
+	return &models.Team{
+		ID:          teamID,
+		OrgID:       orgID,
+		Name:        name,
+		Description: description,
+		Permission:  permission,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+// GetTeam retrieves an organization's team by name
+func GetTeam(orgID int64, name string) (*models.Team, error) {
+	var team models.Team
+	var description sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT id, org_id, name, description, permission, created_at
+		FROM teams WHERE org_id = ? AND name = ?
+	`, orgID, name).Scan(&team.ID, &team.OrgID, &team.Name, &description,
+		&team.Permission, &team.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrTeamNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query team: %w", err)
+	}
+
+	team.Description = description.String
+	return &team, nil
+}
+
+// ListTeams lists an organization's teams
+func ListTeams(orgID int64) ([]*models.Team, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, org_id, name, description, permission, created_at
+		FROM teams WHERE org_id = ?
+		ORDER BY name
+	`, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query teams: %w", err)
+	}
+	defer rows.Close()
+
+	teams := []*models.Team{}
+	for rows.Next() {
+		var team models.Team
+		var description sql.NullString
+		if err := rows.Scan(&team.ID, &team.OrgID, &team.Name, &description,
+			&team.Permission, &team.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan team: %w", err)
+		}
+		team.Description = description.String
+		teams = append(teams, &team)
+	}
+
+	return teams, rows.Err()
+}
+
+// UpdateTeam changes a team's description and permission
+func UpdateTeam(teamID int64, description, permission string) error {
+	_, err := database.DB.Exec(`
+		UPDATE teams SET description = ?, permission = ? WHERE id = ?
+	`, description, permission, teamID)
+	if err != nil {
+		return fmt.Errorf("failed to update team: %w", err)
+	}
+	return nil
+}
+
+// DeleteTeam deletes a team with its memberships and repository grants
+func DeleteTeam(teamID int64) error {
+	for _, stmt := range []string{
+		"DELETE FROM team_repositories WHERE team_id = ?",
+		"DELETE FROM team_members WHERE team_id = ?",
+		"DELETE FROM teams WHERE id = ?",
+	} {
+		if _, err := database.DB.Exec(stmt, teamID); err != nil {
+			return fmt.Errorf("failed to delete team: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListTeamMembers lists the users in a team
+func ListTeamMembers(teamID int64) ([]*models.User, error) {
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.username, u.email, u.full_name, u.is_admin, u.is_active, u.type,
+		       u.created_at, u.updated_at
+		FROM team_members m
+		JOIN users u ON m.user_id = u.id
+		WHERE m.team_id = ?
+		ORDER BY u.username
+	`, teamID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query team members: %w", err)
+	}
+	defer rows.Close()
+
+	users := []*models.User{}
+	for rows.Next() {
+		var user models.User
+		var fullName sql.NullString
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &fullName,
+			&user.IsAdmin, &user.IsActive, &user.Type, &user.CreatedAt,
+			&user.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan team member: %w", err)
+		}
+		user.FullName = fullName.String
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// AddTeamMember adds an organization member to a team. Adding an existing
+// member is a no-op.
+func AddTeamMember(team *models.Team, userID int64) error {
+	role, err := MemberRole(team.OrgID, userID)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return ErrNotMember
+	}
+
+	var exists int
+	err = database.DB.QueryRow(`
+		SELECT COUNT(*) FROM team_members WHERE team_id = ? AND user_id = ?
+	`, team.ID, userID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to query team members: %w", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	_, err = database.DB.Exec(`
+		INSERT INTO team_members (team_id, user_id) VALUES (?, ?)
+	`, team.ID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to add team member: %w", err)
+	}
+	return nil
+}
+
+// RemoveTeamMember removes a user from a team
+func RemoveTeamMember(teamID, userID int64) error {
+	result, err := database.DB.Exec(`
+		DELETE FROM team_members WHERE team_id = ? AND user_id = ?
+	`, teamID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove team member: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to remove team member: %w", err)
+	}
+	if rows == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+// ListTeamRepositories lists the repositories a team has access to
+func ListTeamRepositories(teamID int64) ([]*models.Repository, error) {
+	rows, err := database.DB.Query(`
+		SELECT r.id, r.name, r.description, r.owner_id, u.username, r.is_private,
+		       r.default_branch, r.require_two_factor, r.size, r.stars, r.forks, r.created_at, r.updated_at
+		FROM team_repositories t
+		JOIN repositories r ON t.repository_id = r.id
+		JOIN users u ON r.owner_id = u.id
+		WHERE t.team_id = ?
+		ORDER BY r.name
+	`, teamID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query team repositories: %w", err)
+	}
+	defer rows.Close()
+
+	repos := []*models.Repository{}
+	for rows.Next() {
+		var repo models.Repository
+		err := rows.Scan(&repo.ID, &repo.Name, &repo.Description, &repo.OwnerID,
+			&repo.OwnerName, &repo.IsPrivate, &repo.DefaultBranch, &repo.RequireTwoFactor,
+			&repo.Size, &repo.Stars, &repo.Forks, &repo.CreatedAt, &repo.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan repository: %w", err)
+		}
+		repos = append(repos, &repo)
+	}
+
+	return repos, rows.Err()
+}
+
+// AddTeamRepository grants a team access to one of its organization's
+// repositories. Adding a repository twice is a no-op.
+func AddTeamRepository(teamID, repoID int64) error {
+	var exists int
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM team_repositories WHERE team_id = ? AND repository_id = ?
+	`, teamID, repoID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to query team repositories: %w", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	_, err = database.DB.Exec(`
+		INSERT INTO team_repositories (team_id, repository_id) VALUES (?, ?)
+	`, teamID, repoID)
+	if err != nil {
+		return fmt.Errorf("failed to add team repository: %w", err)
+	}
+	return nil
+}
+
+// RemoveTeamRepository revokes a team's access to a repository. It
+// returns false if the team had no access.
+func RemoveTeamRepository(teamID, repoID int64) (bool, error) {
+	result, err := database.DB.Exec(`
+		DELETE FROM team_repositories WHERE team_id = ? AND repository_id = ?
+	`, teamID, repoID)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove team repository: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove team repository: %w", err)
+	}
+	return rows > 0, nil
+}
@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/zixiao/git-server/internal/auth"
+	"github.com/zixiao/git-server/internal/database"
+	"github.com/zixiao/git-server/internal/models"
+	"github.com/zixiao/git-server/internal/organization"
+)
+
+// Collaborator roles, from least to most privileged. Each role includes
+// the access of the roles below it.
+const (
+	RoleRead     = "read"
+	RoleTriage   = "triage"
+	RoleWrite    = "write"
+	RoleMaintain = "maintain"
+	RoleAdmin    = "admin"
+)
+
+// roleLevels orders the roles; unknown roles have level 0 and grant
+// nothing
+var roleLevels = map[string]int{
+	RoleRead:     1,
+	RoleTriage:   2,
+	RoleWrite:    3,
+	RoleMaintain: 4,
+	RoleAdmin:    5,
+}
+
+// Action is something done to a repository
+type Action string
+
+// Repository actions
+const (
+	// ActionRead views, clones and fetches a repository
+	ActionRead Action = "read"
+	// ActionWrite pushes to a repository
+	ActionWrite Action = "write"
+	// ActionAdmin manages a repository's collaborators and deploy keys
+	ActionAdmin Action = "admin"
+	// ActionDelete deletes a repository
+	ActionDelete Action = "delete"
+)
+
+// actionRoles is the least role each action needs
+var actionRoles = map[Action]string{
+	ActionRead:   RoleRead,
+	ActionWrite:  RoleWrite,
+	ActionAdmin:  RoleAdmin,
+	ActionDelete: RoleAdmin,
+}
+
+// Actor is who acts on a repository: a user, who may be a site admin, or a
+// deploy key. A nil *Actor is an anonymous client.
+type Actor struct {
+	UserID int64
+	// IsAdmin marks a site admin, who may do anything to any repository
+	IsAdmin bool
+	// DeployKey is set when a client authenticated with a deploy key,
+	// which acts only on its own repository; UserID is then 0
+	DeployKey *models.DeployKey
+}
+
+// ValidRole reports whether role is a collaborator role
+func ValidRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// Authorize checks whether an actor may perform an action on a repository.
+// It returns ErrAccessDenied if not. Anyone may read a public repository;
+// everything else needs a role at least as high as the action requires.
+// On a repository that requires two-factor authentication, users without
+// it may still read but get ErrTwoFactorRequired for anything more.
+func Authorize(actor *Actor, repo *models.Repository, action Action) error {
+	required, ok := actionRoles[action]
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	if required == RoleRead && !repo.IsPrivate {
+		return nil
+	}
+	if actor == nil {
+		return ErrAccessDenied
+	}
+
+	role, err := RoleOf(actor, repo)
+	if err != nil {
+		return err
+	}
+	if roleLevels[role] < roleLevels[required] {
+		return ErrAccessDenied
+	}
+
+	// Deploy keys are not people and have no second factor
+	if repo.RequireTwoFactor && actor.DeployKey == nil &&
+		roleLevels[required] >= roleLevels[RoleWrite] {
+		enabled, err := auth.TwoFactorEnabled(actor.UserID)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return ErrTwoFactorRequired
+		}
+	}
+	return nil
+}
+
+// RoleOf returns the role an actor holds on a repository, or "" if none;
+// pending invitations grant no role. Owners and site admins hold admin, as
+// do the owners of an organization that owns the repository. Other users
+// hold the highest role granted by a collaboration or by the teams they
+// are on. A deploy key holds read, or write if it is not read-only, on its
+// own repository only.
+func RoleOf(actor *Actor, repo *models.Repository) (string, error) {
+	switch {
+	case actor.DeployKey != nil:
+		if actor.DeployKey.RepositoryID != repo.ID {
+			return "", nil
+		}
+		if actor.DeployKey.ReadOnly {
+			return RoleRead, nil
+		}
+		return RoleWrite, nil
+	case actor.IsAdmin, repo.OwnerID == actor.UserID:
+		return RoleAdmin, nil
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT permission FROM collaborations
+		WHERE repository_id = ? AND user_id = ? AND pending = ?
+		UNION ALL
+		SELECT t.permission FROM teams t
+		JOIN team_members m ON m.team_id = t.id
+		JOIN team_repositories r ON r.team_id = t.id
+		WHERE r.repository_id = ? AND m.user_id = ?
+		UNION ALL
+		SELECT 'admin' FROM org_members
+		WHERE org_id = ? AND user_id = ? AND role = ?
+	`, repo.ID, actor.UserID, false,
+		repo.ID, actor.UserID,
+		repo.OwnerID, actor.UserID, organization.RoleOwner)
+	if err != nil {
+		return "", fmt.Errorf("failed to check access: %w", err)
+	}
+	defer rows.Close()
+
+	role := ""
+	for rows.Next() {
+		var granted string
+		if err := rows.Scan(&granted); err != nil {
+			return "", fmt.Errorf("failed to check access: %w", err)
+		}
+		if roleLevels[granted] > roleLevels[role] {
+			role = granted
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to check access: %w", err)
+	}
+	return role, nil
+}
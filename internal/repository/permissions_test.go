@@ -0,0 +1,342 @@
+package repository
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/zixiao/git-server/internal/database"
+	"github.com/zixiao/git-server/internal/models"
+	"github.com/zixiao/git-server/internal/organization"
+	"golang.org/x/crypto/ssh"
+)
+
+// openTestDB points the database package at a new SQLite database
+func openTestDB(t *testing.T) {
+	t.Helper()
+	err := database.Init(database.Config{
+		Type: "sqlite3",
+		Path: filepath.Join(t.TempDir(), "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+}
+
+// mustExec runs a statement and returns the ID of the row it inserted
+func mustExec(t *testing.T, query string, args ...any) int64 {
+	t.Helper()
+	result, err := database.DB.Exec(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// addUser creates a user and returns their ID
+func addUser(t *testing.T, name string) int64 {
+	t.Helper()
+	return mustExec(t, `
+		INSERT INTO users (username, email, password) VALUES (?, ?, ?)
+	`, name, name+"@example.com", "")
+}
+
+// addRepo creates a repository in the database only
+func addRepo(t *testing.T, ownerID int64, name string, private, requireTwoFactor bool) *models.Repository {
+	t.Helper()
+	id := mustExec(t, `
+		INSERT INTO repositories (name, owner_id, is_private, require_two_factor)
+		VALUES (?, ?, ?, ?)
+	`, name, ownerID, private, requireTwoFactor)
+	return &models.Repository{
+		ID:               id,
+		Name:             name,
+		OwnerID:          ownerID,
+		IsPrivate:        private,
+		RequireTwoFactor: requireTwoFactor,
+	}
+}
+
+// collaborate makes a user a collaborator with role, accepting the
+// invitation unless pending
+func collaborate(t *testing.T, repo *models.Repository, userID int64, role string, pending bool) {
+	t.Helper()
+	collab, err := InviteCollaborator(repo.ID, userID, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pending {
+		if err := AcceptInvitation(userID, collab.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// deployKeyActor adds a new deploy key to repo and returns the actor of a
+// client authenticated with it, looked up the way the SSH server does
+func deployKeyActor(t *testing.T, repo *models.Repository, readOnly bool) *Actor {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := AddDeployKey(repo.ID, "deploy", string(ssh.MarshalAuthorizedKey(sshPub)), readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GetDeployKeyByFingerprint(added.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Actor{DeployKey: key}
+}
+
+func TestRoleOfAndAuthorize(t *testing.T) {
+	openTestDB(t)
+
+	owner := addUser(t, "owner")
+	admin := addUser(t, "admin")
+	reader := addUser(t, "reader")
+	triager := addUser(t, "triager")
+	writer := addUser(t, "writer")
+	maintainer := addUser(t, "maintainer")
+	invited := addUser(t, "invited")
+	stranger := addUser(t, "stranger")
+	secured := addUser(t, "secured")
+	orgOwner := addUser(t, "org-owner")
+	teamReader := addUser(t, "team-reader")
+	teamWriter := addUser(t, "team-writer")
+	member := addUser(t, "member")
+	coOwner := addUser(t, "co-owner")
+	formerOwner := addUser(t, "former-owner")
+	teamMaintainer := addUser(t, "team-maintainer")
+	formerTeamWriter := addUser(t, "former-team-writer")
+	otherOrgOwner := addUser(t, "other-org-owner")
+
+	private := addRepo(t, owner, "private", true, false)
+	public := addRepo(t, owner, "public", false, false)
+	strict := addRepo(t, owner, "strict", true, true)
+
+	collaborate(t, private, reader, RoleRead, false)
+	collaborate(t, private, triager, RoleTriage, false)
+	collaborate(t, private, writer, RoleWrite, false)
+	collaborate(t, private, maintainer, RoleMaintain, false)
+	collaborate(t, private, invited, RoleAdmin, true)
+	collaborate(t, public, writer, RoleWrite, false)
+	collaborate(t, strict, writer, RoleWrite, false)
+	collaborate(t, strict, reader, RoleRead, false)
+	collaborate(t, strict, secured, RoleWrite, false)
+	mustExec(t, `INSERT INTO two_factor (user_id, secret, enabled) VALUES (?, ?, ?)`, secured, "secret", true)
+
+	// An organization repository reached through teams; team-writer is
+	// on both teams and a read collaborator, and gets the highest role
+	org, err := organization.Create(orgOwner, "acme", "", "acme@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := addRepo(t, org.ID, "tools", true, false)
+	for _, id := range []int64{teamReader, teamWriter, member} {
+		if err := organization.SetMember(org.ID, id, organization.RoleMember); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readers, err := organization.CreateTeam(org.ID, "readers", "", RoleRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writers, err := organization.CreateTeam(org.ID, "writers", "", RoleWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []struct {
+		team   *models.Team
+		userID int64
+	}{{readers, teamReader}, {readers, teamWriter}, {writers, teamWriter}} {
+		if err := organization.AddTeamMember(m.team, m.userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, team := range []*models.Team{readers, writers} {
+		if err := organization.AddTeamRepository(team.ID, tools.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	collaborate(t, tools, teamWriter, RoleRead, false)
+
+	// Further owners inherit admin like the creator, until demoted; team
+	// roles follow the team's permission and current membership
+	for _, id := range []int64{coOwner, formerOwner} {
+		if err := organization.SetMember(org.ID, id, organization.RoleOwner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := organization.SetMember(org.ID, formerOwner, organization.RoleMember); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{teamMaintainer, formerTeamWriter} {
+		if err := organization.SetMember(org.ID, id, organization.RoleMember); err != nil {
+			t.Fatal(err)
+		}
+	}
+	maintainers, err := organization.CreateTeam(org.ID, "maintainers", "", RoleMaintain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := organization.AddTeamMember(maintainers, teamMaintainer); err != nil {
+		t.Fatal(err)
+	}
+	if err := organization.AddTeamRepository(maintainers.ID, tools.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := organization.AddTeamMember(writers, formerTeamWriter); err != nil {
+		t.Fatal(err)
+	}
+	if err := organization.RemoveTeamMember(writers.ID, formerTeamWriter); err != nil {
+		t.Fatal(err)
+	}
+	// docs is on a repository of its own, not on tools
+	docsRepo := addRepo(t, org.ID, "docs", true, false)
+	docs, err := organization.CreateTeam(org.ID, "docs", "", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := organization.AddTeamMember(docs, member); err != nil {
+		t.Fatal(err)
+	}
+	if err := organization.AddTeamRepository(docs.ID, docsRepo.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Owning one organization grants nothing on another's repositories
+	otherOrg, err := organization.Create(otherOrgOwner, "globex", "", "globex@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gadgets := addRepo(t, otherOrg.ID, "gadgets", true, false)
+
+	readKey := deployKeyActor(t, private, true)
+	writeKey := deployKeyActor(t, private, false)
+	strictReadKey := deployKeyActor(t, strict, true)
+	strictKey := deployKeyActor(t, strict, false)
+	user := func(id int64) *Actor { return &Actor{UserID: id} }
+
+	roles := []struct {
+		name  string
+		actor *Actor
+		repo  *models.Repository
+		want  string
+	}{
+		{"owner", user(owner), private, RoleAdmin},
+		{"site admin", &Actor{UserID: admin, IsAdmin: true}, private, RoleAdmin},
+		{"read collaborator", user(reader), private, RoleRead},
+		{"triage collaborator", user(triager), private, RoleTriage},
+		{"write collaborator", user(writer), private, RoleWrite},
+		{"maintain collaborator", user(maintainer), private, RoleMaintain},
+		{"pending invitation", user(invited), private, ""},
+		{"stranger", user(stranger), private, ""},
+		{"collaborator elsewhere", user(reader), public, ""},
+		{"organization owner", user(orgOwner), tools, RoleAdmin},
+		{"team member", user(teamReader), tools, RoleRead},
+		{"highest of teams and collaboration", user(teamWriter), tools, RoleWrite},
+		{"organization member without team", user(member), tools, ""},
+		{"organization co-owner", user(coOwner), tools, RoleAdmin},
+		{"organization owner on another repository", user(orgOwner), docsRepo, RoleAdmin},
+		{"demoted organization owner", user(formerOwner), tools, ""},
+		{"organization owner on another organization", user(orgOwner), gadgets, ""},
+		{"other organization owner", user(otherOrgOwner), tools, ""},
+		{"maintain team member", user(teamMaintainer), tools, RoleMaintain},
+		{"removed team member", user(formerTeamWriter), tools, ""},
+		{"admin team member", user(member), docsRepo, RoleAdmin},
+		{"team member on another team's repository", user(teamWriter), docsRepo, ""},
+		{"read-only deploy key", readKey, private, RoleRead},
+		{"deploy key", writeKey, private, RoleWrite},
+		{"deploy key of another repository", writeKey, public, ""},
+		{"read-only deploy key of another repository", readKey, strict, ""},
+		{"deploy key of another private repository", strictKey, private, ""},
+	}
+	for _, tt := range roles {
+		t.Run("RoleOf/"+tt.name, func(t *testing.T) {
+			role, err := RoleOf(tt.actor, tt.repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if role != tt.want {
+				t.Errorf("RoleOf = %q, want %q", role, tt.want)
+			}
+		})
+	}
+
+	checks := []struct {
+		name   string
+		actor  *Actor
+		repo   *models.Repository
+		action Action
+		want   error
+	}{
+		{"anonymous reads public", nil, public, ActionRead, nil},
+		{"anonymous reads private", nil, private, ActionRead, ErrAccessDenied},
+		{"anonymous writes public", nil, public, ActionWrite, ErrAccessDenied},
+		{"stranger reads public", user(stranger), public, ActionRead, nil},
+		{"stranger writes public", user(stranger), public, ActionWrite, ErrAccessDenied},
+		{"reader reads", user(reader), private, ActionRead, nil},
+		{"reader writes", user(reader), private, ActionWrite, ErrAccessDenied},
+		{"triager writes", user(triager), private, ActionWrite, ErrAccessDenied},
+		{"writer writes", user(writer), private, ActionWrite, nil},
+		{"writer administers", user(writer), private, ActionAdmin, ErrAccessDenied},
+		{"maintainer administers", user(maintainer), private, ActionAdmin, ErrAccessDenied},
+		{"maintainer deletes", user(maintainer), private, ActionDelete, ErrAccessDenied},
+		{"owner deletes", user(owner), private, ActionDelete, nil},
+		{"site admin deletes", &Actor{UserID: admin, IsAdmin: true}, private, ActionDelete, nil},
+		{"invited user reads", user(invited), private, ActionRead, ErrAccessDenied},
+		{"team member writes", user(teamWriter), tools, ActionWrite, nil},
+		{"organization owner administers", user(orgOwner), tools, ActionAdmin, nil},
+		{"organization owner deletes", user(orgOwner), tools, ActionDelete, nil},
+		{"organization co-owner deletes", user(coOwner), tools, ActionDelete, nil},
+		{"demoted organization owner reads", user(formerOwner), tools, ActionRead, ErrAccessDenied},
+		{"organization owner reads another organization", user(orgOwner), gadgets, ActionRead, ErrAccessDenied},
+		{"team reader reads", user(teamReader), tools, ActionRead, nil},
+		{"team reader writes", user(teamReader), tools, ActionWrite, ErrAccessDenied},
+		{"team maintainer writes", user(teamMaintainer), tools, ActionWrite, nil},
+		{"team maintainer administers", user(teamMaintainer), tools, ActionAdmin, ErrAccessDenied},
+		{"removed team member reads", user(formerTeamWriter), tools, ActionRead, ErrAccessDenied},
+		{"organization member without team reads", user(member), tools, ActionRead, ErrAccessDenied},
+		{"admin team member deletes", user(member), docsRepo, ActionDelete, nil},
+		{"read-only deploy key reads", readKey, private, ActionRead, nil},
+		{"read-only deploy key writes", readKey, private, ActionWrite, ErrAccessDenied},
+		{"deploy key reads", writeKey, private, ActionRead, nil},
+		{"deploy key writes", writeKey, private, ActionWrite, nil},
+		{"deploy key administers", writeKey, private, ActionAdmin, ErrAccessDenied},
+		{"deploy key deletes", writeKey, private, ActionDelete, ErrAccessDenied},
+		{"deploy key reads another private repository", writeKey, strict, ActionRead, ErrAccessDenied},
+		{"read-only deploy key reads another private repository", readKey, strict, ActionRead, ErrAccessDenied},
+		{"deploy key reads another public repository", writeKey, public, ActionRead, nil},
+		{"deploy key writes another repository", writeKey, public, ActionWrite, ErrAccessDenied},
+		{"unknown action", user(owner), private, Action("merge"), ErrAccessDenied},
+
+		{"writer without 2FA reads", user(reader), strict, ActionRead, nil},
+		{"writer without 2FA writes", user(writer), strict, ActionWrite, ErrTwoFactorRequired},
+		{"owner without 2FA administers", user(owner), strict, ActionAdmin, ErrTwoFactorRequired},
+		{"writer with 2FA writes", user(secured), strict, ActionWrite, nil},
+		{"stranger without 2FA writes", user(stranger), strict, ActionWrite, ErrAccessDenied},
+		{"deploy key writes where 2FA is required", strictKey, strict, ActionWrite, nil},
+		{"read-only deploy key writes where 2FA is required", strictReadKey, strict, ActionWrite, ErrAccessDenied},
+	}
+	for _, tt := range checks {
+		t.Run("Authorize/"+tt.name, func(t *testing.T) {
+			if err := Authorize(tt.actor, tt.repo, tt.action); err != tt.want {
+				t.Errorf("Authorize = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
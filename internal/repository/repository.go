@@ -6,6 +6,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/zixiao/git-server/internal/auth"
 	"github.com/zixiao/git-server/internal/config"
 	"github.com/zixiao/git-server/internal/database"
 	"github.com/zixiao/git-server/internal/models"
@@ -21,6 +22,19 @@ var (
 	ErrAccessDenied = fmt.Errorf("access denied")
 	// ErrInvalidName is returned when repository name is invalid
 	ErrInvalidName = fmt.Errorf("invalid repository name")
+	// ErrDeployKeyNotFound is returned when a deploy key cannot be found
+	ErrDeployKeyNotFound = fmt.Errorf("deploy key not found")
+	// ErrCollaboratorExists is returned when a user already collaborates on,
+	// or is invited to, a repository
+	ErrCollaboratorExists = fmt.Errorf("collaborator already exists")
+	// ErrCollaboratorNotFound is returned when a user is not a collaborator
+	ErrCollaboratorNotFound = fmt.Errorf("collaborator not found")
+	// ErrInvitationNotFound is returned when a pending invitation cannot be
+	// found
+	ErrInvitationNotFound = fmt.Errorf("invitation not found")
+	// ErrTwoFactorRequired is returned when a user without two-factor
+	// authentication tries to change a repository that requires it
+	ErrTwoFactorRequired = fmt.Errorf("two-factor authentication required")
 )
 
 // Create creates a new repository
@@ -92,13 +106,13 @@ func Get(ownerName, repoName string) (*models.Repository, error) {
 	var repo models.Repository
 	err := database.DB.QueryRow(`
 		SELECT r.id, r.name, r.description, r.owner_id, u.username, r.is_private,
-		       r.default_branch, r.size, r.stars, r.forks, r.created_at, r.updated_at
+		       r.default_branch, r.require_two_factor, r.size, r.stars, r.forks, r.created_at, r.updated_at
 		FROM repositories r
 		JOIN users u ON r.owner_id = u.id
 		WHERE u.username = ? AND r.name = ?
 	`, ownerName, repoName).Scan(&repo.ID, &repo.Name, &repo.Description, &repo.OwnerID,
-		&repo.OwnerName, &repo.IsPrivate, &repo.DefaultBranch, &repo.Size, &repo.Stars,
-		&repo.Forks, &repo.CreatedAt, &repo.UpdatedAt)
+		&repo.OwnerName, &repo.IsPrivate, &repo.DefaultBranch, &repo.RequireTwoFactor,
+		&repo.Size, &repo.Stars, &repo.Forks, &repo.CreatedAt, &repo.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrRepoNotFound
@@ -115,13 +129,13 @@ func GetByID(repoID int64) (*models.Repository, error) {
 	var repo models.Repository
 	err := database.DB.QueryRow(`
 		SELECT r.id, r.name, r.description, r.owner_id, u.username, r.is_private,
-		       r.default_branch, r.size, r.stars, r.forks, r.created_at, r.updated_at
+		       r.default_branch, r.require_two_factor, r.size, r.stars, r.forks, r.created_at, r.updated_at
 		FROM repositories r
 		JOIN users u ON r.owner_id = u.id
 		WHERE r.id = ?
 	`, repoID).Scan(&repo.ID, &repo.Name, &repo.Description, &repo.OwnerID,
-		&repo.OwnerName, &repo.IsPrivate, &repo.DefaultBranch, &repo.Size, &repo.Stars,
-		&repo.Forks, &repo.CreatedAt, &repo.UpdatedAt)
+		&repo.OwnerName, &repo.IsPrivate, &repo.DefaultBranch, &repo.RequireTwoFactor,
+		&repo.Size, &repo.Stars, &repo.Forks, &repo.CreatedAt, &repo.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrRepoNotFound
@@ -137,7 +151,7 @@ func GetByID(repoID int64) (*models.Repository, error) {
 func List(ownerID int64) ([]*models.Repository, error) {
 	rows, err := database.DB.Query(`
 		SELECT r.id, r.name, r.description, r.owner_id, u.username, r.is_private,
-		       r.default_branch, r.size, r.stars, r.forks, r.created_at, r.updated_at
+		       r.default_branch, r.require_two_factor, r.size, r.stars, r.forks, r.created_at, r.updated_at
 		FROM repositories r
 		JOIN users u ON r.owner_id = u.id
 		WHERE r.owner_id = ?
@@ -153,8 +167,8 @@ func List(ownerID int64) ([]*models.Repository, error) {
 	for rows.Next() {
 		var repo models.Repository
 		err := rows.Scan(&repo.ID, &repo.Name, &repo.Description, &repo.OwnerID,
-			&repo.OwnerName, &repo.IsPrivate, &repo.DefaultBranch, &repo.Size,
-			&repo.Stars, &repo.Forks, &repo.CreatedAt, &repo.UpdatedAt)
+			&repo.OwnerName, &repo.IsPrivate, &repo.DefaultBranch, &repo.RequireTwoFactor,
+			&repo.Size, &repo.Stars, &repo.Forks, &repo.CreatedAt, &repo.UpdatedAt)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan repository: %w", err)
 		}
@@ -164,7 +178,23 @@ func List(ownerID int64) ([]*models.Repository, error) {
 	return repos, nil
 }
 
-// Delete deletes a repository
+// Update saves a repository's description, visibility and two-factor
+// requirement
+func Update(repo *models.Repository) error {
+	repo.UpdatedAt = time.Now()
+	_, err := database.DB.Exec(`
+		UPDATE repositories
+		SET description = ?, is_private = ?, require_two_factor = ?, updated_at = ?
+		WHERE id = ?
+	`, repo.Description, repo.IsPrivate, repo.RequireTwoFactor, repo.UpdatedAt, repo.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update repository: %w", err)
+	}
+	return nil
+}
+
+// Delete deletes a repository. Callers check with Authorize that userID
+// may delete it.
 func Delete(repoID, userID int64) error {
 	// Get repository
 	repo, err := GetByID(repoID)
@@ -172,10 +202,9 @@ func Delete(repoID, userID int64) error {
 		return err
 	}
 
-	// Check ownership
-	if repo.OwnerID != userID {
-		return ErrAccessDenied
-	}
+	// Team grants are removed explicitly since SQL Server cannot cascade
+	// them from both teams and repositories
+	database.DB.Exec("DELETE FROM team_repositories WHERE repository_id = ?", repoID)
 
 	// Delete from database
 	_, err = database.DB.Exec("DELETE FROM repositories WHERE id = ?", repoID)
@@ -198,60 +227,313 @@ func Delete(repoID, userID int64) error {
 	return nil
 }
 
-// CheckAccess checks if a user has access to a repository
-func CheckAccess(repoID, userID int64, permission string) (bool, error) {
-	repo, err := GetByID(repoID)
+// AddDeployKey validates a public key and adds it as a deploy key of a
+// repository
+func AddDeployKey(repoID int64, title, authorizedKey string, readOnly bool) (*models.DeployKey, error) {
+	key, fingerprint, err := auth.ParseSSHKey(authorizedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse, err := auth.SSHKeyInUse(fingerprint)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	if inUse {
+		return nil, auth.ErrKeyExists
 	}
 
-	// Owner has full access
-	if repo.OwnerID == userID {
-		return true, nil
+	result, err := database.DB.Exec(`
+		INSERT INTO deploy_keys (repository_id, title, key, fingerprint, read_only)
+		VALUES (?, ?, ?, ?, ?)
+	`, repoID, title, key, fingerprint, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add deploy key: %w", err)
 	}
 
-	// Public repositories allow read access
-	if !repo.IsPrivate && permission == "read" {
-		return true, nil
+	keyID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deploy key ID: %w", err)
 	}
 
-	// Check collaborations
-	var count int
-	err = database.DB.QueryRow(`
-		SELECT COUNT(*) FROM collaborations
-		WHERE repository_id = ? AND user_id = ? AND permission = ?
-	`, repoID, userID, permission).Scan(&count)
+	return &models.DeployKey{
+		ID:           keyID,
+		RepositoryID: repoID,
+		Title:        title,
+		Key:          key,
+		Fingerprint:  fingerprint,
+		ReadOnly:     readOnly,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// GetDeployKey retrieves one of a repository's deploy keys
+func GetDeployKey(repoID, keyID int64) (*models.DeployKey, error) {
+	var key models.DeployKey
+	err := database.DB.QueryRow(`
+		SELECT id, repository_id, title, key, fingerprint, read_only, created_at
+		FROM deploy_keys WHERE id = ? AND repository_id = ?
+	`, keyID, repoID).Scan(&key.ID, &key.RepositoryID, &key.Title, &key.Key,
+		&key.Fingerprint, &key.ReadOnly, &key.CreatedAt)
 
+	if err == sql.ErrNoRows {
+		return nil, ErrDeployKeyNotFound
+	}
 	if err != nil {
-		return false, fmt.Errorf("failed to check access: %w", err)
+		return nil, fmt.Errorf("failed to query deploy key: %w", err)
 	}
 
-	return count > 0, nil
+	return &key, nil
 }
 
-// AddCollaborator adds a collaborator to a repository
-func AddCollaborator(repoID, userID int64, permission string) error {
-	_, err := database.DB.Exec(`
-		INSERT INTO collaborations (repository_id, user_id, permission)
-		VALUES (?, ?, ?)
-	`, repoID, userID, permission)
+// GetDeployKeyByFingerprint retrieves a deploy key by the SHA256
+// fingerprint of its public key
+func GetDeployKeyByFingerprint(fingerprint string) (*models.DeployKey, error) {
+	var key models.DeployKey
+	err := database.DB.QueryRow(`
+		SELECT id, repository_id, title, key, fingerprint, read_only, created_at
+		FROM deploy_keys WHERE fingerprint = ?
+	`, fingerprint).Scan(&key.ID, &key.RepositoryID, &key.Title, &key.Key,
+		&key.Fingerprint, &key.ReadOnly, &key.CreatedAt)
 
+	if err == sql.ErrNoRows {
+		return nil, ErrDeployKeyNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("failed to add collaborator: %w", err)
+		return nil, fmt.Errorf("failed to query deploy key: %w", err)
 	}
 
+	return &key, nil
+}
+
+// ListDeployKeys lists a repository's deploy keys
+func ListDeployKeys(repoID int64) ([]*models.DeployKey, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, repository_id, title, key, fingerprint, read_only, created_at
+		FROM deploy_keys WHERE repository_id = ?
+		ORDER BY created_at DESC, id DESC
+	`, repoID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deploy keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []*models.DeployKey{}
+	for rows.Next() {
+		var key models.DeployKey
+		if err := rows.Scan(&key.ID, &key.RepositoryID, &key.Title, &key.Key,
+			&key.Fingerprint, &key.ReadOnly, &key.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan deploy key: %w", err)
+		}
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+// DeleteDeployKey removes one of a repository's deploy keys
+func DeleteDeployKey(repoID, keyID int64) error {
+	result, err := database.DB.Exec(`
+		DELETE FROM deploy_keys WHERE id = ? AND repository_id = ?
+	`, keyID, repoID)
+	if err != nil {
+		return fmt.Errorf("failed to delete deploy key: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete deploy key: %w", err)
+	}
+	if affected == 0 {
+		return ErrDeployKeyNotFound
+	}
 	return nil
 }
 
-// RemoveCollaborator removes a collaborator from a repository
+// InviteCollaborator invites a user to collaborate on a repository with
+// the given role. The invitation grants nothing until the user accepts it.
+func InviteCollaborator(repoID, userID int64, permission string) (*models.Collaboration, error) {
+	var existing int
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM collaborations WHERE repository_id = ? AND user_id = ?
+	`, repoID, userID).Scan(&existing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query collaborators: %w", err)
+	}
+	if existing > 0 {
+		return nil, ErrCollaboratorExists
+	}
+
+	result, err := database.DB.Exec(`
+		INSERT INTO collaborations (repository_id, user_id, permission, pending)
+		VALUES (?, ?, ?, ?)
+	`, repoID, userID, permission, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add collaborator: %w", err)
+	}
+
+	collabID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get collaboration ID: %w", err)
+	}
+
+	return &models.Collaboration{
+		ID:           collabID,
+		RepositoryID: repoID,
+		UserID:       userID,
+		Permission:   permission,
+		Pending:      true,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// ListCollaborators lists a repository's collaborators, including pending
+// invitations
+func ListCollaborators(repoID int64) ([]*models.Collaborator, error) {
+	rows, err := database.DB.Query(`
+		SELECT c.id, c.permission, c.pending, c.created_at,
+		       u.id, u.username, u.email, u.full_name, u.is_admin, u.is_active, u.type,
+		       u.created_at, u.updated_at
+		FROM collaborations c
+		JOIN users u ON c.user_id = u.id
+		WHERE c.repository_id = ?
+		ORDER BY c.created_at, c.id
+	`, repoID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query collaborators: %w", err)
+	}
+	defer rows.Close()
+
+	collaborators := []*models.Collaborator{}
+	for rows.Next() {
+		collab := models.Collaborator{User: &models.User{}}
+		var fullName sql.NullString
+		err := rows.Scan(&collab.ID, &collab.Permission, &collab.Pending, &collab.CreatedAt,
+			&collab.User.ID, &collab.User.Username, &collab.User.Email, &fullName,
+			&collab.User.IsAdmin, &collab.User.IsActive, &collab.User.Type, &collab.User.CreatedAt,
+			&collab.User.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan collaborator: %w", err)
+		}
+		collab.User.FullName = fullName.String
+		collaborators = append(collaborators, &collab)
+	}
+
+	return collaborators, rows.Err()
+}
+
+// UpdateCollaborator changes a collaborator's role, or the role offered by
+// a pending invitation
+func UpdateCollaborator(repoID, userID int64, permission string) error {
+	result, err := database.DB.Exec(`
+		UPDATE collaborations SET permission = ?
+		WHERE repository_id = ? AND user_id = ?
+	`, permission, repoID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update collaborator: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update collaborator: %w", err)
+	}
+	if affected == 0 {
+		return ErrCollaboratorNotFound
+	}
+	return nil
+}
+
+// RemoveCollaborator removes a collaborator from a repository, or
+// withdraws their invitation
 func RemoveCollaborator(repoID, userID int64) error {
-	_, err := database.DB.Exec(`
+	result, err := database.DB.Exec(`
 		DELETE FROM collaborations WHERE repository_id = ? AND user_id = ?
 	`, repoID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove collaborator: %w", err)
+	}
 
+	affected, err := result.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("failed to remove collaborator: %w", err)
 	}
+	if affected == 0 {
+		return ErrCollaboratorNotFound
+	}
+	return nil
+}
+
+// ListInvitations lists the collaboration invitations a user has not
+// answered yet
+func ListInvitations(userID int64) ([]*models.Invitation, error) {
+	rows, err := database.DB.Query(`
+		SELECT c.id, c.permission, c.created_at,
+		       r.id, r.name, r.description, r.owner_id, u.username, r.is_private,
+		       r.default_branch, r.require_two_factor, r.size, r.stars, r.forks, r.created_at, r.updated_at
+		FROM collaborations c
+		JOIN repositories r ON c.repository_id = r.id
+		JOIN users u ON r.owner_id = u.id
+		WHERE c.user_id = ? AND c.pending = ?
+		ORDER BY c.created_at DESC, c.id DESC
+	`, userID, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invitations: %w", err)
+	}
+	defer rows.Close()
+
+	invitations := []*models.Invitation{}
+	for rows.Next() {
+		inv := models.Invitation{Repository: &models.Repository{}}
+		repo := inv.Repository
+		err := rows.Scan(&inv.ID, &inv.Permission, &inv.CreatedAt,
+			&repo.ID, &repo.Name, &repo.Description, &repo.OwnerID, &repo.OwnerName,
+			&repo.IsPrivate, &repo.DefaultBranch, &repo.RequireTwoFactor, &repo.Size,
+			&repo.Stars, &repo.Forks, &repo.CreatedAt, &repo.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan invitation: %w", err)
+		}
+		invitations = append(invitations, &inv)
+	}
 
+	return invitations, rows.Err()
+}
+
+// AcceptInvitation accepts one of a user's pending invitations, making
+// them a collaborator
+func AcceptInvitation(userID, invitationID int64) error {
+	result, err := database.DB.Exec(`
+		UPDATE collaborations SET pending = ?
+		WHERE id = ? AND user_id = ? AND pending = ?
+	`, false, invitationID, userID, true)
+	if err != nil {
+		return fmt.Errorf("failed to accept invitation: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to accept invitation: %w", err)
+	}
+	if affected == 0 {
+		return ErrInvitationNotFound
+	}
+	return nil
+}
+
+// DeclineInvitation declines one of a user's pending invitations
+func DeclineInvitation(userID, invitationID int64) error {
+	result, err := database.DB.Exec(`
+		DELETE FROM collaborations WHERE id = ? AND user_id = ? AND pending = ?
+	`, invitationID, userID, true)
+	if err != nil {
+		return fmt.Errorf("failed to decline invitation: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to decline invitation: %w", err)
+	}
+	if affected == 0 {
+		return ErrInvitationNotFound
+	}
 	return nil
 }
@@ -0,0 +1,368 @@
+// Package ssh serves git over SSH. Clients authenticate with a public key
+// registered to a user account or as a repository deploy key, and sessions
+// may only run git-upload-pack, git-receive-pack or git-upload-archive on a
+// repository.
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zixiao/git-server/internal/auth"
+	"github.com/zixiao/git-server/internal/config"
+	"github.com/zixiao/git-server/internal/gitservice"
+	"github.com/zixiao/git-server/internal/repository"
+	"github.com/zixiao/git-server/pkg/gitcore"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Permission extensions carrying the authenticated user or deploy key to
+// the session
+const (
+	extUserID      = "user-id"
+	extIsAdmin     = "is-admin"
+	extDeployKeyID = "deploy-key-id"
+	extRepoID      = "repository-id"
+	extName        = "name"
+)
+
+// Server is the embedded SSH server
+type Server struct {
+	config *gossh.ServerConfig
+}
+
+// NewServer creates an SSH server using the host key at hostKeyPath. An
+// ed25519 host key is generated there if none exists yet.
+func NewServer(hostKeyPath string) (*Server, error) {
+	hostKey, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &gossh.ServerConfig{
+		ServerVersion:     "SSH-2.0-ZiXiaoGit",
+		PublicKeyCallback: authenticateKey,
+	}
+	cfg.AddHostKey(hostKey)
+
+	return &Server{config: cfg}, nil
+}
+
+// ListenAndServe accepts SSH connections on addr until the listener fails
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// authenticateKey accepts a public key registered to an active user or as
+// a deploy key, by its SHA256 fingerprint. The SSH username is ignored,
+// since clients conventionally connect as "git".
+func authenticateKey(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+	fingerprint := gossh.FingerprintSHA256(key)
+
+	user, err := auth.GetUserBySSHKey(fingerprint)
+	if err == nil {
+		return &gossh.Permissions{Extensions: map[string]string{
+			extUserID:  strconv.FormatInt(user.ID, 10),
+			extIsAdmin: strconv.FormatBool(user.IsAdmin),
+			extName:    user.Username,
+		}}, nil
+	}
+	if err != auth.ErrKeyNotFound {
+		return nil, err
+	}
+
+	deployKey, err := repository.GetDeployKeyByFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := repository.GetByID(deployKey.RepositoryID)
+	if err != nil {
+		return nil, err
+	}
+	return &gossh.Permissions{Extensions: map[string]string{
+		extDeployKeyID: strconv.FormatInt(deployKey.ID, 10),
+		extRepoID:      strconv.FormatInt(repo.ID, 10),
+		extName:        repo.OwnerName + "/" + repo.Name,
+	}}, nil
+}
+
+// loadHostKey reads the server's host key, generating an ed25519 key the
+// first time
+func loadHostKey(path string) (gossh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate host key: %w", err)
+		}
+		block, err := gossh.MarshalPrivateKey(key, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode host key: %w", err)
+		}
+
+		data = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create host key directory: %w", err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write host key: %w", err)
+		}
+		log.Printf("Generated SSH host key %s", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %w", err)
+	}
+
+	signer, err := gossh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key: %w", err)
+	}
+	return signer, nil
+}
+
+// handleConn runs the handshake and serves the connection's sessions
+func (s *Server) handleConn(conn net.Conn) {
+	sconn, channels, requests, err := gossh.NewServerConn(conn, s.config)
+	if err != nil {
+		// Failed handshakes and rejected keys are routine; nothing to log
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go gossh.DiscardRequests(requests)
+
+	actor, err := connActor(sconn.Permissions.Extensions)
+	if err != nil {
+		log.Printf("ssh: %v", err)
+		return
+	}
+	name := sconn.Permissions.Extensions[extName]
+
+	// channels is closed when the connection goes away, which cancels every
+	// command still running on it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(gossh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go handleSession(ctx, channel, channelRequests, actor, name)
+	}
+}
+
+// connActor rebuilds the repository actor a connection authenticated as
+// from its permission extensions
+func connActor(ext map[string]string) (*repository.Actor, error) {
+	if ext[extDeployKeyID] != "" {
+		keyID, _ := strconv.ParseInt(ext[extDeployKeyID], 10, 64)
+		repoID, _ := strconv.ParseInt(ext[extRepoID], 10, 64)
+		key, err := repository.GetDeployKey(repoID, keyID)
+		if err != nil {
+			return nil, err
+		}
+		return &repository.Actor{DeployKey: key}, nil
+	}
+
+	userID, _ := strconv.ParseInt(ext[extUserID], 10, 64)
+	isAdmin, _ := strconv.ParseBool(ext[extIsAdmin])
+	return &repository.Actor{UserID: userID, IsAdmin: isAdmin}, nil
+}
+
+// handleSession serves one session: environment variables, then a single
+// exec request. Requests keep being answered while the command runs, and
+// the command is cancelled once the channel closes.
+func handleSession(ctx context.Context, channel gossh.Channel, requests <-chan *gossh.Request, actor *repository.Actor, name string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	gitProtocol := ""
+	started := false
+
+	for req := range requests {
+		switch {
+		case req.Type == "env" && !started:
+			var env struct{ Name, Value string }
+			ok := gossh.Unmarshal(req.Payload, &env) == nil && env.Name == "GIT_PROTOCOL"
+			if ok {
+				gitProtocol = env.Value
+			}
+			req.Reply(ok, nil)
+
+		case req.Type == "exec" && !started:
+			var exec struct{ Command string }
+			if err := gossh.Unmarshal(req.Payload, &exec); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			started = true
+			go func() {
+				status := runCommand(ctx, channel, exec.Command, actor, gitProtocol)
+				exit(channel, status)
+			}()
+
+		case req.Type == "shell" && !started:
+			req.Reply(true, nil)
+			started = true
+			fmt.Fprintf(channel.Stderr(), "Hi %s! You've successfully authenticated, "+
+				"but shell access is not provided.\n", name)
+			exit(channel, 1)
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// exit ends a session with the command's exit status
+func exit(channel gossh.Channel, status uint32) {
+	channel.CloseWrite()
+	channel.SendRequest("exit-status", false, gossh.Marshal(struct{ Status uint32 }{status}))
+	channel.Close()
+}
+
+// runCommand checks access to the repository named in an exec request and
+// runs the git service on the channel, returning the exit status
+func runCommand(ctx context.Context, channel gossh.Channel, command string, actor *repository.Actor, gitProtocol string) uint32 {
+	service, owner, repoName, err := parseCommand(command)
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "fatal: %v\n", err)
+		return 128
+	}
+
+	repo, err := repository.Get(owner, repoName)
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "fatal: repository '%s/%s' not found\n", owner, repoName)
+		return 128
+	}
+
+	action := repository.ActionRead
+	if service == gitservice.ServiceReceivePack {
+		action = repository.ActionWrite
+	}
+	if err := repository.Authorize(actor, repo, action); err != nil {
+		if err == repository.ErrTwoFactorRequired {
+			fmt.Fprintf(channel.Stderr(), "fatal: %s/%s requires two-factor authentication; enable it on your account\n", owner, repoName)
+			return 128
+		}
+		fmt.Fprintf(channel.Stderr(), "fatal: access denied to %s/%s\n", owner, repoName)
+		return 128
+	}
+
+	gitRepo := gitcore.NewRepository(config.GlobalConfig.GetRepoPath(owner, repoName))
+	defer gitRepo.Free()
+
+	switch service {
+	case gitservice.ServiceUploadPack:
+		err = gitservice.ServeUploadPack(ctx, gitRepo, channel, channel, gitcore.IsProtocolV2(gitProtocol))
+	case gitservice.ServiceReceivePack:
+		err = gitservice.ServeReceivePack(ctx, gitRepo, channel, channel)
+	case gitservice.ServiceUploadArchive:
+		err = gitservice.ServeUploadArchive(gitRepo, channel, channel)
+	}
+	if err != nil {
+		log.Printf("ssh: %s %s/%s: %v", service, owner, repoName, err)
+		return 1
+	}
+	return 0
+}
+
+// parseCommand splits an exec request such as
+// "git-upload-pack '/alice/demo.git'" into the service and the owner and
+// name of the repository
+func parseCommand(command string) (string, string, string, error) {
+	service, arg, _ := strings.Cut(strings.TrimSpace(command), " ")
+	if service == "git" {
+		// "git upload-pack '...'" is accepted as well
+		var sub string
+		sub, arg, _ = strings.Cut(strings.TrimSpace(arg), " ")
+		service = "git-" + sub
+	}
+
+	switch service {
+	case gitservice.ServiceUploadPack, gitservice.ServiceReceivePack, gitservice.ServiceUploadArchive:
+	default:
+		return "", "", "", fmt.Errorf("unsupported command: %s", command)
+	}
+
+	path, err := unquote(strings.TrimSpace(arg))
+	if err != nil {
+		return "", "", "", err
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+
+	owner, repoName, ok := strings.Cut(path, "/")
+	if !ok || !validPathPart(owner) || !validPathPart(repoName) {
+		return "", "", "", fmt.Errorf("invalid repository path '%s'", path)
+	}
+	return service, owner, repoName, nil
+}
+
+// validPathPart reports whether s can be an owner or repository name
+func validPathPart(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/\\")
+}
+
+// unquote undoes the shell quoting git applies to the repository path:
+// single or double quotes, and backslash escapes outside of them
+func unquote(s string) (string, error) {
+	var out strings.Builder
+	var quote rune
+	escaped := false
+	for _, ch := range s {
+		switch {
+		case escaped:
+			out.WriteRune(ch)
+			escaped = false
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else {
+				out.WriteRune(ch)
+			}
+		case ch == '\\':
+			escaped = true
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ' ':
+			return "", errors.New("unexpected argument after repository path")
+		default:
+			out.WriteRune(ch)
+		}
+	}
+	if quote != 0 || escaped {
+		return "", errors.New("unterminated quote in repository path")
+	}
+	return out.String(), nil
+}
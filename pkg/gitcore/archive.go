@@ -0,0 +1,385 @@
+package gitcore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ArchiveOptions describes a git archive request
+type ArchiveOptions struct {
+	// Format is tar, tgz (or tar.gz) or zip
+	Format string
+	// Prefix is prepended to every path in the archive
+	Prefix string
+	// Treeish names what to archive: a ref, optionally followed by
+	// ":<path>" to archive a subdirectory
+	Treeish string
+	// Paths limits the archive to these paths; empty includes everything
+	Paths []string
+	// Level is the tgz or zip compression level, 0-9, or -1 for the default
+	Level int
+}
+
+// ParseArchiveArgs parses the arguments of an upload-archive request, as
+// "git archive --remote" sends them
+func ParseArchiveArgs(args []string) (*ArchiveOptions, error) {
+	opts := &ArchiveOptions{Format: "tar", Level: -1}
+	pathsOnly := false
+	for _, arg := range args {
+		switch {
+		case pathsOnly:
+			opts.Paths = append(opts.Paths, arg)
+		case arg == "--":
+			pathsOnly = true
+		case strings.HasPrefix(arg, "--format="):
+			opts.Format = strings.TrimPrefix(arg, "--format=")
+		case strings.HasPrefix(arg, "--prefix="):
+			opts.Prefix = strings.TrimPrefix(arg, "--prefix=")
+		case len(arg) == 2 && arg[0] == '-' && arg[1] >= '0' && arg[1] <= '9':
+			opts.Level = int(arg[1] - '0')
+		case arg == "-v" || arg == "--verbose":
+			// Progress is not reported
+		case strings.HasPrefix(arg, "-"):
+			return nil, fmt.Errorf("unsupported archive option %s", arg)
+		case opts.Treeish == "":
+			opts.Treeish = arg
+		default:
+			opts.Paths = append(opts.Paths, arg)
+		}
+	}
+
+	switch opts.Format {
+	case "tar", "tgz", "tar.gz", "zip":
+	default:
+		return nil, fmt.Errorf("unknown archive format '%s'", opts.Format)
+	}
+	if opts.Treeish == "" {
+		return nil, errors.New("no tree-ish to archive")
+	}
+	for i, path := range opts.Paths {
+		opts.Paths[i] = strings.Trim(path, "/")
+	}
+	return opts, nil
+}
+
+// archiveEntry is a file, directory, symlink or submodule in an archive
+type archiveEntry struct {
+	path string
+	mode string
+	sha  string
+}
+
+func (e *archiveEntry) isDir() bool {
+	return e.mode == "40000" || e.mode == "160000"
+}
+
+// WriteArchive writes a tar, tgz or zip archive of a tree to w. Only refs
+// can be archived, not arbitrary object names, so unreachable objects stay
+// private.
+func (r *Repository) WriteArchive(w io.Writer, opts *ArchiveOptions) error {
+	commit, tree, mtime, err := r.resolveArchiveTree(opts.Treeish)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range opts.Paths {
+		if path != "" && !r.treeHasPath(tree, path) {
+			return fmt.Errorf("pathspec '%s' did not match any files", path)
+		}
+	}
+
+	switch opts.Format {
+	case "zip":
+		return r.writeZip(w, opts, commit, tree, mtime)
+	case "tgz", "tar.gz":
+		level := opts.Level
+		if level < 0 {
+			level = gzip.DefaultCompression
+		}
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return err
+		}
+		if err := r.writeTar(gz, opts, commit, tree, mtime); err != nil {
+			return err
+		}
+		return gz.Close()
+	default:
+		return r.writeTar(w, opts, commit, tree, mtime)
+	}
+}
+
+// resolveArchiveTree resolves "<ref>[:<path>]" to a tree, along with the
+// commit it came from (empty for a tree ref) and the time to stamp on
+// archived files
+func (r *Repository) resolveArchiveTree(treeish string) (string, string, time.Time, error) {
+	name, path, _ := strings.Cut(treeish, ":")
+
+	var sha string
+	ok := false
+	if name == "HEAD" {
+		if head, err := r.GetHead(); err == nil {
+			sha, ok = r.resolveRef(head)
+		}
+	} else {
+		sha, ok = r.resolveRef(name)
+	}
+	if !ok {
+		return "", "", time.Time{}, fmt.Errorf("no such ref: %s", name)
+	}
+	if target, isTag := r.PeelTag(sha); isTag {
+		sha = target
+	}
+
+	objType, data, err := r.readObject(sha)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	commit, tree, mtime := "", sha, time.Now()
+	switch objType {
+	case ObjectCommit:
+		commit = sha
+		tree, mtime = parseCommitTree(sha, data)
+		if tree == "" {
+			return "", "", time.Time{}, fmt.Errorf("invalid commit %s", sha)
+		}
+	case ObjectTree:
+	default:
+		return "", "", time.Time{}, fmt.Errorf("not a tree object: %s", name)
+	}
+
+	if path = strings.Trim(path, "/"); path != "" {
+		entry, err := r.lookupTreePath(tree, path)
+		if err != nil {
+			return "", "", time.Time{}, err
+		}
+		if entry.mode != "40000" {
+			return "", "", time.Time{}, fmt.Errorf("not a tree object: %s", treeish)
+		}
+		tree = entry.sha
+	}
+	return commit, tree, mtime, nil
+}
+
+// parseCommitTree returns the tree and committer time of a raw commit
+func parseCommitTree(sha string, data []byte) (string, time.Time) {
+	commit, err := parseCommit(sha, data)
+	if err != nil {
+		return "", time.Now()
+	}
+	if commit.Committer.When.IsZero() {
+		return commit.Tree, time.Now()
+	}
+	return commit.Tree, commit.Committer.When
+}
+
+// readTreeEntries reads a tree's entries, paths relative to the tree
+func (r *Repository) readTreeEntries(sha string) ([]archiveEntry, error) {
+	tree, err := r.ReadTree(sha)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]archiveEntry, len(tree.Entries))
+	for i, entry := range tree.Entries {
+		entries[i] = archiveEntry{path: entry.Name, mode: entry.Mode, sha: entry.SHA}
+	}
+	return entries, nil
+}
+
+// lookupTreePath finds the entry at a slash-separated path below a tree
+func (r *Repository) lookupTreePath(tree, path string) (*archiveEntry, error) {
+	entry, err := r.TreeEntryByPath(tree, path)
+	if errors.Is(err, ErrPathNotFound) {
+		return nil, fmt.Errorf("path '%s' does not exist", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &archiveEntry{path: entry.Name, mode: entry.Mode, sha: entry.SHA}, nil
+}
+
+// treeHasPath reports whether path exists below a tree
+func (r *Repository) treeHasPath(tree, path string) bool {
+	_, err := r.lookupTreePath(tree, path)
+	return err == nil
+}
+
+// walkArchive calls fn for every entry below a tree in tree order, parent
+// directories first, keeping only entries under one of paths
+func (r *Repository) walkArchive(tree, base string, paths []string, fn func(*archiveEntry) error) error {
+	entries, err := r.readTreeEntries(tree)
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		entry.path = base + entry.path
+
+		selected, ancestor := archivePathMatch(entry.path, paths)
+		if !selected && !(ancestor && entry.mode == "40000") {
+			continue
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+		if entry.mode == "40000" {
+			if err := r.walkArchive(entry.sha, entry.path+"/", paths, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archivePathMatch reports whether path is selected by paths (it or one
+// of its parents is listed) or is a directory leading to a listed path
+func archivePathMatch(path string, paths []string) (selected, ancestor bool) {
+	if len(paths) == 0 {
+		return true, false
+	}
+	for _, p := range paths {
+		if p == "" || path == p || strings.HasPrefix(path, p+"/") {
+			return true, false
+		}
+		if strings.HasPrefix(p, path+"/") {
+			ancestor = true
+		}
+	}
+	return false, ancestor
+}
+
+// writeTar writes a tar archive the way git archive does: a pax header
+// carrying the commit ID, then entries with a 0002 umask applied
+func (r *Repository) writeTar(w io.Writer, opts *ArchiveOptions, commit, tree string, mtime time.Time) error {
+	tw := tar.NewWriter(w)
+
+	if commit != "" {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{"comment": commit},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	header := func(name string) *tar.Header {
+		return &tar.Header{Name: name, ModTime: mtime, Uname: "root", Gname: "root"}
+	}
+
+	if strings.HasSuffix(opts.Prefix, "/") {
+		hdr := header(opts.Prefix)
+		hdr.Typeflag, hdr.Mode = tar.TypeDir, 0775
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	err := r.walkArchive(tree, "", opts.Paths, func(entry *archiveEntry) error {
+		hdr := header(opts.Prefix + entry.path)
+		if entry.isDir() {
+			hdr.Name += "/"
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0775
+			return tw.WriteHeader(hdr)
+		}
+
+		_, data, err := r.readObject(entry.sha)
+		if err != nil {
+			return err
+		}
+		switch entry.mode {
+		case "120000":
+			hdr.Typeflag, hdr.Mode, hdr.Linkname = tar.TypeSymlink, 0777, string(data)
+			return tw.WriteHeader(hdr)
+		case "100755":
+			hdr.Mode = 0775
+		default:
+			hdr.Mode = 0664
+		}
+		hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(data))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeZip writes a zip archive, with the commit ID as the archive comment
+func (r *Repository) writeZip(w io.Writer, opts *ArchiveOptions, commit, tree string, mtime time.Time) error {
+	zw := zip.NewWriter(w)
+	if opts.Level > 0 {
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, opts.Level)
+		})
+	}
+	if commit != "" {
+		if err := zw.SetComment(commit); err != nil {
+			return err
+		}
+	}
+
+	method := zip.Deflate
+	if opts.Level == 0 {
+		method = zip.Store
+	}
+
+	if strings.HasSuffix(opts.Prefix, "/") {
+		hdr := &zip.FileHeader{Name: opts.Prefix, Method: zip.Store, Modified: mtime}
+		hdr.SetMode(os.ModeDir | 0775)
+		if _, err := zw.CreateHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	err := r.walkArchive(tree, "", opts.Paths, func(entry *archiveEntry) error {
+		hdr := &zip.FileHeader{Name: opts.Prefix + entry.path, Method: method, Modified: mtime}
+		if entry.isDir() {
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+			hdr.SetMode(os.ModeDir | 0775)
+			_, err := zw.CreateHeader(hdr)
+			return err
+		}
+
+		_, data, err := r.readObject(entry.sha)
+		if err != nil {
+			return err
+		}
+		switch entry.mode {
+		case "120000":
+			hdr.Method = zip.Store
+			hdr.SetMode(os.ModeSymlink | 0777)
+		case "100755":
+			hdr.SetMode(0775)
+		default:
+			hdr.SetMode(0664)
+		}
+		out, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
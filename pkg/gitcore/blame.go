@@ -0,0 +1,468 @@
+package gitcore
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNotFile is returned when blaming a path that is not a file
+var ErrNotFile = errors.New("not a file")
+
+// blameCacheSize is how many blame results are kept for reuse
+const blameCacheSize = 256
+
+// tailBlockSize is the block size git trims common file tails in before
+// a diff without context
+const tailBlockSize = 1024
+
+// BlameOptions controls how a file is blamed
+type BlameOptions struct {
+	// FollowRenames keeps blaming lines past the commit that renamed the
+	// file, as git blame does
+	FollowRenames bool
+	Algorithm     DiffAlgorithm
+}
+
+// BlameHunk is a run of lines that came from the same commit
+type BlameHunk struct {
+	Commit *Commit
+	// Path is the path of the file in Commit, which differs from the
+	// blamed path if the file was renamed since
+	Path string
+	// StartLine is the 1-based number of the first line in the blamed
+	// file, and OrigStartLine its number in Commit's version of the file
+	StartLine     int
+	OrigStartLine int
+	Lines         int
+}
+
+// Blame attributes each line of a file to the commit that wrote it. Blame
+// results are shared through a cache and must not be modified.
+type Blame struct {
+	// Commit is the commit that last changed the file, where blaming
+	// starts
+	Commit *Commit
+	Path   string
+	SHA    string
+	// Hunks cover the lines of the file in order
+	Hunks []BlameHunk
+}
+
+// Blame finds, for each line of the file at path in start, the commit
+// that introduced it. History is walked from start, passing lines that a
+// commit left unchanged on to its parents, as git blame does; lines still
+// held by a commit once its parents have taken theirs are its own.
+//
+// Nothing is blamed on commits that left the file alone, so the result
+// only depends on the blob and the commit that last changed it. Results
+// are cached by those, and views of a hot file at later commits are
+// answered from the cache.
+func (r *Repository) Blame(start *Commit, path string, opts *BlameOptions) (*Blame, error) {
+	if opts == nil {
+		opts = &BlameOptions{FollowRenames: true}
+	}
+	path = strings.Trim(path, "/")
+
+	b := &blamer{
+		repo:    r,
+		opts:    opts,
+		queue:   &commitQueue{},
+		pending: map[string]map[string]*blameOrigin{},
+	}
+	sha, err := b.blobAt(start.Tree, path)
+	if err != nil {
+		return nil, err
+	}
+	if sha == "" {
+		return nil, ErrNotFile
+	}
+	commit, err := b.lastChange(start, path, sha)
+	if err != nil {
+		return nil, err
+	}
+
+	key := blameKey{blob: sha, commit: commit.SHA, path: path, opts: *opts}
+	if blame, ok := blameCache.get(key); ok {
+		return blame, nil
+	}
+
+	origin := &blameOrigin{commit: commit, path: path, sha: sha}
+	if err := b.load(origin); err != nil {
+		return nil, err
+	}
+	if len(origin.lines) > 0 {
+		origin.entries = []blameEntry{{count: len(origin.lines)}}
+		b.queueOrigin(origin)
+	}
+
+	for b.queue.Len() > 0 {
+		commit := b.queue.pop()
+		origins := b.pending[commit.SHA]
+		delete(b.pending, commit.SHA)
+
+		paths := make([]string, 0, len(origins))
+		for path := range origins {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			if err := b.pass(origins[path]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	blame := &Blame{Commit: commit, Path: path, SHA: sha, Hunks: coalesceHunks(b.hunks)}
+	blameCache.add(key, blame)
+	return blame, nil
+}
+
+// blameEntry is a run of count lines of the blamed file, starting at line
+// final, that are lines orig on of an origin's version of the file.
+// Numbers are 0-based.
+type blameEntry struct {
+	final, orig, count int
+}
+
+// blameOrigin is the file as it was in a commit, and the lines blamed on
+// that version so far
+type blameOrigin struct {
+	commit  *Commit
+	path    string
+	sha     string
+	data    []byte
+	lines   []string
+	entries []blameEntry
+}
+
+// blamer holds the state of one blame
+type blamer struct {
+	repo *Repository
+	opts *BlameOptions
+	// queue holds the commits with lines to pass on, newest first, and
+	// pending their origins by path
+	queue   *commitQueue
+	pending map[string]map[string]*blameOrigin
+	hunks   []BlameHunk
+}
+
+// blobAt returns the blob at a path below a tree, or "" if there is no
+// file there
+func (b *blamer) blobAt(tree, path string) (string, error) {
+	entry, err := b.repo.TreeEntryByPath(tree, path)
+	if err != nil {
+		if errors.Is(err, ErrPathNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	if entry.Type() != ObjectBlob {
+		return "", nil
+	}
+	return entry.SHA, nil
+}
+
+// lastChange follows start back through parents that have the same file
+// to the commit that gave the file its content
+func (b *blamer) lastChange(start *Commit, path, sha string) (*Commit, error) {
+	commit := start
+	for {
+		var next *Commit
+		for _, parentSHA := range commit.Parents {
+			parent, err := b.repo.ReadCommit(parentSHA)
+			if err != nil {
+				return nil, err
+			}
+			parentBlob, err := b.blobAt(parent.Tree, path)
+			if err != nil {
+				return nil, err
+			}
+			if parentBlob == sha {
+				next = parent
+				break
+			}
+		}
+		if next == nil {
+			return commit, nil
+		}
+		commit = next
+	}
+}
+
+// load reads the lines of an origin's version of the file
+func (b *blamer) load(o *blameOrigin) error {
+	if o.lines != nil {
+		return nil
+	}
+	blob, err := b.repo.ReadBlob(o.sha)
+	if err != nil {
+		return err
+	}
+	o.data = blob.Data
+	o.lines = splitLines(blob.Data)
+	if o.lines == nil {
+		o.lines = []string{}
+	}
+	return nil
+}
+
+// queueOrigin queues the lines blamed on an origin, merging them with
+// lines already queued for the same version
+func (b *blamer) queueOrigin(o *blameOrigin) {
+	origins := b.pending[o.commit.SHA]
+	if origins == nil {
+		origins = map[string]*blameOrigin{}
+		b.pending[o.commit.SHA] = origins
+		b.queue.push(o.commit)
+	}
+	if queued, ok := origins[o.path]; ok {
+		queued.entries = append(queued.entries, o.entries...)
+		return
+	}
+	origins[o.path] = o
+}
+
+// pass hands the lines blamed on an origin to the parents of its commit
+// and keeps the rest. A parent with the same version of the file takes
+// every line; otherwise each parent in turn takes the lines it has
+// unchanged.
+func (b *blamer) pass(o *blameOrigin) error {
+	parents := make([]*blameOrigin, 0, len(o.commit.Parents))
+	for _, sha := range o.commit.Parents {
+		parent, err := b.repo.ReadCommit(sha)
+		if err != nil {
+			return err
+		}
+		p, err := b.parentOrigin(o, parent)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			continue
+		}
+		if p.sha == o.sha {
+			p.entries = o.entries
+			b.queueOrigin(p)
+			return nil
+		}
+		parents = append(parents, p)
+	}
+
+	for _, p := range parents {
+		if len(o.entries) == 0 {
+			break
+		}
+		if err := b.passToParent(o, p); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range o.entries {
+		b.hunks = append(b.hunks, BlameHunk{
+			Commit:        o.commit,
+			Path:          o.path,
+			StartLine:     e.final + 1,
+			OrigStartLine: e.orig + 1,
+			Lines:         e.count,
+		})
+	}
+	return nil
+}
+
+// parentOrigin finds the version of an origin's file in a parent: at the
+// same path, or with FollowRenames, at the path it was renamed from. It
+// returns nil when the parent has no such file.
+func (b *blamer) parentOrigin(o *blameOrigin, parent *Commit) (*blameOrigin, error) {
+	sha, err := b.blobAt(parent.Tree, o.path)
+	if err != nil {
+		return nil, err
+	}
+	if sha != "" {
+		return &blameOrigin{commit: parent, path: o.path, sha: sha}, nil
+	}
+	if !b.opts.FollowRenames {
+		return nil, nil
+	}
+
+	var files []*FileDiff
+	if err := b.repo.treeChanges(parent.Tree, o.commit.Tree, "", &files); err != nil {
+		return nil, err
+	}
+	opts := DefaultDiffOptions()
+	opts.DetectCopies = false
+	if files, err = b.repo.detectRenames(files, opts); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if (f.Status == StatusRenamed || f.Status == StatusCopied) && f.NewPath == o.path {
+			return &blameOrigin{commit: parent, path: f.OldPath, sha: f.OldSHA}, nil
+		}
+	}
+	return nil, nil
+}
+
+// passToParent diffs a parent's version of the file against an origin's
+// and moves the lines the parent already had to it
+func (b *blamer) passToParent(o, p *blameOrigin) error {
+	if err := b.load(o); err != nil {
+		return err
+	}
+	if err := b.load(p); err != nil {
+		return err
+	}
+
+	// The line of the parent's version each line came from, or -1. Like
+	// git, the common tail is left out of the diff, which can move where
+	// a change is placed.
+	tail := commonTailLines(p.data, o.data)
+	pLines, oLines := p.lines[:len(p.lines)-tail], o.lines[:len(o.lines)-tail]
+	deleted, inserted := diffLines(pLines, oLines, b.opts.Algorithm)
+	from := make([]int, len(o.lines))
+	i := 0
+	for j := range o.lines {
+		if j < len(oLines) && inserted[j] {
+			from[j] = -1
+			continue
+		}
+		for i < len(pLines) && deleted[i] {
+			i++
+		}
+		from[j] = i
+		i++
+	}
+
+	var kept, passed []blameEntry
+	for _, e := range o.entries {
+		for k := 0; k < e.count; {
+			start, first := k, from[e.orig+k]
+			if first < 0 {
+				for k < e.count && from[e.orig+k] < 0 {
+					k++
+				}
+				kept = append(kept, blameEntry{e.final + start, e.orig + start, k - start})
+				continue
+			}
+			for k < e.count && from[e.orig+k] == first+k-start {
+				k++
+			}
+			passed = append(passed, blameEntry{e.final + start, first, k - start})
+		}
+	}
+
+	o.entries = kept
+	if len(passed) > 0 {
+		p.entries = passed
+		b.queueOrigin(p)
+	}
+	return nil
+}
+
+// commonTailLines counts the lines at the end of a and b that git leaves
+// out of a diff without context: their common tail in whole blocks, less
+// the part of a line the tail starts in
+func commonTailLines(a, b []byte) int {
+	trimmed := 0
+	for trimmed+tailBlockSize <= min(len(a), len(b)) &&
+		bytes.Equal(a[len(a)-trimmed-tailBlockSize:len(a)-trimmed], b[len(b)-trimmed-tailBlockSize:len(b)-trimmed]) {
+		trimmed += tailBlockSize
+	}
+
+	tail := a[len(a)-trimmed:]
+	i := bytes.IndexByte(tail, '\n')
+	if i < 0 {
+		return 0
+	}
+	tail = tail[i+1:]
+	lines := bytes.Count(tail, []byte{'\n'})
+	if len(tail) > 0 && tail[len(tail)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
+
+// coalesceHunks sorts hunks by line and joins neighbours that continue
+// each other in the same commit
+func coalesceHunks(hunks []BlameHunk) []BlameHunk {
+	sort.Slice(hunks, func(i, j int) bool {
+		return hunks[i].StartLine < hunks[j].StartLine
+	})
+
+	var out []BlameHunk
+	for _, h := range hunks {
+		if n := len(out); n > 0 {
+			last := &out[n-1]
+			if last.Commit.SHA == h.Commit.SHA && last.Path == h.Path &&
+				last.StartLine+last.Lines == h.StartLine &&
+				last.OrigStartLine+last.Lines == h.OrigStartLine {
+				last.Lines += h.Lines
+				continue
+			}
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// blameKey identifies a blame result: the file's blob and path, the
+// commit that last changed it and the options
+type blameKey struct {
+	blob, commit, path string
+	opts               BlameOptions
+}
+
+// blameLRU keeps recent blame results, dropping the least recently used.
+// Commits name their whole history, so results hold across repositories.
+type blameLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[blameKey]*list.Element
+}
+
+// blameCacheEntry is an element of a blameLRU's order
+type blameCacheEntry struct {
+	key   blameKey
+	blame *Blame
+}
+
+// blameCache is shared by all repositories
+var blameCache = &blameLRU{
+	size:    blameCacheSize,
+	order:   list.New(),
+	entries: map[blameKey]*list.Element{},
+}
+
+// get returns a cached result and marks it as recently used
+func (c *blameLRU) get(key blameKey) (*Blame, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*blameCacheEntry).blame, true
+}
+
+// add caches a result, dropping the least recently used one when full
+func (c *blameLRU) add(key blameKey, blame *Blame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*blameCacheEntry).blame = blame
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&blameCacheEntry{key: key, blame: blame})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*blameCacheEntry).key)
+	}
+}
@@ -0,0 +1,70 @@
+package gitcore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The expected runs in testdata/history are git blame's for c8 of the
+// history fixture, made by testdata/history.sh
+func TestBlameMatchesGit(t *testing.T) {
+	repo := openTestHistory(t)
+	commit := testCommit(t, repo, "tags/c8")
+
+	tests := []struct {
+		path string
+		what string
+	}{
+		{"store.go", "lines of the first commit split by later changes"},
+		{"cache.go", "copied file, which is not followed"},
+		{"text/text.go", "renamed file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			blame, err := repo.Blame(commit, tt.path, &BlameOptions{FollowRenames: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got strings.Builder
+			for _, hunk := range blame.Hunks {
+				fmt.Fprintf(&got, "%s %d %d %d %s\n", hunk.Commit.SHA,
+					hunk.OrigStartLine, hunk.StartLine, hunk.Lines, hunk.Path)
+			}
+			want := readTestdata(t, "history", strings.ReplaceAll(tt.path, "/", "_")+".blame")
+			if got.String() != string(want) {
+				t.Errorf("%s: hunks differ from git\ngot:\n%s\nwant:\n%s", tt.what, got.String(), want)
+			}
+		})
+	}
+}
+
+// Without rename following, lines of a renamed file stop at the rename
+func TestBlameWithoutRenames(t *testing.T) {
+	repo := openTestHistory(t)
+	commit := testCommit(t, repo, "tags/c8")
+	rename := testCommit(t, repo, "tags/c3")
+	added := testCommit(t, repo, "tags/c7")
+
+	blame, err := repo.Blame(commit, "text/text.go", &BlameOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BlameHunk{
+		{Commit: rename, Path: "text/text.go", StartLine: 1, OrigStartLine: 1, Lines: 26},
+		{Commit: added, Path: "text/text.go", StartLine: 27, OrigStartLine: 27, Lines: 5},
+	}
+	if len(blame.Hunks) != len(want) {
+		t.Fatalf("got %d hunks, want %d", len(blame.Hunks), len(want))
+	}
+	for i, hunk := range blame.Hunks {
+		w := want[i]
+		if hunk.Commit.SHA != w.Commit.SHA || hunk.Path != w.Path || hunk.StartLine != w.StartLine ||
+			hunk.OrigStartLine != w.OrigStartLine || hunk.Lines != w.Lines {
+			t.Errorf("hunk %d = %s %s %d %d %d, want %s %s %d %d %d", i,
+				hunk.Commit.SHA, hunk.Path, hunk.StartLine, hunk.OrigStartLine, hunk.Lines,
+				w.Commit.SHA, w.Path, w.StartLine, w.OrigStartLine, w.Lines)
+		}
+	}
+}
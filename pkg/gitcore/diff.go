@@ -0,0 +1,913 @@
+package gitcore
+
+import (
+	"math"
+	"strings"
+)
+
+// DiffAlgorithm selects how the changed lines between two texts are found
+type DiffAlgorithm int
+
+const (
+	// DiffMyers finds a minimal set of changed lines, like git by default
+	DiffMyers DiffAlgorithm = iota
+	// DiffHistogram anchors on lines that occur rarely in both texts,
+	// which often reads better when code moves around
+	DiffHistogram
+)
+
+// Limits of the line filtering done before a Myers diff, as in git
+const (
+	maxEqualLimit = 1024
+	simScanWindow = 100
+	keepRunFactor = 4
+)
+
+// Limits of a Myers search, as in git. A search costing more than
+// heurMinCost edits may stop at a snake of snakeCount lines on a path
+// heurFactor times longer than the cost; one costing the square root of
+// its size, at least minMaxCost, stops at its furthest path.
+const (
+	minMaxCost  = 256
+	heurMinCost = 256
+	snakeCount  = 20
+	heurFactor  = 4
+)
+
+// maxChainLength is how often a line may occur in the old text and still
+// anchor a histogram diff; past it, the region falls back to Myers
+const maxChainLength = 64
+
+// LineOp is what a diff line does
+type LineOp byte
+
+// Diff line operations, as they prefix lines in a unified diff
+const (
+	LineContext LineOp = ' '
+	LineAdded   LineOp = '+'
+	LineDeleted LineOp = '-'
+)
+
+// DiffLine is one line of a hunk
+type DiffLine struct {
+	Op LineOp
+	// Content is the line without its line ending
+	Content string
+	// OldNumber and NewNumber are the line's 1-based numbers in the old
+	// and new text; 0 on the side the line is not in
+	OldNumber int
+	NewNumber int
+	// NoNewline marks a last line that has no line ending
+	NoNewline bool
+}
+
+// Hunk is a run of changed lines with the unchanged lines around them
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	// Section is the line above the hunk that names where it is, such
+	// as a function signature, as git shows after the hunk range
+	Section string
+	Lines   []DiffLine
+}
+
+// DiffText compares two texts line by line and returns the hunks that
+// turn a into b, with context unchanged lines around each change, and
+// how many lines were added and deleted
+func DiffText(a, b []byte, context int, algorithm DiffAlgorithm) ([]Hunk, int, int) {
+	aLines, bLines := splitLines(a), splitLines(b)
+	deleted, inserted := diffLines(aLines, bLines, algorithm)
+	return buildHunks(aLines, bLines, deleted, inserted, context)
+}
+
+// diffLines marks which lines of a are deleted and which of b inserted
+// to turn a into b
+func diffLines(aLines, bLines []string, algorithm DiffAlgorithm) ([]bool, []bool) {
+	// Lines are compared as numbers
+	ids := map[string]int{}
+	intern := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+
+	d := &lineDiffer{
+		a:        intern(aLines),
+		b:        intern(bLines),
+		deleted:  make([]bool, len(aLines)),
+		inserted: make([]bool, len(bLines)),
+	}
+	if algorithm == DiffHistogram {
+		d.histogram(0, len(aLines), 0, len(bLines))
+	} else {
+		d.filteredMyers(0, len(aLines), 0, len(bLines))
+	}
+	compact(d.a, aLines, d.deleted, d.inserted)
+	compact(d.b, bLines, d.inserted, d.deleted)
+	return d.deleted, d.inserted
+}
+
+// splitLines splits text into lines that keep their "\n"; only the last
+// line may lack one
+func splitLines(data []byte) []string {
+	text := string(data)
+	var lines []string
+	for text != "" {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			lines = append(lines, text)
+			break
+		}
+		lines = append(lines, text[:i+1])
+		text = text[i+1:]
+	}
+	return lines
+}
+
+// lineDiffer marks which lines of a are deleted and which of b inserted
+type lineDiffer struct {
+	a, b     []int
+	deleted  []bool
+	inserted []bool
+	// forward and backward hold the Myers paths by diagonal, offset by
+	// diagonal; maxCost is where a search settles for the furthest path
+	forward  []int
+	backward []int
+	diagonal int
+	maxCost  int
+}
+
+// trim narrows a region to where it starts and ends differing
+func (d *lineDiffer) trim(aLo, aHi, bLo, bHi int) (int, int, int, int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		aLo++
+		bLo++
+	}
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+	return aLo, aHi, bLo, bHi
+}
+
+// markAll marks a whole region as changed
+func (d *lineDiffer) markAll(aLo, aHi, bLo, bHi int) {
+	for i := aLo; i < aHi; i++ {
+		d.deleted[i] = true
+	}
+	for j := bLo; j < bHi; j++ {
+		d.inserted[j] = true
+	}
+}
+
+// filteredMyers runs Myers on a region, only on the lines that may match,
+// as git does. Lines with no match on the other side are changed anyway,
+// and lines with many matches are dropped inside runs of such lines,
+// which keeps them from pairing up with far away lines.
+func (d *lineDiffer) filteredMyers(aLo, aHi, bLo, bHi int) {
+	// Matches are counted in the whole region, but only its differing
+	// middle is searched
+	wholeA, wholeB := d.a[aLo:aHi], d.b[bLo:bHi]
+	aLo, aHi, bLo, bHi = d.trim(aLo, aHi, bLo, bHi)
+	keepA := keepLines(d.a[aLo:aHi], wholeB, len(wholeA))
+	keepB := keepLines(d.b[bLo:bHi], wholeA, len(wholeB))
+
+	sub := &lineDiffer{}
+	var aIndex, bIndex []int
+	for i, keep := range keepA {
+		if keep {
+			sub.a = append(sub.a, d.a[aLo+i])
+			aIndex = append(aIndex, aLo+i)
+		} else {
+			d.deleted[aLo+i] = true
+		}
+	}
+	for j, keep := range keepB {
+		if keep {
+			sub.b = append(sub.b, d.b[bLo+j])
+			bIndex = append(bIndex, bLo+j)
+		} else {
+			d.inserted[bLo+j] = true
+		}
+	}
+
+	sub.deleted = make([]bool, len(sub.a))
+	sub.inserted = make([]bool, len(sub.b))
+	diagonals := len(sub.a) + len(sub.b) + 3
+	sub.forward = make([]int, diagonals)
+	sub.backward = make([]int, diagonals)
+	sub.diagonal = len(sub.b) + 1
+	sub.maxCost = max(bogoSqrt(diagonals), minMaxCost)
+	sub.myers(0, len(sub.a), 0, len(sub.b), false)
+	for i, deleted := range sub.deleted {
+		if deleted {
+			d.deleted[aIndex[i]] = true
+		}
+	}
+	for j, inserted := range sub.inserted {
+		if inserted {
+			d.inserted[bIndex[j]] = true
+		}
+	}
+}
+
+// Line matches, for filtering lines before a Myers diff
+const (
+	matchNone = iota
+	matchSome
+	matchMany
+)
+
+// keepLines decides which of the lines that differ take part in a Myers
+// diff against the whole other text; total is the line count of their
+// own text
+func keepLines(lines, other []int, total int) []bool {
+	counts := map[int]int{}
+	for _, id := range other {
+		counts[id]++
+	}
+	limit := min(bogoSqrt(total), maxEqualLimit)
+
+	matches := make([]int, len(lines))
+	for i, id := range lines {
+		switch n := counts[id]; {
+		case n == 0:
+			matches[i] = matchNone
+		case n >= limit:
+			matches[i] = matchMany
+		default:
+			matches[i] = matchSome
+		}
+	}
+
+	keep := make([]bool, len(lines))
+	for i := range lines {
+		keep[i] = matches[i] == matchSome || (matches[i] == matchMany && !inUnmatchedRun(matches, i))
+	}
+	return keep
+}
+
+// inUnmatchedRun reports whether a line with many matches sits in a run
+// of lines with no or many matches that is mostly unmatched
+func inUnmatchedRun(matches []int, i int) bool {
+	start, end := max(i-simScanWindow, 0), min(i+simScanWindow, len(matches)-1)
+
+	none, many := 0, 2
+	for r := i - 1; r >= start && matches[r] != matchSome; r-- {
+		if matches[r] == matchNone {
+			none++
+		} else {
+			many++
+		}
+	}
+	if none == 0 {
+		return false
+	}
+	noneAfter := 0
+	for r := i + 1; r <= end && matches[r] != matchSome; r++ {
+		if matches[r] == matchNone {
+			noneAfter++
+		} else {
+			many++
+		}
+	}
+	if noneAfter == 0 {
+		return false
+	}
+	return many*keepRunFactor < many+none+noneAfter
+}
+
+// bogoSqrt roughly approximates a square root, as git does for its
+// filtering limits
+func bogoSqrt(n int) int {
+	i := 1
+	for ; n > 0; n >>= 2 {
+		i <<= 1
+	}
+	return i
+}
+
+// myers diffs a region by splitting it at the middle of a shortest edit
+// script and recursing, which needs only linear space. Unless needMin is
+// set, a region that is too costly to split exactly is split at a good
+// guess, as git does; the half that was searched exactly is then searched
+// exactly again.
+func (d *lineDiffer) myers(aLo, aHi, bLo, bHi int, needMin bool) {
+	aLo, aHi, bLo, bHi = d.trim(aLo, aHi, bLo, bHi)
+	if aLo == aHi || bLo == bHi {
+		d.markAll(aLo, aHi, bLo, bHi)
+		return
+	}
+
+	x, y, minLo, minHi := d.split(aLo, aHi, bLo, bHi, needMin)
+	if (x == aLo && y == bLo) || (x == aHi && y == bHi) {
+		d.markAll(aLo, aHi, bLo, bHi)
+		return
+	}
+	d.myers(aLo, x, bLo, y, minLo)
+	d.myers(x, aHi, y, bHi, minHi)
+}
+
+// split finds where to split a region, walking shortest paths from both
+// ends at once until they overlap, and reports which halves need an
+// exact search. It is git's xdl_split: paths are kept per diagonal, the
+// line of a the path on that diagonal has reached, and a costly search
+// ends early at a long snake or at the furthest path.
+func (d *lineDiffer) split(aLo, aHi, bLo, bHi int, needMin bool) (int, int, bool, bool) {
+	f, b, o := d.forward, d.backward, d.diagonal
+	dMin, dMax := aLo-bHi, aHi-bLo
+	fMid, bMid := aLo-bLo, aHi-bHi
+	odd := (fMid-bMid)&1 != 0
+	fMin, fMax, bMin, bMax := fMid, fMid, bMid, bMid
+	f[o+fMid] = aLo
+	b[o+bMid] = aHi
+
+	for cost := 1; ; cost++ {
+		gotSnake := false
+
+		if fMin > dMin {
+			fMin--
+			f[o+fMin-1] = -1
+		} else {
+			fMin++
+		}
+		if fMax < dMax {
+			fMax++
+			f[o+fMax+1] = -1
+		} else {
+			fMax--
+		}
+		for k := fMax; k >= fMin; k -= 2 {
+			i := f[o+k+1]
+			if f[o+k-1] >= f[o+k+1] {
+				i = f[o+k-1] + 1
+			}
+			start := i
+			j := i - k
+			for i < aHi && j < bHi && d.a[i] == d.b[j] {
+				i++
+				j++
+			}
+			if i-start > snakeCount {
+				gotSnake = true
+			}
+			f[o+k] = i
+			if odd && bMin <= k && k <= bMax && b[o+k] <= i {
+				return i, j, true, true
+			}
+		}
+
+		if bMin > dMin {
+			bMin--
+			b[o+bMin-1] = math.MaxInt
+		} else {
+			bMin++
+		}
+		if bMax < dMax {
+			bMax++
+			b[o+bMax+1] = math.MaxInt
+		} else {
+			bMax--
+		}
+		for k := bMax; k >= bMin; k -= 2 {
+			i := b[o+k+1] - 1
+			if b[o+k-1] < b[o+k+1] {
+				i = b[o+k-1]
+			}
+			start := i
+			j := i - k
+			for i > aLo && j > bLo && d.a[i-1] == d.b[j-1] {
+				i--
+				j--
+			}
+			if start-i > snakeCount {
+				gotSnake = true
+			}
+			b[o+k] = i
+			if !odd && fMin <= k && k <= fMax && i <= f[o+k] {
+				return i, j, true, true
+			}
+		}
+
+		if needMin {
+			continue
+		}
+
+		// Past some cost, a path that has come far and ends in a long
+		// snake is good enough to split at
+		if gotSnake && cost > heurMinCost {
+			best, x, y := 0, 0, 0
+			for k := fMax; k >= fMin; k -= 2 {
+				i := f[o+k]
+				j := i - k
+				v := (i - aLo) + (j - bLo) - abs(k-fMid)
+				if v > heurFactor*cost && v > best &&
+					aLo+snakeCount <= i && i < aHi && bLo+snakeCount <= j && j < bHi {
+					for s := 1; d.a[i-s] == d.b[j-s]; s++ {
+						if s == snakeCount {
+							best, x, y = v, i, j
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return x, y, true, false
+			}
+
+			for k := bMax; k >= bMin; k -= 2 {
+				i := b[o+k]
+				j := i - k
+				v := (aHi - i) + (bHi - j) - abs(k-bMid)
+				if v > heurFactor*cost && v > best &&
+					aLo < i && i <= aHi-snakeCount && bLo < j && j <= bHi-snakeCount {
+					for s := 0; d.a[i+s] == d.b[j+s]; s++ {
+						if s == snakeCount-1 {
+							best, x, y = v, i, j
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return x, y, false, true
+			}
+		}
+
+		// Past the most it may cost, the split is wherever a path has
+		// come furthest
+		if cost >= d.maxCost {
+			fBest, fBestA := -1, -1
+			for k := fMax; k >= fMin; k -= 2 {
+				i := min(f[o+k], aHi)
+				j := i - k
+				if bHi < j {
+					i, j = bHi+k, bHi
+				}
+				if fBest < i+j {
+					fBest, fBestA = i+j, i
+				}
+			}
+			bBest, bBestA := math.MaxInt, math.MaxInt
+			for k := bMax; k >= bMin; k -= 2 {
+				i := max(aLo, b[o+k])
+				j := i - k
+				if j < bLo {
+					i, j = bLo+k, bLo
+				}
+				if i+j < bBest {
+					bBest, bBestA = i+j, i
+				}
+			}
+			if (aHi+bHi)-bBest < fBest-(aLo+bLo) {
+				return fBestA, fBest - fBestA, true, false
+			}
+			return bBestA, bBest - bBestA, false, true
+		}
+	}
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// histogram diffs a region by finding the longest common run of lines
+// around its rarest line, keeping that run unchanged and recursing on
+// either side of it. It is git's xhistogram: lines occurring more than
+// maxChainLength times never anchor a run, and a region whose common
+// lines all do falls back to Myers.
+func (d *lineDiffer) histogram(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi {
+		positions := map[int][]int{}
+		for i := aLo; i < aHi; i++ {
+			positions[d.a[i]] = append(positions[d.a[i]], i)
+		}
+
+		// As in git, a run whose rarest line occurs maxChainLength+1
+		// times is still found, but then the region falls back to Myers
+		bestCount := maxChainLength + 1
+		bestA, bestB, bestLen := -1, -1, 1
+		common := false
+		for j := bLo; j < bHi; {
+			next := j + 1
+			occurrences := positions[d.b[j]]
+			common = common || len(occurrences) > 0
+			if len(occurrences) > bestCount {
+				j++
+				continue
+			}
+
+			for n := 0; n < len(occurrences); {
+				i := occurrences[n]
+				count := len(occurrences)
+				s, t := i, j
+				for s > aLo && t > bLo && d.a[s-1] == d.b[t-1] {
+					s--
+					t--
+					count = min(count, len(positions[d.a[s]]))
+				}
+				e, f := i+1, j+1
+				for e < aHi && f < bHi && d.a[e] == d.b[f] {
+					count = min(count, len(positions[d.a[e]]))
+					e++
+					f++
+				}
+
+				if f > next {
+					next = f
+				}
+				if e-s > bestLen || count < bestCount {
+					bestCount, bestA, bestB, bestLen = count, s, t, e-s
+				}
+
+				// Occurrences inside the run start no other
+				n++
+				for n < len(occurrences) && occurrences[n] < e {
+					n++
+				}
+			}
+			j = next
+		}
+
+		if bestCount > maxChainLength {
+			if common {
+				d.filteredMyers(aLo, aHi, bLo, bHi)
+				return
+			}
+			break
+		}
+		d.histogram(aLo, bestA, bLo, bestB)
+		aLo, bLo = bestA+bestLen, bestB+bestLen
+	}
+	d.markAll(aLo, aHi, bLo, bHi)
+}
+
+// compact slides each group of changed lines of one text back up to where
+// it lines up with a change in the other text, or else to where git's
+// indent heuristic scores its edges best. Diffs that could place a change
+// in several spots then place it where git would.
+func compact(ids []int, lines []string, changed, other []bool) {
+	// The group [start, end) of this text and its counterpart [oStart,
+	// oEnd) in the other are kept in step across the unchanged lines
+	start, end, oStart, oEnd := 0, 0, 0, 0
+	for end < len(changed) && changed[end] {
+		end++
+	}
+	for oEnd < len(other) && other[oEnd] {
+		oEnd++
+	}
+
+	slideUp := func() bool {
+		if start == 0 || ids[start-1] != ids[end-1] {
+			return false
+		}
+		start--
+		end--
+		changed[start], changed[end] = true, false
+		for start > 0 && changed[start-1] {
+			start--
+		}
+		return true
+	}
+	slideDown := func() bool {
+		if end == len(changed) || ids[start] != ids[end] {
+			return false
+		}
+		changed[start], changed[end] = false, true
+		start++
+		end++
+		for end < len(changed) && changed[end] {
+			end++
+		}
+		return true
+	}
+	otherPrevious := func() {
+		oEnd = oStart - 1
+		oStart = oEnd
+		for oStart > 0 && other[oStart-1] {
+			oStart--
+		}
+	}
+	otherNext := func() {
+		oStart = oEnd + 1
+		oEnd = oStart
+		for oEnd < len(other) && other[oEnd] {
+			oEnd++
+		}
+	}
+
+	for {
+		if end > start {
+			// Sliding can merge groups, so repeat until the size holds
+			earliestEnd, matchingEnd := end, -1
+			for {
+				size := end - start
+				matchingEnd = -1
+				for slideUp() {
+					otherPrevious()
+				}
+				earliestEnd = end
+				if oEnd > oStart {
+					matchingEnd = end
+				}
+				for slideDown() {
+					otherNext()
+					if oEnd > oStart {
+						matchingEnd = end
+					}
+				}
+				if size == end-start {
+					break
+				}
+			}
+			if end != earliestEnd && matchingEnd != -1 {
+				for oEnd == oStart {
+					slideUp()
+					otherPrevious()
+				}
+			} else if end != earliestEnd {
+				// Score the splits above and below the group at each
+				// place it can slide to, looking no further up than the
+				// group's size or indentMaxSliding lines
+				size := end - start
+				shift := max(earliestEnd, end-size-1, end-indentMaxSliding)
+				bestShift, best := -1, splitScore{}
+				for ; shift <= end; shift++ {
+					var score splitScore
+					score.add(lines, shift)
+					score.add(lines, shift-size)
+					if bestShift == -1 || score.compare(best) <= 0 {
+						bestShift, best = shift, score
+					}
+				}
+				for end > bestShift {
+					slideUp()
+					otherPrevious()
+				}
+			}
+		}
+
+		if end == len(changed) {
+			return
+		}
+		start = end + 1
+		end = start
+		for end < len(changed) && changed[end] {
+			end++
+		}
+		otherNext()
+	}
+}
+
+// Weights of git's indent heuristic. A split next to blank lines is good,
+// one at the start or end of the text or into a less indented line bad.
+const (
+	maxIndent                       = 200
+	maxBlanks                       = 20
+	indentMaxSliding                = 100
+	indentWeight                    = 60
+	startOfFilePenalty              = 1
+	endOfFilePenalty                = 21
+	totalBlankWeight                = -30
+	postBlankWeight                 = 6
+	relativeIndentPenalty           = -4
+	relativeIndentWithBlankPenalty  = 10
+	relativeOutdentPenalty          = 24
+	relativeOutdentWithBlankPenalty = 17
+	relativeDedentPenalty           = 23
+	relativeDedentWithBlankPenalty  = 17
+)
+
+// splitScore is how bad the edges of a group of changed lines are, lower
+// being better
+type splitScore struct {
+	effectiveIndent int
+	penalty         int
+}
+
+// add scores the split of lines just before line split
+func (s *splitScore) add(lines []string, split int) {
+	indent := -1
+	if split < len(lines) {
+		indent = lineIndent(lines[split])
+	}
+	preBlank, preIndent := 0, -1
+	for i := split - 1; i >= 0; i-- {
+		if preIndent = lineIndent(lines[i]); preIndent != -1 {
+			break
+		}
+		if preBlank++; preBlank == maxBlanks {
+			preIndent = 0
+			break
+		}
+	}
+	postBlank, postIndent := 0, -1
+	for i := split + 1; i < len(lines); i++ {
+		if postIndent = lineIndent(lines[i]); postIndent != -1 {
+			break
+		}
+		if postBlank++; postBlank == maxBlanks {
+			postIndent = 0
+			break
+		}
+	}
+
+	if preIndent == -1 && preBlank == 0 {
+		s.penalty += startOfFilePenalty
+	}
+	if split >= len(lines) {
+		s.penalty += endOfFilePenalty
+	}
+
+	// Blank lines after the split count from the split line on
+	blankAfter := 0
+	if indent == -1 {
+		blankAfter = 1 + postBlank
+		indent = postIndent
+	}
+	blanks := preBlank + blankAfter
+	s.penalty += totalBlankWeight*blanks + postBlankWeight*blankAfter
+	s.effectiveIndent += indent
+
+	// The split line against the last one above it: indented, outdented
+	// back to a level that continues below, or dedented
+	withBlank := blanks != 0
+	switch {
+	case indent == -1, preIndent == -1, indent == preIndent:
+	case indent > preIndent && withBlank:
+		s.penalty += relativeIndentWithBlankPenalty
+	case indent > preIndent:
+		s.penalty += relativeIndentPenalty
+	case postIndent > indent && withBlank:
+		s.penalty += relativeOutdentWithBlankPenalty
+	case postIndent > indent:
+		s.penalty += relativeOutdentPenalty
+	case withBlank:
+		s.penalty += relativeDedentWithBlankPenalty
+	default:
+		s.penalty += relativeDedentPenalty
+	}
+}
+
+// compare is negative, zero or positive as s is better than, as good as
+// or worse than o
+func (s splitScore) compare(o splitScore) int {
+	indents := 0
+	if s.effectiveIndent > o.effectiveIndent {
+		indents = 1
+	} else if s.effectiveIndent < o.effectiveIndent {
+		indents = -1
+	}
+	return indentWeight*indents + s.penalty - o.penalty
+}
+
+// lineIndent returns the width of a line's leading whitespace, with tabs
+// stopping every 8 columns, or -1 for a blank line
+func lineIndent(line string) int {
+	indent := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			indent++
+		case '\t':
+			indent += 8 - indent%8
+		case '\n', '\r':
+		default:
+			return indent
+		}
+		if indent >= maxIndent {
+			return maxIndent
+		}
+	}
+	return -1
+}
+
+// diffOp is one line of an edit script, with how many old and new lines
+// come before it
+type diffOp struct {
+	op        LineOp
+	line      string
+	oldBefore int
+	newBefore int
+}
+
+// buildHunks groups the changed lines into hunks with context lines
+// around them. Changes closer than twice the context share a hunk.
+func buildHunks(aLines, bLines []string, deleted, inserted []bool, context int) ([]Hunk, int, int) {
+	var ops []diffOp
+	additions, deletions := 0, 0
+	for i, j := 0, 0; i < len(aLines) || j < len(bLines); {
+		switch {
+		case i < len(aLines) && deleted[i]:
+			ops = append(ops, diffOp{op: LineDeleted, line: aLines[i], oldBefore: i, newBefore: j})
+			deletions++
+			i++
+		case j < len(bLines) && inserted[j]:
+			ops = append(ops, diffOp{op: LineAdded, line: bLines[j], oldBefore: i, newBefore: j})
+			additions++
+			j++
+		default:
+			ops = append(ops, diffOp{op: LineContext, line: bLines[j], oldBefore: i, newBefore: j})
+			i++
+			j++
+		}
+	}
+
+	var hunks []Hunk
+	for p := 0; p < len(ops); {
+		for p < len(ops) && ops[p].op == LineContext {
+			p++
+		}
+		if p == len(ops) {
+			break
+		}
+
+		start := max(p-context, 0)
+		end := p
+		for {
+			for end < len(ops) && ops[end].op != LineContext {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].op == LineContext && next-end < 2*context {
+				next++
+			}
+			if next < len(ops) && ops[next].op != LineContext {
+				end = next
+				continue
+			}
+			break
+		}
+		stop := min(end+context, len(ops))
+
+		hunks = append(hunks, newHunk(ops[start:stop], aLines))
+		p = stop
+	}
+	return hunks, additions, deletions
+}
+
+// newHunk builds a hunk from a slice of the edit script
+func newHunk(ops []diffOp, aLines []string) Hunk {
+	hunk := Hunk{Lines: make([]DiffLine, len(ops))}
+	for i, op := range ops {
+		line := DiffLine{
+			Op:        op.op,
+			Content:   strings.TrimSuffix(op.line, "\n"),
+			NoNewline: !strings.HasSuffix(op.line, "\n"),
+		}
+		if op.op != LineAdded {
+			line.OldNumber = op.oldBefore + 1
+			hunk.OldLines++
+		}
+		if op.op != LineDeleted {
+			line.NewNumber = op.newBefore + 1
+			hunk.NewLines++
+		}
+		hunk.Lines[i] = line
+	}
+
+	// As in git, an empty side starts at the line before the hunk
+	hunk.OldStart, hunk.NewStart = ops[0].oldBefore, ops[0].newBefore
+	if hunk.OldLines > 0 {
+		hunk.OldStart++
+	}
+	if hunk.NewLines > 0 {
+		hunk.NewStart++
+	}
+	hunk.Section = sectionHeading(aLines, ops[0].oldBefore)
+	return hunk
+}
+
+// sectionHeading finds the nearest line above old line index before that
+// starts with a letter, "_" or "$", git's default notion of a function
+// line
+func sectionHeading(aLines []string, before int) string {
+	for i := before - 1; i >= 0; i-- {
+		line := aLines[i]
+		if line == "" {
+			continue
+		}
+		ch := line[0]
+		if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_' || ch == '$' {
+			line = strings.TrimSuffix(line, "\n")
+			if len(line) > 80 {
+				line = line[:80]
+			}
+			return strings.TrimRight(line, " \t\r")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package gitcore
+
+import (
+	"strings"
+	"testing"
+)
+
+// The expected hunks in testdata/diff were made by git 2.39 with its
+// default settings:
+//
+//	git diff --no-index --diff-algorithm=<algorithm> <name>.old <name>.new
+//
+// with everything before the first hunk left out
+func TestDiffTextMatchesGit(t *testing.T) {
+	algorithms := []struct {
+		name      string
+		algorithm DiffAlgorithm
+	}{
+		{"myers", DiffMyers},
+		{"histogram", DiffHistogram},
+	}
+	tests := []string{
+		// A function added between two others
+		"function_added",
+		// A section added above another starting with the same line,
+		// which the indent heuristic keeps in one piece
+		"section_added",
+		// A function moved above another and both changed
+		"block_moved",
+		// Lines occurring more often than a histogram anchor may
+		"frequent_lines",
+		// A last line without a line ending
+		"no_newline",
+	}
+
+	for _, name := range tests {
+		old := readTestdata(t, "diff", name+".old")
+		new := readTestdata(t, "diff", name+".new")
+		for _, a := range algorithms {
+			t.Run(name+"/"+a.name, func(t *testing.T) {
+				want := readTestdata(t, "diff", name+"."+a.name+".diff")
+				hunks, additions, deletions := DiffText(old, new, 3, a.algorithm)
+
+				var got strings.Builder
+				writeHunks(&got, &FileDiff{Hunks: hunks})
+				if got.String() != string(want) {
+					t.Errorf("hunks differ from git\ngot:\n%s\nwant:\n%s", got.String(), want)
+				}
+				if want := strings.Count("\n"+string(want), "\n+"); additions != want {
+					t.Errorf("additions = %d, want %d", additions, want)
+				}
+				if want := strings.Count("\n"+string(want), "\n-"); deletions != want {
+					t.Errorf("deletions = %d, want %d", deletions, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package gitcore
+
+/*
+#include "git_c_api.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// FilterSpec is a parsed partial clone filter. Objects a client asks for
+// by name are sent regardless of the filter.
+type FilterSpec struct {
+	// OmitBlobs drops every blob (blob:none, blob:limit=0)
+	OmitBlobs bool
+	// BlobLimit drops blobs of at least this many bytes; negative if unset
+	BlobLimit int64
+	// TreeDepth drops trees and blobs at least this deep below the root
+	// tree; negative if unset
+	TreeDepth int
+}
+
+// ParseFilterSpec parses a filter-spec as sent by "git clone --filter":
+// blob:none, blob:limit=<n>[kmg], tree:<depth>, or a combine: of these
+func ParseFilterSpec(spec string) (*FilterSpec, error) {
+	filter := &FilterSpec{BlobLimit: -1, TreeDepth: -1}
+	if err := filter.add(spec); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// add narrows the filter by one filter-spec
+func (f *FilterSpec) add(spec string) error {
+	switch {
+	case spec == "blob:none":
+		f.OmitBlobs = true
+
+	case strings.HasPrefix(spec, "blob:limit="):
+		limit, err := parseFilterSize(strings.TrimPrefix(spec, "blob:limit="))
+		if err != nil {
+			return fmt.Errorf("invalid filter-spec '%s'", spec)
+		}
+		if limit == 0 {
+			f.OmitBlobs = true
+		} else if f.BlobLimit < 0 || limit < f.BlobLimit {
+			f.BlobLimit = limit
+		}
+
+	case strings.HasPrefix(spec, "tree:"):
+		depth, err := strconv.Atoi(strings.TrimPrefix(spec, "tree:"))
+		if err != nil || depth < 0 {
+			return fmt.Errorf("invalid filter-spec '%s'", spec)
+		}
+		if f.TreeDepth < 0 || depth < f.TreeDepth {
+			f.TreeDepth = depth
+		}
+
+	case strings.HasPrefix(spec, "combine:"):
+		// Sub-filters are URL-encoded and joined by '+'; an object is
+		// sent only if every sub-filter lets it through
+		for _, sub := range strings.Split(strings.TrimPrefix(spec, "combine:"), "+") {
+			decoded, err := url.PathUnescape(sub)
+			if err != nil || decoded == "" {
+				return fmt.Errorf("invalid filter-spec '%s'", spec)
+			}
+			if err := f.add(decoded); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("invalid filter-spec '%s'", spec)
+	}
+	return nil
+}
+
+// parseFilterSize parses a byte count with an optional k, m or g suffix
+func parseFilterSize(value string) (int64, error) {
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// cObjectFilter converts a filter to its C form; call the returned
+// function to release it
+func cObjectFilter(filter *FilterSpec) (*C.git_object_filter, func()) {
+	if filter == nil {
+		return nil, func() {}
+	}
+
+	cFilter := (*C.git_object_filter)(C.calloc(1, C.size_t(unsafe.Sizeof(C.git_object_filter{}))))
+	if filter.OmitBlobs {
+		cFilter.omit_blobs = 1
+	}
+	cFilter.blob_limit = C.longlong(filter.BlobLimit)
+	cFilter.tree_depth = C.int(filter.TreeDepth)
+
+	return cFilter, func() {
+		C.free(unsafe.Pointer(cFilter))
+	}
+}
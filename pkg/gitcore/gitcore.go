@@ -9,13 +9,28 @@ package gitcore
 */
 import "C"
 import (
+	"bytes"
+	"context"
 	"errors"
+	"sort"
+	"strings"
 	"unsafe"
 )
 
+// ZeroSHA is the all-zero object name git uses for missing refs
+const ZeroSHA = "0000000000000000000000000000000000000000"
+
+var (
+	// ErrRefLocked is returned when another update holds a ref's lock
+	ErrRefLocked = errors.New("failed to lock")
+	// ErrStaleRef is returned when a ref no longer has the expected value
+	ErrStaleRef = errors.New("stale info")
+)
+
 // Repository wraps the C++ GitRepository
 type Repository struct {
-	ptr unsafe.Pointer
+	ptr  unsafe.Pointer
+	path string
 }
 
 // NewRepository creates a new repository instance
@@ -24,7 +39,43 @@ func NewRepository(path string) *Repository {
 	defer C.free(unsafe.Pointer(cPath))
 
 	ptr := C.git_repository_new(cPath)
-	return &Repository{ptr: ptr}
+	return &Repository{ptr: ptr, path: path}
+}
+
+// cStringArray converts a Go string slice to a C string array; call the
+// returned function to release it. The array is allocated in C memory so
+// it may also be stored in C structs.
+func cStringArray(strs []string) (**C.char, func()) {
+	if len(strs) == 0 {
+		return nil, func() {}
+	}
+
+	cArray := (**C.char)(C.malloc(C.size_t(len(strs)) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+	cStrs := (*[1 << 28]*C.char)(unsafe.Pointer(cArray))[:len(strs):len(strs)]
+	for i, str := range strs {
+		cStrs[i] = C.CString(str)
+	}
+
+	return cArray, func() {
+		for _, cStr := range cStrs {
+			C.free(unsafe.Pointer(cStr))
+		}
+		C.free(unsafe.Pointer(cArray))
+	}
+}
+
+// goStringArray converts a C string array to a Go string slice
+func goStringArray(cStrs **C.char, count C.int) []string {
+	if cStrs == nil || count == 0 {
+		return []string{}
+	}
+
+	strs := make([]string, int(count))
+	strSlice := (*[1 << 28]*C.char)(unsafe.Pointer(cStrs))[:count:count]
+	for i, cStr := range strSlice {
+		strs[i] = C.GoString(cStr)
+	}
+	return strs
 }
 
 // Free releases the repository resources
@@ -61,6 +112,18 @@ func (r *Repository) IsValid() bool {
 	return result != 0
 }
 
+// GetHead returns the ref HEAD points to (e.g. "refs/heads/main"), or the
+// commit SHA for a detached HEAD
+func (r *Repository) GetHead() (string, error) {
+	cResult := C.git_repository_get_head(r.ptr)
+	if cResult == nil {
+		return "", errors.New("HEAD not found")
+	}
+	defer C.git_free_string(cResult)
+
+	return C.GoString(cResult), nil
+}
+
 // CreateRef creates a new reference
 func (r *Repository) CreateRef(refName, sha string) error {
 	cRefName := C.CString(refName)
@@ -107,6 +170,24 @@ func (r *Repository) ListRefs() ([]string, error) {
 	return refs, nil
 }
 
+// RefMap returns every reference by its full name ("refs/heads/main") with
+// the SHA it points to
+func (r *Repository) RefMap() (map[string]string, error) {
+	refs, err := r.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	refMap := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		sha, err := r.GetRef(ref)
+		if err == nil && sha != "" {
+			refMap["refs/"+ref] = sha
+		}
+	}
+	return refMap, nil
+}
+
 // DeleteRef deletes a reference
 func (r *Repository) DeleteRef(refName string) error {
 	cRefName := C.CString(refName)
@@ -119,6 +200,182 @@ func (r *Repository) DeleteRef(refName string) error {
 	return nil
 }
 
+// LockRef takes the lock file of a reference
+func (r *Repository) LockRef(refName string) error {
+	cRefName := C.CString(refName)
+	defer C.free(unsafe.Pointer(cRefName))
+
+	if C.git_repository_lock_ref(r.ptr, cRefName) == 0 {
+		return ErrRefLocked
+	}
+	return nil
+}
+
+// UnlockRef releases the lock file of a reference
+func (r *Repository) UnlockRef(refName string) {
+	cRefName := C.CString(refName)
+	defer C.free(unsafe.Pointer(cRefName))
+
+	C.git_repository_unlock_ref(r.ptr, cRefName)
+}
+
+// UpdateRef moves a reference from oldSHA to newSHA while holding its lock.
+// A ZeroSHA oldSHA requires the ref not to exist yet; a ZeroSHA newSHA
+// deletes it. refName is relative to refs/, like the other ref methods.
+func (r *Repository) UpdateRef(refName, oldSHA, newSHA string) error {
+	if err := r.LockRef(refName); err != nil {
+		return err
+	}
+	if r.currentRef(refName) != oldSHA {
+		r.UnlockRef(refName)
+		return ErrStaleRef
+	}
+	return r.writeLockedRef(refName, newSHA)
+}
+
+// TransactionError is returned when one update of a ref transaction
+// fails; no ref has been changed
+type TransactionError struct {
+	RefName string
+	Err     error
+}
+
+func (e *TransactionError) Error() string {
+	return e.RefName + ": " + e.Err.Error()
+}
+
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// UpdateRefs applies several ref updates all-or-nothing, with the same
+// rules as UpdateRef. Every ref is locked, checked and has its new value
+// written to its lock file before any ref changes, and refs already
+// changed are restored if a later one cannot be. Ref names are relative
+// to refs/.
+func (r *Repository) UpdateRefs(updates []RefCommand) error {
+	// held marks the locks still to release; committing an update
+	// releases its lock, which may then belong to someone else
+	held := make([]bool, len(updates))
+	defer func() {
+		for i, update := range updates {
+			if held[i] {
+				r.UnlockRef(update.RefName)
+			}
+		}
+	}()
+
+	for i, update := range updates {
+		if err := r.LockRef(update.RefName); err != nil {
+			return &TransactionError{RefName: update.RefName, Err: err}
+		}
+		held[i] = true
+		if r.currentRef(update.RefName) != update.OldSHA {
+			return &TransactionError{RefName: update.RefName, Err: ErrStaleRef}
+		}
+		if err := r.writeRefLock(update.RefName, update.NewSHA); err != nil {
+			return &TransactionError{RefName: update.RefName, Err: err}
+		}
+	}
+
+	for i, update := range updates {
+		if err := r.commitRef(update.RefName, update.NewSHA); err != nil {
+			for _, done := range updates[:i] {
+				if r.LockRef(done.RefName) == nil {
+					r.writeLockedRef(done.RefName, done.OldSHA)
+				}
+			}
+			return &TransactionError{RefName: update.RefName, Err: err}
+		}
+		held[i] = false
+	}
+	return nil
+}
+
+// currentRef returns the value of a ref, or ZeroSHA if it does not exist
+func (r *Repository) currentRef(refName string) string {
+	sha, err := r.GetRef(refName)
+	if err != nil || sha == "" {
+		return ZeroSHA
+	}
+	return sha
+}
+
+// writeRefLock writes the new value of a locked ref into its lock file;
+// there is nothing to write for a deletion
+func (r *Repository) writeRefLock(refName, sha string) error {
+	if sha == ZeroSHA {
+		return nil
+	}
+
+	cRefName := C.CString(refName)
+	cSha := C.CString(sha)
+	defer C.free(unsafe.Pointer(cRefName))
+	defer C.free(unsafe.Pointer(cSha))
+
+	if C.git_repository_write_ref_lock(r.ptr, cRefName, cSha) == 0 {
+		return errors.New("failed to write reference lock")
+	}
+	return nil
+}
+
+// commitRef puts a locked ref's new value in place, or deletes the ref
+// for ZeroSHA, and releases the lock. On failure the lock is still held.
+func (r *Repository) commitRef(refName, sha string) error {
+	if sha == ZeroSHA {
+		if err := r.DeleteRef(refName); err != nil {
+			return err
+		}
+		r.UnlockRef(refName)
+		return nil
+	}
+
+	cRefName := C.CString(refName)
+	defer C.free(unsafe.Pointer(cRefName))
+
+	if C.git_repository_commit_ref(r.ptr, cRefName) == 0 {
+		return errors.New("failed to update reference")
+	}
+	return nil
+}
+
+// writeLockedRef points a locked ref at sha, deleting it for ZeroSHA, and
+// releases the lock whether or not it succeeds
+func (r *Repository) writeLockedRef(refName, sha string) error {
+	err := r.writeRefLock(refName, sha)
+	if err == nil {
+		err = r.commitRef(refName, sha)
+	}
+	if err != nil {
+		r.UnlockRef(refName)
+	}
+	return err
+}
+
+// IsValidRefName checks a full ref name ("refs/heads/main") against git's
+// ref naming rules
+func IsValidRefName(refName string) bool {
+	if !strings.HasPrefix(refName, "refs/") || strings.HasSuffix(refName, "/") ||
+		strings.HasSuffix(refName, ".") || strings.Contains(refName, "..") ||
+		strings.Contains(refName, "@{") || strings.ContainsAny(refName, " ~^:?*[\\") {
+		return false
+	}
+
+	for _, component := range strings.Split(refName, "/") {
+		if component == "" || strings.HasPrefix(component, ".") ||
+			strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+
+	for _, ch := range refName {
+		if ch < 0x20 || ch == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 // CreateBranch creates a new branch
 func (r *Repository) CreateBranch(branchName, sha string) error {
 	cBranchName := C.CString(branchName)
@@ -163,53 +420,59 @@ func (r *Repository) DeleteBranch(branchName string) error {
 	return nil
 }
 
-// ReceivePack processes a git push pack
-func (r *Repository) ReceivePack(packData []byte) error {
-	cPackData := C.CBytes(packData)
-	defer C.free(cPackData)
+// HasObject checks if an object exists, loose or packed
+func (r *Repository) HasObject(sha string) bool {
+	cSha := C.CString(sha)
+	defer C.free(unsafe.Pointer(cSha))
 
-	result := C.git_repository_receive_pack(r.ptr, (*C.char)(cPackData), C.int(len(packData)))
-	if result == 0 {
-		return errors.New("failed to receive pack")
-	}
-	return nil
+	return C.git_repository_has_object(r.ptr, cSha) != 0
 }
 
-// UploadPack generates a pack for git pull/fetch
-func (r *Repository) UploadPack(wants, haves []string) ([]byte, error) {
-	// Convert wants to C array
-	cWants := make([]*C.char, len(wants))
-	for i, want := range wants {
-		cWants[i] = C.CString(want)
-		defer C.free(unsafe.Pointer(cWants[i]))
-	}
+// PeelTag returns the object an annotated tag ultimately points to; ok is
+// false if sha is not a tag
+func (r *Repository) PeelTag(sha string) (string, bool) {
+	cSha := C.CString(sha)
+	defer C.free(unsafe.Pointer(cSha))
 
-	// Convert haves to C array
-	cHaves := make([]*C.char, len(haves))
-	for i, have := range haves {
-		cHaves[i] = C.CString(have)
-		defer C.free(unsafe.Pointer(cHaves[i]))
+	cResult := C.git_repository_peel_tag(r.ptr, cSha)
+	if cResult == nil {
+		return "", false
 	}
+	defer C.git_free_string(cResult)
 
-	var outLen C.int
-	var cWantsPtr **C.char
-	var cHavesPtr **C.char
+	return C.GoString(cResult), true
+}
 
-	if len(wants) > 0 {
-		cWantsPtr = &cWants[0]
-	}
-	if len(haves) > 0 {
-		cHavesPtr = &cHaves[0]
-	}
+// CanAllFromReach reports whether every commit in from has at least one
+// commit of to among its ancestors
+func (r *Repository) CanAllFromReach(from, to []string) bool {
+	cFrom, freeFrom := cStringArray(from)
+	defer freeFrom()
+	cTo, freeTo := cStringArray(to)
+	defer freeTo()
 
-	cResult := C.git_repository_upload_pack(r.ptr, cWantsPtr, C.int(len(wants)),
-		cHavesPtr, C.int(len(haves)), &outLen)
-	if cResult == nil {
-		return nil, errors.New("failed to upload pack")
-	}
-	defer C.git_free_string(cResult)
+	result := C.git_repository_can_all_from_reach(r.ptr, cFrom, C.int(len(from)),
+		cTo, C.int(len(to)))
+	return result != 0
+}
 
-	return C.GoBytes(unsafe.Pointer(cResult), outLen), nil
+// ReceivePack processes a git push pack held in memory; see
+// ReceivePackStream
+func (r *Repository) ReceivePack(packData []byte) error {
+	_, err := r.ReceivePackStream(bytes.NewReader(packData))
+	return err
+}
+
+// UploadPack generates a pack with the objects reachable from wants but
+// not from haves. opts may be nil; otherwise history stops at the shallow
+// boundary it describes and its filter omits objects. See UploadPackTo to
+// stream the pack instead.
+func (r *Repository) UploadPack(wants, haves []string, opts *UploadPackOptions) ([]byte, error) {
+	var pack bytes.Buffer
+	if err := r.UploadPackTo(context.Background(), &pack, wants, haves, opts); err != nil {
+		return nil, err
+	}
+	return pack.Bytes(), nil
 }
 
 // Protocol functions
@@ -233,36 +496,167 @@ func FlushPkt() string {
 	return C.GoString(cResult)
 }
 
-// CreateRefAdvertisement creates a reference advertisement for git protocol
-func CreateRefAdvertisement(refs map[string]string, service string) ([]byte, error) {
-	if len(refs) == 0 {
-		return nil, errors.New("no refs to advertise")
+// FetchRequest is a parsed git-upload-pack request
+type FetchRequest struct {
+	Wants          []string
+	Haves          []string
+	Capabilities   []string
+	Shallows       []string
+	Depth          int
+	DeepenRelative bool
+	DeepenSince    int64
+	DeepenNot      []string
+	Filter         string
+	Done           bool
+}
+
+// HasCapability checks if the client requested a capability
+func (f *FetchRequest) HasCapability(name string) bool {
+	for _, capability := range f.Capabilities {
+		if capability == name || strings.HasPrefix(capability, name+"=") {
+			return true
+		}
 	}
+	return false
+}
 
-	// Convert map to C arrays
-	cRefs := make([]*C.char, 0, len(refs))
-	cShas := make([]*C.char, 0, len(refs))
+// ParseUploadPack parses the want/have/done pkt-line stream sent by a client
+func ParseUploadPack(data []byte) (*FetchRequest, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty upload-pack request")
+	}
+
+	cData := C.CBytes(data)
+	defer C.free(cData)
 
-	for ref, sha := range refs {
-		cRefs = append(cRefs, C.CString(ref))
-		cShas = append(cShas, C.CString(sha))
+	var cReq C.git_fetch_request
+	if C.git_protocol_parse_upload_pack((*C.char)(cData), C.int(len(data)), &cReq) == 0 {
+		return nil, errors.New("failed to parse upload-pack request")
+	}
+	defer C.git_protocol_free_fetch_request(&cReq)
+
+	req := &FetchRequest{
+		Wants:        goStringArray(cReq.wants, cReq.want_count),
+		Haves:        goStringArray(cReq.haves, cReq.have_count),
+		Capabilities: goStringArray(cReq.capabilities, cReq.capability_count),
+		Shallows:     goStringArray(cReq.shallows, cReq.shallow_count),
+		Depth:        int(cReq.depth),
+		DeepenSince:  int64(cReq.deepen_since),
+		DeepenNot:    goStringArray(cReq.deepen_not, cReq.deepen_not_count),
+		Done:         cReq.done != 0,
+	}
+	if cReq.filter != nil {
+		req.Filter = C.GoString(cReq.filter)
 	}
 
-	defer func() {
-		for _, cRef := range cRefs {
-			C.free(unsafe.Pointer(cRef))
+	// Protocol v0 sends deepen-relative as a capability
+	req.DeepenRelative = req.HasCapability("deepen-relative")
+	return req, nil
+}
+
+// RefCommand is a single ref update requested by a push
+type RefCommand struct {
+	OldSHA  string
+	NewSHA  string
+	RefName string
+}
+
+// PushRequest is a parsed git-receive-pack request
+type PushRequest struct {
+	Commands     []RefCommand
+	Capabilities []string
+	// Options are the push options sent with "git push -o"
+	Options []string
+	Pack    []byte
+}
+
+// HasCapability checks if the client requested a capability
+func (p *PushRequest) HasCapability(name string) bool {
+	for _, capability := range p.Capabilities {
+		if capability == name || strings.HasPrefix(capability, name+"=") {
+			return true
 		}
-		for _, cSha := range cShas {
-			C.free(unsafe.Pointer(cSha))
+	}
+	return false
+}
+
+// needsPack reports whether any command creates or updates a ref, which
+// is when a pack follows the commands
+func (p *PushRequest) needsPack() bool {
+	for _, cmd := range p.Commands {
+		if cmd.NewSHA != ZeroSHA {
+			return true
 		}
-	}()
+	}
+	return false
+}
+
+// ParseReceivePack splits a receive-pack request into its ref update
+// commands and the pack data that follows them
+func ParseReceivePack(data []byte) (*PushRequest, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty receive-pack request")
+	}
+
+	cData := C.CBytes(data)
+	defer C.free(cData)
+
+	var cReq C.git_push_request
+	if C.git_protocol_parse_receive_pack((*C.char)(cData), C.int(len(data)), &cReq) == 0 {
+		return nil, errors.New("failed to parse receive-pack request")
+	}
+	defer C.git_protocol_free_push_request(&cReq)
+
+	oldSHAs := goStringArray(cReq.old_shas, cReq.command_count)
+	newSHAs := goStringArray(cReq.new_shas, cReq.command_count)
+	refNames := goStringArray(cReq.ref_names, cReq.command_count)
+
+	req := &PushRequest{
+		Commands:     make([]RefCommand, len(refNames)),
+		Capabilities: goStringArray(cReq.capabilities, cReq.capability_count),
+		Pack:         data[int(cReq.pack_offset):],
+	}
+	for i := range refNames {
+		req.Commands[i] = RefCommand{OldSHA: oldSHAs[i], NewSHA: newSHAs[i], RefName: refNames[i]}
+	}
+
+	return req, nil
+}
+
+// CreateRefAdvertisement creates a reference advertisement for git protocol.
+// HEAD is advertised first, followed by the other refs in sorted order. The
+// "# service=" announcement smart HTTP expects is left out if service is
+// empty, as for SSH.
+func CreateRefAdvertisement(refs map[string]string, service string, capabilities []string) ([]byte, error) {
+	names := make([]string, 0, len(refs))
+	for ref := range refs {
+		if ref != "HEAD" {
+			names = append(names, ref)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := refs["HEAD"]; ok {
+		names = append([]string{"HEAD"}, names...)
+	}
+
+	shas := make([]string, len(names))
+	for i, name := range names {
+		shas[i] = refs[name]
+	}
+
+	cRefs, freeRefs := cStringArray(names)
+	defer freeRefs()
+	cShas, freeShas := cStringArray(shas)
+	defer freeShas()
 
 	cService := C.CString(service)
 	defer C.free(unsafe.Pointer(cService))
+	cCapabilities := C.CString(strings.Join(capabilities, " "))
+	defer C.free(unsafe.Pointer(cCapabilities))
 
 	var outLen C.int
-	cResult := C.git_protocol_create_ref_advertisement(&cRefs[0], &cShas[0],
-		C.int(len(refs)), cService, &outLen)
+	cResult := C.git_protocol_create_ref_advertisement(cRefs, cShas,
+		C.int(len(names)), cService, cCapabilities, &outLen)
 	if cResult == nil {
 		return nil, errors.New("failed to create ref advertisement")
 	}
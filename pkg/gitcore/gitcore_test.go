@@ -0,0 +1,297 @@
+package gitcore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readTestdata reads a file under testdata
+func readTestdata(t *testing.T, elem ...string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(append([]string{"testdata"}, elem...)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// openTestHistory returns a bare repository holding the history fixture
+// that testdata/history.sh builds. Its commits are tagged c1 to c8.
+func openTestHistory(t *testing.T) *Repository {
+	t.Helper()
+	repo := NewRepository(filepath.Join(t.TempDir(), "history.git"))
+	t.Cleanup(repo.Free)
+	if err := repo.Init(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ReceivePack(readTestdata(t, "history.pack")); err != nil {
+		t.Fatal(err)
+	}
+
+	refs := strings.TrimSpace(string(readTestdata(t, "history.refs")))
+	for _, line := range strings.Split(refs, "\n") {
+		sha, name, _ := strings.Cut(line, " ")
+		name = strings.TrimPrefix(name, "refs/")
+		if err := repo.CreateRef(name, sha); err != nil {
+			t.Fatalf("creating %s: %v", name, err)
+		}
+	}
+	return repo
+}
+
+// testCommit reads the commit a ref of the history fixture, such as
+// "tags/c1", points to
+func testCommit(t *testing.T, repo *Repository, ref string) *Commit {
+	t.Helper()
+	sha, err := repo.GetRef(ref)
+	if err != nil {
+		t.Fatalf("%s: %v", ref, err)
+	}
+	commit, err := repo.ReadCommit(sha)
+	if err != nil {
+		t.Fatalf("%s: %v", ref, err)
+	}
+	return commit
+}
+
+// refLocks lists the lock files left under a repository's refs
+func refLocks(t *testing.T, repo *Repository) []string {
+	t.Helper()
+	var locks []string
+	err := filepath.WalkDir(filepath.Join(repo.path, "refs"), func(path string, d os.DirEntry, err error) error {
+		if err == nil && strings.HasSuffix(path, ".lock") {
+			locks = append(locks, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return locks
+}
+
+func TestUpdateRef(t *testing.T) {
+	history := openTestHistory(t)
+	c1 := testCommit(t, history, "tags/c1").SHA
+	c6 := testCommit(t, history, "tags/c6").SHA
+	c7 := testCommit(t, history, "tags/c7").SHA
+	c8 := testCommit(t, history, "tags/c8").SHA
+
+	tests := []struct {
+		name     string
+		ref      string
+		old, new string
+		// setup runs before the update
+		setup   func(t *testing.T, repo *Repository)
+		wantErr error
+		// want is the ref's value afterwards, ZeroSHA for none
+		want string
+	}{
+		{name: "update", ref: "heads/main", old: c8, new: c7, want: c7},
+		{name: "stale old value", ref: "heads/main", old: c6, new: c7, wantErr: ErrStaleRef, want: c8},
+		{name: "create", ref: "heads/topic/new", old: ZeroSHA, new: c1, want: c1},
+		{name: "create an existing ref", ref: "heads/main", old: ZeroSHA, new: c1, wantErr: ErrStaleRef, want: c8},
+		{name: "delete", ref: "heads/feature", old: c6, new: ZeroSHA, want: ZeroSHA},
+		{name: "delete a missing ref", ref: "heads/gone", old: c1, new: ZeroSHA, wantErr: ErrStaleRef, want: ZeroSHA},
+		{
+			name: "locked by another update",
+			ref:  "heads/main", old: c8, new: c7,
+			setup: func(t *testing.T, repo *Repository) {
+				if err := repo.LockRef("heads/main"); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { repo.UnlockRef("heads/main") })
+			},
+			wantErr: ErrRefLocked, want: c8,
+		},
+		{
+			// A crash while writing leaves a partial lock file; the ref
+			// keeps its value and stays locked until the file is removed
+			name: "lock left by a crash",
+			ref:  "heads/main", old: c8, new: c7,
+			setup: func(t *testing.T, repo *Repository) {
+				lock := filepath.Join(repo.path, "refs", "heads", "main.lock")
+				if err := os.WriteFile(lock, []byte(c7[:10]), 0644); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { os.Remove(lock) })
+			},
+			wantErr: ErrRefLocked, want: c8,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := openTestHistory(t)
+			if tt.setup != nil {
+				tt.setup(t, repo)
+			}
+			if err := repo.UpdateRef(tt.ref, tt.old, tt.new); err != tt.wantErr {
+				t.Fatalf("UpdateRef error = %v, want %v", err, tt.wantErr)
+			}
+			if got := repo.currentRef(tt.ref); got != tt.want {
+				t.Errorf("%s = %s, want %s", tt.ref, got, tt.want)
+			}
+			if tt.setup == nil {
+				if locks := refLocks(t, repo); len(locks) > 0 {
+					t.Errorf("locks left behind: %v", locks)
+				}
+			}
+		})
+	}
+}
+
+// Updates racing from the same old value, each through its own handle as
+// concurrent pushes would be: exactly one wins and the others see the ref
+// locked or already moved
+func TestUpdateRefConcurrent(t *testing.T) {
+	history := openTestHistory(t)
+	old := testCommit(t, history, "tags/c8").SHA
+	var targets []string
+	for _, tag := range []string{"c1", "c2", "c3", "c4", "c5", "c6", "c7"} {
+		targets = append(targets, testCommit(t, history, "tags/"+tag).SHA)
+	}
+
+	start := make(chan struct{})
+	errs := make(chan error, len(targets))
+	for _, target := range targets {
+		go func(target string) {
+			repo := NewRepository(history.path)
+			defer repo.Free()
+			<-start
+			errs <- repo.UpdateRef("heads/main", old, target)
+		}(target)
+	}
+	close(start)
+
+	won := 0
+	for range targets {
+		switch err := <-errs; err {
+		case nil:
+			won++
+		case ErrRefLocked, ErrStaleRef:
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d updates won, want 1", won)
+	}
+	got := history.currentRef("heads/main")
+	if got == old {
+		t.Error("no update reached the ref")
+	}
+	if locks := refLocks(t, history); len(locks) > 0 {
+		t.Errorf("locks left behind: %v", locks)
+	}
+}
+
+func TestUpdateRefs(t *testing.T) {
+	history := openTestHistory(t)
+	c1 := testCommit(t, history, "tags/c1").SHA
+	c2 := testCommit(t, history, "tags/c2").SHA
+	c6 := testCommit(t, history, "tags/c6").SHA
+	c7 := testCommit(t, history, "tags/c7").SHA
+	c8 := testCommit(t, history, "tags/c8").SHA
+
+	tests := []struct {
+		name    string
+		updates []RefCommand
+		setup   func(t *testing.T, repo *Repository)
+		// failed names the update that fails, "" if all apply
+		failed  string
+		wantErr error
+	}{
+		{
+			name: "all apply",
+			updates: []RefCommand{
+				{RefName: "heads/main", OldSHA: c8, NewSHA: c7},
+				{RefName: "heads/feature", OldSHA: c6, NewSHA: ZeroSHA},
+				{RefName: "tags/new", OldSHA: ZeroSHA, NewSHA: c1},
+			},
+		},
+		{
+			name: "stale old value",
+			updates: []RefCommand{
+				{RefName: "heads/main", OldSHA: c8, NewSHA: c7},
+				{RefName: "heads/feature", OldSHA: c1, NewSHA: c2},
+				{RefName: "tags/new", OldSHA: ZeroSHA, NewSHA: c1},
+			},
+			failed:  "heads/feature",
+			wantErr: ErrStaleRef,
+		},
+		{
+			name: "locked ref",
+			updates: []RefCommand{
+				{RefName: "heads/main", OldSHA: c8, NewSHA: c7},
+				{RefName: "tags/c1", OldSHA: c1, NewSHA: ZeroSHA},
+			},
+			setup: func(t *testing.T, repo *Repository) {
+				if err := repo.LockRef("tags/c1"); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { repo.UnlockRef("tags/c1") })
+			},
+			failed:  "tags/c1",
+			wantErr: ErrRefLocked,
+		},
+		{
+			// heads/x cannot be written once heads/x/y is, as a directory
+			// is in the way, so main and heads/x/y are rolled back
+			name: "rolled back after a failed write",
+			updates: []RefCommand{
+				{RefName: "heads/main", OldSHA: c8, NewSHA: c7},
+				{RefName: "heads/x/y", OldSHA: ZeroSHA, NewSHA: c1},
+				{RefName: "heads/x", OldSHA: ZeroSHA, NewSHA: c2},
+			},
+			failed: "heads/x",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := openTestHistory(t)
+			if tt.setup != nil {
+				tt.setup(t, repo)
+			}
+			before, err := repo.RefMap()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = repo.UpdateRefs(tt.updates)
+			if tt.failed == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, update := range tt.updates {
+					if got := repo.currentRef(update.RefName); got != update.NewSHA {
+						t.Errorf("%s = %s, want %s", update.RefName, got, update.NewSHA)
+					}
+				}
+			} else {
+				var txErr *TransactionError
+				if !errors.As(err, &txErr) || txErr.RefName != tt.failed {
+					t.Fatalf("UpdateRefs error = %v, want a failure of %s", err, tt.failed)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("UpdateRefs error = %v, want %v", err, tt.wantErr)
+				}
+				after, err := repo.RefMap()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(after, before) {
+					t.Errorf("refs changed by a failed transaction\nbefore: %v\nafter:  %v", before, after)
+				}
+			}
+			if tt.setup == nil {
+				if locks := refLocks(t, repo); len(locks) > 0 {
+					t.Errorf("locks left behind: %v", locks)
+				}
+			}
+		})
+	}
+}
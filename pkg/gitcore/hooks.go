@@ -0,0 +1,76 @@
+package gitcore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// HookRefLines formats ref updates as the "<old> <new> <ref>" lines that
+// pre-receive and post-receive hooks read on stdin
+func HookRefLines(commands []RefCommand) string {
+	var lines strings.Builder
+	for _, cmd := range commands {
+		lines.WriteString(cmd.OldSHA + " " + cmd.NewSHA + " " + cmd.RefName + "\n")
+	}
+	return lines.String()
+}
+
+// PushOptionsEnv returns the GIT_PUSH_OPTION_* variables git sets for
+// hooks when a push carries options
+func PushOptionsEnv(options []string) []string {
+	env := []string{fmt.Sprintf("GIT_PUSH_OPTION_COUNT=%d", len(options))}
+	for i, option := range options {
+		env = append(env, fmt.Sprintf("GIT_PUSH_OPTION_%d=%s", i, option))
+	}
+	return env
+}
+
+// HookEnv returns the environment of a receive hook: the push options and,
+// while a quarantine is open, the variables that let git commands run by
+// the hook read the quarantined objects. Those paths are absolute, as the
+// hook runs inside the repository.
+func (r *Repository) HookEnv(options []string) []string {
+	env := PushOptionsEnv(options)
+	if quarantine := r.QuarantinePath(); quarantine != "" {
+		if abs, err := filepath.Abs(quarantine); err == nil {
+			quarantine = abs
+		}
+		env = append(env,
+			"GIT_QUARANTINE_PATH="+quarantine,
+			"GIT_OBJECT_DIRECTORY="+quarantine,
+			"GIT_ALTERNATE_OBJECT_DIRECTORIES="+filepath.Dir(quarantine))
+	}
+	return env
+}
+
+// RunHook runs hooks/<name> of the repository with GIT_DIR set, feeding it
+// stdin and sending its output to out. A hook that does not exist or is
+// not executable succeeds; one that exits non-zero fails.
+func (r *Repository) RunHook(ctx context.Context, name, stdin string, env []string, out io.Writer) error {
+	path, err := filepath.Abs(filepath.Join(r.path, "hooks", name))
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = r.path
+	cmd.Env = append(os.Environ(), "GIT_DIR=.")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook declined", name)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package gitcore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A pre-receive hook can read the quarantined objects with git, even when
+// the repository was opened by a relative path
+func TestPreReceiveHookSeesQuarantine(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	pack := readTestdata(t, "history.pack")
+	refs := readTestdata(t, "history.refs")
+	var tip string
+	for _, line := range strings.Split(string(refs), "\n") {
+		if sha, name, _ := strings.Cut(line, " "); name == "refs/heads/main" {
+			tip = sha
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	repo := NewRepository("repo.git")
+	t.Cleanup(repo.Free)
+	if err := repo.Init(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join("repo.git", "hooks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook := "#!/bin/sh\nread old new ref\nexec git cat-file -e \"$new\"\n"
+	if err := os.WriteFile(filepath.Join("repo.git", "hooks", "pre-receive"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	lines := HookRefLines([]RefCommand{{OldSHA: ZeroSHA, NewSHA: tip, RefName: "refs/heads/main"}})
+
+	if err := repo.BeginQuarantine(); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.AbortQuarantine()
+	if err := repo.ReceivePack(pack); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := repo.RunHook(context.Background(), "pre-receive", lines, repo.HookEnv(nil), &out); err != nil {
+		t.Fatalf("pre-receive with the pushed objects quarantined: %v\n%s", err, out.String())
+	}
+
+	// Without the quarantine the objects are gone, and the hook fails
+	repo.AbortQuarantine()
+	if err := repo.RunHook(context.Background(), "pre-receive", lines, repo.HookEnv(nil), &out); err == nil {
+		t.Error("pre-receive found objects of an aborted quarantine")
+	}
+}
@@ -0,0 +1,239 @@
+package gitcore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ackMode is the acknowledgement style a client asked for
+type ackMode int
+
+const (
+	ackSingle ackMode = iota
+	ackMulti
+	ackMultiDetailed
+)
+
+// Negotiation is the outcome of one want/have negotiation round
+type Negotiation struct {
+	// Response holds the ACK/NAK pkt-lines for this round
+	Response []byte
+	// Common lists the client's haves that exist in this repository
+	Common []string
+	// Ready is set when the pack should follow the response
+	Ready bool
+}
+
+// Negotiate runs one stateless want/have round of upload-pack. HTTP clients
+// resend every common have on each request, so no server state is kept
+// between rounds.
+func (r *Repository) Negotiate(req *FetchRequest) (*Negotiation, error) {
+	// A deepening client first sends its wants alone to learn the shallow
+	// boundary; that request has no haves section to acknowledge
+	if len(req.Haves) == 0 && !req.Done {
+		if err := r.checkWants(req.Wants); err != nil {
+			return nil, err
+		}
+		return &Negotiation{Common: []string{}}, nil
+	}
+	return r.negotiate(req, nil)
+}
+
+// NegotiateRound runs one round of a stateful negotiation, as over SSH,
+// where the client sends each have only once and waits for the response
+// after every flush. common holds the haves found in earlier rounds; the
+// returned Common includes them.
+func (r *Repository) NegotiateRound(req *FetchRequest, common []string) (*Negotiation, error) {
+	return r.negotiate(req, common)
+}
+
+// checkWants rejects wants a client may not fetch. As with git's
+// allow-reachable-sha1-in-want, a want must be a ref tip, what an annotated
+// tag at a tip points to, or a commit reachable from a tip, so objects
+// left behind by deleted or rewritten branches cannot be fetched.
+func (r *Repository) checkWants(wants []string) error {
+	refs, err := r.RefMap()
+	if err != nil {
+		return err
+	}
+	tips := make(map[string]bool, len(refs))
+	var commits []string
+	for _, sha := range refs {
+		tips[sha] = true
+		if peeled, ok := r.PeelTag(sha); ok {
+			tips[peeled] = true
+			sha = peeled
+		}
+		if _, err := r.ReadCommit(sha); err == nil {
+			commits = append(commits, sha)
+		}
+	}
+
+	others := map[string]bool{}
+	for _, want := range wants {
+		if tips[want] {
+			continue
+		}
+		if _, err := r.ReadCommit(want); err != nil {
+			return fmt.Errorf("not our ref %s", want)
+		}
+		others[want] = true
+	}
+	if len(others) == 0 {
+		return nil
+	}
+
+	// As in git, walk from the other wants with every tip excluded; a want
+	// the walk reaches is not reachable from any ref
+	include := make([]string, 0, len(others))
+	for want := range others {
+		include = append(include, want)
+	}
+	unreachable := ""
+	err = r.Walk(&WalkOptions{Include: include, Exclude: commits}, func(commit *Commit) error {
+		if others[commit.SHA] {
+			unreachable = commit.SHA
+			return ErrStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if unreachable != "" {
+		return fmt.Errorf("not our ref %s", unreachable)
+	}
+	return nil
+}
+
+func (r *Repository) negotiate(req *FetchRequest, common []string) (*Negotiation, error) {
+	if err := r.checkWants(req.Wants); err != nil {
+		return nil, err
+	}
+
+	mode := ackSingle
+	if req.HasCapability("multi_ack_detailed") {
+		mode = ackMultiDetailed
+	} else if req.HasCapability("multi_ack") {
+		mode = ackMulti
+	}
+	noDone := mode == ackMultiDetailed && req.HasCapability("no-done")
+
+	neg := &Negotiation{Common: append([]string{}, common...)}
+
+	var response strings.Builder
+	lastCommon := ""
+	if len(common) > 0 {
+		lastCommon = common[len(common)-1]
+	}
+	gotCommon, gotOther, sentReady := false, false, false
+
+	// Checking every want against the common set walks history, so only
+	// redo it when a new common commit has been found
+	giveUp, giveUpChecked := false, 0
+	okToGiveUp := func() bool {
+		if giveUpChecked != len(neg.Common) {
+			giveUp = r.CanAllFromReach(req.Wants, neg.Common)
+			giveUpChecked = len(neg.Common)
+		}
+		return giveUp
+	}
+
+	for _, have := range req.Haves {
+		if r.HasObject(have) {
+			gotCommon = true
+			lastCommon = have
+			neg.Common = append(neg.Common, have)
+
+			switch mode {
+			case ackMultiDetailed:
+				response.WriteString(PktLine("ACK " + have + " common\n"))
+			case ackMulti:
+				response.WriteString(PktLine("ACK " + have + " continue\n"))
+			default:
+				if len(neg.Common) == 1 {
+					response.WriteString(PktLine("ACK " + have + "\n"))
+				}
+			}
+			continue
+		}
+
+		gotOther = true
+		if mode != ackSingle && len(neg.Common) > 0 && okToGiveUp() {
+			if mode == ackMultiDetailed {
+				sentReady = true
+				response.WriteString(PktLine("ACK " + have + " ready\n"))
+			} else {
+				response.WriteString(PktLine("ACK " + have + " continue\n"))
+			}
+		}
+	}
+
+	if req.Done {
+		if len(neg.Common) > 0 {
+			if mode != ackSingle {
+				response.WriteString(PktLine("ACK " + lastCommon + "\n"))
+			}
+		} else {
+			response.WriteString(PktLine("NAK\n"))
+		}
+		neg.Ready = true
+	} else {
+		// End of a round without "done"
+		if mode == ackMultiDetailed && gotCommon && !gotOther && okToGiveUp() {
+			sentReady = true
+			response.WriteString(PktLine("ACK " + lastCommon + " ready\n"))
+		}
+		if len(neg.Common) == 0 || mode != ackSingle {
+			response.WriteString(PktLine("NAK\n"))
+		}
+		if noDone && sentReady {
+			response.WriteString(PktLine("ACK " + lastCommon + "\n"))
+			neg.Ready = true
+		}
+	}
+
+	neg.Response = []byte(response.String())
+	return neg, nil
+}
+
+// NegotiateV2 runs one round of a protocol v2 fetch. Unless the client sent
+// "done", the response is an acknowledgments section that ends with a flush,
+// or with a delimiter when the packfile section follows.
+func (r *Repository) NegotiateV2(req *FetchRequest) (*Negotiation, error) {
+	if err := r.checkWants(req.Wants); err != nil {
+		return nil, err
+	}
+
+	neg := &Negotiation{Common: []string{}}
+	for _, have := range req.Haves {
+		if r.HasObject(have) {
+			neg.Common = append(neg.Common, have)
+		}
+	}
+
+	if req.Done {
+		neg.Ready = true
+		return neg, nil
+	}
+
+	var response strings.Builder
+	response.WriteString(PktLine("acknowledgments\n"))
+	if len(neg.Common) == 0 {
+		response.WriteString(PktLine("NAK\n"))
+	}
+	for _, have := range neg.Common {
+		response.WriteString(PktLine("ACK " + have + "\n"))
+	}
+
+	if len(neg.Common) > 0 && r.CanAllFromReach(req.Wants, neg.Common) {
+		neg.Ready = true
+		response.WriteString(PktLine("ready\n"))
+		response.WriteString(DelimPkt)
+	} else {
+		response.WriteString(FlushPkt())
+	}
+
+	neg.Response = []byte(response.String())
+	return neg, nil
+}
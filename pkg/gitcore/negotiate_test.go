@@ -0,0 +1,66 @@
+package gitcore
+
+import (
+	"strings"
+	"testing"
+)
+
+// Only ref tips and commits reachable from them may be fetched. With just
+// the feature branch left, c7 and c8 of the history fixture are no longer
+// reachable, though still in the repository.
+func TestNegotiateWants(t *testing.T) {
+	repo := openTestHistory(t)
+	sha := func(tag string) string { return testCommit(t, repo, "tags/"+tag).SHA }
+	c1, c5, c6, c7, c8 := sha("c1"), sha("c5"), sha("c6"), sha("c7"), sha("c8")
+	tree := testCommit(t, repo, "tags/c5").Tree
+
+	refs, err := repo.ListRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range refs {
+		if ref != "heads/feature" {
+			if err := repo.DeleteRef(ref); err != nil {
+				t.Fatalf("deleting %s: %v", ref, err)
+			}
+		}
+	}
+	if !repo.HasObject(c8) {
+		t.Fatal("deleting refs removed objects")
+	}
+
+	tests := []struct {
+		name  string
+		wants []string
+		ok    bool
+	}{
+		{"branch tip", []string{c6}, true},
+		{"parent of the tip", []string{c5}, true},
+		{"root commit", []string{c1}, true},
+		{"tip and ancestor", []string{c6, c1}, true},
+		{"commit of a deleted branch", []string{c7}, false},
+		{"commit of a deleted tag", []string{c8}, false},
+		{"tip and unreachable commit", []string{c6, c7}, false},
+		{"tree of a reachable commit", []string{tree}, false},
+		{"missing object", []string{strings.Repeat("1", 40)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, negotiate := range []func(*FetchRequest) (*Negotiation, error){
+				repo.Negotiate, repo.NegotiateV2,
+			} {
+				_, err := negotiate(&FetchRequest{Wants: tt.wants, Done: true})
+				if tt.ok && err != nil {
+					t.Errorf("wants refused: %v", err)
+				}
+				if !tt.ok && (err == nil || !strings.HasPrefix(err.Error(), "not our ref ")) {
+					t.Errorf("error = %v, want not our ref", err)
+				}
+			}
+			_, err := repo.ComputeShallow(tt.wants, &UploadPackOptions{Depth: 1})
+			if tt.ok != (err == nil) {
+				t.Errorf("ComputeShallow error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,509 @@
+package gitcore
+
+/*
+#include "git_c_api.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+var (
+	// ErrObjectNotFound is returned when an object is neither loose nor in
+	// any pack
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrObjectType is returned when an object is not of the type asked for
+	ErrObjectType = errors.New("unexpected object type")
+)
+
+// ObjectType is the type of a git object, numbered as in packs
+type ObjectType int
+
+// Object types
+const (
+	ObjectCommit ObjectType = 1
+	ObjectTree   ObjectType = 2
+	ObjectBlob   ObjectType = 3
+	ObjectTag    ObjectType = 4
+)
+
+// String returns the type's name as git writes it in object headers
+func (t ObjectType) String() string {
+	switch t {
+	case ObjectCommit:
+		return "commit"
+	case ObjectTree:
+		return "tree"
+	case ObjectBlob:
+		return "blob"
+	case ObjectTag:
+		return "tag"
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the type by name, so it reads well in JSON
+func (t ObjectType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Object is a raw object of any type
+type Object struct {
+	SHA  string
+	Type ObjectType
+	Data []byte
+}
+
+// Signature is the author, committer or tagger of an object
+type Signature struct {
+	Name  string
+	Email string
+	// When carries the time zone the signature was made in
+	When time.Time
+}
+
+// Commit is a parsed commit object
+type Commit struct {
+	SHA       string
+	Tree      string
+	Parents   []string
+	Author    Signature
+	Committer Signature
+	// GPGSignature is the commit's signature block, if it was signed
+	GPGSignature string
+	Message      string
+}
+
+// Summary returns the first line of the commit message
+func (c *Commit) Summary() string {
+	summary, _, _ := strings.Cut(c.Message, "\n")
+	return summary
+}
+
+// File modes of tree entries
+const (
+	ModeFile       = "100644"
+	ModeExecutable = "100755"
+	ModeSymlink    = "120000"
+	ModeDir        = "40000"
+	ModeSubmodule  = "160000"
+)
+
+// TreeEntry is one entry of a tree
+type TreeEntry struct {
+	Name string
+	Mode string
+	SHA  string
+}
+
+// Type returns the type of the object an entry points to. Submodules
+// point to a commit in another repository.
+func (e *TreeEntry) Type() ObjectType {
+	switch e.Mode {
+	case ModeDir:
+		return ObjectTree
+	case ModeSubmodule:
+		return ObjectCommit
+	}
+	return ObjectBlob
+}
+
+// Tree is a parsed tree object; entries are in git's tree order
+type Tree struct {
+	SHA     string
+	Entries []TreeEntry
+}
+
+// Entry returns the entry with the given name, or nil
+func (t *Tree) Entry(name string) *TreeEntry {
+	for i := range t.Entries {
+		if t.Entries[i].Name == name {
+			return &t.Entries[i]
+		}
+	}
+	return nil
+}
+
+// Blob is a blob object
+type Blob struct {
+	SHA  string
+	Data []byte
+}
+
+// binaryCheckSize is how much of a blob IsBinary looks at, as in git
+const binaryCheckSize = 8000
+
+// IsBinary reports whether content looks binary rather than text: like
+// git, it looks for a NUL byte near the start
+func IsBinary(data []byte) bool {
+	if len(data) > binaryCheckSize {
+		data = data[:binaryCheckSize]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// Tag is a parsed annotated tag object
+type Tag struct {
+	SHA        string
+	Object     string
+	ObjectType ObjectType
+	Name       string
+	// Tagger is nil for the few old tags written without one
+	Tagger  *Signature
+	Message string
+}
+
+// readObject reads an object's type and content, loose or packed. Objects
+// in packs may be deltas, which are resolved against their bases.
+func (r *Repository) readObject(sha string) (ObjectType, []byte, error) {
+	cSha := C.CString(sha)
+	defer C.free(unsafe.Pointer(cSha))
+
+	var objType, length C.int
+	cData := C.git_repository_read_object(r.ptr, cSha, &objType, &length)
+	if cData == nil {
+		return 0, nil, fmt.Errorf("%w: %s", ErrObjectNotFound, sha)
+	}
+	defer C.git_free_string(cData)
+
+	return ObjectType(objType), C.GoBytes(unsafe.Pointer(cData), length), nil
+}
+
+// ReadObjectHeader returns an object's type and size from its header,
+// without inflating its content. For a delta in a pack both come from the
+// entry headers along its chain.
+func (r *Repository) ReadObjectHeader(sha string) (ObjectType, int64, error) {
+	cSha := C.CString(sha)
+	defer C.free(unsafe.Pointer(cSha))
+
+	var objType C.int
+	var size C.longlong
+	if C.git_repository_read_object_header(r.ptr, cSha, &objType, &size) == 0 {
+		return 0, 0, fmt.Errorf("%w: %s", ErrObjectNotFound, sha)
+	}
+	return ObjectType(objType), int64(size), nil
+}
+
+// findObjects returns the names of the objects, loose or packed, that
+// start with prefix; no more than limit are returned
+func (r *Repository) findObjects(prefix string, limit int) []string {
+	cPrefix := C.CString(prefix)
+	defer C.free(unsafe.Pointer(cPrefix))
+
+	var count C.int
+	cNames := C.git_repository_find_objects(r.ptr, cPrefix, C.int(limit), &count)
+	if cNames == nil {
+		return nil
+	}
+	defer C.git_free_string_array(cNames, count)
+
+	names := make([]string, int(count))
+	nameSlice := (*[1 << 28]*C.char)(unsafe.Pointer(cNames))[:count:count]
+	for i, cName := range nameSlice {
+		names[i] = C.GoString(cName)
+	}
+	return names
+}
+
+// readTyped reads an object that must be of type want
+func (r *Repository) readTyped(sha string, want ObjectType) ([]byte, error) {
+	objType, data, err := r.readObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	if objType != want {
+		return nil, fmt.Errorf("%w: %s is a %s, not a %s", ErrObjectType, sha, objType, want)
+	}
+	return data, nil
+}
+
+// ReadObject reads an object of any type
+func (r *Repository) ReadObject(sha string) (*Object, error) {
+	objType, data, err := r.readObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{SHA: sha, Type: objType, Data: data}, nil
+}
+
+// ReadCommit reads and parses a commit
+func (r *Repository) ReadCommit(sha string) (*Commit, error) {
+	data, err := r.readTyped(sha, ObjectCommit)
+	if err != nil {
+		return nil, err
+	}
+	return parseCommit(sha, data)
+}
+
+// ReadTree reads and parses a tree
+func (r *Repository) ReadTree(sha string) (*Tree, error) {
+	data, err := r.readTyped(sha, ObjectTree)
+	if err != nil {
+		return nil, err
+	}
+	return parseTree(sha, data)
+}
+
+// ReadBlob reads a blob
+func (r *Repository) ReadBlob(sha string) (*Blob, error) {
+	data, err := r.readTyped(sha, ObjectBlob)
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{SHA: sha, Data: data}, nil
+}
+
+// ObjectReader reads an object's content as a stream. Loose objects and
+// whole objects in packs are inflated as they are read, so only a chunk is
+// held in memory; deltas are resolved in memory when opened.
+type ObjectReader struct {
+	SHA    string
+	Type   ObjectType
+	Size   int64
+	stream unsafe.Pointer
+}
+
+// OpenObject opens an object of any type for reading; the reader must be
+// closed
+func (r *Repository) OpenObject(sha string) (*ObjectReader, error) {
+	cSha := C.CString(sha)
+	defer C.free(unsafe.Pointer(cSha))
+
+	var objType C.int
+	var size C.longlong
+	stream := C.git_repository_open_object(r.ptr, cSha, &objType, &size)
+	if stream == nil {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, sha)
+	}
+	return &ObjectReader{SHA: sha, Type: ObjectType(objType), Size: int64(size), stream: stream}, nil
+}
+
+// OpenBlob opens a blob for reading; the reader must be closed
+func (r *Repository) OpenBlob(sha string) (*ObjectReader, error) {
+	reader, err := r.OpenObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Type != ObjectBlob {
+		reader.Close()
+		return nil, fmt.Errorf("%w: %s is a %s, not a %s", ErrObjectType, sha, reader.Type, ObjectBlob)
+	}
+	return reader, nil
+}
+
+// Read reads the next chunk of the object's content
+func (o *ObjectReader) Read(p []byte) (int, error) {
+	if o.stream == nil {
+		return 0, errors.New("gitcore: read from closed object reader")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(p) > math.MaxInt32 {
+		p = p[:math.MaxInt32]
+	}
+
+	n := C.git_object_stream_read(o.stream, (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)))
+	switch {
+	case n < 0:
+		return 0, fmt.Errorf("object %s is corrupt", o.SHA)
+	case n == 0:
+		return 0, io.EOF
+	}
+	return int(n), nil
+}
+
+// Close releases the reader
+func (o *ObjectReader) Close() error {
+	if o.stream != nil {
+		C.git_object_stream_free(o.stream)
+		o.stream = nil
+	}
+	return nil
+}
+
+// ReadTag reads and parses an annotated tag
+func (r *Repository) ReadTag(sha string) (*Tag, error) {
+	data, err := r.readTyped(sha, ObjectTag)
+	if err != nil {
+		return nil, err
+	}
+	return parseTag(sha, data)
+}
+
+// objectHeaders splits a commit or tag into its headers and message.
+// Continuation lines, which start with a space, are joined to the header
+// before them.
+func objectHeaders(data []byte) ([][2]string, string) {
+	text := string(data)
+	var headers [][2]string
+	for text != "" {
+		line, rest, _ := strings.Cut(text, "\n")
+		if line == "" {
+			return headers, rest
+		}
+		text = rest
+
+		if strings.HasPrefix(line, " ") && len(headers) > 0 {
+			last := &headers[len(headers)-1]
+			last[1] += "\n" + line[1:]
+			continue
+		}
+		key, value, _ := strings.Cut(line, " ")
+		headers = append(headers, [2]string{key, value})
+	}
+	return headers, ""
+}
+
+// parseCommit parses the content of a commit object
+func parseCommit(sha string, data []byte) (*Commit, error) {
+	headers, message := objectHeaders(data)
+	commit := &Commit{SHA: sha, Parents: []string{}, Message: message}
+	for _, header := range headers {
+		var err error
+		switch header[0] {
+		case "tree":
+			commit.Tree = header[1]
+		case "parent":
+			commit.Parents = append(commit.Parents, header[1])
+		case "author":
+			commit.Author, err = parseSignature(header[1])
+		case "committer":
+			commit.Committer, err = parseSignature(header[1])
+		case "gpgsig", "gpgsig-sha256":
+			commit.GPGSignature = header[1]
+		}
+		if err != nil {
+			return nil, fmt.Errorf("corrupt commit %s: %w", sha, err)
+		}
+	}
+
+	if commit.Tree == "" {
+		return nil, fmt.Errorf("corrupt commit %s: no tree", sha)
+	}
+	return commit, nil
+}
+
+// parseTag parses the content of a tag object
+func parseTag(sha string, data []byte) (*Tag, error) {
+	headers, message := objectHeaders(data)
+	tag := &Tag{SHA: sha, Message: message}
+	for _, header := range headers {
+		switch header[0] {
+		case "object":
+			tag.Object = header[1]
+		case "type":
+			switch header[1] {
+			case "commit":
+				tag.ObjectType = ObjectCommit
+			case "tree":
+				tag.ObjectType = ObjectTree
+			case "blob":
+				tag.ObjectType = ObjectBlob
+			case "tag":
+				tag.ObjectType = ObjectTag
+			}
+		case "tag":
+			tag.Name = header[1]
+		case "tagger":
+			tagger, err := parseSignature(header[1])
+			if err != nil {
+				return nil, fmt.Errorf("corrupt tag %s: %w", sha, err)
+			}
+			tag.Tagger = &tagger
+		}
+	}
+
+	if tag.Object == "" || tag.ObjectType == 0 {
+		return nil, fmt.Errorf("corrupt tag %s: no object", sha)
+	}
+	return tag, nil
+}
+
+// parseSignature parses "Name <email> <seconds> <zone>"
+func parseSignature(value string) (Signature, error) {
+	open := strings.LastIndexByte(value, '<')
+	close := strings.LastIndexByte(value, '>')
+	if open < 0 || close < open {
+		return Signature{}, fmt.Errorf("invalid signature %q", value)
+	}
+
+	sig := Signature{
+		Name:  strings.TrimSpace(value[:open]),
+		Email: value[open+1 : close],
+	}
+
+	fields := strings.Fields(value[close+1:])
+	if len(fields) == 0 {
+		return sig, nil
+	}
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return Signature{}, fmt.Errorf("invalid signature time %q", fields[0])
+	}
+
+	location := time.UTC
+	if len(fields) > 1 && len(fields[1]) == 5 {
+		// +hhmm or -hhmm
+		if zone, err := strconv.Atoi(fields[1][1:]); err == nil {
+			offset := (zone/100)*3600 + (zone%100)*60
+			if fields[1][0] == '-' {
+				offset = -offset
+			}
+			location = time.FixedZone(fields[1], offset)
+		}
+	}
+	sig.When = time.Unix(seconds, 0).In(location)
+	return sig, nil
+}
+
+// parseTree parses the content of a tree object
+func parseTree(sha string, data []byte) (*Tree, error) {
+	// <mode> SP <name> NUL <20-byte SHA>
+	tree := &Tree{SHA: sha, Entries: []TreeEntry{}}
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if space < 0 || nul < space || nul+21 > len(data) {
+			return nil, fmt.Errorf("corrupt tree %s", sha)
+		}
+		tree.Entries = append(tree.Entries, TreeEntry{
+			Mode: string(data[:space]),
+			Name: string(data[space+1 : nul]),
+			SHA:  hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+		data = data[nul+21:]
+	}
+	return tree, nil
+}
+
+// findTreeEntry looks up one entry in the content of a tree without
+// parsing the others, for walks that look at a single path in every commit
+func findTreeEntry(data []byte, name string) (TreeEntry, bool) {
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if space < 0 || nul < space || nul+21 > len(data) {
+			return TreeEntry{}, false
+		}
+		if string(data[space+1:nul]) == name {
+			return TreeEntry{
+				Name: name,
+				Mode: string(data[:space]),
+				SHA:  hex.EncodeToString(data[nul+1 : nul+21]),
+			}, true
+		}
+		data = data[nul+21:]
+	}
+	return TreeEntry{}, false
+}
@@ -0,0 +1,427 @@
+package gitcore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// abbrevLength is how many hex digits of an object name patches show
+const abbrevLength = 7
+
+// statWidth is the line width format-patch keeps its diffstat within
+const statWidth = 72
+
+// base85Alphabet encodes binary patches, as in git
+const base85Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+// abbrev shortens an object name for a patch; the empty name is zeros
+func abbrev(sha string) string {
+	if sha == "" {
+		return ZeroSHA[:abbrevLength]
+	}
+	return sha[:abbrevLength]
+}
+
+// WriteUnified writes a diff in git's unified format, as git diff prints
+// it. Truncated files are written without hunks.
+func (d *Diff) WriteUnified(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range d.Files {
+		writeFileHeader(bw, f)
+		writeHunks(bw, f)
+	}
+	return bw.Flush()
+}
+
+// Patch returns the hunks of a file change in unified format, without
+// the file header
+func (f *FileDiff) Patch() string {
+	var b strings.Builder
+	writeHunks(&b, f)
+	return b.String()
+}
+
+// writeFileHeader writes the "diff --git" line of a file change and the
+// lines about modes, renames and blobs that follow it
+func writeFileHeader(w io.StringWriter, f *FileDiff) {
+	writeMetaInfo(w, f)
+	if f.OldSHA == f.NewSHA {
+		return
+	}
+
+	w.WriteString("index " + abbrev(f.OldSHA) + ".." + abbrev(f.NewSHA))
+	if f.OldMode == f.NewMode {
+		w.WriteString(" " + f.NewMode)
+	}
+	w.WriteString("\n")
+
+	oldName, newName := "a/"+f.OldPath, "b/"+f.NewPath
+	if f.Status == StatusAdded {
+		oldName = "/dev/null"
+	}
+	if f.Status == StatusDeleted {
+		newName = "/dev/null"
+	}
+	if f.Binary {
+		w.WriteString("Binary files " + oldName + " and " + newName + " differ\n")
+	} else if len(f.Hunks) > 0 {
+		w.WriteString("--- " + oldName + "\n+++ " + newName + "\n")
+	}
+}
+
+// writeMetaInfo writes the "diff --git" line and the mode and rename
+// lines of a file change
+func writeMetaInfo(w io.StringWriter, f *FileDiff) {
+	oldPath, newPath := f.OldPath, f.NewPath
+	switch f.Status {
+	case StatusAdded:
+		oldPath = newPath
+	case StatusDeleted:
+		newPath = oldPath
+	}
+	w.WriteString("diff --git a/" + oldPath + " b/" + newPath + "\n")
+
+	switch f.Status {
+	case StatusAdded:
+		w.WriteString("new file mode " + f.NewMode + "\n")
+	case StatusDeleted:
+		w.WriteString("deleted file mode " + f.OldMode + "\n")
+	default:
+		if f.OldMode != f.NewMode {
+			w.WriteString("old mode " + f.OldMode + "\nnew mode " + f.NewMode + "\n")
+		}
+	}
+	if f.Status == StatusRenamed || f.Status == StatusCopied {
+		verb := "rename"
+		if f.Status == StatusCopied {
+			verb = "copy"
+		}
+		w.WriteString("similarity index " + strconv.Itoa(f.Similarity) + "%\n")
+		w.WriteString(verb + " from " + f.OldPath + "\n" + verb + " to " + f.NewPath + "\n")
+	}
+}
+
+// writeHunks writes the hunks of a file change
+func writeHunks(w io.StringWriter, f *FileDiff) {
+	for _, hunk := range f.Hunks {
+		w.WriteString("@@ -" + hunkRange(hunk.OldStart, hunk.OldLines) +
+			" +" + hunkRange(hunk.NewStart, hunk.NewLines) + " @@")
+		if hunk.Section != "" {
+			w.WriteString(" " + hunk.Section)
+		}
+		w.WriteString("\n")
+
+		for _, line := range hunk.Lines {
+			w.WriteString(string(line.Op) + line.Content + "\n")
+			if line.NoNewline {
+				w.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+}
+
+// hunkRange formats one side of a hunk header; a single line has no count
+func hunkRange(start, lines int) string {
+	if lines == 1 {
+		return strconv.Itoa(start)
+	}
+	return strconv.Itoa(start) + "," + strconv.Itoa(lines)
+}
+
+// FormatPatch writes a commit and its diff as an email, like git
+// format-patch, so that git am can apply it; binary files are included
+// in full. n and total number the patch within a series; a series of one
+// is not numbered.
+func (r *Repository) FormatPatch(w io.Writer, commit *Commit, diff *Diff, n, total int) error {
+	bw := bufio.NewWriter(w)
+
+	subject, body, _ := strings.Cut(strings.TrimLeft(commit.Message, "\n"), "\n\n")
+	subject = strings.Join(strings.Fields(subject), " ")
+	body = strings.Trim(body, "\n")
+
+	prefix := "[PATCH]"
+	if total > 1 {
+		prefix = fmt.Sprintf("[PATCH %d/%d]", n, total)
+	}
+
+	fmt.Fprintf(bw, "From %s Mon Sep 17 00:00:00 2001\n", commit.SHA)
+	fmt.Fprintf(bw, "From: %s <%s>\n", mime.QEncoding.Encode("UTF-8", commit.Author.Name), commit.Author.Email)
+	fmt.Fprintf(bw, "Date: %s\n", commit.Author.When.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	fmt.Fprintf(bw, "Subject: %s %s\n", prefix, mime.QEncoding.Encode("UTF-8", subject))
+	if !isASCII(commit.Message) {
+		bw.WriteString("MIME-Version: 1.0\nContent-Type: text/plain; charset=UTF-8\nContent-Transfer-Encoding: 8bit\n")
+	}
+	bw.WriteString("\n")
+	if body != "" {
+		bw.WriteString(body + "\n")
+	}
+
+	bw.WriteString("---\n")
+	writeStat(bw, diff)
+	bw.WriteString("\n")
+	for _, f := range diff.Files {
+		if !f.Binary {
+			writeFileHeader(bw, f)
+			writeHunks(bw, f)
+			continue
+		}
+		if err := r.writeBinaryPatch(bw, f); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("-- \ngit-server\n\n")
+	return bw.Flush()
+}
+
+// writeBinaryPatch writes a binary file change as a git binary patch:
+// the new content and then the old, each compressed in full
+func (r *Repository) writeBinaryPatch(w *bufio.Writer, f *FileDiff) error {
+	writeMetaInfo(w, f)
+	oldSHA, newSHA := f.OldSHA, f.NewSHA
+	if oldSHA == "" {
+		oldSHA = ZeroSHA
+	}
+	if newSHA == "" {
+		newSHA = ZeroSHA
+	}
+	w.WriteString("index " + oldSHA + ".." + newSHA + "\nGIT binary patch\n")
+
+	for _, sha := range []string{f.NewSHA, f.OldSHA} {
+		data, err := r.diffSide(sha, ModeFile)
+		if err != nil {
+			return err
+		}
+		if err := writeBinaryLiteral(w, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBinaryLiteral writes data as a "literal" block of a binary patch:
+// zlib compressed, base85 encoded in lines of up to 52 bytes, each led
+// by a letter giving its length
+func writeBinaryLiteral(w *bufio.Writer, data []byte) error {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "literal %d\n", len(data))
+	rest := compressed.Bytes()
+	for len(rest) > 0 {
+		n := min(len(rest), 52)
+		if n <= 26 {
+			w.WriteByte(byte('A' + n - 1))
+		} else {
+			w.WriteByte(byte('a' + n - 27))
+		}
+		w.WriteString(encodeBase85(rest[:n]))
+		w.WriteString("\n")
+		rest = rest[n:]
+	}
+	w.WriteString("\n")
+	return nil
+}
+
+// encodeBase85 encodes data four bytes at a time into five characters,
+// padding the last group with zeros
+func encodeBase85(data []byte) string {
+	var b strings.Builder
+	for len(data) > 0 {
+		var group uint32
+		for i := 0; i < 4; i++ {
+			group <<= 8
+			if i < len(data) {
+				group |= uint32(data[i])
+			}
+		}
+		var chars [5]byte
+		for i := 4; i >= 0; i-- {
+			chars[i] = base85Alphabet[group%85]
+			group /= 85
+		}
+		b.Write(chars[:])
+		data = data[min(len(data), 4):]
+	}
+	return b.String()
+}
+
+// isASCII reports whether s has only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// renameName shows a rename or copy compactly, putting the parts of the
+// paths that differ in braces: "dir/{old => new}/file"
+func renameName(a, b string) string {
+	// The common prefix and suffix are whole path components
+	prefix := 0
+	for i := 0; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
+		if a[i] == '/' {
+			prefix = i + 1
+		}
+	}
+	charAt := func(s string, i int) byte {
+		if i == len(s) {
+			return 0
+		}
+		return s[i]
+	}
+	suffix := 0
+	adjust := 0
+	if prefix > 0 {
+		adjust = 1
+	}
+	for i, j := len(a), len(b); prefix-adjust <= i && prefix-adjust <= j && charAt(a, i) == charAt(b, j); i, j = i-1, j-1 {
+		if charAt(a, i) == '/' {
+			suffix = len(a) - i
+		}
+	}
+
+	aMid := a[prefix:max(len(a)-suffix, prefix)]
+	bMid := b[prefix:max(len(b)-suffix, prefix)]
+	if prefix+suffix == 0 {
+		return aMid + " => " + bMid
+	}
+	return a[:prefix] + "{" + aMid + " => " + bMid + "}" + a[len(a)-suffix:]
+}
+
+// writeStat writes the diffstat and summary of a diff as format-patch
+// shows them below the commit message
+func writeStat(w *bufio.Writer, diff *Diff) {
+	names := make([]string, len(diff.Files))
+	nameWidth, maxChanges, hasBinary := 0, 0, false
+	for i, f := range diff.Files {
+		names[i] = f.Path()
+		if f.Status == StatusRenamed || f.Status == StatusCopied {
+			names[i] = renameName(f.OldPath, f.NewPath)
+		}
+		nameWidth = max(nameWidth, utf8.RuneCountInString(names[i]))
+		if f.Binary {
+			hasBinary = true
+		} else {
+			maxChanges = max(maxChanges, f.Additions+f.Deletions)
+		}
+	}
+	countWidth := len(strconv.Itoa(maxChanges))
+	if hasBinary {
+		countWidth = max(countWidth, len("Bin"))
+	}
+
+	// As in git, when everything does not fit the graph gets up to 3/8
+	// of the line, and names that are still too long are cut on the left
+	graphWidth := maxChanges
+	if nameWidth+countWidth+6+graphWidth > statWidth {
+		graphWidth = min(graphWidth, max(statWidth*3/8-countWidth-6, 6))
+		if nameWidth > statWidth-countWidth-6-graphWidth {
+			nameWidth = statWidth - countWidth - 6 - graphWidth
+		} else {
+			graphWidth = statWidth - countWidth - 6 - nameWidth
+		}
+	}
+
+	for i, f := range diff.Files {
+		name := names[i]
+		if runes := []rune(name); len(runes) > nameWidth {
+			name = string(runes[len(runes)-nameWidth+3:])
+			if slash := strings.IndexByte(name, '/'); slash >= 0 {
+				name = name[slash:]
+			}
+			name = "..." + name
+		}
+		name += strings.Repeat(" ", max(nameWidth-utf8.RuneCountInString(name), 0))
+
+		if f.Binary {
+			fmt.Fprintf(w, " %s | %*s", name, countWidth, "Bin")
+			if f.OldSHA != f.NewSHA {
+				fmt.Fprintf(w, " %d -> %d bytes", f.OldSize, f.NewSize)
+			}
+			w.WriteString("\n")
+			continue
+		}
+
+		changes := f.Additions + f.Deletions
+		adds, dels := f.Additions, f.Deletions
+		if graphWidth <= maxChanges {
+			total := scaleStat(changes, graphWidth, maxChanges)
+			if total < 2 && adds > 0 && dels > 0 {
+				total = 2
+			}
+			if adds < dels {
+				adds = scaleStat(adds, graphWidth, maxChanges)
+				dels = total - adds
+			} else {
+				dels = scaleStat(dels, graphWidth, maxChanges)
+				adds = total - dels
+			}
+		}
+		fmt.Fprintf(w, " %s | %*d", name, countWidth, changes)
+		if changes > 0 {
+			w.WriteString(" " + strings.Repeat("+", adds) + strings.Repeat("-", dels))
+		}
+		w.WriteString("\n")
+	}
+
+	files := "files"
+	if len(diff.Files) == 1 {
+		files = "file"
+	}
+	fmt.Fprintf(w, " %d %s changed", len(diff.Files), files)
+	if diff.Additions > 0 || diff.Deletions == 0 {
+		fmt.Fprintf(w, ", %d %s(+)", diff.Additions, plural(diff.Additions, "insertion"))
+	}
+	if diff.Deletions > 0 || diff.Additions == 0 {
+		fmt.Fprintf(w, ", %d %s(-)", diff.Deletions, plural(diff.Deletions, "deletion"))
+	}
+	w.WriteString("\n")
+
+	for _, f := range diff.Files {
+		switch f.Status {
+		case StatusAdded:
+			fmt.Fprintf(w, " create mode %s %s\n", f.NewMode, f.NewPath)
+		case StatusDeleted:
+			fmt.Fprintf(w, " delete mode %s %s\n", f.OldMode, f.OldPath)
+		case StatusRenamed:
+			fmt.Fprintf(w, " rename %s (%d%%)\n", renameName(f.OldPath, f.NewPath), f.Similarity)
+		case StatusCopied:
+			fmt.Fprintf(w, " copy %s (%d%%)\n", renameName(f.OldPath, f.NewPath), f.Similarity)
+		}
+		if f.Status != StatusAdded && f.Status != StatusDeleted && f.OldMode != f.NewMode {
+			fmt.Fprintf(w, " mode change %s => %s %s\n", f.OldMode, f.NewMode, f.NewPath)
+		}
+	}
+}
+
+// scaleStat scales a change count down to the graph width, as git does,
+// keeping at least one mark for any change
+func scaleStat(n, width, maxChanges int) int {
+	if n == 0 {
+		return 0
+	}
+	return 1 + n*(width-1)/maxChanges
+}
+
+// plural adds an "s" to a word unless n is one
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
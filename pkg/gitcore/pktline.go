@@ -0,0 +1,89 @@
+package gitcore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// PktReader reads pkt-lines one at a time from a stream. Stateful
+// transports such as SSH need it: the client waits for a response after
+// each section, so a request cannot be read to the end in one go.
+type PktReader struct {
+	br *bufio.Reader
+}
+
+// NewPktReader creates a pkt-line reader
+func NewPktReader(r io.Reader) *PktReader {
+	return &PktReader{br: bufio.NewReaderSize(r, receiveChunkSize)}
+}
+
+// Reader returns the buffered stream positioned after the last pkt-line
+// read, e.g. to read the pack that follows a push's commands
+func (p *PktReader) Reader() io.Reader {
+	return p.br
+}
+
+// ReadPkt reads one pkt-line and returns it framed as received, so flush
+// and delimiter packets can be told apart from data. io.EOF is returned
+// only when the stream ends between pkt-lines.
+func (p *PktReader) ReadPkt() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(p.br, header); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.New("truncated pkt-line")
+	}
+
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil || (length > 1 && length < 4) {
+		return nil, fmt.Errorf("invalid pkt-line length %q", header)
+	}
+	if length < 4 {
+		return header, nil
+	}
+
+	pkt := make([]byte, length)
+	copy(pkt, header)
+	if _, err := io.ReadFull(p.br, pkt[4:]); err != nil {
+		return nil, errors.New("truncated pkt-line")
+	}
+	return pkt, nil
+}
+
+// ReadSection reads pkt-lines up to and including a flush, framed as
+// ParseUploadPack and ParseCommandRequest expect them
+func (p *PktReader) ReadSection() ([]byte, error) {
+	var section bytes.Buffer
+	for {
+		pkt, err := p.ReadPkt()
+		if err != nil {
+			if err == io.EOF && section.Len() > 0 {
+				return nil, errors.New("truncated pkt-line section")
+			}
+			return nil, err
+		}
+		section.Write(pkt)
+		if IsFlushPkt(pkt) {
+			return section.Bytes(), nil
+		}
+	}
+}
+
+// IsFlushPkt reports whether a framed pkt-line is a flush packet
+func IsFlushPkt(pkt []byte) bool {
+	return string(pkt) == "0000"
+}
+
+// PktPayload returns the payload of a framed pkt-line without its
+// trailing newline
+func PktPayload(pkt []byte) string {
+	if len(pkt) < 4 {
+		return ""
+	}
+	return string(bytes.TrimSuffix(pkt[4:], []byte("\n")))
+}
@@ -0,0 +1,248 @@
+package gitcore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DelimPkt separates the capability and argument sections of a protocol
+// v2 request, and the sections of a fetch response
+const DelimPkt = "0001"
+
+// ProtocolV2Capabilities lists what upload-pack advertises to protocol v2
+// clients
+var ProtocolV2Capabilities = []string{"ls-refs", "fetch=shallow filter", "object-info", "object-format=sha1"}
+
+// IsProtocolV2 reports whether a Git-Protocol header asks for version 2
+func IsProtocolV2(gitProtocol string) bool {
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateV2Advertisement creates the protocol v2 capability advertisement
+// sent in place of the ref list
+func CreateV2Advertisement(capabilities []string) []byte {
+	var adv strings.Builder
+	adv.WriteString(PktLine("version 2\n"))
+	for _, capability := range capabilities {
+		adv.WriteString(PktLine(capability + "\n"))
+	}
+	adv.WriteString(FlushPkt())
+	return []byte(adv.String())
+}
+
+// CommandRequest is a parsed protocol v2 command request
+type CommandRequest struct {
+	Command      string
+	Capabilities []string
+	Args         []string
+}
+
+// ParseCommandRequest parses a "command=<name>" request: capability lines,
+// a delimiter, then the command arguments up to the flush
+func ParseCommandRequest(data []byte) (*CommandRequest, error) {
+	req := &CommandRequest{}
+	inArgs := false
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated pkt-line")
+		}
+		length, err := strconv.ParseUint(string(data[:4]), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pkt-line length %q", data[:4])
+		}
+
+		switch {
+		case length == 0:
+			if req.Command == "" {
+				return nil, errors.New("missing command")
+			}
+			return req, nil
+		case length == 1:
+			inArgs = true
+			data = data[4:]
+			continue
+		case length < 4 || int(length) > len(data):
+			return nil, fmt.Errorf("invalid pkt-line length %d", length)
+		}
+
+		line := strings.TrimSuffix(string(data[4:length]), "\n")
+		data = data[length:]
+
+		switch {
+		case inArgs:
+			req.Args = append(req.Args, line)
+		case req.Command == "":
+			if !strings.HasPrefix(line, "command=") {
+				return nil, fmt.Errorf("expected command, got %q", line)
+			}
+			req.Command = strings.TrimPrefix(line, "command=")
+		default:
+			req.Capabilities = append(req.Capabilities, line)
+		}
+	}
+
+	return nil, errors.New("request not terminated by flush")
+}
+
+// LsRefs answers an ls-refs command. Refs are filtered by any ref-prefix
+// arguments; "symrefs" and "peel" add the symref target of HEAD and the
+// object an annotated tag points to.
+func (r *Repository) LsRefs(args []string) ([]byte, error) {
+	var prefixes []string
+	symrefs, peel := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		}
+	}
+
+	refs, err := r.RefMap()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(refs)+1)
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	head, _ := r.GetHead()
+	if sha, ok := refs[head]; ok {
+		refs["HEAD"] = sha
+		names = append([]string{"HEAD"}, names...)
+	}
+
+	var out strings.Builder
+	for _, name := range names {
+		if !matchesRefPrefix(name, prefixes) {
+			continue
+		}
+
+		line := refs[name] + " " + name
+		if symrefs && name == "HEAD" {
+			line += " symref-target:" + head
+		}
+		if peel {
+			if target, ok := r.PeelTag(refs[name]); ok {
+				line += " peeled:" + target
+			}
+		}
+		out.WriteString(PktLine(line + "\n"))
+	}
+	out.WriteString(FlushPkt())
+
+	return []byte(out.String()), nil
+}
+
+// matchesRefPrefix reports whether name starts with one of prefixes; an
+// empty prefix list matches every ref
+func matchesRefPrefix(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ObjectInfo answers an object-info command. With the "size" argument,
+// each "oid <sha>" is listed with its size, or with an empty one if the
+// object does not exist, as git does.
+func (r *Repository) ObjectInfo(args []string) ([]byte, error) {
+	size := false
+	var oids []string
+	for _, arg := range args {
+		switch {
+		case arg == "size":
+			size = true
+		case strings.HasPrefix(arg, "oid "):
+			oid := strings.TrimPrefix(arg, "oid ")
+			if !isObjectName(oid) {
+				return nil, fmt.Errorf("object-info: invalid object name %q", oid)
+			}
+			oids = append(oids, oid)
+		default:
+			return nil, fmt.Errorf("object-info: unexpected line: %q", arg)
+		}
+	}
+
+	var out strings.Builder
+	if len(oids) > 0 && size {
+		out.WriteString(PktLine("size\n"))
+	}
+	for _, oid := range oids {
+		line := oid
+		if size {
+			line += " "
+			if _, objectSize, err := r.ReadObjectHeader(oid); err == nil {
+				line += strconv.FormatInt(objectSize, 10)
+			}
+		}
+		out.WriteString(PktLine(line + "\n"))
+	}
+	out.WriteString(FlushPkt())
+
+	return []byte(out.String()), nil
+}
+
+// ParseFetchArgs converts the arguments of a v2 fetch command into a
+// FetchRequest. Flag arguments such as "thin-pack" or "no-progress" are
+// kept as capabilities.
+func ParseFetchArgs(args []string) (*FetchRequest, error) {
+	req := &FetchRequest{}
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "want "):
+			req.Wants = append(req.Wants, strings.TrimPrefix(arg, "want "))
+		case strings.HasPrefix(arg, "have "):
+			req.Haves = append(req.Haves, strings.TrimPrefix(arg, "have "))
+		case arg == "done":
+			req.Done = true
+		case strings.HasPrefix(arg, "shallow "):
+			req.Shallows = append(req.Shallows, strings.TrimPrefix(arg, "shallow "))
+		case strings.HasPrefix(arg, "deepen "):
+			depth, err := strconv.Atoi(strings.TrimPrefix(arg, "deepen "))
+			if err != nil || depth <= 0 {
+				return nil, fmt.Errorf("invalid deepen: %s", arg)
+			}
+			req.Depth = depth
+		case arg == "deepen-relative":
+			req.DeepenRelative = true
+		case strings.HasPrefix(arg, "deepen-since "):
+			since, err := strconv.ParseInt(strings.TrimPrefix(arg, "deepen-since "), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid deepen-since: %s", arg)
+			}
+			req.DeepenSince = since
+		case strings.HasPrefix(arg, "deepen-not "):
+			req.DeepenNot = append(req.DeepenNot, strings.TrimPrefix(arg, "deepen-not "))
+		case strings.HasPrefix(arg, "filter "):
+			req.Filter = strings.TrimPrefix(arg, "filter ")
+		default:
+			req.Capabilities = append(req.Capabilities, arg)
+		}
+	}
+
+	if len(req.Wants) == 0 {
+		return nil, errors.New("fetch without wants")
+	}
+	return req, nil
+}
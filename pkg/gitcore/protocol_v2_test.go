@@ -0,0 +1,182 @@
+package gitcore
+
+import (
+	"strings"
+	"testing"
+)
+
+// commandRequest frames a protocol v2 command as a client sends it
+func commandRequest(command string, args ...string) []byte {
+	var req strings.Builder
+	req.WriteString(PktLine("command=" + command + "\n"))
+	req.WriteString(PktLine("agent=git/2.39.5\n"))
+	req.WriteString(PktLine("object-format=sha1\n"))
+	req.WriteString(DelimPkt)
+	for _, arg := range args {
+		req.WriteString(PktLine(arg + "\n"))
+	}
+	req.WriteString(FlushPkt())
+	return []byte(req.String())
+}
+
+// pktLines frames lines as pkt-lines followed by a flush
+func pktLines(lines ...string) string {
+	var out strings.Builder
+	for _, line := range lines {
+		out.WriteString(PktLine(line + "\n"))
+	}
+	out.WriteString(FlushPkt())
+	return out.String()
+}
+
+// The expected refs are those of the history fixture, where HEAD is main
+// and v1.0 is the only annotated tag
+func TestLsRefs(t *testing.T) {
+	repo := openTestHistory(t)
+	const (
+		main    = "e997d77ebd982a63b8279fce2eae0d2fec6f8545"
+		feature = "e0b6f29d93f50871539ed32bd5fd8b1da0d8edbe"
+		c1      = "09a149854030ed40bdac0a946db79260d0f8a03c"
+		v1      = "ea462cb50add7e60b9fca01915ab8813b81f1a67"
+	)
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "all refs",
+			want: pktLines(
+				main+" HEAD",
+				feature+" refs/heads/feature",
+				main+" refs/heads/main",
+				c1+" refs/tags/c1",
+				"2f6da0e818887c2dd4a91b63a3a82a3698869c47 refs/tags/c2",
+				"d79454615845cde092326e58a50e8de92cd2d702 refs/tags/c3",
+				"d28dc7e4d243414b99bb0b59639d7fc99f88adca refs/tags/c4",
+				"b88ec74352abd2d1dcac7616338e96698596cec0 refs/tags/c5",
+				feature+" refs/tags/c6",
+				"fb07918b66faa0cd49e41274cf49197405e61e1c refs/tags/c7",
+				main+" refs/tags/c8",
+				v1+" refs/tags/v1.0",
+			),
+		},
+		{
+			name: "branches",
+			args: []string{"ref-prefix refs/heads/"},
+			want: pktLines(feature+" refs/heads/feature", main+" refs/heads/main"),
+		},
+		{
+			name: "several prefixes",
+			args: []string{"ref-prefix refs/heads/m", "ref-prefix refs/tags/c1"},
+			want: pktLines(main+" refs/heads/main", c1+" refs/tags/c1"),
+		},
+		{
+			name: "no match",
+			args: []string{"ref-prefix refs/pull/"},
+			want: pktLines(),
+		},
+		{
+			name: "HEAD with symrefs",
+			args: []string{"symrefs", "ref-prefix HEAD"},
+			want: pktLines(main + " HEAD symref-target:refs/heads/main"),
+		},
+		{
+			name: "symrefs only mark HEAD",
+			args: []string{"symrefs", "ref-prefix refs/heads/main"},
+			want: pktLines(main + " refs/heads/main"),
+		},
+		{
+			name: "peeled tags",
+			args: []string{"peel", "ref-prefix refs/tags/v", "ref-prefix refs/tags/c1"},
+			want: pktLines(c1+" refs/tags/c1", v1+" refs/tags/v1.0 peeled:"+main),
+		},
+		{
+			name: "tags without peel",
+			args: []string{"ref-prefix refs/tags/v"},
+			want: pktLines(v1 + " refs/tags/v1.0"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := ParseCommandRequest(commandRequest("ls-refs", tt.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd.Command != "ls-refs" || strings.Join(cmd.Args, ",") != strings.Join(tt.args, ",") {
+				t.Fatalf("parsed %q with args %q", cmd.Command, cmd.Args)
+			}
+			got, err := repo.LsRefs(cmd.Args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ls-refs response\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The sizes are git cat-file's for the history fixture
+func TestObjectInfo(t *testing.T) {
+	repo := openTestHistory(t)
+	const (
+		commit  = "e997d77ebd982a63b8279fce2eae0d2fec6f8545"
+		tag     = "ea462cb50add7e60b9fca01915ab8813b81f1a67"
+		tree    = "5408c63fd5007aa9953e4a8dbfb4447494a6730a"
+		blob    = "526465a9e8847d0258a03f000b29c2c17b36381a"
+		missing = "1111111111111111111111111111111111111111"
+	)
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "sizes",
+			args: []string{"size", "oid " + commit, "oid " + tag, "oid " + tree, "oid " + blob},
+			want: pktLines("size", commit+" 282", tag+" 141", tree+" 175", blob+" 640"),
+		},
+		{
+			name: "missing object",
+			args: []string{"size", "oid " + missing, "oid " + blob},
+			want: pktLines("size", missing+" ", blob+" 640"),
+		},
+		{
+			name: "no attributes",
+			args: []string{"oid " + blob},
+			want: pktLines(blob),
+		},
+		{
+			name: "no objects",
+			args: []string{"size"},
+			want: pktLines(),
+		},
+		{name: "abbreviated name", args: []string{"size", "oid 526465a"}, wantErr: true},
+		{name: "unknown attribute", args: []string{"type", "oid " + blob}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := ParseCommandRequest(commandRequest("object-info", tt.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := repo.ObjectInfo(cmd.Args)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ObjectInfo = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("object-info response\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package gitcore
+
+/*
+#include "git_c_api.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// receiveChunkSize is how much of a pushed pack is handed to the indexer
+// at a time
+const receiveChunkSize = 64 << 10
+
+// ReadReceivePack reads the command list of a receive-pack request from r,
+// and the push options that follow it if the client sent "push-options",
+// leaving the pack unread. The returned reader yields the pack, or is nil
+// when the request carries none (an empty or delete-only push).
+func ReadReceivePack(r io.Reader) (*PushRequest, io.Reader, error) {
+	br := bufio.NewReaderSize(r, receiveChunkSize)
+
+	var commands bytes.Buffer
+	if err := readPktSection(br, &commands, nil); err != nil {
+		return nil, nil, err
+	}
+	commands.WriteString(FlushPkt())
+
+	req, err := ParseReceivePack(commands.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if req.HasCapability("push-options") {
+		err := readPktSection(br, nil, func(line []byte) {
+			req.Options = append(req.Options, strings.TrimSuffix(string(line), "\n"))
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Clients only send a pack when some ref gets a new value, and over SSH
+	// they wait for the report without closing the stream otherwise
+	if !req.needsPack() {
+		return req, nil, nil
+	}
+	if _, err := br.Peek(1); err == io.EOF {
+		return req, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return req, br, nil
+}
+
+// readPktSection reads pkt-lines up to a flush, copying them as framed to
+// raw and passing each payload to line; either may be nil
+func readPktSection(br *bufio.Reader, raw *bytes.Buffer, line func([]byte)) error {
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return errors.New("truncated receive-pack request")
+		}
+
+		length, err := strconv.ParseUint(string(header), 16, 16)
+		if err != nil || (length > 0 && length < 4) {
+			return fmt.Errorf("invalid pkt-line length %q", header)
+		}
+		if length == 0 {
+			return nil
+		}
+
+		payload := make([]byte, length-4)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return errors.New("truncated receive-pack request")
+		}
+		if raw != nil {
+			raw.Write(header)
+			raw.Write(payload)
+		}
+		if line != nil {
+			line(payload)
+		}
+	}
+}
+
+// ReceivePackStream stores a pushed pack read from pack. The pack is
+// written to a temporary file in the repository and indexed as it
+// arrives; it becomes visible only once it is complete and every delta
+// resolves. Returns the number of objects stored.
+func (r *Repository) ReceivePackStream(pack io.Reader) (int, error) {
+	indexer := C.git_repository_receive_pack_begin(r.ptr)
+	if indexer == nil {
+		return 0, errors.New("failed to create temporary pack")
+	}
+	defer C.git_pack_indexer_free(indexer)
+
+	// Reading stops at the end of the pack rather than the end of the
+	// stream: over SSH the client keeps the connection open for the report
+	buf := make([]byte, receiveChunkSize)
+	for C.git_pack_indexer_done(indexer) == 0 {
+		n, err := pack.Read(buf)
+		if n > 0 && C.git_pack_indexer_append(indexer, (*C.char)(unsafe.Pointer(&buf[0])), C.int(n)) == 0 {
+			return 0, errors.New("invalid pack data")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var count C.int
+	if C.git_repository_receive_pack_finish(r.ptr, indexer, &count) == 0 {
+		return 0, errors.New("failed to index pack")
+	}
+	return int(count), nil
+}
+
+// BeginQuarantine holds the packs received from now on in a quarantine
+// directory, where they can be read but are not yet part of the object
+// store. MigrateQuarantine moves them in; AbortQuarantine (or Free)
+// discards them.
+func (r *Repository) BeginQuarantine() error {
+	if C.git_repository_begin_quarantine(r.ptr) == 0 {
+		return errors.New("failed to create quarantine directory")
+	}
+	return nil
+}
+
+// MigrateQuarantine moves quarantined packs into the object store
+func (r *Repository) MigrateQuarantine() error {
+	if C.git_repository_migrate_quarantine(r.ptr) == 0 {
+		return errors.New("unable to migrate objects to permanent storage")
+	}
+	return nil
+}
+
+// AbortQuarantine discards quarantined packs; it does nothing once they
+// have been migrated
+func (r *Repository) AbortQuarantine() {
+	C.git_repository_abort_quarantine(r.ptr)
+}
+
+// CheckConnectivity reports whether every object reachable from tip is
+// present and well formed. Objects already in the object store end the
+// walk, so only what the current push brought in is examined.
+func (r *Repository) CheckConnectivity(tip string) bool {
+	cTip := C.CString(tip)
+	defer C.free(unsafe.Pointer(cTip))
+
+	return C.git_repository_check_connectivity(r.ptr, cTip) != 0
+}
+
+// QuarantinePath returns the quarantine directory of an open quarantine,
+// or "" if there is none
+func (r *Repository) QuarantinePath() string {
+	cPath := C.git_repository_quarantine_path(r.ptr)
+	if cPath == nil {
+		return ""
+	}
+	defer C.git_free_string(cPath)
+
+	return C.GoString(cPath)
+}
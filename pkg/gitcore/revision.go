@@ -0,0 +1,212 @@
+package gitcore
+
+import (
+	"container/heap"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrUnknownRevision is returned when a revision names no commit
+	ErrUnknownRevision = errors.New("unknown revision")
+	// ErrAmbiguousRevision is returned when an abbreviated object name
+	// matches more than one commit
+	ErrAmbiguousRevision = errors.New("ambiguous revision")
+)
+
+const (
+	// minAbbrev is the shortest abbreviated object name resolved, as in git
+	minAbbrev = 4
+	// maxAbbrevCandidates bounds how many objects an abbreviated name is
+	// matched against; a name matching more is ambiguous
+	maxAbbrevCandidates = 256
+)
+
+// isHex reports whether s is made of lowercase hex digits
+func isHex(s string) bool {
+	for _, ch := range s {
+		if (ch < '0' || ch > '9') && (ch < 'a' || ch > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isObjectName reports whether s is a full lowercase hex object name
+func isObjectName(s string) bool {
+	return len(s) == len(ZeroSHA) && isHex(s)
+}
+
+// isAbbrevObjectName reports whether s can be an abbreviated object name
+func isAbbrevObjectName(s string) bool {
+	return len(s) >= minAbbrev && len(s) < len(ZeroSHA) && isHex(s)
+}
+
+// ResolveCommit resolves a revision to the commit it names. A revision is
+// HEAD, a full commit SHA or a unique abbreviation of at least four hex
+// digits, or a branch or tag name, full ("refs/tags/v1") or short ("v1"),
+// optionally followed by "~<n>" (the n-th first-parent ancestor) and
+// "^<n>" (the n-th parent) steps. As in git, a ref wins over an object
+// name it also abbreviates. Annotated tags are peeled to their commit. An
+// abbreviation matching several commits gives ErrAmbiguousRevision.
+func (r *Repository) ResolveCommit(rev string) (*Commit, error) {
+	if i := strings.IndexAny(rev, "~^"); i > 0 {
+		commit, err := r.ResolveCommit(rev[:i])
+		if err != nil {
+			return nil, err
+		}
+		return r.resolveAncestor(commit, rev[i:])
+	}
+
+	if rev == "HEAD" {
+		head, err := r.GetHead()
+		if err != nil {
+			return nil, ErrUnknownRevision
+		}
+		rev = head
+	}
+
+	sha := ""
+	if isObjectName(rev) && r.HasObject(rev) {
+		sha = rev
+	} else {
+		// Ref names end up in file paths, so only well-formed ones are
+		// looked up
+		name := strings.TrimPrefix(rev, "refs/")
+		if IsValidRefName("refs/" + name) {
+			sha, _ = r.resolveRef(name)
+		}
+		if sha == "" && isAbbrevObjectName(rev) {
+			var err error
+			if sha, err = r.resolveAbbrev(rev); err != nil {
+				return nil, err
+			}
+		}
+		if sha == "" {
+			return nil, ErrUnknownRevision
+		}
+	}
+
+	if target, isTag := r.PeelTag(sha); isTag {
+		sha = target
+	}
+
+	commit, err := r.ReadCommit(sha)
+	if errors.Is(err, ErrObjectType) || errors.Is(err, ErrObjectNotFound) {
+		return nil, ErrUnknownRevision
+	}
+	return commit, err
+}
+
+// resolveAbbrev finds the object an abbreviated name stands for, or ""
+// if there is none. Where several objects match, git's rule for revisions
+// that must name a commit applies: the one commit, or tag of a commit,
+// among them is taken.
+func (r *Repository) resolveAbbrev(prefix string) (string, error) {
+	candidates := r.findObjects(prefix, maxAbbrevCandidates)
+	switch len(candidates) {
+	case 0:
+		return "", nil
+	case 1:
+		return candidates[0], nil
+	case maxAbbrevCandidates:
+		return "", ErrAmbiguousRevision
+	}
+
+	match := ""
+	for _, sha := range candidates {
+		if target, isTag := r.PeelTag(sha); isTag {
+			sha = target
+		}
+		objType, _, err := r.ReadObjectHeader(sha)
+		if err != nil || objType != ObjectCommit {
+			continue
+		}
+		if match != "" && match != sha {
+			return "", ErrAmbiguousRevision
+		}
+		match = sha
+	}
+	if match == "" {
+		return "", ErrAmbiguousRevision
+	}
+	return match, nil
+}
+
+// resolveAncestor follows "~<n>" and "^<n>" steps from a commit; a step
+// without a number counts one
+func (r *Repository) resolveAncestor(commit *Commit, steps string) (*Commit, error) {
+	for steps != "" {
+		op := steps[0]
+		end := 1
+		for end < len(steps) && steps[end] >= '0' && steps[end] <= '9' {
+			end++
+		}
+		n := 1
+		if end > 1 {
+			var err error
+			if n, err = strconv.Atoi(steps[1:end]); err != nil {
+				return nil, ErrUnknownRevision
+			}
+		}
+		steps = steps[end:]
+
+		switch op {
+		case '~':
+			for ; n > 0; n-- {
+				if len(commit.Parents) == 0 {
+					return nil, ErrUnknownRevision
+				}
+				var err error
+				if commit, err = r.ReadCommit(commit.Parents[0]); err != nil {
+					return nil, err
+				}
+			}
+		case '^':
+			if n == 0 {
+				continue
+			}
+			if n > len(commit.Parents) {
+				return nil, ErrUnknownRevision
+			}
+			var err error
+			if commit, err = r.ReadCommit(commit.Parents[n-1]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrUnknownRevision
+		}
+	}
+	return commit, nil
+}
+
+// commitQueue is a priority queue of commits, newest committer date first
+type commitQueue []*Commit
+
+func (q commitQueue) Len() int { return len(q) }
+
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].Committer.When.After(q[j].Committer.When)
+}
+
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *commitQueue) Push(x any) { *q = append(*q, x.(*Commit)) }
+
+func (q *commitQueue) Pop() any {
+	old := *q
+	commit := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return commit
+}
+
+// push adds a commit to the queue
+func (q *commitQueue) push(commit *Commit) {
+	heap.Push(q, commit)
+}
+
+// pop removes and returns the newest commit in the queue
+func (q *commitQueue) pop() *Commit {
+	return heap.Pop(q).(*Commit)
+}
@@ -0,0 +1,69 @@
+package gitcore
+
+import (
+	"errors"
+	"testing"
+)
+
+// The expected commits are what git rev-parse "<rev>^{commit}" gives in
+// the history fixture, where c8 merges c6 into c7
+func TestResolveCommit(t *testing.T) {
+	repo := openTestHistory(t)
+
+	tests := []struct {
+		rev  string
+		want string // tag of the commit, or "" for ErrUnknownRevision
+	}{
+		{"HEAD", "c8"},
+		{"main", "c8"},
+		{"heads/main", "c8"},
+		{"refs/tags/c3", "c3"},
+		{"tags/c3", "c3"},
+		{"e997d77ebd982a63b8279fce2eae0d2fec6f8545", "c8"},
+		{"e997d77", "c8"},
+		{"e997", "c8"},
+		{"v1.0", "c8"},
+		{"nope", ""},
+		{"~1", ""},
+
+		{"c8~0", "c8"},
+		{"c8^0", "c8"},
+		{"c8~", "c7"},
+		{"c8^", "c7"},
+		{"c8^1", "c7"},
+		{"c8^2", "c6"},
+		{"c8^3", ""},
+		{"c8^^", "c5"},
+		{"c8~2", "c5"},
+		{"c8~3^", "c3"},
+		{"c8^2^", "c5"},
+		{"c8^2~", "c5"},
+		{"c8^0~1", "c7"},
+		{"c8~1^2", ""},
+		{"main^2~1", "c5"},
+		{"v1.0^", "c7"},
+		{"v1.0~1", "c7"},
+		{"e997d77ebd982a63b8279fce2eae0d2fec6f8545~1", "c7"},
+		{"c1~1", ""},
+		{"c1^", ""},
+		{"c8~x", ""},
+		{"c8^-1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rev, func(t *testing.T) {
+			commit, err := repo.ResolveCommit(tt.rev)
+			if tt.want == "" {
+				if !errors.Is(err, ErrUnknownRevision) {
+					t.Fatalf("ResolveCommit(%q) = %v, %v; want ErrUnknownRevision", tt.rev, commit, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveCommit(%q): %v", tt.rev, err)
+			}
+			if want := testCommit(t, repo, "tags/"+tt.want); commit.SHA != want.SHA {
+				t.Errorf("ResolveCommit(%q) = %s, want %s (%s)", tt.rev, commit.SHA, want.SHA, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package gitcore
+
+/*
+#include "git_c_api.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// UploadPackOptions narrows what a fetch sends, by a shallow boundary, a
+// partial clone filter or both
+type UploadPackOptions struct {
+	// Depth limits history to this many commits from each want (deepen)
+	Depth int
+	// Relative counts Depth from the client's shallow commits
+	// (deepen-relative)
+	Relative bool
+	// Since drops commits older than this time (deepen-since)
+	Since time.Time
+	// DeepenNot drops commits reachable from these SHAs (deepen-not)
+	DeepenNot []string
+	// Shallow lists the client's current shallow commits
+	Shallow []string
+	// Filter omits objects for a partial clone; nil sends everything
+	Filter *FilterSpec
+}
+
+// Deepen reports whether the options ask for a new shallow boundary
+func (o *UploadPackOptions) Deepen() bool {
+	return o != nil && (o.Depth > 0 || !o.Since.IsZero() || len(o.DeepenNot) > 0)
+}
+
+// ShallowUpdate lists the commits that become shallow or stop being
+// shallow on the client
+type ShallowUpdate struct {
+	Shallow   []string
+	Unshallow []string
+}
+
+// PktLines formats the update as shallow/unshallow pkt-lines
+func (u *ShallowUpdate) PktLines() string {
+	var lines strings.Builder
+	for _, sha := range u.Shallow {
+		lines.WriteString(PktLine("shallow " + sha + "\n"))
+	}
+	for _, sha := range u.Unshallow {
+		lines.WriteString(PktLine("unshallow " + sha + "\n"))
+	}
+	return lines.String()
+}
+
+// cShallowOptions converts options to their C form; call the returned
+// function to release it
+func cShallowOptions(opts *UploadPackOptions) (*C.git_shallow_options, func()) {
+	if opts == nil {
+		return nil, func() {}
+	}
+
+	cDeepenNot, freeDeepenNot := cStringArray(opts.DeepenNot)
+	cShallow, freeShallow := cStringArray(opts.Shallow)
+
+	cOpts := (*C.git_shallow_options)(C.calloc(1, C.size_t(unsafe.Sizeof(C.git_shallow_options{}))))
+	cOpts.depth = C.int(opts.Depth)
+	if opts.Relative {
+		cOpts.relative = 1
+	}
+	cOpts.deepen_not = cDeepenNot
+	cOpts.deepen_not_count = C.int(len(opts.DeepenNot))
+	cOpts.client_shallow = cShallow
+	cOpts.client_shallow_count = C.int(len(opts.Shallow))
+	if !opts.Since.IsZero() {
+		cOpts.since = C.longlong(opts.Since.Unix())
+	}
+
+	return cOpts, func() {
+		freeDeepenNot()
+		freeShallow()
+		C.free(unsafe.Pointer(cOpts))
+	}
+}
+
+// UploadPackOptions builds the options of a fetch request, resolving
+// deepen-not ref names to commits and parsing the filter-spec
+func (r *Repository) UploadPackOptions(req *FetchRequest) (*UploadPackOptions, error) {
+	opts := &UploadPackOptions{Depth: req.Depth, Relative: req.DeepenRelative, Shallow: req.Shallows}
+	if req.DeepenSince > 0 {
+		opts.Since = time.Unix(req.DeepenSince, 0)
+	}
+
+	for _, name := range req.DeepenNot {
+		sha, ok := r.resolveRef(name)
+		if !ok {
+			return nil, fmt.Errorf("deepen-not is not a ref: %s", name)
+		}
+		opts.DeepenNot = append(opts.DeepenNot, sha)
+	}
+
+	if opts.Depth > 0 && (!opts.Since.IsZero() || len(opts.DeepenNot) > 0) {
+		return nil, errors.New("deepen and deepen-since (or deepen-not) cannot be used together")
+	}
+
+	if req.Filter != "" {
+		filter, err := ParseFilterSpec(req.Filter)
+		if err != nil {
+			return nil, err
+		}
+		opts.Filter = filter
+	}
+	return opts, nil
+}
+
+// resolveRef looks up a full or abbreviated ref name ("main",
+// "heads/main", "refs/heads/main")
+func (r *Repository) resolveRef(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "refs/")
+	for _, candidate := range []string{name, "heads/" + name, "tags/" + name} {
+		if sha, err := r.GetRef(candidate); err == nil && sha != "" {
+			return sha, true
+		}
+	}
+	return "", false
+}
+
+// ComputeShallow works out the new shallow boundary for a deepening fetch.
+// The wants are checked as in Negotiate, since over SSH the boundary is
+// sent before the first negotiation round.
+func (r *Repository) ComputeShallow(wants []string, opts *UploadPackOptions) (*ShallowUpdate, error) {
+	if err := r.checkWants(wants); err != nil {
+		return nil, err
+	}
+
+	cWants, freeWants := cStringArray(wants)
+	defer freeWants()
+	cOpts, freeOpts := cShallowOptions(opts)
+	defer freeOpts()
+
+	var cShallow, cUnshallow **C.char
+	var shallowCount, unshallowCount C.int
+	if C.git_repository_compute_shallow(r.ptr, cWants, C.int(len(wants)), cOpts,
+		&cShallow, &shallowCount, &cUnshallow, &unshallowCount) == 0 {
+		return nil, errors.New("no commits selected for shallow requests")
+	}
+	defer C.git_free_string_array(cShallow, shallowCount)
+	defer C.git_free_string_array(cUnshallow, unshallowCount)
+
+	return &ShallowUpdate{
+		Shallow:   goStringArray(cShallow, shallowCount),
+		Unshallow: goStringArray(cUnshallow, unshallowCount),
+	}, nil
+}
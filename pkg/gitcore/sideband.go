@@ -0,0 +1,128 @@
+package gitcore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Side-band channels
+const (
+	// BandData carries pack data or the report-status stream
+	BandData byte = 1
+	// BandProgress carries progress and informational messages
+	BandProgress byte = 2
+	// BandError carries a fatal error; the client aborts after it
+	BandError byte = 3
+)
+
+// Packet size limits for side-band and side-band-64k, including the
+// 4-byte length and 1-byte band prefix
+const (
+	sideBandPacketMax    = 1000
+	sideBand64kPacketMax = 65520
+)
+
+// EncodePktLine frames binary data as a pkt-line. Unlike PktLine it is safe
+// for data containing NUL bytes.
+func EncodePktLine(data []byte) []byte {
+	pkt := make([]byte, 0, len(data)+4)
+	pkt = append(pkt, fmt.Sprintf("%04x", len(data)+4)...)
+	return append(pkt, data...)
+}
+
+// PackObjectCount returns the object count from a pack header
+func PackObjectCount(pack []byte) int {
+	if len(pack) < 12 || string(pack[:4]) != "PACK" {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(pack[8:12]))
+}
+
+// SideBandWriter multiplexes data, progress and fatal errors onto one
+// pkt-line stream. Writes go to the data band.
+type SideBandWriter struct {
+	w          io.Writer
+	maxPayload int
+	// Quiet drops progress messages, for clients that sent "quiet" or
+	// "no-progress"
+	Quiet bool
+}
+
+// NewSideBandWriter creates a side-band writer; large selects the
+// side-band-64k packet size
+func NewSideBandWriter(w io.Writer, large bool) *SideBandWriter {
+	max := sideBandPacketMax
+	if large {
+		max = sideBand64kPacketMax
+	}
+	return &SideBandWriter{w: w, maxPayload: max - 5}
+}
+
+// Write sends p on the data band, split into as many packets as needed
+func (s *SideBandWriter) Write(p []byte) (int, error) {
+	if err := s.writeBand(BandData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Progress sends a message on the progress band
+func (s *SideBandWriter) Progress(format string, args ...interface{}) error {
+	if s.Quiet {
+		return nil
+	}
+	return s.writeBand(BandProgress, []byte(fmt.Sprintf(format, args...)))
+}
+
+// Message sends a message on the progress band even when Quiet is set;
+// use it for errors the user must see
+func (s *SideBandWriter) Message(format string, args ...interface{}) error {
+	return s.writeBand(BandProgress, []byte(fmt.Sprintf(format, args...)))
+}
+
+// MessageWriter returns a writer whose output goes to the progress band
+// like Message, e.g. for the output of a hook
+func (s *SideBandWriter) MessageWriter() io.Writer {
+	return messageWriter{s}
+}
+
+type messageWriter struct {
+	s *SideBandWriter
+}
+
+func (m messageWriter) Write(p []byte) (int, error) {
+	if err := m.s.writeBand(BandProgress, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Fatal sends a message on the error band; nothing should follow it
+func (s *SideBandWriter) Fatal(message string) error {
+	return s.writeBand(BandError, []byte(message+"\n"))
+}
+
+// Flush ends the side-band stream
+func (s *SideBandWriter) Flush() error {
+	_, err := io.WriteString(s.w, FlushPkt())
+	return err
+}
+
+func (s *SideBandWriter) writeBand(band byte, p []byte) error {
+	for len(p) > 0 {
+		n := len(p)
+		if n > s.maxPayload {
+			n = s.maxPayload
+		}
+
+		packet := make([]byte, 0, n+1)
+		packet = append(packet, band)
+		packet = append(packet, p[:n]...)
+		if _, err := s.w.Write(EncodePktLine(packet)); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
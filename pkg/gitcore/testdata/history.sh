@@ -0,0 +1,122 @@
+#!/bin/sh
+# Rebuilds the history fixture: a small repository with renames, copies,
+# mode changes, a binary file and a merge, packed into history.pack with
+# its refs in history.refs, and git's own view of it under history/: the
+# diff of each commit and the blame of each file at c8.
+# Run from this directory with git on the PATH.
+set -e
+
+here=$(pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+export HOME="$tmp" GIT_CONFIG_NOSYSTEM=1
+export GIT_AUTHOR_NAME="A U Thor" GIT_AUTHOR_EMAIL=author@example.com
+export GIT_COMMITTER_NAME="C O Mitter" GIT_COMMITTER_EMAIL=committer@example.com
+
+git init -q -b main "$tmp/repo"
+cd "$tmp/repo"
+
+n=0
+# commit records the work tree as commit c<n>, a day after the last one
+commit() {
+	n=$((n + 1))
+	GIT_AUTHOR_DATE="$((1700000000 + n * 86400)) +0000"
+	GIT_COMMITTER_DATE=$GIT_AUTHOR_DATE
+	export GIT_AUTHOR_DATE GIT_COMMITTER_DATE
+	git add -A
+	git commit -q -m "$1"
+	git tag "c$n"
+}
+
+# c1: the first version of each file
+cp "$here/diff/function_added.old" store.go
+mkdir strutil
+cat > strutil/strutil.go <<'EOF'
+package strutil
+
+import "strings"
+
+// Reverse returns s with its bytes in reverse order
+func Reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// Words splits s around runs of spaces
+func Words(s string) []string {
+	return strings.Fields(s)
+}
+
+// Title upper-cases the first letter of each word
+func Title(s string) string {
+	words := Words(s)
+	for i, w := range words {
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, " ")
+}
+EOF
+printf 'store\n=====\n\nAn in-memory key value store.\n' > README
+commit "Add store"
+
+# c2: a function added in the middle of a file
+cp "$here/diff/function_added.new" store.go
+printf 'store\n=====\n\nAn in-memory key value store, with Get, Set and Delete.\n' > README
+commit "Add Store.Set"
+
+# c3: a renamed and edited file, and a copy of a modified one
+mkdir text
+git mv strutil/strutil.go text/text.go
+sed -i 's/^package strutil$/package text/' text/text.go
+sed 's/Store/Cache/g; s/store/cache/g; s/in memory/until they expire/' store.go > cache.go
+sed -i 's/^\/\/ Store keeps values in memory$/\/\/ Store keeps values in memory until deleted/' store.go
+commit "Move strutil to text and add a cache"
+
+# c4: a binary file and a script
+printf '\211PNG\r\n\032\n\000\000\000\rIHDR\000\000\000\001' > logo.png
+printf '#!/bin/sh\ngo build ./...\n' > build.sh
+commit "Add logo and build script"
+
+# c5: a deleted file and a mode change
+git rm -q README
+chmod +x build.sh
+commit "Drop README and make build.sh executable"
+
+# c6 on a branch, c7 on main and their merge c8, tagged v1.0
+git checkout -q -b feature
+sed -i 's/^\/\/ Delete removes key$/\/\/ Delete removes key, if it is there/' store.go
+commit "Document Delete"
+git checkout -q main
+printf '\n// Lines splits s into lines\nfunc Lines(s string) []string {\n\treturn strings.Split(s, "\\n")\n}\n' >> text/text.go
+commit "Add text.Lines"
+n=$((n + 1))
+GIT_AUTHOR_DATE="$((1700000000 + n * 86400)) +0000"
+GIT_COMMITTER_DATE=$GIT_AUTHOR_DATE
+git merge -q --no-ff -m "Merge branch 'feature'" feature
+git tag "c$n"
+git tag -a -m "Version 1.0" v1.0
+
+git rev-list --objects --all | git pack-objects -q --stdout > "$here/history.pack"
+git for-each-ref --format='%(objectname) %(refname)' > "$here/history.refs"
+
+rm -rf "$here/history"
+mkdir "$here/history"
+for tag in $(git tag -l 'c*'); do
+	if ! git rev-parse -q --verify "$tag^2" > /dev/null; then
+		git show --format= -M -C --abbrev=7 "$tag" > "$here/history/$tag.diff"
+	fi
+done
+
+# Blame lists each run of lines as git blame --incremental does, in file
+# order: commit, line in that commit, line in c8, number of lines and path
+# in the commit
+for file in store.go cache.go text/text.go; do
+	git blame --incremental c8 -- "$file" | awk '
+		length($1) == 40 && NF == 4 { entry = $0 }
+		/^filename / { print entry, substr($0, 10) }
+	' | sort -n -k 3 > "$here/history/$(echo "$file" | tr / _).blame"
+done
@@ -0,0 +1,148 @@
+package gitcore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPathNotFound is returned when a path does not exist in a tree
+var ErrPathNotFound = errors.New("path not found")
+
+// TreeEntryByPath finds the entry at a slash-separated path below a tree.
+// The empty path names the tree itself, returned as a directory entry.
+func (r *Repository) TreeEntryByPath(tree, path string) (*TreeEntry, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return &TreeEntry{Mode: ModeDir, SHA: tree}, nil
+	}
+
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		t, err := r.ReadTree(tree)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := t.Entry(part)
+		if entry == nil {
+			return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path)
+		}
+		if i == len(parts)-1 {
+			return entry, nil
+		}
+		if entry.Mode != ModeDir {
+			return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path)
+		}
+		tree = entry.SHA
+	}
+	return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path)
+}
+
+// LastCommits finds, for each named entry of the directory dir, the most
+// recent commit reachable from start that gave the entry its content at
+// start. History is searched newest first, following only commits where
+// some entry still has that content, and at most limit commits are read;
+// entries not resolved by then are missing from the result.
+func (r *Repository) LastCommits(start *Commit, dir string, names []string, limit int) (map[string]*Commit, error) {
+	// Directory contents by commit; nil when a commit lacks the directory
+	listings := map[string]map[string]string{}
+	listing := func(commit string) (map[string]string, error) {
+		if entries, ok := listings[commit]; ok {
+			return entries, nil
+		}
+		c, err := r.ReadCommit(commit)
+		if err != nil {
+			return nil, err
+		}
+		var entries map[string]string
+		entry, err := r.TreeEntryByPath(c.Tree, dir)
+		if err == nil && entry.Mode == ModeDir {
+			tree, err := r.ReadTree(entry.SHA)
+			if err != nil {
+				return nil, err
+			}
+			entries = make(map[string]string, len(tree.Entries))
+			for _, e := range tree.Entries {
+				entries[e.Name] = e.SHA
+			}
+		} else if err != nil && !errors.Is(err, ErrPathNotFound) {
+			return nil, err
+		}
+		listings[commit] = entries
+		return entries, nil
+	}
+
+	target, err := listing(start.SHA)
+	if err != nil {
+		return nil, err
+	}
+	pending := map[string]bool{}
+	for _, name := range names {
+		if _, ok := target[name]; ok {
+			pending[name] = true
+		}
+	}
+
+	found := map[string]*Commit{}
+	queue := &commitQueue{}
+	queue.push(start)
+	queued := map[string]bool{start.SHA: true}
+	for read := 0; queue.Len() > 0 && len(pending) > 0 && read < limit; read++ {
+		commit := queue.pop()
+		entries, err := listing(commit.SHA)
+		if err != nil {
+			return nil, err
+		}
+
+		parents := make([]map[string]string, len(commit.Parents))
+		for i, parent := range commit.Parents {
+			if parents[i], err = listing(parent); err != nil {
+				return nil, err
+			}
+		}
+
+		// The commit introduced an entry's content if it has it and no
+		// parent does
+		for name := range pending {
+			if entries[name] != target[name] {
+				continue
+			}
+			introduced := true
+			for _, parent := range parents {
+				if parent[name] == target[name] {
+					introduced = false
+					break
+				}
+			}
+			if introduced {
+				found[name] = commit
+				delete(pending, name)
+			}
+		}
+
+		for i, parent := range commit.Parents {
+			if queued[parent] || !hasAnyTarget(parents[i], target, pending) {
+				continue
+			}
+			c, err := r.ReadCommit(parent)
+			if err != nil {
+				return nil, err
+			}
+			queue.push(c)
+			queued[parent] = true
+		}
+	}
+	return found, nil
+}
+
+// hasAnyTarget reports whether a directory listing has the target content
+// of any pending entry
+func hasAnyTarget(entries, target map[string]string, pending map[string]bool) bool {
+	for name := range pending {
+		if entries[name] == target[name] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,571 @@
+package gitcore
+
+import (
+	"path"
+	"sort"
+)
+
+// ChangeStatus is how a file changed between two trees
+type ChangeStatus string
+
+// File change statuses
+const (
+	StatusAdded    ChangeStatus = "added"
+	StatusDeleted  ChangeStatus = "deleted"
+	StatusModified ChangeStatus = "modified"
+	StatusRenamed  ChangeStatus = "renamed"
+	StatusCopied   ChangeStatus = "copied"
+)
+
+// emptyBlobSHA is the name of the empty blob, which git never pairs as a
+// rename since any empty file would match
+const emptyBlobSHA = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+
+// renameLimit bounds the added and deleted files compared by content to
+// find renames, as every pair is scored
+const renameLimit = 400
+
+// DiffOptions controls how two trees are compared. Zero limits mean no
+// limit.
+type DiffOptions struct {
+	// Context is the number of unchanged lines around each change
+	Context   int
+	Algorithm DiffAlgorithm
+	// DetectRenames pairs deleted files with added files of similar
+	// content, and DetectCopies finds added files similar to a modified
+	// or renamed file
+	DetectRenames bool
+	DetectCopies  bool
+	// Similarity is the percentage of content two files must share to be
+	// a rename or copy
+	Similarity int
+	// MaxFiles bounds the files in a diff; later files are left out
+	MaxFiles int
+	// MaxLines bounds the hunk lines in a diff; files whose hunks do not
+	// fit keep their stats but lose their hunks
+	MaxLines int
+	// MaxFileSize bounds the bytes of a file that is diffed line by line
+	MaxFileSize int
+}
+
+// DefaultDiffOptions returns git's defaults for context and renames, with
+// limits fit for showing a diff in a browser
+func DefaultDiffOptions() *DiffOptions {
+	return &DiffOptions{
+		Context:       3,
+		DetectRenames: true,
+		DetectCopies:  true,
+		Similarity:    50,
+		MaxFiles:      300,
+		MaxLines:      20000,
+		MaxFileSize:   1024 * 1024,
+	}
+}
+
+// FileDiff is the change to one file. The old side is empty for added
+// files and the new side for deleted ones.
+type FileDiff struct {
+	Status  ChangeStatus
+	OldPath string
+	NewPath string
+	OldMode string
+	NewMode string
+	OldSHA  string
+	NewSHA  string
+	// Similarity is the percentage of content a renamed or copied file
+	// shares with its source
+	Similarity int
+	Binary     bool
+	// OldSize and NewSize are the sizes of the two sides in bytes, known
+	// once the contents were compared
+	OldSize int
+	NewSize int
+	// Truncated is set when the hunks were left out, because the file is
+	// too large or the diff ran out of lines
+	Truncated bool
+	Additions int
+	Deletions int
+	Hunks     []Hunk
+}
+
+// Path returns the path of the file after the change, or before it for a
+// deleted file
+func (f *FileDiff) Path() string {
+	if f.Status == StatusDeleted {
+		return f.OldPath
+	}
+	return f.NewPath
+}
+
+// Diff is the change between two trees
+type Diff struct {
+	Files     []*FileDiff
+	Additions int
+	Deletions int
+	// Truncated is set when files or hunks were left out to keep within
+	// the limits of the options
+	Truncated bool
+}
+
+// DiffTrees compares two trees; an empty old or new tree name stands for
+// the empty tree. Files come sorted by path.
+func (r *Repository) DiffTrees(oldTree, newTree string, opts *DiffOptions) (*Diff, error) {
+	if opts == nil {
+		opts = DefaultDiffOptions()
+	}
+
+	var files []*FileDiff
+	if err := r.treeChanges(oldTree, newTree, "", &files); err != nil {
+		return nil, err
+	}
+	if opts.DetectRenames {
+		var err error
+		if files, err = r.detectRenames(files, opts); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Path() < files[j].Path()
+	})
+
+	diff := &Diff{Files: files}
+	if opts.MaxFiles > 0 && len(files) > opts.MaxFiles {
+		diff.Files = files[:opts.MaxFiles]
+		diff.Truncated = true
+	}
+
+	lines := 0
+	for _, f := range diff.Files {
+		if err := r.diffContent(f, opts); err != nil {
+			return nil, err
+		}
+
+		n := 0
+		for _, hunk := range f.Hunks {
+			n += len(hunk.Lines)
+		}
+		if opts.MaxLines > 0 && lines+n > opts.MaxLines {
+			f.Hunks = nil
+			f.Truncated = true
+		} else {
+			lines += n
+		}
+
+		diff.Additions += f.Additions
+		diff.Deletions += f.Deletions
+		diff.Truncated = diff.Truncated || f.Truncated
+	}
+	return diff, nil
+}
+
+// DiffBlobs compares two blobs; an empty name stands for a missing blob
+func (r *Repository) DiffBlobs(oldSHA, newSHA string, opts *DiffOptions) (*FileDiff, error) {
+	if opts == nil {
+		opts = DefaultDiffOptions()
+	}
+
+	f := &FileDiff{Status: StatusModified, OldSHA: oldSHA, NewSHA: newSHA}
+	switch {
+	case oldSHA == "":
+		f.Status, f.NewMode = StatusAdded, ModeFile
+	case newSHA == "":
+		f.Status, f.OldMode = StatusDeleted, ModeFile
+	default:
+		f.OldMode, f.NewMode = ModeFile, ModeFile
+	}
+	if err := r.diffContent(f, opts); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// treeEntries reads a tree's entries by name; the empty name has none
+func (r *Repository) treeEntries(tree string) (map[string]TreeEntry, error) {
+	entries := map[string]TreeEntry{}
+	if tree == "" {
+		return entries, nil
+	}
+	t, err := r.ReadTree(tree)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range t.Entries {
+		entries[e.Name] = e
+	}
+	return entries, nil
+}
+
+// treeChanges appends the files that differ between two trees below dir.
+// Subtrees with the same name are only read when they differ.
+func (r *Repository) treeChanges(oldTree, newTree, dir string, files *[]*FileDiff) error {
+	if oldTree == newTree {
+		return nil
+	}
+	oldEntries, err := r.treeEntries(oldTree)
+	if err != nil {
+		return err
+	}
+	newEntries, err := r.treeEntries(newTree)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(oldEntries)+len(newEntries))
+	for name := range oldEntries {
+		names = append(names, name)
+	}
+	for name := range newEntries {
+		if _, ok := oldEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		o, inOld := oldEntries[name]
+		n, inNew := newEntries[name]
+		filePath := dir + name
+
+		if inOld && inNew && o.Mode != ModeDir && n.Mode != ModeDir && fileKind(o.Mode) == fileKind(n.Mode) {
+			if o.SHA != n.SHA || o.Mode != n.Mode {
+				*files = append(*files, &FileDiff{
+					Status:  StatusModified,
+					OldPath: filePath, NewPath: filePath,
+					OldMode: o.Mode, NewMode: n.Mode,
+					OldSHA: o.SHA, NewSHA: n.SHA,
+				})
+			}
+			continue
+		}
+
+		// Otherwise, as in git, the old entry goes and the new one comes,
+		// directories with all their files
+		oldSub, newSub := "", ""
+		if inOld && o.Mode == ModeDir {
+			oldSub = o.SHA
+		} else if inOld {
+			*files = append(*files, &FileDiff{
+				Status:  StatusDeleted,
+				OldPath: filePath, OldMode: o.Mode, OldSHA: o.SHA,
+			})
+		}
+		if inNew && n.Mode == ModeDir {
+			newSub = n.SHA
+		} else if inNew {
+			*files = append(*files, &FileDiff{
+				Status:  StatusAdded,
+				NewPath: filePath, NewMode: n.Mode, NewSHA: n.SHA,
+			})
+		}
+		if oldSub != "" || newSub != "" {
+			if err := r.treeChanges(oldSub, newSub, filePath+"/", files); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fileKind groups the file modes whose contents are compared with each
+// other: regular files, whether executable or not, symlinks and
+// submodules
+func fileKind(mode string) string {
+	if mode == ModeExecutable {
+		return ModeFile
+	}
+	return mode
+}
+
+// diffSide reads one side of a file change. Submodules are shown as the
+// commit they point at, as git does.
+func (r *Repository) diffSide(sha, mode string) ([]byte, error) {
+	switch {
+	case sha == "":
+		return nil, nil
+	case mode == ModeSubmodule:
+		return []byte("Subproject commit " + sha + "\n"), nil
+	}
+	blob, err := r.ReadBlob(sha)
+	if err != nil {
+		return nil, err
+	}
+	return blob.Data, nil
+}
+
+// diffContent fills in the hunks and stats of a file change
+func (r *Repository) diffContent(f *FileDiff, opts *DiffOptions) error {
+	if f.OldSHA == f.NewSHA {
+		return nil
+	}
+	oldData, err := r.diffSide(f.OldSHA, f.OldMode)
+	if err != nil {
+		return err
+	}
+	newData, err := r.diffSide(f.NewSHA, f.NewMode)
+	if err != nil {
+		return err
+	}
+
+	f.OldSize, f.NewSize = len(oldData), len(newData)
+
+	if IsBinary(oldData) || IsBinary(newData) {
+		f.Binary = true
+		return nil
+	}
+	if opts.MaxFileSize > 0 && (len(oldData) > opts.MaxFileSize || len(newData) > opts.MaxFileSize) {
+		f.Truncated = true
+		return nil
+	}
+	f.Hunks, f.Additions, f.Deletions = DiffText(oldData, newData, opts.Context, opts.Algorithm)
+	return nil
+}
+
+// spanHashBase is the modulus of git's span hashes
+const spanHashBase = 107927
+
+// spanSignature summarizes a text for similarity scoring as git does: the
+// text is cut into spans that end at a newline or after 64 bytes, and
+// the bytes of each span are counted by hash. The text's size is kept.
+type spanSignature struct {
+	spans map[uint32]int
+	size  int
+}
+
+// newSpanSignature hashes the spans of a text. As in git, a CR before a
+// newline is skipped, and a last span without a newline is not counted.
+func newSpanSignature(data []byte) *spanSignature {
+	sig := &spanSignature{spans: map[uint32]int{}, size: len(data)}
+	var accum1, accum2 uint32
+	n := 0
+	for i, c := range data {
+		if c == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			continue
+		}
+		old := accum1
+		accum1 = accum1<<7 ^ accum2>>25
+		accum2 = accum2<<7 ^ old>>25
+		accum1 += uint32(c)
+		n++
+		if n < 64 && c != '\n' {
+			continue
+		}
+		sig.spans[(accum1+accum2*0x61)%spanHashBase] += n
+		n, accum1, accum2 = 0, 0, 0
+	}
+	return sig
+}
+
+// similarity scores how much of two texts is the same, as a percentage
+// of the larger one, counting the bytes of spans they share
+func similarity(a, b *spanSignature) int {
+	if a.size > b.size {
+		a, b = b, a
+	}
+	common := 0
+	for hash, n := range a.spans {
+		common += min(n, b.spans[hash])
+	}
+	return common * 100 / b.size
+}
+
+// renameDetector pairs the added files of a diff with deleted or modified
+// files they came from
+type renameDetector struct {
+	repo       *Repository
+	opts       *DiffOptions
+	signatures map[string]*spanSignature
+	// used maps deleted files already renamed to their destinations
+	used map[*FileDiff][]*FileDiff
+}
+
+// signature returns the span signature of a blob, or nil for empty and
+// binary blobs, which are only renamed when unchanged
+func (d *renameDetector) signature(sha, mode string) (*spanSignature, error) {
+	if sig, ok := d.signatures[sha]; ok {
+		return sig, nil
+	}
+
+	var sig *spanSignature
+	if mode != ModeSubmodule {
+		blob, err := d.repo.ReadBlob(sha)
+		if err != nil {
+			return nil, err
+		}
+		if len(blob.Data) > 0 && !IsBinary(blob.Data) &&
+			(d.opts.MaxFileSize == 0 || len(blob.Data) <= d.opts.MaxFileSize) {
+			sig = newSpanSignature(blob.Data)
+		}
+	}
+	d.signatures[sha] = sig
+	return sig, nil
+}
+
+// score scores an added file against a possible source; 0 when either
+// cannot be compared or the sizes alone rule out a match
+func (d *renameDetector) score(src, dst *FileDiff) (int, error) {
+	if fileKind(src.OldMode) != fileKind(dst.NewMode) {
+		return 0, nil
+	}
+	if src.OldSHA == dst.NewSHA {
+		return 100, nil
+	}
+	srcSig, err := d.signature(src.OldSHA, src.OldMode)
+	if err != nil || srcSig == nil {
+		return 0, err
+	}
+	dstSig, err := d.signature(dst.NewSHA, dst.NewMode)
+	if err != nil || dstSig == nil {
+		return 0, err
+	}
+	if min(srcSig.size, dstSig.size)*100 < max(srcSig.size, dstSig.size)*d.opts.Similarity {
+		return 0, nil
+	}
+	return similarity(srcSig, dstSig), nil
+}
+
+// pair turns an added file into a rename or copy of src
+func (d *renameDetector) pair(src, dst *FileDiff, status ChangeStatus, score int) {
+	dst.Status = status
+	dst.OldPath, dst.OldMode, dst.OldSHA = src.OldPath, src.OldMode, src.OldSHA
+	dst.Similarity = score
+	if src.Status == StatusDeleted {
+		d.used[src] = append(d.used[src], dst)
+	}
+}
+
+// detectRenames turns added files into renames of deleted files, and with
+// DetectCopies into copies of modified or renamed files. Unchanged
+// renames are found first, preferring a source with the same base name,
+// then the most similar pairs.
+func (r *Repository) detectRenames(files []*FileDiff, opts *DiffOptions) ([]*FileDiff, error) {
+	var added, deleted []*FileDiff
+	for _, f := range files {
+		switch f.Status {
+		case StatusAdded:
+			added = append(added, f)
+		case StatusDeleted:
+			deleted = append(deleted, f)
+		}
+	}
+	if len(added) == 0 {
+		return files, nil
+	}
+
+	d := &renameDetector{
+		repo:       r,
+		opts:       opts,
+		signatures: map[string]*spanSignature{},
+		used:       map[*FileDiff][]*FileDiff{},
+	}
+
+	bySHA := map[string][]*FileDiff{}
+	for _, f := range deleted {
+		if f.OldSHA != emptyBlobSHA {
+			bySHA[f.OldSHA] = append(bySHA[f.OldSHA], f)
+		}
+	}
+	var unmatched []*FileDiff
+	for _, dst := range added {
+		var src *FileDiff
+		for _, f := range bySHA[dst.NewSHA] {
+			if d.used[f] != nil || fileKind(f.OldMode) != fileKind(dst.NewMode) {
+				continue
+			}
+			if src == nil || path.Base(f.OldPath) == path.Base(dst.NewPath) {
+				src = f
+			}
+		}
+		if src == nil {
+			unmatched = append(unmatched, dst)
+			continue
+		}
+		d.pair(src, dst, StatusRenamed, 100)
+	}
+
+	var remaining []*FileDiff
+	for _, f := range deleted {
+		if d.used[f] == nil {
+			remaining = append(remaining, f)
+		}
+	}
+	if len(unmatched) > 0 && len(remaining) > 0 && len(unmatched) <= renameLimit && len(remaining) <= renameLimit {
+		type match struct {
+			src, dst *FileDiff
+			score    int
+		}
+		var matches []match
+		for _, dst := range unmatched {
+			for _, src := range remaining {
+				score, err := d.score(src, dst)
+				if err != nil {
+					return nil, err
+				}
+				if score >= opts.Similarity {
+					matches = append(matches, match{src, dst, score})
+				}
+			}
+		}
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].score > matches[j].score
+		})
+		for _, m := range matches {
+			if d.used[m.src] != nil || m.dst.Status != StatusAdded {
+				continue
+			}
+			d.pair(m.src, m.dst, StatusRenamed, m.score)
+		}
+	}
+
+	if opts.DetectCopies {
+		var sources []*FileDiff
+		for _, f := range files {
+			if f.Status == StatusModified || d.used[f] != nil {
+				sources = append(sources, f)
+			}
+		}
+		if len(sources) <= renameLimit {
+			for _, dst := range unmatched {
+				if dst.Status != StatusAdded {
+					continue
+				}
+				var best *FileDiff
+				bestScore := 0
+				for _, src := range sources {
+					score, err := d.score(src, dst)
+					if err != nil {
+						return nil, err
+					}
+					if score >= opts.Similarity && score > bestScore {
+						best, bestScore = src, score
+					}
+				}
+				if best != nil {
+					d.pair(best, dst, StatusCopied, bestScore)
+				}
+			}
+		}
+	}
+
+	// As in git, a deleted file with several destinations is renamed to
+	// the last of them by path and copied to the others
+	for _, dsts := range d.used {
+		sort.Slice(dsts, func(i, j int) bool {
+			return dsts[i].NewPath < dsts[j].NewPath
+		})
+		for i, dst := range dsts {
+			dst.Status = StatusCopied
+			if i == len(dsts)-1 {
+				dst.Status = StatusRenamed
+			}
+		}
+	}
+
+	// Renamed files are no longer deleted
+	kept := make([]*FileDiff, 0, len(files))
+	for _, f := range files {
+		if d.used[f] == nil {
+			kept = append(kept, f)
+		}
+	}
+	return kept, nil
+}
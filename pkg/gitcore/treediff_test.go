@@ -0,0 +1,50 @@
+package gitcore
+
+import (
+	"strings"
+	"testing"
+)
+
+// The expected diffs in testdata/history are git show -M -C of each
+// commit of the history fixture, made by testdata/history.sh
+func TestDiffTreesMatchesGit(t *testing.T) {
+	repo := openTestHistory(t)
+
+	tests := []struct {
+		tag  string
+		what string
+	}{
+		{"c1", "root commit"},
+		{"c2", "modified file"},
+		{"c3", "rename and copy"},
+		{"c4", "binary and text files added"},
+		{"c5", "file deleted and mode changed"},
+		{"c6", "modified file"},
+		{"c7", "lines appended"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			commit := testCommit(t, repo, "tags/"+tt.tag)
+			parentTree := ""
+			if len(commit.Parents) > 0 {
+				parent, err := repo.ReadCommit(commit.Parents[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				parentTree = parent.Tree
+			}
+
+			diff, err := repo.DiffTrees(parentTree, commit.Tree, DefaultDiffOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got strings.Builder
+			if err := diff.WriteUnified(&got); err != nil {
+				t.Fatal(err)
+			}
+			if want := readTestdata(t, "history", tt.tag+".diff"); got.String() != string(want) {
+				t.Errorf("%s: diff differs from git\ngot:\n%s\nwant:\n%s", tt.what, got.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package gitcore
+
+/*
+#include "git_c_api.h"
+#include <stdlib.h>
+
+extern int goPackWrite(void* payload, char* data, int len);
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// packSink is the destination of a streamed pack
+type packSink struct {
+	ctx context.Context
+	w   io.Writer
+	err error
+}
+
+//export goPackWrite
+func goPackWrite(payload unsafe.Pointer, data *C.char, length C.int) C.int {
+	sink := (*(*cgo.Handle)(payload)).Value().(*packSink)
+	if err := sink.ctx.Err(); err != nil {
+		sink.err = err
+		return 0
+	}
+	if _, err := sink.w.Write(unsafe.Slice((*byte)(unsafe.Pointer(data)), int(length))); err != nil {
+		sink.err = err
+		return 0
+	}
+	return 1
+}
+
+// UploadPackTo streams the pack UploadPack builds to w as it is generated,
+// so a large clone is never held in memory. Generation stops at the next
+// write once ctx is cancelled or a write fails, e.g. when the client has
+// gone away.
+func (r *Repository) UploadPackTo(ctx context.Context, w io.Writer, wants, haves []string, opts *UploadPackOptions) error {
+	cWants, freeWants := cStringArray(wants)
+	defer freeWants()
+	cHaves, freeHaves := cStringArray(haves)
+	defer freeHaves()
+	cOpts, freeOpts := cShallowOptions(opts)
+	defer freeOpts()
+	var filter *FilterSpec
+	if opts != nil {
+		filter = opts.Filter
+	}
+	cFilter, freeFilter := cObjectFilter(filter)
+	defer freeFilter()
+
+	sink := &packSink{ctx: ctx, w: w}
+	handle := cgo.NewHandle(sink)
+	defer handle.Delete()
+
+	if C.git_repository_upload_pack_stream(r.ptr, cWants, C.int(len(wants)),
+		cHaves, C.int(len(haves)), cOpts, cFilter,
+		(C.git_pack_write_cb)(unsafe.Pointer(C.goPackWrite)), unsafe.Pointer(&handle)) == 0 {
+		if sink.err != nil {
+			return sink.err
+		}
+		return errors.New("failed to upload pack")
+	}
+	return nil
+}
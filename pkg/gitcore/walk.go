@@ -0,0 +1,422 @@
+package gitcore
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrStopWalk may be returned by a Walk callback to end the walk early;
+// Walk then returns nil
+var ErrStopWalk = errors.New("stop walk")
+
+// ErrNoMergeBase is returned when two commits share no history
+var ErrNoMergeBase = errors.New("no merge base")
+
+// WalkOrder is the order a walk visits commits in
+type WalkOrder int
+
+const (
+	// OrderDate visits commits newest committer date first, streaming
+	// them as they are found
+	OrderDate WalkOrder = iota
+	// OrderTopo never visits a commit before its children and keeps lines
+	// of history together. It has to read every selected commit before
+	// visiting the first.
+	OrderTopo
+)
+
+// maxPathCacheSize bounds the tree lookups a path-limited walk remembers
+const maxPathCacheSize = 100000
+
+// WalkOptions selects and orders the commits of a walk
+type WalkOptions struct {
+	// Include are the commits to start from; the walk visits them and
+	// their ancestors
+	Include []string
+	// Exclude are commits whose ancestors, and themselves, are left out
+	Exclude []string
+	// FirstParent follows only the first parent of merges
+	FirstParent bool
+	// Path limits the walk to commits that changed this file or
+	// directory. As in git, a merge that kept the path as one of its
+	// parents had it is skipped, along with the other parents' history.
+	Path string
+	// Author keeps commits whose author name or email contains it,
+	// ignoring case
+	Author string
+	// Since and Until keep commits committed in this time range; zero
+	// values leave it open
+	Since time.Time
+	Until time.Time
+	Order WalkOrder
+}
+
+// ResolveRange resolves a revision range to the commits to include and
+// exclude. "a..b" is the commits reachable from b but not from a, with
+// HEAD standing in for a side left empty; anything else is a single
+// revision.
+func (r *Repository) ResolveRange(spec string) ([]string, []string, error) {
+	from, to, isRange := strings.Cut(spec, "..")
+	if !isRange {
+		commit, err := r.ResolveCommit(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{commit.SHA}, nil, nil
+	}
+
+	if from == "" {
+		from = "HEAD"
+	}
+	if to == "" {
+		to = "HEAD"
+	}
+	fromCommit, err := r.ResolveCommit(from)
+	if err != nil {
+		return nil, nil, err
+	}
+	toCommit, err := r.ResolveCommit(to)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []string{toCommit.SHA}, []string{fromCommit.SHA}, nil
+}
+
+// walker holds the state of one walk
+type walker struct {
+	repo *Repository
+	opts *WalkOptions
+	// paths caches the object at opts.Path below a tree, by tree and
+	// remaining path
+	paths map[string]string
+}
+
+// Walk calls fn for each commit selected by opts, in the order it asks
+// for. Like git, it relies on committer dates to know when excluded
+// history has been fully seen and when commits get older than Since, so
+// commits with badly skewed clocks may be misplaced.
+func (r *Repository) Walk(opts *WalkOptions, fn func(*Commit) error) error {
+	w := &walker{repo: r, opts: opts, paths: map[string]string{}}
+
+	queue := &commitQueue{}
+	queued := map[string]bool{}
+	excluded := map[string]bool{}
+	add := func(commit *Commit, exclude bool) {
+		if exclude {
+			excluded[commit.SHA] = true
+		}
+		if !queued[commit.SHA] {
+			queued[commit.SHA] = true
+			queue.push(commit)
+		}
+	}
+
+	for _, sha := range opts.Exclude {
+		commit, err := r.ReadCommit(sha)
+		if err != nil {
+			return err
+		}
+		add(commit, true)
+	}
+	for _, sha := range opts.Include {
+		commit, err := r.ReadCommit(sha)
+		if err != nil {
+			return err
+		}
+		add(commit, false)
+	}
+
+	// Topological order needs the whole graph walked first
+	var visited []*Commit
+	edges := map[string][]string{}
+	shown := map[string]bool{}
+
+	for queue.Len() > 0 {
+		if len(opts.Exclude) > 0 && allExcluded(*queue, excluded) {
+			break
+		}
+
+		commit := queue.pop()
+		if excluded[commit.SHA] {
+			parents, err := w.readParents(commit.Parents)
+			if err != nil {
+				return err
+			}
+			for _, parent := range parents {
+				add(parent, true)
+			}
+			continue
+		}
+
+		// Everything still queued is older
+		if !opts.Since.IsZero() && commit.Committer.When.Before(opts.Since) {
+			break
+		}
+
+		parents, show, err := w.simplify(commit)
+		if err != nil {
+			return err
+		}
+		for _, parent := range parents {
+			add(parent, false)
+		}
+		show = show && w.matches(commit)
+
+		if opts.Order == OrderTopo {
+			visited = append(visited, commit)
+			for _, parent := range parents {
+				edges[commit.SHA] = append(edges[commit.SHA], parent.SHA)
+			}
+			shown[commit.SHA] = show
+			continue
+		}
+		if show {
+			if err := fn(commit); err != nil {
+				if err == ErrStopWalk {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+
+	if opts.Order == OrderTopo {
+		for _, commit := range topoSort(visited, edges) {
+			if !shown[commit.SHA] || excluded[commit.SHA] {
+				continue
+			}
+			if err := fn(commit); err != nil {
+				if err == ErrStopWalk {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// allExcluded reports whether every queued commit is excluded, when the
+// rest of the walk could only find excluded history
+func allExcluded(queue commitQueue, excluded map[string]bool) bool {
+	for _, commit := range queue {
+		if !excluded[commit.SHA] {
+			return false
+		}
+	}
+	return true
+}
+
+// Flags of a merge base search
+const (
+	fromFirst = 1 << iota
+	fromSecond
+	stale
+)
+
+// MergeBase finds the best common ancestor of two commits: the newest
+// commit reachable from both that is not an ancestor of another such
+// commit. It returns ErrNoMergeBase when the histories are unrelated.
+func (r *Repository) MergeBase(a, b string) (string, error) {
+	if a == b {
+		return a, nil
+	}
+
+	flags := map[string]int{}
+	queue := &commitQueue{}
+	for _, start := range []struct {
+		sha  string
+		flag int
+	}{{a, fromFirst}, {b, fromSecond}} {
+		commit, err := r.ReadCommit(start.sha)
+		if err != nil {
+			return "", err
+		}
+		flags[commit.SHA] |= start.flag
+		queue.push(commit)
+	}
+
+	// Commits reachable from both sides are candidates, and everything
+	// below one is stale; the walk ends when only stale commits are left
+	var candidates []string
+	for queue.Len() > 0 && !allStale(*queue, flags) {
+		commit := queue.pop()
+		flag := flags[commit.SHA]
+		if flag&(fromFirst|fromSecond) == fromFirst|fromSecond && flag&stale == 0 {
+			candidates = append(candidates, commit.SHA)
+			flag |= stale
+		}
+
+		for _, sha := range commit.Parents {
+			if flags[sha]&flag == flag {
+				continue
+			}
+			parent, err := r.ReadCommit(sha)
+			if err != nil {
+				return "", err
+			}
+			flags[sha] |= flag
+			queue.push(parent)
+		}
+	}
+
+	// Ancestors of a candidate go stale before they are popped, so the
+	// first candidate is the newest best one
+	if len(candidates) == 0 {
+		return "", ErrNoMergeBase
+	}
+	return candidates[0], nil
+}
+
+// allStale reports whether every queued commit is below a merge base
+// candidate
+func allStale(queue commitQueue, flags map[string]int) bool {
+	for _, commit := range queue {
+		if flags[commit.SHA]&stale == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readParents reads the parents a walk follows
+func (w *walker) readParents(shas []string) ([]*Commit, error) {
+	if w.opts.FirstParent && len(shas) > 1 {
+		shas = shas[:1]
+	}
+	parents := make([]*Commit, len(shas))
+	for i, sha := range shas {
+		commit, err := w.repo.ReadCommit(sha)
+		if err != nil {
+			return nil, err
+		}
+		parents[i] = commit
+	}
+	return parents, nil
+}
+
+// simplify returns the parents to follow from a commit and whether it is
+// shown. Without a path every commit is shown and all its parents
+// followed. With one, a commit that has the same path content as a parent
+// is hidden and only that parent followed; the others are shown if they
+// changed the path, or for a root commit, if they have it.
+func (w *walker) simplify(commit *Commit) ([]*Commit, bool, error) {
+	parents, err := w.readParents(commit.Parents)
+	if err != nil || w.opts.Path == "" {
+		return parents, true, err
+	}
+
+	sha, err := w.pathSHA(commit.Tree, strings.Trim(w.opts.Path, "/"))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(parents) == 0 {
+		return nil, sha != "", nil
+	}
+
+	for _, parent := range parents {
+		parentSHA, err := w.pathSHA(parent.Tree, strings.Trim(w.opts.Path, "/"))
+		if err != nil {
+			return nil, false, err
+		}
+		if parentSHA == sha {
+			return []*Commit{parent}, false, nil
+		}
+	}
+	return parents, true, nil
+}
+
+// pathSHA returns the object at a path below a tree, or "" if there is
+// none. Trees are mostly shared between neighbouring commits, so lookups
+// are cached at every level.
+func (w *walker) pathSHA(tree, path string) (string, error) {
+	key := tree + "\x00" + path
+	if sha, ok := w.paths[key]; ok {
+		return sha, nil
+	}
+
+	data, err := w.repo.readTyped(tree, ObjectTree)
+	if err != nil {
+		return "", err
+	}
+
+	sha := ""
+	name, rest, nested := strings.Cut(path, "/")
+	if entry, ok := findTreeEntry(data, name); ok {
+		if !nested {
+			sha = entry.SHA
+		} else if entry.Mode == ModeDir {
+			if sha, err = w.pathSHA(entry.SHA, rest); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if len(w.paths) >= maxPathCacheSize {
+		w.paths = map[string]string{}
+	}
+	w.paths[key] = sha
+	return sha, nil
+}
+
+// matches applies the author and date filters to a commit
+func (w *walker) matches(commit *Commit) bool {
+	if author := strings.ToLower(w.opts.Author); author != "" &&
+		!strings.Contains(strings.ToLower(commit.Author.Name), author) &&
+		!strings.Contains(strings.ToLower(commit.Author.Email), author) {
+		return false
+	}
+	if !w.opts.Until.IsZero() && commit.Committer.When.After(w.opts.Until) {
+		return false
+	}
+	return w.opts.Since.IsZero() || !commit.Committer.When.Before(w.opts.Since)
+}
+
+// topoSort orders commits so that none comes before its children, given
+// the parent edges the walk followed. Commits are taken depth first, so a
+// line of history stays together until it reaches a merge base.
+func topoSort(commits []*Commit, edges map[string][]string) []*Commit {
+	bySHA := make(map[string]*Commit, len(commits))
+	for _, commit := range commits {
+		bySHA[commit.SHA] = commit
+	}
+
+	children := make(map[string]int, len(commits))
+	for _, commit := range commits {
+		for _, parent := range edges[commit.SHA] {
+			if _, ok := bySHA[parent]; ok {
+				children[parent]++
+			}
+		}
+	}
+
+	// Tips go on the stack oldest first, so the newest is taken first
+	var stack []*Commit
+	for i := len(commits) - 1; i >= 0; i-- {
+		if children[commits[i].SHA] == 0 {
+			stack = append(stack, commits[i])
+		}
+	}
+
+	sorted := make([]*Commit, 0, len(commits))
+	for len(stack) > 0 {
+		commit := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		sorted = append(sorted, commit)
+
+		// As in git, the first parent is pushed first, so a merged branch
+		// comes right below its merge
+		for _, sha := range edges[commit.SHA] {
+			parent, ok := bySHA[sha]
+			if !ok {
+				continue
+			}
+			children[parent.SHA]--
+			if children[parent.SHA] == 0 {
+				stack = append(stack, parent)
+			}
+		}
+	}
+	return sorted
+}
@@ -160,7 +160,8 @@ git:
 
 security:
   jwt_secret: $jwtSecret
-  jwt_expiration: 24
+  access_token_expiration: 15
+  refresh_token_expiration: 720
   password_min: 8
   enable_ssh: false
   ssh_port: 2222